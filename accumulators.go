@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// maxAccumulationGap is the longest interval between two observations that is
+// integrated. Longer gaps, e.g. when the exporter was down, are skipped rather
+// than guessed.
+const maxAccumulationGap = 3 * time.Hour
+
+// accumulatorSaveInterval is the minimum time between two writes of the state
+// file.
+const accumulatorSaveInterval = time.Minute
+
+// accumulatorState is the state of a single accumulator.
+type accumulatorState struct {
+	Total    float64   `json:"total"`
+	LastTime time.Time `json:"last_time"`
+	LastRate float64   `json:"last_rate"`
+	// Day and DayTotal are the current day, as YYYY-MM-DD, and its total,
+	// for the accumulators that are also kept by day.
+	Day      string  `json:"day,omitempty"`
+	DayTotal float64 `json:"day_total,omitempty"`
+}
+
+// accumulators integrate rates over time, e.g. the precipitation intensity in
+// mm/h into millimeters of rain, per kind and location. The state is
+// optionally persisted to a file, so that the totals survive restarts and can
+// be exported as counters.
+type accumulators struct {
+	path string
+
+	mu       sync.Mutex
+	state    map[string]map[string]*accumulatorState
+	lastSave time.Time
+}
+
+// loadAccumulators loads the accumulators state from path. If path is empty
+// the state is only kept in memory. A missing file is not an error.
+func loadAccumulators(path string) (*accumulators, error) {
+	a := accumulators{
+		path:  path,
+		state: make(map[string]map[string]*accumulatorState),
+	}
+	if path == "" {
+		return &a, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &a, nil
+		}
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &a.state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal state file: %w", err)
+	}
+	return &a, nil
+}
+
+// add records the rate, expressed per hour, observed at time t and integrates
+// it since the previous observation.
+func (a *accumulators) add(kind, location string, t time.Time, rate float64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.addLocked(kind, location, t, rate)
+	return a.maybeSaveLocked()
+}
+
+// addDaily is like add, but also keeps the total of the day of t in the time
+// zone tz. The increment since the previous observation goes to the day of t.
+func (a *accumulators) addDaily(kind, location string, t time.Time, tz *time.Location, rate float64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, increment := a.addLocked(kind, location, t, rate)
+	if day := t.In(tz).Format("2006-01-02"); st.Day != day {
+		st.Day = day
+		st.DayTotal = 0
+	}
+	st.DayTotal += increment
+	return a.maybeSaveLocked()
+}
+
+// addLocked integrates the rate observed at time t, and returns the state and
+// the increment of the total. Must be called with a.mu held.
+func (a *accumulators) addLocked(kind, location string, t time.Time, rate float64) (*accumulatorState, float64) {
+	if a.state[kind] == nil {
+		a.state[kind] = make(map[string]*accumulatorState)
+	}
+	st, ok := a.state[kind][location]
+	if !ok {
+		st = &accumulatorState{}
+		a.state[kind][location] = st
+	}
+	var increment float64
+	if ok && t.After(st.LastTime) {
+		if dt := t.Sub(st.LastTime); dt <= maxAccumulationGap {
+			// trapezoidal rule
+			increment = (st.LastRate + rate) / 2 * dt.Hours()
+			st.Total += increment
+		}
+	}
+	st.LastTime = t
+	st.LastRate = rate
+	return st, increment
+}
+
+// maybeSaveLocked writes the state file if it was not written recently. Must
+// be called with a.mu held.
+func (a *accumulators) maybeSaveLocked() error {
+	if a.path != "" && time.Since(a.lastSave) >= accumulatorSaveInterval {
+		return a.saveLocked()
+	}
+	return nil
+}
+
+// total returns the accumulated total for the given kind and location.
+func (a *accumulators) total(kind, location string) (float64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, ok := a.state[kind][location]
+	if !ok {
+		return 0, false
+	}
+	return st.Total, true
+}
+
+// dayTotal returns the total of the day day, as YYYY-MM-DD, for the given kind
+// and location. The total is 0 until the first observation of the day.
+func (a *accumulators) dayTotal(kind, location, day string) (float64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st, ok := a.state[kind][location]
+	if !ok {
+		return 0, false
+	}
+	if st.Day != day {
+		return 0, true
+	}
+	return st.DayTotal, true
+}
+
+// prune removes the state of all the locations not in keep, and saves the
+// state file if anything was removed.
+func (a *accumulators) prune(keep map[string]bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var pruned bool
+	for _, locations := range a.state {
+		for name := range locations {
+			if !keep[name] {
+				delete(locations, name)
+				pruned = true
+			}
+		}
+	}
+	if !pruned || a.path == "" {
+		return nil
+	}
+	return a.saveLocked()
+}
+
+// save writes the state to the state file, if any.
+func (a *accumulators) save() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.path == "" {
+		return nil
+	}
+	return a.saveLocked()
+}
+
+// saveLocked writes the state atomically. Must be called with a.mu held.
+func (a *accumulators) saveLocked() error {
+	data, err := json.Marshal(a.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(a.path), filepath.Base(a.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+	a.lastSave = time.Now()
+	return nil
+}
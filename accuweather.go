@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// accuWeatherURL is the base URL of the AccuWeather APIs.
+const accuWeatherURL = "https://dataservice.accuweather.com"
+
+// accuWeatherIcons maps the AccuWeather icon numbers to a Dark Sky icon. The
+// icons from 33 are the night ones.
+var accuWeatherIcons = map[int]string{
+	1:  "clear-day",
+	2:  "clear-day",
+	3:  "partly-cloudy-day",
+	4:  "partly-cloudy-day",
+	5:  "partly-cloudy-day",
+	6:  "cloudy",
+	7:  "cloudy",
+	8:  "cloudy",
+	11: "fog",
+	12: "rain",
+	13: "rain",
+	14: "rain",
+	15: "thunderstorm",
+	16: "thunderstorm",
+	17: "thunderstorm",
+	18: "rain",
+	19: "snow",
+	20: "snow",
+	21: "snow",
+	22: "snow",
+	23: "snow",
+	24: "sleet",
+	25: "sleet",
+	26: "sleet",
+	29: "sleet",
+	30: "clear-day",
+	31: "clear-day",
+	32: "wind",
+	33: "clear-night",
+	34: "clear-night",
+	35: "partly-cloudy-night",
+	36: "partly-cloudy-night",
+	37: "partly-cloudy-night",
+	38: "cloudy",
+	39: "rain",
+	40: "rain",
+	41: "thunderstorm",
+	42: "thunderstorm",
+	43: "snow",
+	44: "snow",
+}
+
+// accuWeatherLocation is a location of the AccuWeather Locations API. The
+// other APIs take its key rather than coordinates.
+type accuWeatherLocation struct {
+	Key           string `json:"Key"`
+	Type          string `json:"Type"`
+	LocalizedName string `json:"LocalizedName"`
+	GeoPosition   struct {
+		Latitude  float64 `json:"Latitude"`
+		Longitude float64 `json:"Longitude"`
+	} `json:"GeoPosition"`
+	TimeZone struct {
+		Name string `json:"Name"`
+	} `json:"TimeZone"`
+}
+
+// accuWeatherLocations caches the AccuWeather locations by coordinates, as
+// returned by Location.LatString and Location.LngString. The locations
+// geocoded with AccuWeather are added, so that the provider does not look
+// them up again.
+var accuWeatherLocations = struct {
+	mu        sync.Mutex
+	locations map[string]*accuWeatherLocation
+}{locations: make(map[string]*accuWeatherLocation)}
+
+// accuWeatherGet decodes the JSON response of an AccuWeather API into v, and
+// returns the raw response and its headers.
+func accuWeatherGet(ctx context.Context, httpClient *http.Client, apiKey, path string, q url.Values, v interface{}) ([]byte, http.Header, error) {
+	q.Set("apikey", apiKey)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, accuWeatherURL+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		countAPIError("accuweather", reasonForError(err))
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		countAPIError("accuweather", reasonForError(err))
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		reason := reasonForStatus(resp.StatusCode, string(data))
+		countAPIError("accuweather", reason)
+		return nil, nil, &APIError{Provider: "accuweather", Reason: reason, Err: fmt.Errorf("HTTP status %s: %s", resp.Status, data)}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		countAPIError("accuweather", reasonDecode)
+		return nil, nil, &APIError{Provider: "accuweather", Reason: reasonDecode, Err: err}
+	}
+	return data, resp.Header, nil
+}
+
+// accuWeatherGeocode geocodes a location name with the AccuWeather Locations
+// API, and caches its location key for the provider.
+func accuWeatherGeocode(ctx context.Context, httpClient *http.Client, apiKey, locName string) (*Location, error) {
+	q := url.Values{}
+	q.Set("q", locName)
+	var results []accuWeatherLocation
+	if _, _, err := accuWeatherGet(ctx, httpClient, apiKey, "/locations/v1/search", q, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no location found for '%s'", locName)
+	}
+	r := results[0]
+	loc := Location{
+		Name: r.LocalizedName,
+		Lat:  r.GeoPosition.Latitude,
+		Lng:  r.GeoPosition.Longitude,
+		// the locations are cities, postal codes or points of interest
+		Accuracy: "APPROXIMATE",
+	}
+	if r.Type == "POI" {
+		loc.Accuracy = "GEOMETRIC_CENTER"
+	}
+	accuWeatherLocations.mu.Lock()
+	accuWeatherLocations.locations[loc.LatString()+","+loc.LngString()] = &r
+	accuWeatherLocations.mu.Unlock()
+	return &loc, nil
+}
+
+// accuWeatherMetric is a value of the Current Conditions API, which reports
+// both metric and imperial values.
+type accuWeatherMetric struct {
+	Metric struct {
+		Value float64 `json:"Value"`
+	} `json:"Metric"`
+}
+
+// accuWeatherValue is a value of the Forecast APIs, requested in metric
+// units.
+type accuWeatherValue struct {
+	Value float64 `json:"Value"`
+}
+
+// accuWeatherCurrent are the current conditions, requested with details.
+type accuWeatherCurrent struct {
+	EpochTime           int64             `json:"EpochTime"`
+	WeatherText         string            `json:"WeatherText"`
+	WeatherIcon         int               `json:"WeatherIcon"`
+	PrecipitationType   string            `json:"PrecipitationType"`
+	Temperature         accuWeatherMetric `json:"Temperature"`
+	RealFeelTemperature accuWeatherMetric `json:"RealFeelTemperature"`
+	RelativeHumidity    float64           `json:"RelativeHumidity"`
+	DewPoint            accuWeatherMetric `json:"DewPoint"`
+	Wind                struct {
+		Direction struct {
+			Degrees float64 `json:"Degrees"`
+		} `json:"Direction"`
+		Speed accuWeatherMetric `json:"Speed"`
+	} `json:"Wind"`
+	WindGust struct {
+		Speed accuWeatherMetric `json:"Speed"`
+	} `json:"WindGust"`
+	UVIndex              int64             `json:"UVIndex"`
+	Visibility           accuWeatherMetric `json:"Visibility"`
+	CloudCover           float64           `json:"CloudCover"`
+	Pressure             accuWeatherMetric `json:"Pressure"`
+	PrecipitationSummary struct {
+		PastHour accuWeatherMetric `json:"PastHour"`
+	} `json:"PrecipitationSummary"`
+}
+
+// dataPoint converts the current conditions to the Dark Sky data model. The
+// wind speeds are in km/h.
+func (c *accuWeatherCurrent) dataPoint() forecast.DataPoint {
+	dp := forecast.DataPoint{
+		Time:                c.EpochTime,
+		Summary:             c.WeatherText,
+		Icon:                accuWeatherIcons[c.WeatherIcon],
+		Temperature:         c.Temperature.Metric.Value,
+		ApparentTemperature: c.RealFeelTemperature.Metric.Value,
+		Humidity:            c.RelativeHumidity / 100,
+		DewPoint:            c.DewPoint.Metric.Value,
+		WindBearing:         c.Wind.Direction.Degrees,
+		WindSpeed:           c.Wind.Speed.Metric.Value / 3.6,
+		WindGust:            c.WindGust.Speed.Metric.Value / 3.6,
+		UVIndex:             c.UVIndex,
+		Visibility:          c.Visibility.Metric.Value,
+		CloudCover:          c.CloudCover / 100,
+		Pressure:            c.Pressure.Metric.Value,
+		PrecipIntensity:     c.PrecipitationSummary.PastHour.Metric.Value,
+	}
+	if dp.PrecipIntensity > 0 || c.PrecipitationType != "" {
+		dp.PrecipType = accuWeatherPrecipType(c.PrecipitationType)
+	}
+	return dp
+}
+
+// accuWeatherPrecipType maps an AccuWeather precipitation type to a Dark Sky
+// one.
+func accuWeatherPrecipType(t string) string {
+	switch t {
+	case "Snow":
+		return "snow"
+	case "Ice", "Mixed":
+		return "sleet"
+	}
+	return "rain"
+}
+
+// accuWeatherHour is an hour of the hourly forecast, requested with details.
+type accuWeatherHour struct {
+	EpochDateTime       int64            `json:"EpochDateTime"`
+	WeatherIcon         int              `json:"WeatherIcon"`
+	IconPhrase          string           `json:"IconPhrase"`
+	PrecipitationType   string           `json:"PrecipitationType"`
+	Temperature         accuWeatherValue `json:"Temperature"`
+	RealFeelTemperature accuWeatherValue `json:"RealFeelTemperature"`
+	DewPoint            accuWeatherValue `json:"DewPoint"`
+	Wind                struct {
+		Speed     accuWeatherValue `json:"Speed"`
+		Direction struct {
+			Degrees float64 `json:"Degrees"`
+		} `json:"Direction"`
+	} `json:"Wind"`
+	WindGust struct {
+		Speed accuWeatherValue `json:"Speed"`
+	} `json:"WindGust"`
+	RelativeHumidity         float64          `json:"RelativeHumidity"`
+	Visibility               accuWeatherValue `json:"Visibility"`
+	UVIndex                  int64            `json:"UVIndex"`
+	PrecipitationProbability float64          `json:"PrecipitationProbability"`
+	TotalLiquid              accuWeatherValue `json:"TotalLiquid"`
+	CloudCover               float64          `json:"CloudCover"`
+}
+
+// dataPoint converts an hour of the forecast to the Dark Sky data model.
+func (h *accuWeatherHour) dataPoint() forecast.DataPoint {
+	dp := forecast.DataPoint{
+		Time:                h.EpochDateTime,
+		Summary:             h.IconPhrase,
+		Icon:                accuWeatherIcons[h.WeatherIcon],
+		Temperature:         h.Temperature.Value,
+		ApparentTemperature: h.RealFeelTemperature.Value,
+		DewPoint:            h.DewPoint.Value,
+		WindSpeed:           h.Wind.Speed.Value / 3.6,
+		WindBearing:         h.Wind.Direction.Degrees,
+		WindGust:            h.WindGust.Speed.Value / 3.6,
+		Humidity:            h.RelativeHumidity / 100,
+		Visibility:          h.Visibility.Value,
+		UVIndex:             h.UVIndex,
+		PrecipProbability:   h.PrecipitationProbability / 100,
+		PrecipIntensity:     h.TotalLiquid.Value,
+		CloudCover:          h.CloudCover / 100,
+	}
+	if dp.PrecipIntensity > 0 || h.PrecipitationType != "" {
+		dp.PrecipType = accuWeatherPrecipType(h.PrecipitationType)
+	}
+	return dp
+}
+
+// accuWeatherDay is a day of the daily forecast, requested with details.
+type accuWeatherDay struct {
+	EpochDate int64 `json:"EpochDate"`
+	Sun       struct {
+		EpochRise int64 `json:"EpochRise"`
+		EpochSet  int64 `json:"EpochSet"`
+	} `json:"Sun"`
+	Temperature struct {
+		Minimum accuWeatherValue `json:"Minimum"`
+		Maximum accuWeatherValue `json:"Maximum"`
+	} `json:"Temperature"`
+	Day struct {
+		Icon                     int     `json:"Icon"`
+		IconPhrase               string  `json:"IconPhrase"`
+		PrecipitationType        string  `json:"PrecipitationType"`
+		PrecipitationProbability float64 `json:"PrecipitationProbability"`
+		Wind                     struct {
+			Speed     accuWeatherValue `json:"Speed"`
+			Direction struct {
+				Degrees float64 `json:"Degrees"`
+			} `json:"Direction"`
+		} `json:"Wind"`
+		TotalLiquid accuWeatherValue `json:"TotalLiquid"`
+	} `json:"Day"`
+	AirAndPollen []struct {
+		Name  string  `json:"Name"`
+		Value float64 `json:"Value"`
+	} `json:"AirAndPollen"`
+}
+
+// dataPoint converts a day of the forecast to the Dark Sky data model, using
+// the daytime forecast for the conditions.
+func (d *accuWeatherDay) dataPoint() forecast.DataPoint {
+	dp := forecast.DataPoint{
+		Time:              d.EpochDate,
+		Summary:           d.Day.IconPhrase,
+		Icon:              accuWeatherIcons[d.Day.Icon],
+		SunriseTime:       d.Sun.EpochRise,
+		SunsetTime:        d.Sun.EpochSet,
+		TemperatureMin:    d.Temperature.Minimum.Value,
+		TemperatureMax:    d.Temperature.Maximum.Value,
+		PrecipProbability: d.Day.PrecipitationProbability / 100,
+		PrecipIntensity:   d.Day.TotalLiquid.Value / 24,
+		WindSpeed:         d.Day.Wind.Speed.Value / 3.6,
+		WindBearing:       d.Day.Wind.Direction.Degrees,
+	}
+	if dp.PrecipIntensity > 0 || d.Day.PrecipitationType != "" {
+		dp.PrecipType = accuWeatherPrecipType(d.Day.PrecipitationType)
+	}
+	for _, p := range d.AirAndPollen {
+		if p.Name == "UVIndex" {
+			dp.UVIndex = int64(p.Value)
+		}
+	}
+	return dp
+}
+
+// accuWeatherForecasts returns whether the hourly and the daily forecasts are
+// requested from AccuWeather, which is only if they are exported.
+func (c *Config) accuWeatherForecasts() (hourly, daily bool) {
+	return c.ForecastHours > 0 || c.RouteAPI, c.ForecastDays > 0 || c.OutlookWeeks > 0
+}
+
+// accuWeatherProvider gets the weather from the AccuWeather Current
+// Conditions and Forecast APIs. The free tier only allows 50 calls per day,
+// so the forecasts are only requested if exported.
+type accuWeatherProvider struct {
+	httpClient *http.Client
+	apiKey     string
+	hourly     bool
+	daily      bool
+}
+
+// Name implements Provider.Name for accuWeatherProvider.
+func (p *accuWeatherProvider) Name() string {
+	return "accuweather"
+}
+
+// location returns the AccuWeather location of the coordinates, or of the
+// location key if configured, looking it up the first time.
+func (p *accuWeatherProvider) location(ctx context.Context, loc *Location) (*accuWeatherLocation, error) {
+	coords := loc.LatString() + "," + loc.LngString()
+	if loc.NativeProvider == p.Name() {
+		coords = "key:" + loc.NativeID
+	}
+	accuWeatherLocations.mu.Lock()
+	al, ok := accuWeatherLocations.locations[coords]
+	accuWeatherLocations.mu.Unlock()
+	if ok {
+		return al, nil
+	}
+	path, q := "/locations/v1/cities/geoposition/search", url.Values{}
+	if loc.NativeProvider == p.Name() {
+		path = "/locations/v1/" + url.PathEscape(loc.NativeID)
+	} else {
+		q.Set("q", coords)
+	}
+	al = &accuWeatherLocation{}
+	if _, _, err := accuWeatherGet(ctx, p.httpClient, p.apiKey, path, q, al); err != nil {
+		return nil, fmt.Errorf("location key lookup failed: %w", err)
+	}
+	accuWeatherLocations.mu.Lock()
+	accuWeatherLocations.locations[coords] = al
+	accuWeatherLocations.mu.Unlock()
+	return al, nil
+}
+
+// locate implements nativeLocator.locate for accuWeatherProvider, with the
+// AccuWeather location keys.
+func (p *accuWeatherProvider) locate(ctx context.Context, id string) (*Location, error) {
+	al, err := p.location(ctx, &Location{NativeProvider: p.Name(), NativeID: id})
+	if err != nil {
+		return nil, err
+	}
+	return &Location{
+		Name:     al.LocalizedName,
+		Lat:      al.GeoPosition.Latitude,
+		Lng:      al.GeoPosition.Longitude,
+		Accuracy: "APPROXIMATE",
+	}, nil
+}
+
+// Get implements Provider.Get for accuWeatherProvider.
+func (p *accuWeatherProvider) Get(ctx context.Context, loc *Location) (*Weather, error) {
+	al, err := p.location(ctx, loc)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Set("details", "true")
+	var current []accuWeatherCurrent
+	data, header, err := accuWeatherGet(ctx, p.httpClient, p.apiKey, "/currentconditions/v1/"+al.Key, q, &current)
+	if err != nil {
+		return nil, err
+	}
+	if len(current) == 0 {
+		countAPIError(p.Name(), reasonDecode)
+		return nil, &APIError{Provider: p.Name(), Reason: reasonDecode, Err: fmt.Errorf("no current conditions")}
+	}
+	fc := forecast.Forecast{
+		Latitude:  loc.Lat,
+		Longitude: loc.Lng,
+		Timezone:  al.TimeZone.Name,
+		Currently: current[0].dataPoint(),
+		Flags:     forecast.Flags{Units: string(forecast.SI), Sources: []string{"accuweather"}},
+	}
+	_, offset := time.Now().In(forecastLocation(&fc)).Zone()
+	fc.Offset = float64(offset) / 3600
+	q.Set("metric", "true")
+	if p.hourly {
+		var hours []accuWeatherHour
+		if _, _, err := accuWeatherGet(ctx, p.httpClient, p.apiKey, "/forecasts/v1/hourly/12hour/"+al.Key, q, &hours); err != nil {
+			return nil, err
+		}
+		for idx := range hours {
+			fc.Hourly.Data = append(fc.Hourly.Data, hours[idx].dataPoint())
+		}
+	}
+	if p.daily {
+		var daily struct {
+			DailyForecasts []accuWeatherDay `json:"DailyForecasts"`
+		}
+		if _, _, err := accuWeatherGet(ctx, p.httpClient, p.apiKey, "/forecasts/v1/daily/5day/"+al.Key, q, &daily); err != nil {
+			return nil, err
+		}
+		for idx := range daily.DailyForecasts {
+			fc.Daily.Data = append(fc.Daily.Data, daily.DailyForecasts[idx].dataPoint())
+		}
+	}
+	// the current conditions are the main response
+	w := Weather{Forecast: &fc, Stations: &StationInfo{}, Endpoint: accuWeatherURL, ResponseSHA256: sha256Hex(data)}
+	w.QuotaUsage, w.HasQuotaUsage = quotaUsage(p.Name(), header)
+	return &w, nil
+}
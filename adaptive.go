@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults of the adaptive refresh intervals, if not configured.
+const (
+	defaultAdaptiveMinInterval = time.Minute
+	defaultAdaptiveMaxInterval = time.Hour
+)
+
+// quotaDangerThreshold is the fraction of the daily quota above which the
+// refresh interval is lengthened even without errors.
+const quotaDangerThreshold = 0.9
+
+// adaptiveRecoveryPeriods is the number of refresh intervals without
+// throttling after which the refresh interval is shortened again.
+const adaptiveRecoveryPeriods = 5
+
+// AdaptiveRefreshConfig configures the rate-limit-aware refresh interval.
+type AdaptiveRefreshConfig struct {
+	// MinInterval is the refresh interval when the provider is healthy.
+	MinInterval Duration `json:"min_interval"`
+	// MaxInterval is the longest refresh interval used when throttled.
+	MaxInterval Duration `json:"max_interval"`
+}
+
+// quotaUsage returns the fraction of the daily quota used, as reported by the
+// response headers of a provider, if available. Dark Sky reports the number
+// of calls of the day in X-Forecast-API-Calls, other providers use the
+// X-RateLimit-Limit and X-RateLimit-Remaining convention, its per-day variant
+// for Tomorrow.io, or the RateLimit-Limit and RateLimit-Remaining one for
+// AccuWeather.
+func quotaUsage(provider string, h http.Header) (float64, bool) {
+	if v := h.Get("X-Forecast-API-Calls"); v != "" {
+		calls, err := strconv.ParseFloat(v, 64)
+		quota := freeTierDailyQuotas[provider]
+		if err != nil || quota <= 0 {
+			return 0, false
+		}
+		return calls / quota, true
+	}
+	limitHeader, remainingHeader := "X-RateLimit-Limit", "X-RateLimit-Remaining"
+	switch {
+	case h.Get("X-RateLimit-Limit-Day") != "":
+		limitHeader, remainingHeader = "X-RateLimit-Limit-Day", "X-RateLimit-Remaining-Day"
+	case h.Get("RateLimit-Limit") != "":
+		limitHeader, remainingHeader = "RateLimit-Limit", "RateLimit-Remaining"
+	}
+	limit, err := strconv.ParseFloat(h.Get(limitHeader), 64)
+	if err != nil || limit <= 0 {
+		return 0, false
+	}
+	remaining, err := strconv.ParseFloat(h.Get(remainingHeader), 64)
+	if err != nil {
+		return 0, false
+	}
+	return 1 - remaining/limit, true
+}
+
+type adaptiveState struct {
+	interval   time.Duration
+	lastChange time.Time
+}
+
+// adaptiveRefresh tracks the effective refresh interval of each provider. The
+// interval is doubled, up to the maximum, when a provider throttles the
+// requests or reports that the quota is almost exhausted, and halved, down to
+// the minimum, after some time without problems.
+type adaptiveRefresh struct {
+	min, max time.Duration
+	desc     *prometheus.Desc
+
+	mu     sync.Mutex
+	states map[string]*adaptiveState
+}
+
+func newAdaptiveRefresh(config *AdaptiveRefreshConfig) *adaptiveRefresh {
+	a := adaptiveRefresh{
+		min: time.Duration(config.MinInterval),
+		max: time.Duration(config.MaxInterval),
+		desc: prometheus.NewDesc(
+			"weather_exporter_effective_refresh_interval_seconds",
+			"Current minimum interval between two weather requests for the same location, lengthened when the provider throttles",
+			[]string{"provider"}, nil,
+		),
+		states: make(map[string]*adaptiveState),
+	}
+	if a.min <= 0 {
+		a.min = defaultAdaptiveMinInterval
+	}
+	if a.max < a.min {
+		a.max = defaultAdaptiveMaxInterval
+		if a.max < a.min {
+			a.max = a.min
+		}
+	}
+	return &a
+}
+
+// state returns the state of a provider. Must be called with a.mu held.
+func (a *adaptiveRefresh) state(provider string) *adaptiveState {
+	st, ok := a.states[provider]
+	if !ok {
+		st = &adaptiveState{interval: a.min}
+		a.states[provider] = st
+	}
+	return st
+}
+
+// interval returns the current refresh interval of a provider.
+func (a *adaptiveRefresh) interval(provider string) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state(provider).interval
+}
+
+// throttled lengthens the refresh interval of a provider. Multiple calls
+// within the minimum interval, e.g. for several locations in the same scrape,
+// count once.
+func (a *adaptiveRefresh) throttled(provider, why string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := a.state(provider)
+	if time.Since(st.lastChange) < a.min || st.interval >= a.max {
+		return
+	}
+	st.interval *= 2
+	if st.interval > a.max {
+		st.interval = a.max
+	}
+	st.lastChange = time.Now()
+	warnf(context.Background(), "%s %s, refresh interval lengthened to %s", provider, why, st.interval)
+}
+
+// ok records a successful request, shortening the refresh interval of a
+// provider if it has not been throttled for a while.
+func (a *adaptiveRefresh) ok(provider string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	st := a.state(provider)
+	if st.interval <= a.min || time.Since(st.lastChange) < adaptiveRecoveryPeriods*st.interval {
+		return
+	}
+	st.interval /= 2
+	if st.interval < a.min {
+		st.interval = a.min
+	}
+	st.lastChange = time.Now()
+	logf(context.Background(), "%s is healthy again, refresh interval shortened to %s", provider, st.interval)
+}
+
+// observe updates the refresh interval of a provider after a successful
+// request, given the quota usage reported by the provider, if known.
+func (a *adaptiveRefresh) observe(provider string, usage float64, known bool) {
+	if known && usage >= quotaDangerThreshold {
+		a.throttled(provider, "quota almost exhausted")
+		return
+	}
+	a.ok(provider)
+}
+
+// Describe implements prometheus.Collector.Describe for adaptiveRefresh.
+func (a *adaptiveRefresh) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.desc
+}
+
+// Collect implements prometheus.Collector.Collect for adaptiveRefresh.
+func (a *adaptiveRefresh) Collect(ch chan<- prometheus.Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for provider, st := range a.states {
+		ch <- prometheus.MustNewConstMetric(a.desc, prometheus.GaugeValue, st.interval.Seconds(), provider)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// faaStatusURL is the FAA National Airspace System status feed, which
+	// lists the US airports with delays, ground stops or closures.
+	faaStatusURL = "https://nasstatus.faa.gov/api/airport-status-information"
+	// faaStatusMaxAge is how long the FAA status is reused. The status of all
+	// the airports comes with a single request.
+	faaStatusMaxAge = 5 * time.Minute
+)
+
+// airportStatus is the delay status of an airport. The airports with no
+// delays are not listed in the FAA status, and have a zero status.
+type airportStatus struct {
+	// ArrivalDelay and DepartureDelay are the maximum delays, in minutes.
+	ArrivalDelay   float64
+	DepartureDelay float64
+	GroundStop     bool
+	Closed         bool
+}
+
+// faaDurationRe matches the parts of an FAA delay, e.g. "1 hour and 59
+// minutes".
+var faaDurationRe = regexp.MustCompile(`(\d+)\s*(hour|minute)`)
+
+// parseFAADuration returns an FAA delay in minutes.
+func parseFAADuration(s string) float64 {
+	var minutes float64
+	for _, m := range faaDurationRe.FindAllStringSubmatch(strings.ToLower(s), -1) {
+		v, _ := strconv.ParseFloat(m[1], 64)
+		if m[2] == "hour" {
+			v *= 60
+		}
+		minutes += v
+	}
+	return minutes
+}
+
+// parseFAAStatus parses the FAA status feed, returning the status of the
+// listed airports by code.
+func parseFAAStatus(data []byte) (map[string]*airportStatus, error) {
+	var doc struct {
+		DelayTypes []struct {
+			GroundDelays []struct {
+				Airport string `xml:"ARPT"`
+				Max     string `xml:"Max"`
+			} `xml:"Ground_Delay_List>Ground_Delay"`
+			Delays []struct {
+				Airport string `xml:"ARPT"`
+				Delays  []struct {
+					Type string `xml:"Type,attr"`
+					Max  string `xml:"Max"`
+				} `xml:"Arrival_Departure"`
+			} `xml:"Arrival_Departure_Delay_List>Delay"`
+			GroundStops []struct {
+				Airport string `xml:"ARPT"`
+			} `xml:"Ground_Stop_List>Program"`
+			Closures []struct {
+				Airport string `xml:"ARPT"`
+			} `xml:"Airport_Closure_List>Airport"`
+		} `xml:"Delay_type"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]*airportStatus)
+	status := func(code string) *airportStatus {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if statuses[code] == nil {
+			statuses[code] = &airportStatus{}
+		}
+		return statuses[code]
+	}
+	raise := func(a *float64, b float64) {
+		if b > *a {
+			*a = b
+		}
+	}
+	for _, dt := range doc.DelayTypes {
+		// ground delay programs hold the flights to the airport at their
+		// origin, so they delay the arrivals
+		for _, gd := range dt.GroundDelays {
+			raise(&status(gd.Airport).ArrivalDelay, parseFAADuration(gd.Max))
+		}
+		for _, d := range dt.Delays {
+			st := status(d.Airport)
+			for _, ad := range d.Delays {
+				if strings.EqualFold(ad.Type, "Arrival") {
+					raise(&st.ArrivalDelay, parseFAADuration(ad.Max))
+				} else {
+					raise(&st.DepartureDelay, parseFAADuration(ad.Max))
+				}
+			}
+		}
+		for _, gs := range dt.GroundStops {
+			status(gs.Airport).GroundStop = true
+		}
+		for _, c := range dt.Closures {
+			status(c.Airport).Closed = true
+		}
+	}
+	return statuses, nil
+}
+
+// airportStatuses caches the FAA status of all the airports.
+type airportStatuses struct {
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	statuses  map[string]*airportStatus
+	fetchedAt time.Time
+}
+
+func newAirportStatuses(httpClient *http.Client) *airportStatuses {
+	return &airportStatuses{httpClient: httpClient}
+}
+
+// get returns the status of an airport, fetching the FAA status if it is
+// older than faaStatusMaxAge. After a failure, the FAA status is not fetched
+// again until faaStatusMaxAge has passed.
+func (s *airportStatuses) get(ctx context.Context, code string) (*airportStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.fetchedAt) >= faaStatusMaxAge {
+		s.fetchedAt = time.Now()
+		statuses, err := s.fetch(ctx)
+		s.statuses = statuses
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.statuses == nil {
+		return nil, fmt.Errorf("airport status not available")
+	}
+	if st, ok := s.statuses[strings.ToUpper(code)]; ok {
+		return st, nil
+	}
+	return &airportStatus{}, nil
+}
+
+// fetch gets and parses the FAA status.
+func (s *airportStatuses) fetch(ctx context.Context) (map[string]*airportStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, faaStatusURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	statuses, err := parseFAAStatus(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return statuses, nil
+}
+
+// validateAirports checks that the airports are FAA location identifiers,
+// e.g. "EWR".
+func validateAirports(airports map[string]string) error {
+	for name, code := range airports {
+		if len(code) != 3 {
+			return fmt.Errorf("location '%s': invalid airport code '%s'", name, code)
+		}
+		for _, c := range code {
+			if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+				return fmt.Errorf("location '%s': invalid airport code '%s'", name, code)
+			}
+		}
+	}
+	return nil
+}
+
+// boolToFloat returns 1 for true and 0 for false, for boolean gauges.
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultAlertmanagerInterval is how often the active weather alerts are sent
+// to Alertmanager, if not configured.
+const defaultAlertmanagerInterval = time.Minute
+
+// weatherAlertName is the alertname label of the weather alerts.
+const weatherAlertName = "WeatherAlert"
+
+// AlertmanagerConfig configures the forwarding of the weather alerts issued
+// by the providers to Alertmanager.
+type AlertmanagerConfig struct {
+	// URL is the base URL of Alertmanager, e.g. http://localhost:9093.
+	URL string `json:"url"`
+	// Interval is how often the active alerts are sent.
+	Interval Duration `json:"interval"`
+	// Labels are added to every alert, e.g. to route them.
+	Labels map[string]string `json:"labels"`
+}
+
+// amAlert is an alert in the Alertmanager v2 API format.
+type amAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// alertmanagerBridge periodically sends the active weather alerts of every
+// location to Alertmanager. Alerts that are not sent anymore resolve when
+// they expire.
+type alertmanagerBridge struct {
+	config      *AlertmanagerConfig
+	constLabels map[string]string
+	httpClient  *http.Client
+	wc          *WeatherCollector
+}
+
+func newAlertmanagerBridge(config *AlertmanagerConfig, constLabels map[string]string, wc *WeatherCollector) *alertmanagerBridge {
+	return &alertmanagerBridge{
+		config:      config,
+		constLabels: constLabels,
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		wc:          wc,
+	}
+}
+
+func (b *alertmanagerBridge) interval() time.Duration {
+	if b.config.Interval > 0 {
+		return time.Duration(b.config.Interval)
+	}
+	return defaultAlertmanagerInterval
+}
+
+// alerts returns the active weather alerts of the cached locations at time
+// now. Alerts without an expiration time end after three intervals, unless
+// sent again.
+func (b *alertmanagerBridge) alerts(now time.Time) []amAlert {
+	alerts := []amAlert{}
+	for _, a := range activeAlerts(b.wc.Snapshot(), now) {
+		endsAt := a.Expires
+		if endsAt.IsZero() {
+			endsAt = now.Add(3 * b.interval())
+		}
+		labels := make(map[string]string, len(b.constLabels)+len(b.config.Labels)+4)
+		for k, v := range b.constLabels {
+			labels[k] = v
+		}
+		for k, v := range b.config.Labels {
+			labels[k] = v
+		}
+		labels["alertname"] = weatherAlertName
+		labels["location"] = a.Location
+		labels["severity"] = a.Severity
+		labels["event"] = a.Title
+		annotations := make(map[string]string)
+		if a.Description != "" {
+			annotations["description"] = a.Description
+		}
+		if len(a.Regions) > 0 {
+			annotations["regions"] = strings.Join(a.Regions, ", ")
+		}
+		alerts = append(alerts, amAlert{
+			Labels:       labels,
+			Annotations:  annotations,
+			StartsAt:     a.Time,
+			EndsAt:       endsAt,
+			GeneratorURL: a.URI,
+		})
+	}
+	return alerts
+}
+
+// send posts the active alerts to Alertmanager.
+func (b *alertmanagerBridge) send(ctx context.Context) (int, error) {
+	alerts := b.alerts(time.Now())
+	if len(alerts) == 0 {
+		return 0, nil
+	}
+	data, err := json.Marshal(alerts)
+	if err != nil {
+		return 0, err
+	}
+	u := strings.TrimSuffix(b.config.URL, "/") + "/api/v2/alerts"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return 0, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return len(alerts), nil
+}
+
+// run sends the active alerts at every interval until ctx is done.
+func (b *alertmanagerBridge) run(ctx context.Context) {
+	ticker := time.NewTicker(b.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := b.send(ctx); err != nil {
+				warnf(ctx, "Failed to send weather alerts to Alertmanager: %v", err)
+			}
+		}
+	}
+}
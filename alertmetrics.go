@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+)
+
+// unknownSeverity is the severity label of the alerts whose provider gives
+// no severity.
+const unknownSeverity = "unknown"
+
+// alertSeverity returns the severity label of an alert.
+func alertSeverity(a *weatherAlert) string {
+	if a.Severity == "" {
+		return unknownSeverity
+	}
+	return a.Severity
+}
+
+// alertKey identifies an alert across fetches.
+type alertKey struct {
+	title string
+	time  int64
+}
+
+// alertCounter counts the weather alerts issued for each location by
+// severity. An alert is counted the first time it appears in a fetched
+// forecast.
+type alertCounter struct {
+	mu sync.Mutex
+	// seen are the alerts of the last forecast of each location.
+	seen   map[string]map[alertKey]bool
+	counts map[string]map[string]float64
+}
+
+func newAlertCounter() *alertCounter {
+	return &alertCounter{
+		seen:   make(map[string]map[alertKey]bool),
+		counts: make(map[string]map[string]float64),
+	}
+}
+
+// observe counts the alerts of a location that were not in its previous
+// forecast.
+func (c *alertCounter) observe(name string, alerts []weatherAlert) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := make(map[alertKey]bool, len(alerts))
+	for idx := range alerts {
+		a := &alerts[idx]
+		key := alertKey{title: a.Title, time: a.Time.Unix()}
+		seen[key] = true
+		if c.seen[name][key] {
+			continue
+		}
+		if c.counts[name] == nil {
+			c.counts[name] = make(map[string]float64)
+		}
+		c.counts[name][alertSeverity(a)]++
+	}
+	c.seen[name] = seen
+}
+
+// forEach calls fn for every counter of a location.
+func (c *alertCounter) forEach(name string, fn func(severity string, count float64)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for severity, count := range c.counts[name] {
+		fn(severity, count)
+	}
+}
+
+// prune removes the counters of all the locations not in keep.
+func (c *alertCounter) prune(keep map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.counts {
+		if !keep[name] {
+			delete(c.counts, name)
+		}
+	}
+	for name := range c.seen {
+		if !keep[name] {
+			delete(c.seen, name)
+		}
+	}
+}
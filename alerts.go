@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// weatherAlert is a severe weather alert issued by the provider for a
+// location.
+type weatherAlert struct {
+	Location    string
+	Title       string
+	Severity    string
+	Description string
+	Regions     []string
+	URI         string
+	Time        time.Time
+	// Expires is the zero time if the provider gave no expiration time.
+	Expires time.Time
+}
+
+// activeAlerts returns the weather alerts of the cached locations that are
+// not expired at time now.
+func activeAlerts(snapshot []*LocationWeather, now time.Time) []weatherAlert {
+	var alerts []weatherAlert
+	for _, lw := range snapshot {
+		for _, a := range lw.Weather.Forecast.Alerts {
+			wa := weatherAlert{
+				Location:    lw.Name,
+				Title:       a.Title,
+				Severity:    strings.ToLower(a.Severity),
+				Description: a.Description,
+				Regions:     a.Regions,
+				URI:         a.URI,
+				Time:        time.Unix(a.Time, 0),
+			}
+			if a.Expires > 0 {
+				wa.Expires = time.Unix(int64(a.Expires), 0)
+				if !wa.Expires.After(now) {
+					continue
+				}
+			}
+			alerts = append(alerts, wa)
+		}
+	}
+	return alerts
+}
+
+// atomFeed is an Atom feed, as per RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Link       *atomLink      `xml:"link,omitempty"`
+	Categories []atomCategory `xml:"category"`
+	Summary    string         `xml:"summary,omitempty"`
+}
+
+// alertsFeed builds the Atom feed of the given alerts, most recent first.
+func alertsFeed(alerts []weatherAlert, now time.Time) *atomFeed {
+	feed := atomFeed{
+		ID:      "urn:prometheus-weather-exporter:alerts",
+		Title:   "Weather alerts",
+		Updated: now.UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: "prometheus-weather-exporter"},
+	}
+	for idx := len(alerts) - 1; idx >= 0; idx-- {
+		a := alerts[idx]
+		e := atomEntry{
+			// stable across fetches, so that feed readers do not show the
+			// same alert twice
+			ID:      "urn:prometheus-weather-exporter:alert:" + sha256Hex([]byte(fmt.Sprintf("%s\x00%d\x00%s", a.Location, a.Time.Unix(), a.Title)))[:16],
+			Title:   fmt.Sprintf("%s: %s", a.Location, a.Title),
+			Updated: a.Time.UTC().Format(time.RFC3339),
+			Summary: a.Description,
+		}
+		if a.URI != "" {
+			e.Link = &atomLink{Href: a.URI}
+		}
+		if a.Severity != "" {
+			e.Categories = append(e.Categories, atomCategory{Term: a.Severity})
+		}
+		for _, r := range a.Regions {
+			e.Categories = append(e.Categories, atomCategory{Term: r})
+		}
+		feed.Entries = append(feed.Entries, e)
+	}
+	return &feed
+}
+
+// alertsFeedHandler returns an HTTP handler serving the active weather alerts
+// of every location as an Atom feed, or of a single one with the location
+// query parameter. It uses the data fetched by the last scrape and never
+// calls the APIs.
+func alertsFeedHandler(wc *WeatherCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		alerts := activeAlerts(wc.Snapshot(), now)
+		if name := r.URL.Query().Get("location"); name != "" {
+			var filtered []weatherAlert
+			for _, a := range alerts {
+				if a.Location == name {
+					filtered = append(filtered, a)
+				}
+			}
+			alerts = filtered
+		}
+		data, err := xml.MarshalIndent(alertsFeed(alerts, now), "", "  ")
+		if err != nil {
+			errorf(r.Context(), "Failed to render alerts feed: %v", err)
+			http.Error(w, "failed to render alerts feed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		if _, err := w.Write(append([]byte(xml.Header), data...)); err != nil {
+			errorf(r.Context(), "Failed to write alerts feed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// locationsPath is the path of the locations admin API.
+const locationsPath = "/api/v1/locations"
+
+// refreshPath is the path of the refresh API.
+const refreshPath = "/api/v1/refresh"
+
+// writeJSON writes v as the JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		errorf(context.Background(), "Failed to write JSON response: %v", err)
+	}
+}
+
+// locationsHandler returns an HTTP handler for the locations admin API:
+//   - GET /api/v1/locations lists the configured locations;
+//   - GET /api/v1/locations/<name> returns a single location;
+//   - PUT /api/v1/locations/<name> with {"enabled": false} or
+//     {"enabled": true} disables or enables a location, if admin is true.
+//
+// Changes are not persisted to the configuration file.
+func locationsHandler(wc *WeatherCollector, admin bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, locationsPath), "/")
+		if name == "" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, wc.LocationStates())
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			if !admin {
+				http.Error(w, "admin API disabled, run with -web.enable-admin-api", http.StatusForbidden)
+				return
+			}
+			var req struct {
+				Enabled *bool `json:"enabled"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+				http.Error(w, `body must be {"enabled": true} or {"enabled": false}`, http.StatusBadRequest)
+				return
+			}
+			if err := wc.SetEnabled(name, *req.Enabled); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			action := "disabled"
+			if *req.Enabled {
+				action = "enabled"
+			}
+			logf(r.Context(), "Location '%s' %s via the admin API", name, action)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, st := range wc.LocationStates() {
+			if st.Name == name {
+				writeJSON(w, st)
+				return
+			}
+		}
+		http.Error(w, fmt.Sprintf("unknown location '%s'", name), http.StatusNotFound)
+	})
+}
+
+// refreshLocationHandler returns an HTTP handler for the refresh API: POST
+// /api/v1/refresh/<name> fetches the weather of an enabled location right
+// away, regardless of its refresh interval, and returns the fresh values.
+func refreshLocationHandler(wc *WeatherCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, refreshPath), "/")
+		found := false
+		for _, loc := range wc.Locations() {
+			if loc == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("unknown or disabled location '%s'", name), http.StatusNotFound)
+			return
+		}
+		ctx := withCorrelationID(r.Context(), "refresh-"+newCorrelationID())
+		lw, err := wc.update(ctx, name)
+		if err != nil {
+			errorf(ctx, "Failed to refresh weather for '%s': %v", name, err)
+			http.Error(w, fmt.Sprintf("failed to refresh '%s': %v", name, err), http.StatusBadGateway)
+			return
+		}
+		logf(ctx, "Location '%s' refreshed via the API", name)
+		writeJSON(w, newRenderData([]*LocationWeather{lw}).Locations[0])
+	})
+}
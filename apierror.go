@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Reasons used to classify the API failures in the exporter metrics.
+const (
+	reasonTimeout = "timeout"
+	reasonNetwork = "network"
+	reasonAuth    = "auth"
+	reasonQuota   = "quota"
+	reason4xx     = "4xx"
+	reason5xx     = "5xx"
+	reasonDecode  = "decode"
+	reasonAPI     = "api"
+)
+
+// APIError is an error returned by an upstream API, classified by reason.
+type APIError struct {
+	Provider string
+	Reason   string
+	Err      error
+}
+
+// Error implements error.Error for APIError.
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Provider, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// reasonForStatus classifies an HTTP status code. The body of the response is
+// used to detect quota errors reported with a generic status code.
+func reasonForStatus(code int, body string) string {
+	body = strings.ToLower(body)
+	switch {
+	case code == 429 || strings.Contains(body, "limit exceeded") || strings.Contains(body, "quota"):
+		return reasonQuota
+	case code == 401 || code == 403:
+		return reasonAuth
+	case code >= 500:
+		return reason5xx
+	default:
+		return reason4xx
+	}
+}
+
+// reasonForError classifies an error returned by an HTTP client.
+func reasonForError(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Reason
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return reasonTimeout
+	}
+	return reasonNetwork
+}
+
+// reasonForMapsError classifies an error returned by the Google Maps client,
+// which reports API errors as "maps: <STATUS> - <message>".
+func reasonForMapsError(err error) string {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "OVER_QUERY_LIMIT"), strings.Contains(msg, "OVER_DAILY_LIMIT"):
+		return reasonQuota
+	case strings.Contains(msg, "REQUEST_DENIED"):
+		return reasonAuth
+	case strings.HasPrefix(msg, "maps: "):
+		return reasonAPI
+	default:
+		return reasonForError(err)
+	}
+}
+
+// countAPIError increments the API errors counter for the given provider.
+func countAPIError(provider, reason string) {
+	if apiErrors != nil {
+		apiErrors.WithLabelValues(provider, reason).Inc()
+	}
+}
+
+// getJSON gets a JSON document from an API without a provider of its own,
+// e.g. the river gauges, and decodes it into v. The errors are classified and
+// counted like the ones of the providers, named after the host of u.
+func getJSON(ctx context.Context, httpClient *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	provider := providerForHost(req.URL.Hostname())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		countAPIError(provider, reasonForError(err))
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		countAPIError(provider, reasonForError(err))
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		reason := reasonForStatus(resp.StatusCode, string(data))
+		countAPIError(provider, reason)
+		return &APIError{Provider: provider, Reason: reason, Err: fmt.Errorf("HTTP status %s: %s", resp.Status, data)}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		countAPIError(provider, reasonDecode)
+		return &APIError{Provider: provider, Reason: reasonDecode, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultEAWSURL is the CAAMLv6 bulletin collection of the Euregio
+	// Tyrol, South Tyrol and Trentino, used if an EAWS region has no URL.
+	defaultEAWSURL = "https://static.avalanche.report/bulletins/latest/EUREGIO_en_CAAMLv6.json"
+	// avalancheOrgURL is the avalanche.org forecast API.
+	avalancheOrgURL = "https://api.avalanche.org/v2/public/product"
+	// avalancheMaxAge is how long the bulletins are reused. They are
+	// published once or twice a day.
+	avalancheMaxAge = time.Hour
+)
+
+// Sources of the avalanche bulletins.
+const (
+	avalancheSourceEAWS         = "eaws"
+	avalancheSourceAvalancheOrg = "avalancheorg"
+)
+
+// eawsDangerLevels are the CAAMLv6 danger ratings, by value. no_snow and
+// no_rating are not exported.
+var eawsDangerLevels = map[string]float64{
+	"low":          1,
+	"moderate":     2,
+	"considerable": 3,
+	"high":         4,
+	"very_high":    5,
+}
+
+// avalancheOrgElevations are the labels of the avalanche.org elevation bands.
+var avalancheOrgElevations = []struct{ key, label string }{
+	{"lower", "below_treeline"},
+	{"middle", "near_treeline"},
+	{"upper", "above_treeline"},
+}
+
+// AvalancheRegionConfig is a region of an avalanche bulletin.
+type AvalancheRegionConfig struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	// ID is the EAWS region ID, e.g. "AT-07-04", or the avalanche.org zone
+	// ID.
+	ID string `json:"id"`
+	// URL is the CAAMLv6 JSON bulletin collection of an EAWS region.
+	URL string `json:"url"`
+	// Center is the avalanche.org center ID, e.g. "NWAC".
+	Center string `json:"center"`
+}
+
+// validateAvalancheRegions checks that the regions have unique names, a
+// supported source and the IDs the source needs.
+func validateAvalancheRegions(regions []*AvalancheRegionConfig) error {
+	names := make(map[string]bool)
+	for _, r := range regions {
+		if r == nil || r.Name == "" {
+			return fmt.Errorf("avalanche region with no name")
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate avalanche region '%s'", r.Name)
+		}
+		names[r.Name] = true
+		if r.ID == "" {
+			return fmt.Errorf("avalanche region '%s' has no id", r.Name)
+		}
+		switch r.Source {
+		case avalancheSourceEAWS:
+		case avalancheSourceAvalancheOrg:
+			if r.Center == "" {
+				return fmt.Errorf("avalanche region '%s' has no center", r.Name)
+			}
+		default:
+			return fmt.Errorf("avalanche region '%s': unsupported source '%s', must be %s or %s", r.Name, r.Source, avalancheSourceEAWS, avalancheSourceAvalancheOrg)
+		}
+	}
+	return nil
+}
+
+// avalancheRating is a danger level, for the given elevation and aspects.
+type avalancheRating struct {
+	Elevation string
+	Aspect    string
+	Level     float64
+}
+
+// eawsBulletins is a CAAMLv6 bulletin collection.
+type eawsBulletins struct {
+	Bulletins []struct {
+		Regions []struct {
+			RegionID string `json:"regionID"`
+		} `json:"regions"`
+		DangerRatings []struct {
+			MainValue string `json:"mainValue"`
+			Elevation *struct {
+				LowerBound string `json:"lowerBound"`
+				UpperBound string `json:"upperBound"`
+			} `json:"elevation"`
+			Aspects []string `json:"aspects"`
+		} `json:"dangerRatings"`
+	} `json:"bulletins"`
+}
+
+// eawsElevation returns the label of a CAAMLv6 elevation, e.g. "above_2200m",
+// or "below_treeline" for a bound given as "treeline".
+func eawsElevation(lower, upper string) string {
+	bound := func(b string) string {
+		if _, err := fmt.Sscanf(b, "%d", new(int)); err == nil {
+			return b + "m"
+		}
+		return b
+	}
+	switch {
+	case lower != "" && upper != "":
+		return bound(lower) + "_" + bound(upper)
+	case lower != "":
+		return "above_" + bound(lower)
+	case upper != "":
+		return "below_" + bound(upper)
+	}
+	return "all"
+}
+
+// ratings returns the danger ratings of a region. The ratings of the
+// different times of the day, e.g. with wet snow in the afternoon, are
+// merged into the highest one.
+func (b *eawsBulletins) ratings(region string) []avalancheRating {
+	levels := make(map[[2]string]float64)
+	for _, bulletin := range b.Bulletins {
+		found := false
+		for _, r := range bulletin.Regions {
+			if r.RegionID == region {
+				found = true
+			}
+		}
+		if !found {
+			continue
+		}
+		for _, dr := range bulletin.DangerRatings {
+			level, ok := eawsDangerLevels[dr.MainValue]
+			if !ok {
+				continue
+			}
+			elevation := "all"
+			if e := dr.Elevation; e != nil {
+				elevation = eawsElevation(e.LowerBound, e.UpperBound)
+			}
+			aspect := "all"
+			if len(dr.Aspects) > 0 && len(dr.Aspects) < 8 {
+				aspects := append([]string{}, dr.Aspects...)
+				sort.Strings(aspects)
+				aspect = strings.Join(aspects, ",")
+			}
+			key := [2]string{elevation, aspect}
+			if level > levels[key] {
+				levels[key] = level
+			}
+		}
+	}
+	var ratings []avalancheRating
+	for key, level := range levels {
+		ratings = append(ratings, avalancheRating{Elevation: key[0], Aspect: key[1], Level: level})
+	}
+	return ratings
+}
+
+// avalancheOrgRatings gets the current danger ratings of an avalanche.org
+// zone, by elevation band.
+func avalancheOrgRatings(ctx context.Context, httpClient *http.Client, center, zone string) ([]avalancheRating, error) {
+	q := url.Values{}
+	q.Set("type", "forecast")
+	q.Set("center_id", center)
+	q.Set("zone_id", zone)
+	var r struct {
+		Danger []map[string]interface{} `json:"danger"`
+	}
+	if err := getJSON(ctx, httpClient, avalancheOrgURL+"?"+q.Encode(), &r); err != nil {
+		return nil, err
+	}
+	var ratings []avalancheRating
+	for _, d := range r.Danger {
+		if d["valid_day"] != "current" {
+			continue
+		}
+		for _, e := range avalancheOrgElevations {
+			// -1 and 0 mean no rating
+			if level, ok := d[e.key].(float64); ok && level >= 1 {
+				ratings = append(ratings, avalancheRating{Elevation: e.label, Aspect: "all", Level: level})
+			}
+		}
+	}
+	return ratings, nil
+}
+
+// avalancheBulletins caches the danger ratings of the regions, by region
+// name.
+type avalancheBulletins struct {
+	mu        sync.Mutex
+	ratings   map[string][]avalancheRating
+	fetchedAt time.Time
+}
+
+func newAvalancheBulletins() *avalancheBulletins {
+	return &avalancheBulletins{}
+}
+
+// cached returns the last danger ratings of the regions, however old.
+func (ab *avalancheBulletins) cached() map[string][]avalancheRating {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	return ab.ratings
+}
+
+// get returns the danger ratings of the regions, fetching them if they are
+// older than avalancheMaxAge. Every EAWS bulletin collection is fetched once
+// for all its regions. Regions that cannot be fetched are not returned.
+func (ab *avalancheBulletins) get(ctx context.Context, httpClient *http.Client, regions []*AvalancheRegionConfig) map[string][]avalancheRating {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	if ab.ratings != nil && time.Since(ab.fetchedAt) < avalancheMaxAge {
+		return ab.ratings
+	}
+	ratings := make(map[string][]avalancheRating)
+	collections := make(map[string]*eawsBulletins)
+	for _, r := range regions {
+		switch r.Source {
+		case avalancheSourceEAWS:
+			u := r.URL
+			if u == "" {
+				u = defaultEAWSURL
+			}
+			b, ok := collections[u]
+			if !ok {
+				b = &eawsBulletins{}
+				if err := getJSON(ctx, httpClient, u, b); err != nil {
+					errorf(ctx, "Failed to get the avalanche bulletins at %s: %v", u, err)
+					b = nil
+				}
+				collections[u] = b
+			}
+			if b != nil {
+				ratings[r.Name] = b.ratings(r.ID)
+			}
+		case avalancheSourceAvalancheOrg:
+			rr, err := avalancheOrgRatings(ctx, httpClient, r.Center, r.ID)
+			if err != nil {
+				errorf(ctx, "Failed to get the avalanche bulletin of '%s': %v", r.Name, err)
+				continue
+			}
+			ratings[r.Name] = rr
+		}
+	}
+	ab.ratings = ratings
+	ab.fetchedAt = time.Now()
+	return ratings
+}
+
+// refreshAvalanche fetches the avalanche bulletins if they are too old.
+func (wc *WeatherCollector) refreshAvalanche(ctx context.Context) {
+	if len(wc.cfg().AvalancheRegions) == 0 {
+		return
+	}
+	wc.avalanche.get(ctx, wc.httpClient, wc.cfg().AvalancheRegions)
+}
+
+// collectAvalanche sends the danger levels of the avalanche regions to ch.
+// When polling, the bulletins are fetched by the poller, and only the cached
+// ones are sent.
+func (wc *WeatherCollector) collectAvalanche(ctx context.Context, ch chan<- prometheus.Metric) {
+	if len(wc.cfg().AvalancheRegions) == 0 {
+		return
+	}
+	var ratings map[string][]avalancheRating
+	if wc.polling() {
+		ratings = wc.avalanche.cached()
+	} else {
+		ratings = wc.avalanche.get(ctx, wc.httpClient, wc.cfg().AvalancheRegions)
+	}
+	for _, r := range wc.cfg().AvalancheRegions {
+		for _, rating := range ratings[r.Name] {
+			ch <- prometheus.MustNewConstMetric(wc.avalancheDangerDesc, prometheus.GaugeValue, rating.Level, r.Name, r.Source, rating.Elevation, rating.Aspect)
+		}
+	}
+}
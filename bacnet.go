@@ -0,0 +1,781 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"net"
+	"runtime/debug"
+)
+
+// BACnetConfig configures the BACnet/IP server.
+type BACnetConfig struct {
+	// Listen is the UDP address to listen to. Defaults to ":47808", the
+	// standard BACnet/IP port.
+	Listen string `json:"listen"`
+	// DeviceInstance is the instance number of the device object, which must
+	// be unique on the BACnet network. Defaults to 9102.
+	DeviceInstance uint32 `json:"device_instance"`
+	// DeviceName is the name of the device object. Defaults to
+	// "weather-exporter".
+	DeviceName string `json:"device_name"`
+	// BBMDs are the addresses of the BACnet broadcast management devices
+	// whose forwarded messages are answered, e.g. "192.0.2.1". A forwarded
+	// message carries the address to answer to, so the ones from other
+	// hosts are dropped.
+	BBMDs []string `json:"bbmds"`
+}
+
+const (
+	defaultBACnetListen         = ":47808"
+	defaultBACnetDeviceInstance = 9102
+	defaultBACnetDeviceName     = "weather-exporter"
+	// bacnetMaxInstance is the highest valid object instance number.
+	bacnetMaxInstance = 1<<22 - 1
+	// bacnetMaxAPDU is the maximum APDU size accepted and sent, the maximum
+	// for BACnet/IP. Segmentation is not supported.
+	bacnetMaxAPDU = 1476
+	// bacnetInstancesPerLocation is the number of analog input instances
+	// reserved for each location.
+	bacnetInstancesPerLocation = 10
+	// bacnetVendorID is the vendor identifier reported by the device. The
+	// exporter has no identifier assigned by ASHRAE.
+	bacnetVendorID = 0
+)
+
+// BACnet object types.
+const (
+	bacnetAnalogInput = 0
+	bacnetDevice      = 8
+)
+
+// BACnet property identifiers.
+const (
+	bacnetPropAPDUTimeout                  = 11
+	bacnetPropApplicationSoftwareVersion   = 12
+	bacnetPropDescription                  = 28
+	bacnetPropDeviceAddressBinding         = 30
+	bacnetPropEventState                   = 36
+	bacnetPropFirmwareRevision             = 44
+	bacnetPropMaxAPDULengthAccepted        = 62
+	bacnetPropModelName                    = 70
+	bacnetPropNumberOfAPDURetries          = 73
+	bacnetPropObjectIdentifier             = 75
+	bacnetPropObjectList                   = 76
+	bacnetPropObjectName                   = 77
+	bacnetPropObjectType                   = 79
+	bacnetPropOutOfService                 = 81
+	bacnetPropPresentValue                 = 85
+	bacnetPropProtocolObjectTypesSupported = 96
+	bacnetPropProtocolServicesSupported    = 97
+	bacnetPropProtocolVersion              = 98
+	bacnetPropSegmentationSupported        = 107
+	bacnetPropStatusFlags                  = 111
+	bacnetPropSystemStatus                 = 112
+	bacnetPropUnits                        = 117
+	bacnetPropVendorIdentifier             = 120
+	bacnetPropVendorName                   = 121
+	bacnetPropProtocolRevision             = 139
+	bacnetPropDatabaseRevision             = 155
+)
+
+// BACnet engineering units.
+const (
+	bacnetUnitsPercentRelativeHumidity     = 29
+	bacnetUnitsDegreesCelsius              = 62
+	bacnetUnitsKilojoulesPerKilogramDryAir = 149
+)
+
+// BACnet application tags.
+const (
+	bacnetTagBoolean          = 1
+	bacnetTagUnsigned         = 2
+	bacnetTagReal             = 4
+	bacnetTagCharacterString  = 7
+	bacnetTagBitString        = 8
+	bacnetTagEnumerated       = 9
+	bacnetTagObjectIdentifier = 12
+)
+
+// BACnet virtual link control (BVLC) and network layer (NPDU) constants.
+const (
+	bacnetBVLCType              = 0x81
+	bacnetBVLCForwardedNPDU     = 0x04
+	bacnetBVLCOriginalUnicast   = 0x0a
+	bacnetBVLCOriginalBroadcast = 0x0b
+
+	bacnetNPDUVersion              = 0x01
+	bacnetNPDUNetworkMessage       = 0x80
+	bacnetNPDUDestinationSpecified = 0x20
+	bacnetNPDUSourceSpecified      = 0x08
+	bacnetGlobalBroadcastNetwork   = 0xffff
+)
+
+// BACnet PDU types and services.
+const (
+	bacnetConfirmedRequest   = 0x00
+	bacnetUnconfirmedRequest = 0x10
+	bacnetComplexACK         = 0x30
+	bacnetError              = 0x50
+	bacnetReject             = 0x60
+	bacnetAbort              = 0x70
+
+	// bacnetSegmentedMessage is set in confirmed requests that are
+	// segmented.
+	bacnetSegmentedMessage = 0x08
+	// bacnetAbortFromServer is set in the aborts sent by the server.
+	bacnetAbortFromServer = 0x01
+
+	bacnetServiceIAm          = 0
+	bacnetServiceWhoIs        = 8
+	bacnetServiceReadProperty = 12
+	// bacnetServiceWhoIsBit is the bit of Who-Is in
+	// protocol-services-supported.
+	bacnetServiceWhoIsBit = 34
+)
+
+// BACnet reject, abort and error reasons.
+const (
+	bacnetRejectOther                   = 0
+	bacnetRejectUnrecognizedService     = 9
+	bacnetAbortSegmentationNotSupported = 4
+
+	bacnetErrorClassObject          = 1
+	bacnetErrorClassProperty        = 2
+	bacnetErrorUnknownObject        = 31
+	bacnetErrorUnknownProperty      = 32
+	bacnetErrorInvalidArrayIndex    = 42
+	bacnetErrorPropertyIsNotAnArray = 50
+)
+
+// Values of the device object properties.
+const (
+	bacnetProtocolRevision         = 14
+	bacnetSegmentationNotSupported = 3
+	// bacnetServicesSupportedBits and bacnetObjectTypesSupportedBits are
+	// the lengths of protocol-services-supported and
+	// protocol-object-types-supported for the protocol revision.
+	bacnetServicesSupportedBits    = 41
+	bacnetObjectTypesSupportedBits = 56
+)
+
+// bacnetQuantity is an outdoor condition exported as an analog input object
+// for every location.
+type bacnetQuantity struct {
+	name  string
+	units uint32
+	value func(*LocationWeather) float64
+}
+
+// bacnetQuantities are the conditions exported for every location. The
+// position in the list is the offset of the object instance in the block of
+// the location.
+var bacnetQuantities = []bacnetQuantity{
+	{
+		name:  "temperature",
+		units: bacnetUnitsDegreesCelsius,
+		value: func(lw *LocationWeather) float64 { return lw.Weather.Forecast.Currently.Temperature },
+	},
+	{
+		name:  "humidity",
+		units: bacnetUnitsPercentRelativeHumidity,
+		value: func(lw *LocationWeather) float64 { return lw.Weather.Forecast.Currently.Humidity * 100 },
+	},
+	{
+		name:  "dew point",
+		units: bacnetUnitsDegreesCelsius,
+		value: func(lw *LocationWeather) float64 { return lw.Weather.Forecast.Currently.DewPoint },
+	},
+	{
+		name:  "enthalpy",
+		units: bacnetUnitsKilojoulesPerKilogramDryAir,
+		value: func(lw *LocationWeather) float64 {
+			dp := &lw.Weather.Forecast.Currently
+			return enthalpy(dp.Temperature, dp.Humidity, dp.Pressure)
+		},
+	},
+}
+
+// standardPressure is the standard atmospheric pressure, in hectopascals.
+const standardPressure = 1013.25
+
+// enthalpy returns the specific enthalpy of moist air in kJ/kg of dry air,
+// given the temperature in celsius, the relative humidity as a ratio and the
+// pressure in hectopascals, or the standard pressure if 0.
+func enthalpy(temperature, humidity, pressure float64) float64 {
+	if pressure <= 0 {
+		pressure = standardPressure
+	}
+	// saturation vapor pressure, Magnus formula
+	saturation := 6.112 * math.Exp(17.62*temperature/(243.12+temperature))
+	vapor := humidity * saturation
+	// humidity ratio, in kg of water per kg of dry air
+	ratio := 0.622 * vapor / (pressure - vapor)
+	return 1.006*temperature + ratio*(2501+1.86*temperature)
+}
+
+// bacnetObjectID is a BACnet object identifier.
+type bacnetObjectID struct {
+	typ      uint32
+	instance uint32
+}
+
+func (o bacnetObjectID) encode() uint32 {
+	return o.typ<<22 | o.instance
+}
+
+// bacnetServer is a read-only BACnet/IP device serving outdoor conditions of
+// every location as analog input objects. It answers Who-Is and ReadProperty.
+// Like the dashboard, it uses the data fetched by the last scrape or poll and
+// never calls the APIs.
+type bacnetServer struct {
+	conn     *net.UDPConn
+	device   bacnetObjectID
+	name     string
+	version  string
+	wc       *WeatherCollector
+	services []byte
+	types    []byte
+	bbmds    map[string]bool
+}
+
+// newBACnetServer creates a BACnet/IP server for wc, listening on the
+// configured address.
+func newBACnetServer(config *BACnetConfig, wc *WeatherCollector) (*bacnetServer, error) {
+	listen := config.Listen
+	if listen == "" {
+		listen = defaultBACnetListen
+	}
+	instance := config.DeviceInstance
+	if instance == 0 {
+		instance = defaultBACnetDeviceInstance
+	}
+	if instance >= bacnetMaxInstance {
+		return nil, fmt.Errorf("invalid device instance %d, must be less than %d", instance, bacnetMaxInstance)
+	}
+	name := config.DeviceName
+	if name == "" {
+		name = defaultBACnetDeviceName
+	}
+	bbmds := make(map[string]bool)
+	for _, b := range config.BBMDs {
+		ip, err := net.ResolveIPAddr("ip4", b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BBMD address '%s': %w", b, err)
+		}
+		bbmds[ip.IP.String()] = true
+	}
+	addr, err := net.ResolveUDPAddr("udp4", listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address '%s': %w", listen, err)
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", listen, err)
+	}
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+	}
+	return &bacnetServer{
+		conn:     conn,
+		device:   bacnetObjectID{typ: bacnetDevice, instance: instance},
+		name:     name,
+		version:  version,
+		wc:       wc,
+		services: bacnetBits(bacnetServicesSupportedBits, bacnetServiceReadProperty, bacnetServiceWhoIsBit),
+		types:    bacnetBits(bacnetObjectTypesSupportedBits, bacnetAnalogInput, bacnetDevice),
+		bbmds:    bbmds,
+	}, nil
+}
+
+// run answers the requests until ctx is done.
+func (s *bacnetServer) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.conn.Close()
+	}()
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				warnf(ctx, "BACnet server stopped: %v", err)
+			}
+			return
+		}
+		resp, dst := s.handle(buf[:n], src)
+		if resp == nil {
+			continue
+		}
+		if _, err := s.conn.WriteToUDP(resp, dst); err != nil {
+			warnf(ctx, "Failed to send BACnet response to %s: %v", dst, err)
+		}
+	}
+}
+
+var errMalformedBACnet = errors.New("malformed BACnet message")
+
+// handle returns the response to a BVLC message and where to send it, or a
+// nil response if there is nothing to answer.
+func (s *bacnetServer) handle(msg []byte, src *net.UDPAddr) ([]byte, *net.UDPAddr) {
+	if len(msg) < 4 || msg[0] != bacnetBVLCType || int(binary.BigEndian.Uint16(msg[2:4])) != len(msg) {
+		return nil, nil
+	}
+	npdu := msg[4:]
+	dst := src
+	switch msg[1] {
+	case bacnetBVLCOriginalUnicast, bacnetBVLCOriginalBroadcast:
+	case bacnetBVLCForwardedNPDU:
+		// forwarded by a BBMD, answer the original source. Anybody could
+		// forge one to send the response elsewhere.
+		if !s.bbmds[src.IP.String()] || len(npdu) < 6 {
+			return nil, nil
+		}
+		dst = &net.UDPAddr{IP: net.IP(append([]byte(nil), npdu[:4]...)), Port: int(binary.BigEndian.Uint16(npdu[4:6]))}
+		npdu = npdu[6:]
+	default:
+		return nil, nil
+	}
+	apdu, route, err := parseNPDU(npdu)
+	if err != nil {
+		return nil, nil
+	}
+	resp := s.handleAPDU(apdu)
+	if resp == nil {
+		return nil, nil
+	}
+	out := []byte{bacnetBVLCType, bacnetBVLCOriginalUnicast, 0, 0}
+	out = append(out, route...)
+	out = append(out, resp...)
+	binary.BigEndian.PutUint16(out[2:4], uint16(len(out)))
+	return out, dst
+}
+
+// parseNPDU returns the APDU of an NPDU addressed to this device, and the
+// NPDU header of the response, routing it back to the source network if the
+// request came through a router.
+func parseNPDU(npdu []byte) (apdu, route []byte, err error) {
+	if len(npdu) < 2 || npdu[0] != bacnetNPDUVersion {
+		return nil, nil, errMalformedBACnet
+	}
+	control := npdu[1]
+	if control&bacnetNPDUNetworkMessage != 0 {
+		return nil, nil, errors.New("network layer messages are not supported")
+	}
+	pos := 2
+	if control&bacnetNPDUDestinationSpecified != 0 {
+		if len(npdu) < pos+3 {
+			return nil, nil, errMalformedBACnet
+		}
+		dnet := binary.BigEndian.Uint16(npdu[pos:])
+		if dnet != bacnetGlobalBroadcastNetwork {
+			return nil, nil, errors.New("not a router")
+		}
+		pos += 3 + int(npdu[pos+2])
+	}
+	route = []byte{bacnetNPDUVersion, 0}
+	if control&bacnetNPDUSourceSpecified != 0 {
+		if len(npdu) < pos+3 {
+			return nil, nil, errMalformedBACnet
+		}
+		slen := int(npdu[pos+2])
+		if len(npdu) < pos+3+slen {
+			return nil, nil, errMalformedBACnet
+		}
+		// the source network and address become the destination, with the
+		// maximum hop count
+		route = append([]byte{bacnetNPDUVersion, bacnetNPDUDestinationSpecified}, npdu[pos:pos+3+slen]...)
+		route = append(route, 0xff)
+		pos += 3 + slen
+	}
+	if control&bacnetNPDUDestinationSpecified != 0 {
+		// hop count
+		pos++
+	}
+	if len(npdu) <= pos {
+		return nil, nil, errMalformedBACnet
+	}
+	return npdu[pos:], route, nil
+}
+
+// handleAPDU returns the response to an APDU, or nil.
+func (s *bacnetServer) handleAPDU(apdu []byte) []byte {
+	switch apdu[0] & 0xf0 {
+	case bacnetUnconfirmedRequest:
+		if len(apdu) >= 2 && apdu[1] == bacnetServiceWhoIs && s.matchesWhoIs(apdu[2:]) {
+			return s.iAm()
+		}
+		return nil
+	case bacnetConfirmedRequest:
+	default:
+		return nil
+	}
+	if len(apdu) < 4 {
+		return nil
+	}
+	invokeID := apdu[2]
+	if apdu[0]&bacnetSegmentedMessage != 0 {
+		return []byte{bacnetAbort | bacnetAbortFromServer, invokeID, bacnetAbortSegmentationNotSupported}
+	}
+	if apdu[3] != bacnetServiceReadProperty {
+		return []byte{bacnetReject, invokeID, bacnetRejectUnrecognizedService}
+	}
+	maxAPDU := bacnetMaxAPDUSize(apdu[1] & 0x0f)
+	resp := s.readProperty(invokeID, apdu[4:])
+	if len(resp) > maxAPDU {
+		return []byte{bacnetAbort | bacnetAbortFromServer, invokeID, bacnetAbortSegmentationNotSupported}
+	}
+	return resp
+}
+
+// bacnetMaxAPDUSize decodes the maximum APDU size accepted by a client.
+func bacnetMaxAPDUSize(code byte) int {
+	sizes := []int{50, 128, 206, 480, 1024, 1476}
+	if int(code) < len(sizes) {
+		return sizes[code]
+	}
+	return sizes[0]
+}
+
+// matchesWhoIs returns whether the device is in the range of a Who-Is
+// request.
+func (s *bacnetServer) matchesWhoIs(params []byte) bool {
+	if len(params) == 0 {
+		return true
+	}
+	low, rest, err := bacnetReadContext(params, 0)
+	if err != nil {
+		return false
+	}
+	high, _, err := bacnetReadContext(rest, 1)
+	if err != nil {
+		return false
+	}
+	return s.device.instance >= bacnetUnsigned(low) && s.device.instance <= bacnetUnsigned(high)
+}
+
+// iAm returns the I-Am announcement of the device.
+func (s *bacnetServer) iAm() []byte {
+	apdu := []byte{bacnetUnconfirmedRequest, bacnetServiceIAm}
+	apdu = bacnetAppendObjectID(apdu, s.device)
+	apdu = bacnetAppendUnsigned(apdu, bacnetTagUnsigned, bacnetMaxAPDU)
+	apdu = bacnetAppendUnsigned(apdu, bacnetTagEnumerated, bacnetSegmentationNotSupported)
+	return bacnetAppendUnsigned(apdu, bacnetTagUnsigned, bacnetVendorID)
+}
+
+// readProperty answers a ReadProperty request.
+func (s *bacnetServer) readProperty(invokeID byte, params []byte) []byte {
+	errorPDU := func(class, code uint32) []byte {
+		pdu := []byte{bacnetError, invokeID, bacnetServiceReadProperty}
+		pdu = bacnetAppendUnsigned(pdu, bacnetTagEnumerated, class)
+		return bacnetAppendUnsigned(pdu, bacnetTagEnumerated, code)
+	}
+	reject := []byte{bacnetReject, invokeID, bacnetRejectOther}
+	objValue, rest, err := bacnetReadContext(params, 0)
+	if err != nil || len(objValue) != 4 {
+		return reject
+	}
+	propValue, rest, err := bacnetReadContext(rest, 1)
+	if err != nil {
+		return reject
+	}
+	raw := binary.BigEndian.Uint32(objValue)
+	obj := bacnetObjectID{typ: raw >> 22, instance: raw & bacnetMaxInstance}
+	prop := bacnetUnsigned(propValue)
+	index, hasIndex := uint32(0), false
+	if len(rest) > 0 {
+		indexValue, _, err := bacnetReadContext(rest, 2)
+		if err != nil {
+			return reject
+		}
+		index, hasIndex = bacnetUnsigned(indexValue), true
+	}
+
+	objects := s.objects()
+	var value []byte
+	if obj.typ == bacnetDevice && (obj.instance == s.device.instance || obj.instance == bacnetMaxInstance) {
+		// the wildcard instance addresses the local device
+		obj = s.device
+		if prop == bacnetPropObjectList {
+			switch {
+			case !hasIndex:
+				for _, o := range objects {
+					value = bacnetAppendObjectID(value, o.id)
+				}
+			case index == 0:
+				value = bacnetAppendUnsigned(value, bacnetTagUnsigned, uint32(len(objects)))
+			case int(index) <= len(objects):
+				value = bacnetAppendObjectID(value, objects[index-1].id)
+			default:
+				return errorPDU(bacnetErrorClassProperty, bacnetErrorInvalidArrayIndex)
+			}
+		} else {
+			value = s.deviceProperty(prop, objects)
+		}
+	} else {
+		var found *bacnetAnalogInputObject
+		for idx := range objects {
+			if objects[idx].id == obj {
+				found = &objects[idx]
+				break
+			}
+		}
+		if found == nil {
+			return errorPDU(bacnetErrorClassObject, bacnetErrorUnknownObject)
+		}
+		value = found.property(prop)
+	}
+	if value == nil {
+		return errorPDU(bacnetErrorClassProperty, bacnetErrorUnknownProperty)
+	}
+	if hasIndex && prop != bacnetPropObjectList {
+		return errorPDU(bacnetErrorClassProperty, bacnetErrorPropertyIsNotAnArray)
+	}
+
+	ack := []byte{bacnetComplexACK, invokeID, bacnetServiceReadProperty}
+	ack = bacnetAppendContext(ack, 0, bacnetUint32(obj.encode()))
+	ack = bacnetAppendContext(ack, 1, bacnetUint(prop))
+	if hasIndex {
+		ack = bacnetAppendContext(ack, 2, bacnetUint(index))
+	}
+	ack = append(ack, 3<<4|0x0e)
+	ack = append(ack, value...)
+	return append(ack, 3<<4|0x0f)
+}
+
+// deviceProperty returns the encoded value of a property of the device
+// object, or nil if unknown.
+func (s *bacnetServer) deviceProperty(prop uint32, objects []bacnetAnalogInputObject) []byte {
+	var v []byte
+	switch prop {
+	case bacnetPropObjectIdentifier:
+		return bacnetAppendObjectID(v, s.device)
+	case bacnetPropObjectName:
+		return bacnetAppendString(v, s.name)
+	case bacnetPropObjectType:
+		return bacnetAppendUnsigned(v, bacnetTagEnumerated, bacnetDevice)
+	case bacnetPropSystemStatus:
+		// operational
+		return bacnetAppendUnsigned(v, bacnetTagEnumerated, 0)
+	case bacnetPropVendorName:
+		return bacnetAppendString(v, "prometheus-weather-exporter")
+	case bacnetPropVendorIdentifier:
+		return bacnetAppendUnsigned(v, bacnetTagUnsigned, bacnetVendorID)
+	case bacnetPropModelName:
+		return bacnetAppendString(v, "prometheus-weather-exporter")
+	case bacnetPropDescription:
+		return bacnetAppendString(v, "Outdoor weather conditions")
+	case bacnetPropFirmwareRevision, bacnetPropApplicationSoftwareVersion:
+		return bacnetAppendString(v, s.version)
+	case bacnetPropProtocolVersion:
+		return bacnetAppendUnsigned(v, bacnetTagUnsigned, 1)
+	case bacnetPropProtocolRevision:
+		return bacnetAppendUnsigned(v, bacnetTagUnsigned, bacnetProtocolRevision)
+	case bacnetPropProtocolServicesSupported:
+		return bacnetAppendBitString(v, bacnetServicesSupportedBits, s.services)
+	case bacnetPropProtocolObjectTypesSupported:
+		return bacnetAppendBitString(v, bacnetObjectTypesSupportedBits, s.types)
+	case bacnetPropMaxAPDULengthAccepted:
+		return bacnetAppendUnsigned(v, bacnetTagUnsigned, bacnetMaxAPDU)
+	case bacnetPropSegmentationSupported:
+		return bacnetAppendUnsigned(v, bacnetTagEnumerated, bacnetSegmentationNotSupported)
+	case bacnetPropAPDUTimeout:
+		return bacnetAppendUnsigned(v, bacnetTagUnsigned, 3000)
+	case bacnetPropNumberOfAPDURetries:
+		return bacnetAppendUnsigned(v, bacnetTagUnsigned, 3)
+	case bacnetPropDeviceAddressBinding:
+		// an empty list
+		return []byte{}
+	case bacnetPropDatabaseRevision:
+		// changes when the objects change, e.g. when locations are
+		// reloaded
+		h := crc32.NewIEEE()
+		for _, o := range objects {
+			fmt.Fprintln(h, o.name)
+		}
+		return bacnetAppendUnsigned(v, bacnetTagUnsigned, h.Sum32())
+	}
+	return nil
+}
+
+// bacnetAnalogInputObject is an outdoor condition of a location.
+type bacnetAnalogInputObject struct {
+	id    bacnetObjectID
+	name  string
+	units uint32
+	value float64
+	// fault is set if the weather of the location is not available, or its
+	// last fetch failed.
+	fault bool
+}
+
+// objects returns the analog input objects for the current weather. The
+// objects of a location are numbered from its position in the configuration
+// times bacnetInstancesPerLocation.
+func (s *bacnetServer) objects() []bacnetAnalogInputObject {
+	snapshot := make(map[string]*LocationWeather)
+	for _, lw := range s.wc.Snapshot() {
+		snapshot[lw.Name] = lw
+	}
+	var objects []bacnetAnalogInputObject
+	for idx, name := range s.wc.Locations() {
+		lw, ok := snapshot[name]
+		for q, quantity := range bacnetQuantities {
+			o := bacnetAnalogInputObject{
+				id:    bacnetObjectID{typ: bacnetAnalogInput, instance: uint32(idx*bacnetInstancesPerLocation + q)},
+				name:  name + " " + quantity.name,
+				units: quantity.units,
+				fault: !ok || s.wc.isFailing(name),
+			}
+			if ok {
+				o.value = quantity.value(lw)
+			}
+			objects = append(objects, o)
+		}
+	}
+	return objects
+}
+
+// property returns the encoded value of a property of the object, or nil if
+// unknown.
+func (o *bacnetAnalogInputObject) property(prop uint32) []byte {
+	var v []byte
+	switch prop {
+	case bacnetPropObjectIdentifier:
+		return bacnetAppendObjectID(v, o.id)
+	case bacnetPropObjectName:
+		return bacnetAppendString(v, o.name)
+	case bacnetPropObjectType:
+		return bacnetAppendUnsigned(v, bacnetTagEnumerated, bacnetAnalogInput)
+	case bacnetPropPresentValue:
+		v = bacnetAppendTag(v, bacnetTagReal, 4)
+		return append(v, bacnetUint32(math.Float32bits(float32(o.value)))...)
+	case bacnetPropStatusFlags:
+		// in-alarm, fault, overridden, out-of-service
+		var flags byte
+		if o.fault {
+			flags |= 0x40
+		}
+		return bacnetAppendBitString(v, 4, []byte{flags})
+	case bacnetPropEventState:
+		// normal
+		return bacnetAppendUnsigned(v, bacnetTagEnumerated, 0)
+	case bacnetPropOutOfService:
+		// booleans are encoded in the tag
+		return bacnetAppendTag(v, bacnetTagBoolean, 0)
+	case bacnetPropUnits:
+		return bacnetAppendUnsigned(v, bacnetTagEnumerated, o.units)
+	case bacnetPropDescription:
+		return bacnetAppendString(v, o.name)
+	}
+	return nil
+}
+
+// bacnetBits returns a bit string of the given length with the given bits
+// set.
+func bacnetBits(length int, bits ...int) []byte {
+	b := make([]byte, (length+7)/8)
+	for _, bit := range bits {
+		b[bit/8] |= 0x80 >> (bit % 8)
+	}
+	return b
+}
+
+// bacnetAppendTag appends an application tag for a value of the given
+// length.
+func bacnetAppendTag(buf []byte, tag byte, length int) []byte {
+	switch {
+	case length <= 4:
+		return append(buf, tag<<4|byte(length))
+	case length < 254:
+		return append(buf, tag<<4|5, byte(length))
+	default:
+		return append(buf, tag<<4|5, 254, byte(length>>8), byte(length))
+	}
+}
+
+// bacnetAppendContext appends a context tagged value.
+func bacnetAppendContext(buf []byte, tag byte, value []byte) []byte {
+	return append(append(buf, tag<<4|0x08|byte(len(value))), value...)
+}
+
+// bacnetUint encodes an unsigned value with the minimum number of bytes.
+func bacnetUint(v uint32) []byte {
+	switch {
+	case v <= 0xff:
+		return []byte{byte(v)}
+	case v <= 0xffff:
+		return []byte{byte(v >> 8), byte(v)}
+	case v <= 0xffffff:
+		return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	return bacnetUint32(v)
+}
+
+func bacnetUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// bacnetAppendUnsigned appends an unsigned or enumerated value.
+func bacnetAppendUnsigned(buf []byte, tag byte, v uint32) []byte {
+	b := bacnetUint(v)
+	return append(bacnetAppendTag(buf, tag, len(b)), b...)
+}
+
+// bacnetAppendObjectID appends an object identifier.
+func bacnetAppendObjectID(buf []byte, o bacnetObjectID) []byte {
+	return append(bacnetAppendTag(buf, bacnetTagObjectIdentifier, 4), bacnetUint32(o.encode())...)
+}
+
+// bacnetAppendString appends a UTF-8 character string.
+func bacnetAppendString(buf []byte, s string) []byte {
+	buf = bacnetAppendTag(buf, bacnetTagCharacterString, len(s)+1)
+	// the first byte is the character set, 0 for UTF-8
+	return append(append(buf, 0), s...)
+}
+
+// bacnetAppendBitString appends a bit string of the given length in bits.
+func bacnetAppendBitString(buf []byte, length int, bits []byte) []byte {
+	buf = bacnetAppendTag(buf, bacnetTagBitString, len(bits)+1)
+	// the first byte is the number of unused bits in the last byte
+	return append(append(buf, byte(len(bits)*8-length)), bits...)
+}
+
+// bacnetReadContext reads a context tagged value with the given tag number.
+func bacnetReadContext(data []byte, tag byte) (value, rest []byte, err error) {
+	if len(data) < 1 || data[0]>>4 != tag || data[0]&0x08 == 0 {
+		return nil, nil, errMalformedBACnet
+	}
+	length := int(data[0] & 0x07)
+	data = data[1:]
+	switch length {
+	case 5:
+		if len(data) < 1 || data[0] >= 254 {
+			return nil, nil, errMalformedBACnet
+		}
+		length = int(data[0])
+		data = data[1:]
+	case 6, 7:
+		// opening and closing tags
+		return nil, nil, errMalformedBACnet
+	}
+	if len(data) < length {
+		return nil, nil, errMalformedBACnet
+	}
+	return data[:length], data[length:], nil
+}
+
+// bacnetUnsigned decodes an unsigned value.
+func bacnetUnsigned(b []byte) uint32 {
+	var v uint32
+	for _, x := range b {
+		v = v<<8 | uint32(x)
+	}
+	return v
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// LocationWeather is the outcome of a successful weather lookup for a
+// location.
+type LocationWeather struct {
+	// Name is the location name as configured.
+	Name     string
+	Location *Location
+	// Provider is the name of the weather provider.
+	Provider string
+	// GeocodeStale is true if the coordinates come from the geocoding cache
+	// because geocoding failed.
+	GeocodeStale bool
+	Weather      *Weather
+	FetchedAt    time.Time
+	// Normal is the normal mean temperature for the day, if climate normals
+	// are enabled and available.
+	Normal    float64
+	HasNormal bool
+	// Airport is the delay status of the airport of the location, if
+	// configured and available.
+	Airport *airportStatus
+}
+
+// weatherCache holds the last successful weather lookup for each location.
+type weatherCache struct {
+	mu      sync.Mutex
+	entries map[string]*LocationWeather
+}
+
+func newWeatherCache() *weatherCache {
+	return &weatherCache{entries: make(map[string]*LocationWeather)}
+}
+
+func (c *weatherCache) get(name string) (*LocationWeather, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lw, ok := c.entries[name]
+	return lw, ok
+}
+
+func (c *weatherCache) set(name string, lw *LocationWeather) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[name] = lw
+}
+
+// prune removes the entries of all the locations not in keep.
+func (c *weatherCache) prune(keep map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.entries {
+		if !keep[name] {
+			delete(c.entries, name)
+		}
+	}
+}
+
+// Snapshot returns the last weather fetched for each location, in the
+// configured order. Locations that were never fetched are skipped. It never
+// calls the APIs.
+func (wc *WeatherCollector) Snapshot() []*LocationWeather {
+	var snapshot []*LocationWeather
+	for _, name := range wc.Locations() {
+		if lw, ok := wc.weatherCache.get(name); ok {
+			snapshot = append(snapshot, lw)
+		}
+	}
+	return snapshot
+}
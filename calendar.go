@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// calendarProdID identifies the exporter in the calendar feed.
+const calendarProdID = "-//insomniacslk//prometheus-weather-exporter//EN"
+
+// icsEscape escapes a text value as per RFC 5545.
+func icsEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// icsLine writes a content line, folded at 75 octets as per RFC 5545.
+func icsLine(buf *bytes.Buffer, line string) {
+	// continuation lines start with a space
+	limit := 75
+	for len(line) > limit {
+		// do not split UTF-8 sequences
+		n := limit
+		for n > 0 && line[n]&0xc0 == 0x80 {
+			n--
+		}
+		buf.WriteString(line[:n] + "\r\n ")
+		line = line[n:]
+		limit = 74
+	}
+	buf.WriteString(line + "\r\n")
+}
+
+// forecastLocation returns the time zone of a forecast, falling back to its
+// UTC offset.
+func forecastLocation(fc *forecast.Forecast) *time.Location {
+	if fc.Timezone != "" {
+		if loc, err := time.LoadLocation(fc.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.FixedZone("", int(fc.Offset*3600))
+}
+
+// calendarSummary describes a daily forecast in a single line, e.g.
+// "Dublin: Light rain, 4-9°C".
+func calendarSummary(name string, dp *forecast.DataPoint) string {
+	s := name + ": "
+	if dp.Summary != "" {
+		s += strings.TrimSuffix(dp.Summary, ".") + ", "
+	}
+	return s + fmt.Sprintf("%.0f-%.0f°C", dp.TemperatureMin, dp.TemperatureMax)
+}
+
+// calendarDescription gives the details of a daily forecast.
+func calendarDescription(dp *forecast.DataPoint) string {
+	lines := []string{
+		fmt.Sprintf("Temperature: %.1f to %.1f °C", dp.TemperatureMin, dp.TemperatureMax),
+		fmt.Sprintf("Precipitation probability: %.0f%%", dp.PrecipProbability*100),
+		fmt.Sprintf("Precipitation: %.1f mm", dp.PrecipIntensity*24),
+		fmt.Sprintf("Wind: %.1f m/s", dp.WindSpeed),
+	}
+	if dp.UVIndex > 0 {
+		lines = append(lines, fmt.Sprintf("UV index: %d", dp.UVIndex))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// writeCalendar writes an iCalendar feed with an all-day event per day of
+// the daily forecast of every location.
+func writeCalendar(buf *bytes.Buffer, snapshot []*LocationWeather) {
+	icsLine(buf, "BEGIN:VCALENDAR")
+	icsLine(buf, "VERSION:2.0")
+	icsLine(buf, "PRODID:"+calendarProdID)
+	icsLine(buf, "CALSCALE:GREGORIAN")
+	icsLine(buf, "X-WR-CALNAME:Weather forecast")
+	for _, lw := range snapshot {
+		fc := lw.Weather.Forecast
+		tz := forecastLocation(fc)
+		stamp := lw.FetchedAt.UTC().Format("20060102T150405Z")
+		for idx := range fc.Daily.Data {
+			dp := &fc.Daily.Data[idx]
+			day := time.Unix(dp.Time, 0).In(tz)
+			start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+			icsLine(buf, "BEGIN:VEVENT")
+			icsLine(buf, fmt.Sprintf("UID:%s-%s@prometheus-weather-exporter", start.Format("20060102"), strings.ReplaceAll(lw.Name, " ", "_")))
+			icsLine(buf, "DTSTAMP:"+stamp)
+			icsLine(buf, "DTSTART;VALUE=DATE:"+start.Format("20060102"))
+			icsLine(buf, "DTEND;VALUE=DATE:"+start.AddDate(0, 0, 1).Format("20060102"))
+			icsLine(buf, "SUMMARY:"+icsEscape(calendarSummary(lw.Name, dp)))
+			icsLine(buf, "DESCRIPTION:"+icsEscape(calendarDescription(dp)))
+			icsLine(buf, fmt.Sprintf("GEO:%f;%f", lw.Location.Lat, lw.Location.Lng))
+			icsLine(buf, "TRANSP:TRANSPARENT")
+			icsLine(buf, "END:VEVENT")
+		}
+	}
+	icsLine(buf, "END:VCALENDAR")
+}
+
+// calendarHandler returns an HTTP handler serving the daily forecast of every
+// location as an iCalendar feed, or of a single one with the location query
+// parameter. Like the dashboard, it uses the data fetched by the last scrape
+// and never calls the APIs.
+func calendarHandler(wc *WeatherCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshot := wc.Snapshot()
+		if name := r.URL.Query().Get("location"); name != "" {
+			var filtered []*LocationWeather
+			for _, lw := range snapshot {
+				if lw.Name == name {
+					filtered = append(filtered, lw)
+				}
+			}
+			if len(filtered) == 0 {
+				http.Error(w, fmt.Sprintf("no forecast for location '%s'", name), http.StatusNotFound)
+				return
+			}
+			snapshot = filtered
+		}
+		var buf bytes.Buffer
+		writeCalendar(&buf, snapshot)
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		if _, err := buf.WriteTo(w); err != nil {
+			errorf(r.Context(), "Failed to write calendar: %v", err)
+		}
+	})
+}
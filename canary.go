@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultCanaryInterval is the interval between canary checks if not
+// configured.
+const defaultCanaryInterval = time.Minute
+
+// CanaryConfig configures the canary location, which is fetched on its own
+// schedule to detect provider or API key problems early.
+type CanaryConfig struct {
+	Location string   `json:"location"`
+	Interval Duration `json:"interval"`
+}
+
+// canary periodically fetches the weather for the canary location, bypassing
+// the weather cache, and exports the outcome as health metrics. The location
+// is resolved like the other locations, so it is only geocoded again when
+// its cached coordinates expire.
+type canary struct {
+	config   *Config
+	resolve  func(ctx context.Context, name string) (*Location, bool, error)
+	provider Provider
+
+	up          prometheus.Gauge
+	lastSuccess prometheus.Gauge
+	duration    prometheus.Gauge
+	checks      *prometheus.CounterVec
+}
+
+func newCanary(config *Config, resolve func(context.Context, string) (*Location, bool, error), provider Provider, reg prometheus.Registerer) *canary {
+	labels := prometheus.Labels{"location": config.Canary.Location}
+	c := canary{
+		config:   config,
+		resolve:  resolve,
+		provider: provider,
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "weather_canary_up",
+			Help:        "Whether the last canary check succeeded",
+			ConstLabels: labels,
+		}),
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "weather_canary_last_success_timestamp_seconds",
+			Help:        "Timestamp of the last successful canary check",
+			ConstLabels: labels,
+		}),
+		duration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "weather_canary_duration_seconds",
+			Help:        "Duration of the last canary check",
+			ConstLabels: labels,
+		}),
+		checks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "weather_canary_checks_total",
+			Help:        "Number of canary checks, by result",
+			ConstLabels: labels,
+		}, []string{"result"}),
+	}
+	reg.MustRegister(c.up, c.lastSuccess, c.duration, c.checks)
+	return &c
+}
+
+// check fetches the weather for the canary location once.
+func (c *canary) check(ctx context.Context) error {
+	loc, _, err := c.resolve(ctx, c.config.Canary.Location)
+	if err != nil {
+		return fmt.Errorf("geocoding failed: %w", err)
+	}
+	_, err = c.provider.Get(ctx, loc)
+	return err
+}
+
+// run checks the canary location at every interval until ctx is done.
+func (c *canary) run(ctx context.Context) {
+	interval := time.Duration(c.config.Canary.Interval)
+	if interval <= 0 {
+		interval = defaultCanaryInterval
+	}
+	logf(ctx, "Checking canary location '%s' every %s", c.config.Canary.Location, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		cctx := withLogFields(withCorrelationID(ctx, "canary-"+newCorrelationID()), "location", c.config.Canary.Location, "provider", c.provider.Name())
+		if err := c.check(cctx); err != nil {
+			warnf(cctx, "Canary check for '%s' failed: %v", c.config.Canary.Location, err)
+			c.up.Set(0)
+			c.checks.WithLabelValues("failure").Inc()
+		} else {
+			c.up.Set(1)
+			c.lastSuccess.SetToCurrentTime()
+			c.checks.WithLabelValues("success").Inc()
+		}
+		c.duration.Set(time.Since(start).Seconds())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// CardinalityReport is the number of active series, in total, per metric
+// family and per location.
+type CardinalityReport struct {
+	Total     int            `json:"total"`
+	Families  map[string]int `json:"families"`
+	Locations map[string]int `json:"locations"`
+}
+
+// seriesCount returns the number of series exposed by a metric.
+func seriesCount(mtype dto.MetricType, m *dto.Metric) int {
+	switch mtype {
+	case dto.MetricType_SUMMARY:
+		// quantiles, plus _sum and _count
+		return len(m.GetSummary().GetQuantile()) + 2
+	case dto.MetricType_HISTOGRAM:
+		// buckets, plus +Inf, _sum and _count
+		return len(m.GetHistogram().GetBucket()) + 3
+	default:
+		return 1
+	}
+}
+
+// getCardinalityReport gathers the metrics and counts the active series.
+func getCardinalityReport(g prometheus.Gatherer) (*CardinalityReport, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	report := CardinalityReport{
+		Families:  make(map[string]int),
+		Locations: make(map[string]int),
+	}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			n := seriesCount(mf.GetType(), m)
+			report.Total += n
+			report.Families[mf.GetName()] += n
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "location" {
+					report.Locations[lp.GetValue()] += n
+				}
+			}
+		}
+	}
+	return &report, nil
+}
+
+// cardinalityHandler returns an HTTP handler serving the cardinality report
+// in JSON format.
+func cardinalityHandler(g prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, err := getCardinalityReport(g)
+		if err != nil {
+			errorf(r.Context(), "Failed to gather metrics for cardinality report: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			errorf(r.Context(), "Failed to write cardinality report: %v", err)
+		}
+	})
+}
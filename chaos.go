@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errChaos is the error returned for requests failed by chaosTransport.
+var errChaos = errors.New("chaos: injected network error")
+
+// chaosTransport is an http.RoundTripper that injects faults in the API
+// requests, to validate the alerting on the exporter metrics.
+type chaosTransport struct {
+	next http.RoundTripper
+	// latency is added to every request.
+	latency time.Duration
+	// errorRate is the probability of failing a request, either with a
+	// network error or with an HTTP 500.
+	errorRate float64
+	// malformedRate is the probability of truncating a response body.
+	malformedRate float64
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// validateChaos checks the fault injection flags: the latency cannot be
+// negative, and the rates are probabilities.
+func validateChaos(latency time.Duration, errorRate, malformedRate float64) error {
+	if latency < 0 {
+		return fmt.Errorf("-chaos.latency cannot be negative, got %s", latency)
+	}
+	if errorRate < 0 || errorRate > 1 {
+		return fmt.Errorf("-chaos.error-rate must be between 0 and 1, got %g", errorRate)
+	}
+	if malformedRate < 0 || malformedRate > 1 {
+		return fmt.Errorf("-chaos.malformed-rate must be between 0 and 1, got %g", malformedRate)
+	}
+	return nil
+}
+
+func newChaosTransport(next http.RoundTripper, latency time.Duration, errorRate, malformedRate float64) *chaosTransport {
+	return &chaosTransport{
+		next:          next,
+		latency:       latency,
+		errorRate:     errorRate,
+		malformedRate: malformedRate,
+		rnd:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// roll returns true with the given probability.
+func (t *chaosTransport) roll(probability float64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rnd.Float64() < probability
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip for chaosTransport.
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.latency > 0 {
+		select {
+		case <-time.After(t.latency):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if t.roll(t.errorRate) {
+		if t.roll(0.5) {
+			return nil, errChaos
+		}
+		body := `{"code": 500, "error": "chaos: injected server error"}`
+		return &http.Response{
+			Status:        "500 Internal Server Error",
+			StatusCode:    http.StatusInternalServerError,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !t.roll(t.malformedRate) {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body = body[:len(body)/2]
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Condition is a weather condition with a stable numeric code, so that it can
+// be exported as a metric value and mapped back to an icon, e.g. with Grafana
+// value mappings.
+type Condition struct {
+	Code        int    `json:"code"`
+	Icon        string `json:"icon"`
+	Description string `json:"description"`
+}
+
+// conditions is the mapping of the forecast icons to numeric codes. Codes
+// must never change or be reused, new conditions are appended.
+var conditions = []Condition{
+	{Code: 0, Icon: "", Description: "Unknown"},
+	{Code: 1, Icon: "clear-day", Description: "Clear (day)"},
+	{Code: 2, Icon: "clear-night", Description: "Clear (night)"},
+	{Code: 3, Icon: "partly-cloudy-day", Description: "Partly cloudy (day)"},
+	{Code: 4, Icon: "partly-cloudy-night", Description: "Partly cloudy (night)"},
+	{Code: 5, Icon: "cloudy", Description: "Cloudy"},
+	{Code: 6, Icon: "rain", Description: "Rain"},
+	{Code: 7, Icon: "sleet", Description: "Sleet"},
+	{Code: 8, Icon: "snow", Description: "Snow"},
+	{Code: 9, Icon: "wind", Description: "Wind"},
+	{Code: 10, Icon: "fog", Description: "Fog"},
+	{Code: 11, Icon: "hail", Description: "Hail"},
+	{Code: 12, Icon: "thunderstorm", Description: "Thunderstorm"},
+	{Code: 13, Icon: "tornado", Description: "Tornado"},
+}
+
+// conditionCode returns the numeric code of a forecast icon, or 0 if unknown.
+func conditionCode(icon string) int {
+	for _, c := range conditions {
+		if c.Icon == icon {
+			return c.Code
+		}
+	}
+	return 0
+}
+
+// conditionCodesHandler serves the mapping of the condition codes in JSON
+// format.
+func conditionCodesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, conditions)
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// consensusMedian is the provider label of the median of the providers.
+const consensusMedian = "median"
+
+// ConsensusConfig configures the consensus mode, where the weather of every
+// location is also fetched from several providers to compare them.
+type ConsensusConfig struct {
+	Providers []string `json:"providers"`
+	// Median is whether the median of the providers is exported too.
+	Median bool `json:"median"`
+}
+
+// validateConsensus checks that the consensus providers are at least two,
+// unique and supported.
+func validateConsensus(config *Config) error {
+	c := config.Consensus
+	if c == nil {
+		return nil
+	}
+	if len(c.Providers) < 2 {
+		return fmt.Errorf("at least two providers are needed")
+	}
+	seen := make(map[string]bool)
+	for _, name := range c.Providers {
+		if name == consensusMedian {
+			return fmt.Errorf("'%s' is not a provider", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate provider '%s'", name)
+		}
+		seen[name] = true
+		if _, err := config.providerConfig(name, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newConsensusProviders returns the consensus providers, in the configured
+// order. The main provider is shared. Invalid providers are skipped, see
+// validateConsensus.
+func newConsensusProviders(config *Config, httpClient *http.Client, main Provider) []Provider {
+	if config.Consensus == nil {
+		return nil
+	}
+	var result []Provider
+	for _, name := range config.Consensus.Providers {
+		if name == main.Name() {
+			result = append(result, main)
+			continue
+		}
+		pc, err := config.providerConfig(name, "")
+		if err != nil {
+			continue
+		}
+		result = append(result, providers[name](pc, httpClient))
+	}
+	return result
+}
+
+// newConsensusDescs returns the descriptors of the consensus metrics, by
+// field name.
+func newConsensusDescs(config *Config, constLabels prometheus.Labels) map[string]*prometheus.Desc {
+	descs := make(map[string]*prometheus.Desc)
+	if config.Consensus == nil {
+		return descs
+	}
+	for _, key := range config.Metrics {
+		field, _ := lookupField(key)
+		descs[key] = prometheus.NewDesc(
+			fmt.Sprintf("weather_consensus_%s", key),
+			fmt.Sprintf("By provider - %s", field.helpString(config.HelpLanguage, fieldConversion(config.Units, field).unit)),
+			withUnitLabel([]string{"location", "provider"}, config.Units),
+			constLabels,
+		)
+	}
+	return descs
+}
+
+// consensusEntry is the last weather of a location from a consensus provider.
+type consensusEntry struct {
+	weather   *Weather
+	fetchedAt time.Time
+}
+
+// consensusCache holds the last weather of every location from every
+// consensus provider, keyed by location and provider name.
+type consensusCache struct {
+	mu      sync.Mutex
+	entries map[[2]string]consensusEntry
+}
+
+func newConsensusCache() *consensusCache {
+	return &consensusCache{entries: make(map[[2]string]consensusEntry)}
+}
+
+// prune removes the weather of all the locations not in keep.
+func (c *consensusCache) prune(keep map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if !keep[key[0]] {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// median returns the median of values, which must not be empty. values is
+// sorted in place.
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// cachedConsensusWeather returns the last weather of a location from a
+// consensus provider, and when it was fetched. The weather of the main
+// provider is taken from the cache of the main metrics, and is always
+// current.
+func (wc *WeatherCollector) cachedConsensusWeather(name string, p Provider) (*Weather, time.Time, bool) {
+	if lw, ok := wc.weatherCache.get(name); ok && lw.Provider == p.Name() {
+		return lw.Weather, time.Now(), true
+	}
+	wc.consensus.mu.Lock()
+	defer wc.consensus.mu.Unlock()
+	e, ok := wc.consensus.entries[[2]string{name, p.Name()}]
+	return e.weather, e.fetchedAt, ok
+}
+
+// consensusWeather returns the weather of a location from a consensus
+// provider, fetching it if missing or older than the route maximum age.
+func (wc *WeatherCollector) consensusWeather(ctx context.Context, name string, p Provider) (*Weather, error) {
+	if w, fetchedAt, ok := wc.cachedConsensusWeather(name, p); ok && time.Since(fetchedAt) < wc.cfg().routeMaxAge() {
+		return w, nil
+	}
+	key := [2]string{name, p.Name()}
+	loc, _, err := wc.resolveLocation(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("geocoding failed: %w", err)
+	}
+	w, err := p.Get(ctx, loc)
+	if err != nil {
+		return nil, err
+	}
+	if wc.cfg().LowMemory {
+		w = currentOnly(w)
+	}
+	wc.consensus.mu.Lock()
+	wc.consensus.entries[key] = consensusEntry{weather: w, fetchedAt: time.Now()}
+	wc.consensus.mu.Unlock()
+	return w, nil
+}
+
+// fetchConsensus returns the weather of the given locations from every
+// consensus provider, fetching the ones that are missing or too old, by
+// location and then by provider. The weather that cannot be fetched is nil.
+func (wc *WeatherCollector) fetchConsensus(ctx context.Context, locations []string) []*Weather {
+	n := len(wc.consensusProviders)
+	jobs := make([]string, 0, len(locations)*n)
+	for _, name := range locations {
+		for _, p := range wc.consensusProviders {
+			jobs = append(jobs, name+" from "+p.Name())
+		}
+	}
+	weather := make([]*Weather, len(jobs))
+	wc.forEachLocation(jobs, func(idx int, job string) {
+		name, p := locations[idx/n], wc.consensusProviders[idx%n]
+		ctx := withLogFields(ctx, "location", name, "provider", p.Name())
+		w, err := wc.consensusWeather(ctx, name, p)
+		if err != nil {
+			errorf(ctx, "Failed to get consensus weather for '%s': %v", job, err)
+			return
+		}
+		weather[idx] = w
+	})
+	return weather
+}
+
+// refreshConsensus fetches the weather of every location from every
+// consensus provider, if missing or too old.
+func (wc *WeatherCollector) refreshConsensus(ctx context.Context) {
+	if len(wc.consensusProviders) == 0 {
+		return
+	}
+	wc.fetchConsensus(ctx, wc.Locations())
+}
+
+// collectConsensus sends the metrics of every location from every consensus
+// provider to ch, and their median if enabled. When polling, the weather is
+// fetched by the poller, and only the cached one is sent.
+func (wc *WeatherCollector) collectConsensus(ctx context.Context, ch chan<- prometheus.Metric) {
+	if len(wc.consensusProviders) == 0 {
+		return
+	}
+	locations := wc.Locations()
+	n := len(wc.consensusProviders)
+	var weather []*Weather
+	if wc.polling() {
+		for _, name := range locations {
+			for _, p := range wc.consensusProviders {
+				w, _, _ := wc.cachedConsensusWeather(name, p)
+				weather = append(weather, w)
+			}
+		}
+	} else {
+		weather = wc.fetchConsensus(ctx, locations)
+	}
+	wc.mu.RLock()
+	descs := wc.consensusDescs
+	wc.mu.RUnlock()
+	units := wc.cfg().Units
+	for lidx, name := range locations {
+		for key, desc := range descs {
+			field, _ := lookupField(key)
+			conv := fieldConversion(units, field)
+			var values []float64
+			for pidx, p := range wc.consensusProviders {
+				w := weather[lidx*n+pidx]
+				if w == nil {
+					continue
+				}
+				v := conv.value(field.Value(&w.Forecast.Currently))
+				values = append(values, v)
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, wc.round(key, v), wc.unitLabelValues(conv, name, p.Name())...)
+			}
+			if wc.cfg().Consensus.Median && len(values) > 0 {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, wc.round(key, median(values)), wc.unitLabelValues(conv, name, consensusMedian)...)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultConsulAddress and defaultConsulServiceName are used if not
+// configured.
+const (
+	defaultConsulAddress     = "http://127.0.0.1:8500"
+	defaultConsulServiceName = "weather-exporter"
+)
+
+// ConsulConfig configures the registration of the exporter as a Consul
+// service.
+type ConsulConfig struct {
+	// Address is the URL of the Consul agent.
+	Address string `json:"address"`
+	// Token is the ACL token, if any.
+	Token string `json:"token"`
+	// ServiceName is the name of the registered service.
+	ServiceName string `json:"service_name"`
+	// ServiceAddress is the address Prometheus uses to reach the exporter. If
+	// empty, Consul uses the address of the agent's node.
+	ServiceAddress string `json:"service_address"`
+	// Tags are added to the service tags, which also include one
+	// "location=<name>" tag per configured location.
+	Tags []string `json:"tags"`
+}
+
+// consulService is the subset of the Consul agent service definition that is
+// used by the exporter.
+type consulService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Address string            `json:"Address,omitempty"`
+	Port    int               `json:"Port"`
+	Tags    []string          `json:"Tags"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Check   *consulCheck      `json:"Check,omitempty"`
+}
+
+type consulCheck struct {
+	HTTP                           string `json:"HTTP"`
+	Interval                       string `json:"Interval"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+// consulRegistration registers the exporter in Consul through the agent HTTP
+// API, and deregisters it on shutdown.
+type consulRegistration struct {
+	config     *ConsulConfig
+	httpClient *http.Client
+	service    consulService
+}
+
+// newConsulRegistration builds the service definition for an exporter
+// listening on listenAddr and serving metrics on metricsPath.
+func newConsulRegistration(config *ConsulConfig, listenAddr, metricsPath string, locations []string) (*consulRegistration, error) {
+	_, portStr, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address '%s': %w", listenAddr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen port '%s': %w", portStr, err)
+	}
+	name := config.ServiceName
+	if name == "" {
+		name = defaultConsulServiceName
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+	tags := append([]string{}, config.Tags...)
+	for _, loc := range locations {
+		tags = append(tags, "location="+loc)
+	}
+	checkHost := config.ServiceAddress
+	if checkHost == "" {
+		checkHost = "127.0.0.1"
+	}
+	return &consulRegistration{
+		config:     config,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		service: consulService{
+			ID:      fmt.Sprintf("%s-%s-%d", name, hostname, port),
+			Name:    name,
+			Address: config.ServiceAddress,
+			Port:    port,
+			Tags:    tags,
+			Meta:    map[string]string{"metrics_path": metricsPath},
+			Check: &consulCheck{
+				HTTP:                           fmt.Sprintf("http://%s/-/healthy", net.JoinHostPort(checkHost, portStr)),
+				Interval:                       "30s",
+				DeregisterCriticalServiceAfter: "10m",
+			},
+		},
+	}, nil
+}
+
+func (c *consulRegistration) do(ctx context.Context, path string, body io.Reader) error {
+	address := c.config.Address
+	if address == "" {
+		address = defaultConsulAddress
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("invalid Consul address '%s': %w", address, err)
+	}
+	u.Path = path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if c.config.Token != "" {
+		req.Header.Set("X-Consul-Token", c.config.Token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// register registers the service in Consul.
+func (c *consulRegistration) register(ctx context.Context) error {
+	data, err := json.Marshal(c.service)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, "/v1/agent/service/register", bytes.NewReader(data))
+}
+
+// deregister removes the service from Consul.
+func (c *consulRegistration) deregister(ctx context.Context) error {
+	return c.do(ctx, "/v1/agent/service/deregister/"+url.PathEscape(c.service.ID), nil)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// correlationIDHeader is the HTTP header carrying the correlation ID in the
+// outgoing API requests.
+const correlationIDHeader = "X-Request-ID"
+
+type correlationIDKey struct{}
+
+// newCorrelationID returns a random ID used to correlate the log lines and
+// the API requests of a single scrape.
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// not fatal, correlation IDs are only a debugging aid
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// withCorrelationID returns a copy of ctx carrying the given correlation ID.
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// correlationID returns the correlation ID carried by ctx, if any.
+func correlationID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationIDKey{}).(string)
+	return id, ok
+}
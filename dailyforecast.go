@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dailyForecastField is a value exported for every day of the daily forecast,
+// as weather_forecast_<name>.
+type dailyForecastField struct {
+	name string
+	help string
+	// unit is the SI unit of the value, converted to the configured unit
+	// system.
+	unit  string
+	value func(*forecast.DataPoint) float64
+}
+
+// dailyForecastFields are the values exported from the daily forecast.
+var dailyForecastFields = []dailyForecastField{
+	{
+		name:  "temperature_max",
+		help:  "Maximum temperature forecast for the day",
+		unit:  "celsius",
+		value: func(dp *forecast.DataPoint) float64 { return dp.TemperatureMax },
+	},
+	{
+		name:  "temperature_min",
+		help:  "Minimum temperature forecast for the day",
+		unit:  "celsius",
+		value: func(dp *forecast.DataPoint) float64 { return dp.TemperatureMin },
+	},
+	{
+		name: "precipitation_millimeters",
+		help: "Total precipitation forecast for the day",
+		unit: "millimeters",
+		// the daily precipitation intensity is the average over the day, in
+		// mm/h
+		value: func(dp *forecast.DataPoint) float64 { return dp.PrecipIntensity * 24 },
+	},
+	{
+		name:  "precip_probability",
+		help:  "Probability of precipitation during the day",
+		unit:  "ratio",
+		value: func(dp *forecast.DataPoint) float64 { return dp.PrecipProbability },
+	},
+}
+
+// newDailyForecastDescs returns the descriptors of the daily forecast
+// metrics, in the same order as dailyForecastFields, in the given unit system.
+func newDailyForecastDescs(units string, constLabels prometheus.Labels) []*prometheus.Desc {
+	descs := make([]*prometheus.Desc, 0, len(dailyForecastFields))
+	for _, f := range dailyForecastFields {
+		descs = append(descs, prometheus.NewDesc(
+			"weather_forecast_"+f.name,
+			fmt.Sprintf("%s (%s)", f.help, conversion(units, f.unit).unit),
+			withUnitLabel([]string{"location", "day_offset"}, units),
+			constLabels,
+		))
+	}
+	return descs
+}
+
+// dayForecast is the forecast for a day, relative to the current one.
+type dayForecast struct {
+	// Offset is the number of days from today, in the time zone of the
+	// location.
+	Offset    int
+	DataPoint *forecast.DataPoint
+}
+
+// dailyForecast returns the daily forecast for today and the following days,
+// up to days in total. The offsets are computed from the dates of the data
+// points rather than their position, so that a forecast fetched yesterday
+// does not report yesterday as today.
+func dailyForecast(fc *forecast.Forecast, now time.Time, days int) []dayForecast {
+	tz := forecastLocation(fc)
+	now = now.In(tz)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	var result []dayForecast
+	for idx := range fc.Daily.Data {
+		dp := &fc.Daily.Data[idx]
+		t := time.Unix(dp.Time, 0).In(tz)
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		// both dates are midnight UTC, so there are no DST changes
+		offset := int(day.Sub(today) / (24 * time.Hour))
+		if offset < 0 {
+			continue
+		}
+		if offset >= days {
+			break
+		}
+		result = append(result, dayForecast{Offset: offset, DataPoint: dp})
+	}
+	return result
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+
+// dashboardTemplate is the HTML page served at /dashboard. It only uses the
+// cached weather, and reloads itself every minute.
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap(renderFuncs)).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Weather</title>
+<style>
+body { font-family: sans-serif; margin: 2em; background: #f5f5f5; color: #222; }
+.locations { display: flex; flex-wrap: wrap; gap: 1em; }
+.location { background: #fff; border-radius: 6px; padding: 1em 1.5em; min-width: 14em; box-shadow: 0 1px 3px rgba(0,0,0,.2); }
+.location h2 { margin: 0 0 .2em 0; font-size: 1.2em; }
+.temperature { font-size: 2.5em; margin: .2em 0; }
+.summary { color: #555; }
+table { margin-top: .5em; font-size: .9em; }
+td:first-child { color: #777; padding-right: 1em; }
+.footer { margin-top: 2em; font-size: .8em; color: #777; }
+</style>
+</head>
+<body>
+<h1>Weather</h1>
+{{if not .Locations}}<p>No data yet, waiting for the first scrape.</p>{{end}}
+<div class="locations">
+{{range .Locations}}<div class="location">
+<h2>{{.Name}}</h2>
+<div class="summary">{{.Summary}}</div>
+<div class="temperature">{{round (index .Values "temperature") 1}}&nbsp;°C</div>
+<table>
+<tr><td>Feels like</td><td>{{round (index .Values "apparent_temperature") 1}}&nbsp;°C</td></tr>
+<tr><td>Humidity</td><td>{{round (percent (index .Values "humidity")) 0}}%</td></tr>
+<tr><td>Wind</td><td>{{round (index .Values "wind_speed") 1}}&nbsp;m/s</td></tr>
+<tr><td>Cloud cover</td><td>{{round (percent (index .Values "cloud_cover")) 0}}%</td></tr>
+<tr><td>Precipitation</td><td>{{round (index .Values "precip_intensity") 1}}&nbsp;mm/h</td></tr>
+<tr><td>Updated</td><td>{{.FetchedAt.Format "15:04:05"}}</td></tr>
+</table>
+</div>
+{{end}}</div>
+<div class="footer">Generated at {{.Now.Format "2006-01-02 15:04:05 MST"}}</div>
+</body>
+</html>
+`))
+
+// dashboardHandler serves a simple HTML dashboard with the current conditions
+// of every location. It never calls the APIs.
+func dashboardHandler(wc *WeatherCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := dashboardTemplate.Execute(&buf, newRenderData(wc.Snapshot())); err != nil {
+			errorf(r.Context(), "Failed to render dashboard: %v", err)
+			http.Error(w, "failed to render dashboard", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := buf.WriteTo(w); err != nil {
+			errorf(r.Context(), "Failed to write dashboard: %v", err)
+		}
+	})
+}
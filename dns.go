@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsCache resolves host names for outgoing connections, caching the results
+// for a configurable TTL and honouring static host to IP overrides. If a
+// lookup fails and a stale entry is available, the stale entry is used, so
+// that a flaky resolver does not cause failed API requests.
+type dnsCache struct {
+	ttl        time.Duration
+	maxEntries int
+	static     map[string]string
+	resolver   *net.Resolver
+	dialer     *net.Dialer
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration, maxEntries int, static map[string]string) *dnsCache {
+	return &dnsCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		static:     static,
+		resolver:   net.DefaultResolver,
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		entries: make(map[string]dnsEntry),
+	}
+}
+
+func (d *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	if ip, ok := d.static[host]; ok {
+		return []string{ip}, nil
+	}
+	if net.ParseIP(host) != nil || d.ttl <= 0 {
+		return []string{host}, nil
+	}
+	d.mu.Lock()
+	entry, ok := d.entries[host]
+	d.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		if ok {
+			warnf(ctx, "DNS lookup for '%s' failed, using stale entry: %v", host, err)
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+	d.mu.Lock()
+	if d.maxEntries > 0 && len(d.entries) >= d.maxEntries {
+		d.evict()
+	}
+	d.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(d.ttl)}
+	d.mu.Unlock()
+	return addrs, nil
+}
+
+// evict makes room for a new entry, removing expired entries first, or an
+// arbitrary one if none is expired. Must be called with d.mu held.
+func (d *dnsCache) evict() {
+	now := time.Now()
+	for host, entry := range d.entries {
+		if now.After(entry.expires) {
+			delete(d.entries, host)
+		}
+	}
+	for host := range d.entries {
+		if len(d.entries) < d.maxEntries {
+			break
+		}
+		delete(d.entries, host)
+	}
+}
+
+// DialContext is a drop-in replacement for net.Dialer.DialContext that uses
+// the cache to resolve the host.
+func (d *dnsCache) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, a := range addrs {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses found for '%s'", host)
+	}
+	return nil, lastErr
+}
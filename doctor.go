@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// doctorTimeout is the timeout of every check run by the doctor.
+const doctorTimeout = 30 * time.Second
+
+// geocodingEndpoint returns the geocoding API endpoint checked for
+// connectivity.
+func geocodingEndpoint(config *Config) string {
+	if config.geocoderName() == geocoderNominatim {
+		if config.NominatimURL != "" {
+			return config.NominatimURL
+		}
+		return defaultNominatimURL
+	}
+	if config.geocoderName() == geocoderAccuWeather {
+		return accuWeatherURL
+	}
+	return "https://maps.googleapis.com/"
+}
+
+// doctor runs troubleshooting checks against the configuration.
+type doctor struct {
+	out        io.Writer
+	config     *Config
+	httpClient *http.Client
+	provider   Provider
+	failures   int
+}
+
+func (d *doctor) ok(format string, v ...interface{}) {
+	fmt.Fprintf(d.out, "  [ OK ] "+format+"\n", v...)
+}
+
+func (d *doctor) warn(format string, v ...interface{}) {
+	fmt.Fprintf(d.out, "  [WARN] "+format+"\n", v...)
+}
+
+func (d *doctor) fail(format string, v ...interface{}) {
+	d.failures++
+	fmt.Fprintf(d.out, "  [FAIL] "+format+"\n", v...)
+}
+
+func (d *doctor) checkConnectivity() {
+	fmt.Fprintln(d.out, "Connectivity:")
+	endpoints := []string{providerEndpoints[d.provider.Name()]}
+	if d.provider.Name() == "pirateweather" && d.config.PirateWeatherURL != "" {
+		endpoints = []string{d.config.PirateWeatherURL}
+	}
+	// the providers of the locations that have their own
+	seen := map[string]bool{d.provider.Name(): true}
+	for _, l := range d.config.Locations {
+		for _, name := range l.providerList() {
+			if !seen[name] {
+				seen[name] = true
+				endpoints = append(endpoints, providerEndpoints[name])
+			}
+		}
+	}
+	if len(d.config.geocodedLocations()) > 0 {
+		endpoints = append([]string{geocodingEndpoint(d.config)}, endpoints...)
+	}
+	for _, endpoint := range endpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+		if err != nil {
+			cancel()
+			d.fail("%s: %v", endpoint, err)
+			continue
+		}
+		start := time.Now()
+		resp, err := d.httpClient.Do(req)
+		cancel()
+		if err != nil {
+			d.fail("%s: %v", endpoint, err)
+			continue
+		}
+		resp.Body.Close()
+		d.ok("%s: reachable in %s", endpoint, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// checkLocations geocodes every enabled location without explicit
+// coordinates, which also validates the Google Maps API key if used, and
+// returns the first resolved one.
+func (d *doctor) checkLocations() *Location {
+	fmt.Fprintln(d.out, "Locations:")
+	var first *Location
+	for _, name := range d.config.enabledLocations() {
+		if loc, ok := d.config.coordinates(name); ok {
+			d.ok("%s: explicit coordinates (%s, %s)", name, loc.LatString(), loc.LngString())
+			if first == nil {
+				first = loc
+			}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+		loc, err := getLocation(ctx, d.httpClient, d.config, name)
+		cancel()
+		if err != nil {
+			reason := reasonForError(err)
+			if d.config.geocoderName() == geocoderGoogleMaps {
+				reason = reasonForMapsError(err)
+			}
+			d.fail("%s: %v (reason: %s)", name, err, reason)
+			continue
+		}
+		if err := checkGeocodeQuality(d.config, name, loc); err != nil {
+			d.fail("%s: %v", name, err)
+			continue
+		}
+		d.ok("%s: %s (%s, %s), accuracy %s", name, loc.Name, loc.LatString(), loc.LngString(), loc.Accuracy)
+		if first == nil {
+			first = loc
+		}
+	}
+	return first
+}
+
+// checkForecast fetches the weather for a location, which validates the
+// provider API key.
+func (d *doctor) checkForecast(name string, loc *Location) {
+	fmt.Fprintln(d.out, "Weather provider:")
+	if loc == nil {
+		d.fail("%s: skipped, no location could be resolved", d.provider.Name())
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	w, err := d.provider.Get(ctx, loc)
+	if err != nil {
+		d.fail("%s: %v (reason: %s)", d.provider.Name(), err, reasonForError(err))
+		return
+	}
+	d.ok("%s: %s, %.1f°C at %s", d.provider.Name(), w.Forecast.Currently.Summary, w.Forecast.Currently.Temperature, name)
+}
+
+func (d *doctor) checkUsage(scrapeInterval time.Duration) {
+	fmt.Fprintf(d.out, "Projected API usage, with a scrape interval of %s:\n", scrapeInterval)
+	for _, u := range estimateUsage(d.config, scrapeInterval) {
+		switch {
+		case u.OverQuota():
+			d.warn("%s: %.0f calls/day, above the free tier of %.0f calls/day", u.Provider, u.CallsPerDay, u.FreeTierQuota)
+		case u.FreeTierQuota > 0:
+			d.ok("%s: %.0f calls/day, within the free tier of %.0f calls/day", u.Provider, u.CallsPerDay, u.FreeTierQuota)
+		default:
+			d.ok("%s: %.0f calls/day", u.Provider, u.CallsPerDay)
+		}
+	}
+}
+
+// runDoctor checks the connectivity to the providers, validates the API keys,
+// resolves every location and estimates the API usage, printing a report. It
+// returns an error if any check failed.
+func runDoctor(out io.Writer, config *Config, httpClient *http.Client, provider Provider, scrapeInterval time.Duration) error {
+	d := doctor{out: out, config: config, httpClient: httpClient, provider: provider}
+	d.checkConnectivity()
+	loc := d.checkLocations()
+	var name string
+	if loc != nil {
+		name = loc.Name
+	}
+	d.checkForecast(name, loc)
+	d.checkUsage(scrapeInterval)
+	if d.failures > 0 {
+		return fmt.Errorf("%d check(s) failed", d.failures)
+	}
+	fmt.Fprintln(out, "All checks passed.")
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// nativeHistogramBucketFactor is the growth factor between native histogram
+// buckets, giving a resolution of about 10%.
+const nativeHistogramBucketFactor = 1.1
+
+// apiRequestDuration is the latency of the requests to the upstream APIs. It
+// is set by registerExporterMetrics.
+var apiRequestDuration *prometheus.HistogramVec
+
+// apiRequests counts the requests to the upstream APIs, by provider and HTTP
+// status. It is set by registerExporterMetrics.
+var apiRequests *prometheus.CounterVec
+
+// apiErrors counts the failed requests to the upstream APIs, by provider and
+// reason. It is set by registerExporterMetrics.
+var apiErrors *prometheus.CounterVec
+
+// apiCost is the estimated cost of the requests to the upstream APIs, by
+// provider and API key fingerprint. It is set by registerExporterMetrics.
+var apiCost *prometheus.CounterVec
+
+// registerExporterMetrics creates and registers the metrics about the
+// exporter itself. If nativeHistograms is true, latencies are exported as
+// native histograms instead of classic ones.
+func registerExporterMetrics(reg prometheus.Registerer, nativeHistograms bool) {
+	opts := prometheus.HistogramOpts{
+		Name: "weather_exporter_api_request_duration_seconds",
+		Help: "Duration of the requests to the upstream APIs",
+	}
+	if nativeHistograms {
+		opts.NativeHistogramBucketFactor = nativeHistogramBucketFactor
+	} else {
+		opts.Buckets = prometheus.DefBuckets
+	}
+	apiRequestDuration = prometheus.NewHistogramVec(opts, []string{"provider"})
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "weather_exporter_api_requests_total",
+		Help: "Number of requests to the upstream APIs, by HTTP status, or \"error\" if no response was received",
+	}, []string{"provider", "status"})
+	apiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "weather_exporter_api_errors_total",
+		Help: "Number of failed requests to the upstream APIs, by reason",
+	}, []string{"provider", "reason"})
+	apiCost = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "weather_exporter_estimated_cost_total",
+		Help: "Estimated cost of the requests to the upstream APIs, based on the configured pricing",
+	}, []string{"provider", "key"})
+	reg.MustRegister(apiRequestDuration, apiRequests, apiErrors, apiCost)
+}
+
+// requestStatus returns the status label of an API request.
+func requestStatus(code int, err error) string {
+	if err != nil {
+		return "error"
+	}
+	return strconv.Itoa(code)
+}
+
+// lastSuccessCollector exports the time of the last successful fetch of
+// every location.
+type lastSuccessCollector struct {
+	wc   *WeatherCollector
+	desc *prometheus.Desc
+}
+
+func newLastSuccessCollector(wc *WeatherCollector) *lastSuccessCollector {
+	return &lastSuccessCollector{
+		wc: wc,
+		desc: prometheus.NewDesc(
+			"weather_exporter_last_success_timestamp_seconds",
+			"Time of the last successful fetch of the weather for the location",
+			[]string{"location"},
+			nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.Describe for lastSuccessCollector.
+func (c *lastSuccessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.Collect for lastSuccessCollector.
+func (c *lastSuccessCollector) Collect(ch chan<- prometheus.Metric) {
+	// only successful fetches are cached
+	for _, lw := range c.wc.Snapshot() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(lw.FetchedAt.UnixNano())/1e9, lw.Name)
+	}
+}
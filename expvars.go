@@ -0,0 +1,33 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+)
+
+// stats are internal counters published at /debug/vars, for quick
+// inspection with curl and for tools that predate the Prometheus formats.
+// Importing expvar registers the handler on the default HTTP mux.
+var stats = expvar.NewMap("weather_exporter")
+
+func init() {
+	stats.Set("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+}
+
+// Keys of the stats map.
+const (
+	// statFetches and statFetchErrors count the weather fetches, i.e. the
+	// geocoding and forecast requests for a location.
+	statFetches     = "fetches"
+	statFetchErrors = "fetch_errors"
+	// statFetchesInFlight is the number of fetches in progress.
+	statFetchesInFlight = "fetches_in_flight"
+	// statCacheHits counts the scrapes served from the weather cache, e.g.
+	// during quiet hours or within the refresh interval.
+	statCacheHits = "cache_hits"
+	// statGeocodeRetryQueue is the number of locations waiting for a
+	// geocoding retry.
+	statGeocodeRetryQueue = "geocode_retry_queue"
+)
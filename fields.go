@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// defaultHelpLanguage is the language used for HELP strings when none is
+// configured, or when a translation is missing.
+const defaultHelpLanguage = "en"
+
+// helpPrefixes is the prefix of every weather metric HELP string, by
+// language.
+var helpPrefixes = map[string]string{
+	"en": "Weather forecast",
+	"it": "Previsioni meteo",
+	"de": "Wettervorhersage",
+	"fr": "Prévisions météo",
+	"es": "Previsión meteorológica",
+}
+
+// Field describes a value that can be exported as a metric from a forecast
+// data point.
+type Field struct {
+	// Name is the name used in the configuration file, and the suffix of the
+	// metric name.
+	Name string
+	// Source is the name of the forecast.DataPoint field holding the value.
+	Source string
+	// Unit is the unit of the exported value.
+	Unit string
+	// Convert, if not nil, converts the source value to Unit.
+	Convert func(float64) float64
+	// Help is the description of the field, by language.
+	Help map[string]string
+}
+
+// fields is the registry of the supported fields.
+var fields = []Field{
+	{
+		Name:   "temperature",
+		Source: "Temperature",
+		Unit:   "celsius",
+		Help: map[string]string{
+			"en": "temperature",
+			"it": "temperatura",
+			"de": "Temperatur",
+			"fr": "température",
+			"es": "temperatura",
+		},
+	},
+	{
+		Name:   "apparent_temperature",
+		Source: "ApparentTemperature",
+		Unit:   "celsius",
+		Help: map[string]string{
+			"en": "apparent temperature",
+			"it": "temperatura percepita",
+			"de": "gefühlte Temperatur",
+			"fr": "température ressentie",
+			"es": "sensación térmica",
+		},
+	},
+	{
+		Name:   "wind_speed",
+		Source: "WindSpeed",
+		Unit:   "meters per second",
+		Help: map[string]string{
+			"en": "wind speed",
+			"it": "velocità del vento",
+			"de": "Windgeschwindigkeit",
+			"fr": "vitesse du vent",
+			"es": "velocidad del viento",
+		},
+	},
+	{
+		Name:   "cloud_cover",
+		Source: "CloudCover",
+		Unit:   "ratio",
+		Help: map[string]string{
+			"en": "cloud cover",
+			"it": "copertura nuvolosa",
+			"de": "Bewölkung",
+			"fr": "couverture nuageuse",
+			"es": "nubosidad",
+		},
+	},
+	{
+		Name:   "humidity",
+		Source: "Humidity",
+		Unit:   "ratio",
+		Help: map[string]string{
+			"en": "humidity",
+			"it": "umidità",
+			"de": "Luftfeuchtigkeit",
+			"fr": "humidité",
+			"es": "humedad",
+		},
+	},
+	{
+		Name:   "precip_intensity",
+		Source: "PrecipIntensity",
+		Unit:   "millimeters per hour",
+		Help: map[string]string{
+			"en": "precipitation intensity",
+			"it": "intensità delle precipitazioni",
+			"de": "Niederschlagsintensität",
+			"fr": "intensité des précipitations",
+			"es": "intensidad de precipitación",
+		},
+	},
+	{
+		Name:   "precip_probability",
+		Source: "PrecipProbability",
+		Unit:   "ratio",
+		Help: map[string]string{
+			"en": "precipitation probability",
+			"it": "probabilità di precipitazioni",
+			"de": "Niederschlagswahrscheinlichkeit",
+			"fr": "probabilité de précipitations",
+			"es": "probabilidad de precipitación",
+		},
+	},
+	{
+		Name:   "pressure",
+		Source: "Pressure",
+		Unit:   "hectopascals",
+		Help: map[string]string{
+			"en": "sea-level air pressure",
+			"it": "pressione atmosferica al livello del mare",
+			"de": "Luftdruck auf Meereshöhe",
+			"fr": "pression atmosphérique au niveau de la mer",
+			"es": "presión atmosférica al nivel del mar",
+		},
+	},
+	{
+		Name:   "dew_point",
+		Source: "DewPoint",
+		Unit:   "celsius",
+		Help: map[string]string{
+			"en": "dew point",
+			"it": "punto di rugiada",
+			"de": "Taupunkt",
+			"fr": "point de rosée",
+			"es": "punto de rocío",
+		},
+	},
+	{
+		Name:   "uv_index",
+		Source: "UVIndex",
+		Unit:   "index",
+		Help: map[string]string{
+			"en": "UV index",
+			"it": "indice UV",
+			"de": "UV-Index",
+			"fr": "indice UV",
+			"es": "índice UV",
+		},
+	},
+	{
+		Name:   "visibility",
+		Source: "Visibility",
+		Unit:   "kilometers",
+		Help: map[string]string{
+			"en": "visibility",
+			"it": "visibilità",
+			"de": "Sichtweite",
+			"fr": "visibilité",
+			"es": "visibilidad",
+		},
+	},
+	{
+		Name:   "ozone",
+		Source: "Ozone",
+		Unit:   "Dobson units",
+		Help: map[string]string{
+			"en": "columnar density of total atmospheric ozone",
+			"it": "densità colonnare dell'ozono atmosferico",
+			"de": "Gesamtsäule des atmosphärischen Ozons",
+			"fr": "colonne totale d'ozone atmosphérique",
+			"es": "columna total de ozono atmosférico",
+		},
+	},
+	{
+		Name:   "wind_gust",
+		Source: "WindGust",
+		Unit:   "meters per second",
+		Help: map[string]string{
+			"en": "wind gust speed",
+			"it": "velocità delle raffiche di vento",
+			"de": "Böengeschwindigkeit",
+			"fr": "vitesse des rafales de vent",
+			"es": "velocidad de las ráfagas de viento",
+		},
+	},
+	{
+		Name:   "wind_bearing",
+		Source: "WindBearing",
+		Unit:   "degrees",
+		Help: map[string]string{
+			"en": "direction the wind is coming from, clockwise from true north",
+			"it": "direzione di provenienza del vento, in senso orario dal nord geografico",
+			"de": "Windrichtung, im Uhrzeigersinn ab geografisch Nord",
+			"fr": "direction d'où vient le vent, dans le sens horaire depuis le nord géographique",
+			"es": "dirección de procedencia del viento, en sentido horario desde el norte geográfico",
+		},
+	},
+	{
+		Name:   "nearest_storm_distance",
+		Source: "NearestStormDistance",
+		Unit:   "kilometers",
+		Help: map[string]string{
+			"en": "distance to the nearest storm",
+			"it": "distanza dal temporale più vicino",
+			"de": "Entfernung zum nächsten Gewitter",
+			"fr": "distance de l'orage le plus proche",
+			"es": "distancia a la tormenta más cercana",
+		},
+	},
+}
+
+func init() {
+	// make sure that the registry only references existing fields, so that
+	// Value never fails at runtime.
+	t := reflect.TypeOf(forecast.DataPoint{})
+	for _, f := range fields {
+		sf, ok := t.FieldByName(f.Source)
+		if !ok {
+			panic(fmt.Sprintf("field '%s': forecast.DataPoint has no field '%s'", f.Name, f.Source))
+		}
+		switch sf.Type.Kind() {
+		case reflect.Float64, reflect.Int64:
+		default:
+			panic(fmt.Sprintf("field '%s': unsupported type %s", f.Name, sf.Type))
+		}
+	}
+}
+
+// lookupField returns the field with the given name from the registry.
+func lookupField(name string) (*Field, bool) {
+	for idx := range fields {
+		if fields[idx].Name == name {
+			return &fields[idx], true
+		}
+	}
+	return nil, false
+}
+
+// Value returns the value of the field in the given data point, converted to
+// the field unit.
+func (f *Field) Value(dp *forecast.DataPoint) float64 {
+	v := reflect.ValueOf(dp).Elem().FieldByName(f.Source)
+	var val float64
+	if v.Kind() == reflect.Int64 {
+		val = float64(v.Int())
+	} else {
+		val = v.Float()
+	}
+	if f.Convert != nil {
+		val = f.Convert(val)
+	}
+	return val
+}
+
+// HelpString returns the HELP string for the field in the given language,
+// falling back to English.
+func (f *Field) HelpString(lang string) string {
+	return f.helpString(lang, f.Unit)
+}
+
+// helpString returns the HELP string for the field in the given language and
+// unit.
+func (f *Field) helpString(lang, unit string) string {
+	if !isSupportedHelpLanguage(lang) {
+		lang = defaultHelpLanguage
+	}
+	help, ok := f.Help[lang]
+	if !ok {
+		help = f.Help[defaultHelpLanguage]
+	}
+	return fmt.Sprintf("%s - %s (%s)", helpPrefixes[lang], help, unit)
+}
+
+// isSupportedHelpLanguage returns whether HELP strings are available in the
+// given language.
+func isSupportedHelpLanguage(lang string) bool {
+	_, ok := helpPrefixes[lang]
+	return ok
+}
+
+// writeFieldsDoc writes a Markdown table documenting the supported fields.
+func writeFieldsDoc(w io.Writer) error {
+	sorted := make([]Field, len(fields))
+	copy(sorted, fields)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	if _, err := fmt.Fprintln(w, "| Metric | Unit | Description |\n|--------|------|-------------|"); err != nil {
+		return err
+	}
+	for _, f := range sorted {
+		desc := strings.ToUpper(f.Help[defaultHelpLanguage][:1]) + f.Help[defaultHelpLanguage][1:]
+		if _, err := fmt.Fprintf(w, "| `weather_%s` | %s | %s |\n", f.Name, f.Unit, desc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
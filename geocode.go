@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// geocodeAccuracies maps the location types returned by the geocoder to a
+// rank, from the least to the most accurate.
+var geocodeAccuracies = map[string]int{
+	"APPROXIMATE":        1,
+	"GEOMETRIC_CENTER":   2,
+	"RANGE_INTERPOLATED": 3,
+	"ROOFTOP":            4,
+}
+
+// geocodeAccuracyRank returns the rank of a geocoder location type, or 0 if
+// unknown. The comparison is case-insensitive.
+func geocodeAccuracyRank(accuracy string) int {
+	return geocodeAccuracies[strings.ToUpper(accuracy)]
+}
+
+// checkGeocodeQuality returns an error if the geocoded location does not
+// satisfy the configured quality requirements.
+func checkGeocodeQuality(config *Config, name string, loc *Location) error {
+	if config.RejectPartialMatches && loc.PartialMatch {
+		return fmt.Errorf("geocoding returned only a partial match for '%s' (%s)", name, loc.Name)
+	}
+	if config.MinGeocodeAccuracy != "" && geocodeAccuracyRank(loc.Accuracy) < geocodeAccuracyRank(config.MinGeocodeAccuracy) {
+		return fmt.Errorf("geocoding result for '%s' is too imprecise: got %s, want at least %s", name, loc.Accuracy, strings.ToUpper(config.MinGeocodeAccuracy))
+	}
+	return nil
+}
+
+// defaultGeocodeCacheTTL is how long geocoding results are reused before
+// geocoding the location again.
+const defaultGeocodeCacheTTL = 30 * 24 * time.Hour
+
+// geocodeEntry is a geocoding result, as persisted in the geocoding cache
+// file.
+type geocodeEntry struct {
+	Name         string  `json:"name"`
+	Lat          float64 `json:"lat"`
+	Lng          float64 `json:"lng"`
+	Accuracy     string  `json:"accuracy,omitempty"`
+	PartialMatch bool    `json:"partial_match,omitempty"`
+	// NativeProvider and NativeID are set if the location was looked up by
+	// its provider-native ID rather than geocoded.
+	NativeProvider string    `json:"native_provider,omitempty"`
+	NativeID       string    `json:"native_id,omitempty"`
+	GeocodedAt     time.Time `json:"geocoded_at"`
+}
+
+func (e *geocodeEntry) location() *Location {
+	return &Location{
+		Name:           e.Name,
+		Lat:            e.Lat,
+		Lng:            e.Lng,
+		Accuracy:       e.Accuracy,
+		PartialMatch:   e.PartialMatch,
+		NativeProvider: e.NativeProvider,
+		NativeID:       e.NativeID,
+	}
+}
+
+// geocodeCache holds the last successfully geocoded coordinates for each
+// location name, so that locations are not geocoded on every fetch, and can
+// still be served when the geocoding API is unavailable, e.g. because the
+// quota is exhausted. If path is set the cache is persisted there, so that
+// restarts do not geocode the locations again.
+type geocodeCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*geocodeEntry
+}
+
+func newGeocodeCache() *geocodeCache {
+	return &geocodeCache{entries: make(map[string]*geocodeEntry)}
+}
+
+// loadGeocodeCache loads the geocoding cache from path. If path is empty the
+// cache is only kept in memory. A missing file is not an error.
+func loadGeocodeCache(path string) (*geocodeCache, error) {
+	c := newGeocodeCache()
+	c.path = path
+	if path == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("failed to read geocoding cache file: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal geocoding cache file: %w", err)
+	}
+	return c, nil
+}
+
+// get returns the cached coordinates of a location, and when they were
+// geocoded.
+func (c *geocodeCache) get(name string) (*Location, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return e.location(), e.GeocodedAt, true
+}
+
+func (c *geocodeCache) set(name string, loc *Location) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[name] = &geocodeEntry{
+		Name:           loc.Name,
+		Lat:            loc.Lat,
+		Lng:            loc.Lng,
+		Accuracy:       loc.Accuracy,
+		PartialMatch:   loc.PartialMatch,
+		NativeProvider: loc.NativeProvider,
+		NativeID:       loc.NativeID,
+		GeocodedAt:     time.Now(),
+	}
+	return c.saveLocked()
+}
+
+// prune removes the cached coordinates of all the locations not in keep.
+func (c *geocodeCache) prune(keep map[string]bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var pruned bool
+	for name := range c.entries {
+		if !keep[name] {
+			delete(c.entries, name)
+			pruned = true
+		}
+	}
+	if !pruned {
+		return nil
+	}
+	return c.saveLocked()
+}
+
+// saveLocked writes the cache file atomically, if any. Must be called with
+// c.mu held.
+func (c *geocodeCache) saveLocked() error {
+	if c.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary geocoding cache file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write geocoding cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write geocoding cache file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("failed to replace geocoding cache file: %w", err)
+	}
+	return nil
+}
+
+// geocodeCacheTTL returns how long geocoding results are reused.
+func (c *Config) geocodeCacheTTL() time.Duration {
+	if c.GeocodeCacheTTL > 0 {
+		return time.Duration(c.GeocodeCacheTTL)
+	}
+	return defaultGeocodeCacheTTL
+}
+
+// resolveLocation returns the coordinates of a location name. Locations with
+// explicit coordinates in the configuration are never geocoded, the others
+// only if not cached or the cached result expired. If geocoding fails
+// but the location was resolved before, the cached coordinates are returned
+// and stale is set to true.
+func (wc *WeatherCollector) resolveLocation(ctx context.Context, name string) (loc *Location, stale bool, err error) {
+	ctx = withLogFields(ctx, "location", name)
+	if loc, ok := wc.explicitCoordinates(name); ok {
+		return loc, false, nil
+	}
+	if id := wc.cfg().providerID(name); id != "" {
+		return wc.locateNative(ctx, name, id)
+	}
+	cached, geocodedAt, ok := wc.geocodeCache.get(name)
+	// the quality requirements may have changed since the location was cached
+	if ok && time.Since(geocodedAt) < wc.cfg().geocodeCacheTTL() && checkGeocodeQuality(wc.cfg(), name, cached) == nil {
+		return cached, false, nil
+	}
+	loc, err = getLocation(ctx, wc.httpClient, wc.cfg(), name)
+	if err == nil {
+		if err := checkGeocodeQuality(wc.cfg(), name, loc); err != nil {
+			return nil, false, err
+		}
+		if err := wc.geocodeCache.set(name, loc); err != nil {
+			warnf(ctx, "Failed to save the geocoding cache: %v", err)
+		}
+		return loc, false, nil
+	}
+	if !ok {
+		return nil, false, err
+	}
+	warnf(ctx, "Geocoding failed for '%s', using cached coordinates: %v", name, err)
+	return cached, true, nil
+}
+
+// locateNative returns the coordinates of a location with a provider-native
+// ID, looked up by its provider if not cached, or if the cached result expired
+// or is for another ID. The geocoding quality requirements do not apply, as
+// the ID identifies the location unambiguously. If the lookup fails but the
+// location was resolved before, the cached coordinates are returned as stale.
+func (wc *WeatherCollector) locateNative(ctx context.Context, name, id string) (*Location, bool, error) {
+	p := wc.providersFor(name)[0]
+	cached, locatedAt, ok := wc.geocodeCache.get(name)
+	if ok && (cached.NativeProvider != p.Name() || cached.NativeID != id) {
+		ok = false
+	}
+	if ok && time.Since(locatedAt) < wc.cfg().geocodeCacheTTL() {
+		return cached, false, nil
+	}
+	// validated by validateLocationProviders
+	locator, _ := p.(nativeLocator)
+	if locator == nil {
+		return nil, false, fmt.Errorf("provider '%s' does not support provider_id", p.Name())
+	}
+	loc, err := locator.locate(ctx, id)
+	if err == nil {
+		loc.NativeProvider, loc.NativeID = p.Name(), id
+		if err := wc.geocodeCache.set(name, loc); err != nil {
+			warnf(ctx, "Failed to save the geocoding cache: %v", err)
+		}
+		return loc, false, nil
+	}
+	if !ok {
+		return nil, false, err
+	}
+	warnf(ctx, "Lookup of %s ID '%s' failed for '%s', using cached coordinates: %v", p.Name(), id, name, err)
+	return cached, true, nil
+}
+
+// geocodeConcurrency is the number of locations geocoded in parallel at
+// startup.
+const geocodeConcurrency = 8
+
+// Backoff of the background geocoding retries.
+const (
+	geocodeRetryMinInterval = time.Minute
+	geocodeRetryMaxInterval = 30 * time.Minute
+)
+
+// geocodeAll geocodes the given locations concurrently, logging the progress,
+// and returns the ones that could not be resolved, with the reason.
+func (wc *WeatherCollector) geocodeAll(ctx context.Context, names []string) map[string]error {
+	concurrency := geocodeConcurrency
+	if wc.cfg().LowMemory {
+		concurrency = lowMemoryConcurrency
+	}
+	// log the progress about every 10%
+	step := len(names) / 10
+	if step < 1 {
+		step = 1
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		done   int
+		failed = make(map[string]error)
+	)
+	sem := make(chan struct{}, concurrency)
+	start := time.Now()
+	for _, name := range names {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(name string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			_, _, err := wc.resolveLocation(ctx, name)
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			if err != nil {
+				failed[name] = err
+				errorf(withLogFields(ctx, "location", name), "Failed to geocode '%s': %v", name, err)
+			}
+			if done%step == 0 || done == len(names) {
+				logf(ctx, "Geocoded %d/%d locations (%d failed)", done, len(names), len(failed))
+			}
+		}(name)
+	}
+	wg.Wait()
+	logf(ctx, "Geocoding done in %s", time.Since(start).Round(time.Millisecond))
+	return failed
+}
+
+// retryGeocoding retries to geocode the given locations in the background,
+// with an exponential backoff, until they are resolved, removed from the
+// configuration, or ctx is done.
+func (wc *WeatherCollector) retryGeocoding(ctx context.Context, names []string) {
+	interval := geocodeRetryMinInterval
+	stats.Add(statGeocodeRetryQueue, int64(len(names)))
+	for len(names) > 0 {
+		select {
+		case <-ctx.Done():
+			stats.Add(statGeocodeRetryQueue, -int64(len(names)))
+			return
+		case <-time.After(interval):
+		}
+		current := make(map[string]bool)
+		for _, name := range wc.Locations() {
+			current[name] = true
+		}
+		var pending []string
+		for _, name := range names {
+			if !current[name] {
+				continue
+			}
+			if _, _, err := wc.resolveLocation(ctx, name); err != nil {
+				pending = append(pending, name)
+				continue
+			}
+			logf(withLogFields(ctx, "location", name), "Geocoded '%s' after retrying", name)
+		}
+		stats.Add(statGeocodeRetryQueue, int64(len(pending)-len(names)))
+		names = pending
+		interval *= 2
+		if interval > geocodeRetryMaxInterval {
+			interval = geocodeRetryMaxInterval
+		}
+	}
+}
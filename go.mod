@@ -4,6 +4,9 @@ go 1.16
 
 require (
 	github.com/insomniacslk/darksky v0.0.0-20220506080447-8215aef6b1d3
-	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_golang v1.14.0
+	github.com/prometheus/client_model v0.3.0
+	github.com/prometheus/common v0.37.0
+	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
 	googlemaps.github.io/maps v1.3.2
 )
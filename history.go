@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// historyResolution is the minimum time between two observations in the
+// history of a location. Observations fetched more often are not recorded, so
+// that the size of the history only depends on the longest delta window.
+const historyResolution = time.Minute
+
+// observation is a set of values recorded at a given time. The values are in
+// the same order as the delta_metrics configuration.
+type observation struct {
+	time   time.Time
+	values []float64
+}
+
+// history is a ring buffer of the most recent observations of a location.
+type history struct {
+	obs   []observation
+	start int
+	n     int
+}
+
+func newHistory(size int) *history {
+	return &history{obs: make([]observation, size)}
+}
+
+// get returns the i-th oldest observation.
+func (h *history) get(i int) *observation {
+	return &h.obs[(h.start+i)%len(h.obs)]
+}
+
+// add records an observation, overwriting the oldest one if the buffer is
+// full. Observations closer than historyResolution to the previous one are
+// ignored.
+func (h *history) add(o observation) {
+	if h.n > 0 && o.time.Sub(h.get(h.n-1).time) < historyResolution {
+		return
+	}
+	if h.n < len(h.obs) {
+		h.obs[(h.start+h.n)%len(h.obs)] = o
+		h.n++
+		return
+	}
+	h.obs[h.start] = o
+	h.start = (h.start + 1) % len(h.obs)
+}
+
+// valueAt returns the idx-th value at time t, linearly interpolating between
+// the two observations around t, so that gaps in the history (e.g. missed
+// fetches) do not skew the result. It returns false if the history does not
+// go back to t.
+func (h *history) valueAt(t time.Time, idx int) (float64, bool) {
+	if h.n == 0 || h.get(0).time.After(t) {
+		return 0, false
+	}
+	for i := h.n - 1; i >= 0; i-- {
+		before := h.get(i)
+		if before.time.After(t) {
+			continue
+		}
+		if i == h.n-1 || before.time.Equal(t) {
+			return before.values[idx], true
+		}
+		after := h.get(i + 1)
+		ratio := float64(t.Sub(before.time)) / float64(after.time.Sub(before.time))
+		return before.values[idx] + ratio*(after.values[idx]-before.values[idx]), true
+	}
+	return 0, false
+}
+
+// historyStore holds the history of every location.
+type historyStore struct {
+	size int
+
+	mu        sync.Mutex
+	histories map[string]*history
+}
+
+// newHistoryStore returns a store whose histories are long enough to cover
+// the longest of the given windows.
+func newHistoryStore(windows []Duration) *historyStore {
+	var longest time.Duration
+	for _, w := range windows {
+		if time.Duration(w) > longest {
+			longest = time.Duration(w)
+		}
+	}
+	// one more to always have an observation before the window start
+	size := int(longest/historyResolution) + 2
+	return &historyStore{size: size, histories: make(map[string]*history)}
+}
+
+func (s *historyStore) add(name string, o observation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.histories[name]
+	if !ok {
+		h = newHistory(s.size)
+		s.histories[name] = h
+	}
+	h.add(o)
+}
+
+// delta returns the change of the idx-th value between the time of the latest
+// observation and window earlier.
+func (s *historyStore) delta(name string, idx int, window time.Duration) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.histories[name]
+	if !ok || h.n == 0 {
+		return 0, false
+	}
+	latest := h.get(h.n - 1)
+	past, ok := h.valueAt(latest.time.Add(-window), idx)
+	if !ok {
+		return 0, false
+	}
+	return latest.values[idx] - past, true
+}
+
+// prune removes the histories of all the locations not in keep.
+func (s *historyStore) prune(keep map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.histories {
+		if !keep[name] {
+			delete(s.histories, name)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// getHourlyDescs returns the descriptors of the hourly forecast of the
+// configured metrics, by field name.
+func getHourlyDescs(metrics []string, lang, units string, constLabels prometheus.Labels) map[string]*prometheus.Desc {
+	descs := make(map[string]*prometheus.Desc)
+	for _, key := range metrics {
+		field, ok := lookupField(key)
+		if !ok {
+			continue
+		}
+		descs[key] = prometheus.NewDesc(
+			fmt.Sprintf("weather_hourly_%s", key),
+			fmt.Sprintf("Hourly forecast by hours ahead - %s", field.helpString(lang, fieldConversion(units, field).unit)),
+			withUnitLabel([]string{"location", "hours_ahead"}, units),
+			constLabels,
+		)
+	}
+	return descs
+}
+
+// hourlyMetricDescs returns the descriptors of the hourly forecast of the
+// configured metrics, by field name.
+func (wc *WeatherCollector) hourlyMetricDescs() map[string]*prometheus.Desc {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	return wc.hourlyDescs
+}
+
+// hourForecast is the forecast for an hour, relative to the current one.
+type hourForecast struct {
+	// HoursAhead is the number of hours from the start of the current hour.
+	HoursAhead int
+	DataPoint  *forecast.DataPoint
+}
+
+// hourlyForecast returns the hourly forecast for the current hour and the
+// following ones, up to hours in total. Like for the daily forecast, the
+// offsets are computed from the times of the data points, so that a cached
+// forecast does not report past hours as upcoming.
+func hourlyForecast(fc *forecast.Forecast, now time.Time, hours int) []hourForecast {
+	start := now.Truncate(time.Hour)
+	var result []hourForecast
+	for idx := range fc.Hourly.Data {
+		dp := &fc.Hourly.Data[idx]
+		d := time.Unix(dp.Time, 0).Sub(start)
+		if d < 0 {
+			continue
+		}
+		ahead := int(d / time.Hour)
+		if ahead >= hours {
+			break
+		}
+		result = append(result, hourForecast{HoursAhead: ahead, DataPoint: dp})
+	}
+	return result
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KNXConfig configures the publishing of weather values to KNX group
+// addresses through a KNXnet/IP tunneling server, e.g. knxd or an IP
+// interface.
+type KNXConfig struct {
+	// Gateway is the UDP address of the tunneling server, e.g.
+	// 192.168.1.10:3671.
+	Gateway string `json:"gateway"`
+	// Interval is how often the values are published.
+	Interval Duration          `json:"interval"`
+	Publish  []*KNXPublication `json:"publish"`
+}
+
+// KNXPublication publishes a metric of a location to a group address.
+type KNXPublication struct {
+	Location string `json:"location"`
+	Metric   string `json:"metric"`
+	// GroupAddress is a three-level (e.g. 1/2/3) or two-level (e.g. 1/515)
+	// group address.
+	GroupAddress string `json:"group_address"`
+}
+
+const (
+	// defaultKNXInterval is how often the values are published, if not
+	// configured.
+	defaultKNXInterval = time.Minute
+	// defaultKNXPort is the standard KNXnet/IP port, used if the gateway
+	// has none.
+	defaultKNXPort = "3671"
+	// knxConnectTimeout and knxRequestTimeout are the timeouts of the
+	// connection and of the other requests, as per the KNXnet/IP
+	// specification.
+	knxConnectTimeout = 10 * time.Second
+	knxRequestTimeout = time.Second
+)
+
+// KNXnet/IP service types.
+const (
+	knxConnectRequest    = 0x0205
+	knxConnectResponse   = 0x0206
+	knxDisconnectRequest = 0x0209
+	knxDisconnectResp    = 0x020a
+	knxTunnelingRequest  = 0x0420
+	knxTunnelingAck      = 0x0421
+)
+
+// parseKNXGroupAddress parses a three-level or two-level group address.
+func parseKNXGroupAddress(s string) (uint16, error) {
+	parts := strings.Split(s, "/")
+	limits := map[int][]int{
+		2: {31, 2047},
+		3: {31, 7, 255},
+	}[len(parts)]
+	if limits == nil {
+		return 0, fmt.Errorf("invalid group address '%s'", s)
+	}
+	var addr uint16
+	for idx, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > limits[idx] {
+			return 0, fmt.Errorf("invalid group address '%s'", s)
+		}
+		switch {
+		case idx == 0:
+			addr = uint16(n) << 11
+		case idx == 1 && len(parts) == 3:
+			addr |= uint16(n) << 8
+		default:
+			addr |= uint16(n)
+		}
+	}
+	if addr == 0 {
+		return 0, fmt.Errorf("invalid group address '%s'", s)
+	}
+	return addr, nil
+}
+
+// validateKNX checks the KNX configuration.
+func validateKNX(config *KNXConfig) error {
+	if config.Gateway == "" {
+		return fmt.Errorf("no gateway configured")
+	}
+	if len(config.Publish) == 0 {
+		return fmt.Errorf("nothing to publish")
+	}
+	for idx, p := range config.Publish {
+		if p.Location == "" {
+			return fmt.Errorf("publication %d has no location", idx)
+		}
+		if _, ok := lookupField(p.Metric); !ok {
+			return fmt.Errorf("publication %d: unknown metric '%s'", idx, p.Metric)
+		}
+		if _, err := parseKNXGroupAddress(p.GroupAddress); err != nil {
+			return fmt.Errorf("publication %d: %w", idx, err)
+		}
+	}
+	return nil
+}
+
+// knxValue returns the value of a field in the unit of the matching KNX
+// datapoint type: ratios are sent in percent (DPT 9.007) and the pressure in
+// pascals (DPT 9.006), the other fields in their own unit.
+func knxValue(f *Field, v float64) float64 {
+	switch f.Unit {
+	case "ratio", "hectopascals":
+		return v * 100
+	}
+	return v
+}
+
+// knxFloat16 encodes a value as a KNX 2-byte float (DPT 9). Values that
+// cannot be encoded are sent as invalid data.
+func knxFloat16(v float64) [2]byte {
+	m := math.Round(v * 100)
+	e := 0
+	for (m < -2048 || m > 2047) && e < 15 {
+		e++
+		m = math.Round(v * 100 / float64(int(1)<<e))
+	}
+	raw := uint16(0x7fff)
+	if m >= -2048 && m <= 2047 {
+		mant := int(m)
+		raw = uint16(mant)&0x07ff | uint16(e)<<11
+		if mant < 0 {
+			raw |= 0x8000
+		}
+	}
+	return [2]byte{byte(raw >> 8), byte(raw)}
+}
+
+// knxFrame returns a KNXnet/IP frame with the given service type and body.
+func knxFrame(service uint16, body ...[]byte) []byte {
+	frame := []byte{0x06, 0x10, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(frame[2:4], service)
+	for _, b := range body {
+		frame = append(frame, b...)
+	}
+	binary.BigEndian.PutUint16(frame[4:6], uint16(len(frame)))
+	return frame
+}
+
+// knxHPAI returns the UDP host protocol address information of a local
+// address. Addresses that are not IPv4 are sent unspecified, which asks the
+// server to reply to the address the request comes from.
+func knxHPAI(addr net.Addr) []byte {
+	hpai := []byte{0x08, 0x01, 0, 0, 0, 0, 0, 0}
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		if ip := udp.IP.To4(); ip != nil {
+			copy(hpai[2:6], ip)
+			binary.BigEndian.PutUint16(hpai[6:8], uint16(udp.Port))
+		}
+	}
+	return hpai
+}
+
+// knxTunnel is a tunneling connection to a KNXnet/IP server.
+type knxTunnel struct {
+	conn    net.Conn
+	channel byte
+	seq     byte
+}
+
+// dialKNXTunnel opens a link layer tunneling connection to a KNXnet/IP
+// server.
+func dialKNXTunnel(ctx context.Context, gateway string) (*knxTunnel, error) {
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, defaultKNXPort)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", gateway)
+	if err != nil {
+		return nil, err
+	}
+	t := knxTunnel{conn: conn}
+	hpai := knxHPAI(conn.LocalAddr())
+	// tunnel connection, link layer
+	cri := []byte{0x04, 0x04, 0x02, 0x00}
+	if _, err := conn.Write(knxFrame(knxConnectRequest, hpai, hpai, cri)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	deadline := time.Now().Add(knxConnectTimeout)
+	for {
+		service, body, err := t.receive(deadline)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("no connection response: %w", err)
+		}
+		if service != knxConnectResponse || len(body) < 2 {
+			continue
+		}
+		if body[1] != 0 {
+			conn.Close()
+			return nil, fmt.Errorf("connection refused with status 0x%02x", body[1])
+		}
+		t.channel = body[0]
+		return &t, nil
+	}
+}
+
+// receive returns the service type and the body of the next frame.
+func (t *knxTunnel) receive(deadline time.Time) (uint16, []byte, error) {
+	if err := t.conn.SetReadDeadline(deadline); err != nil {
+		return 0, nil, err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := t.conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < 6 || buf[0] != 0x06 || buf[1] != 0x10 || int(binary.BigEndian.Uint16(buf[4:6])) != n {
+			continue
+		}
+		return binary.BigEndian.Uint16(buf[2:4]), buf[6:n], nil
+	}
+}
+
+// write sends a GroupValueWrite with a 2-byte value to a group address, and
+// waits for the server to acknowledge it, repeating it once as per the
+// specification.
+func (t *knxTunnel) write(group uint16, value [2]byte) error {
+	// L_Data.req, standard frame with low priority to a group address, with
+	// the source address filled by the server
+	cemi := []byte{
+		0x11, 0x00, 0xbc, 0xe0, 0x00, 0x00, byte(group >> 8), byte(group),
+		0x03, 0x00, 0x80, value[0], value[1],
+	}
+	seq := t.seq
+	t.seq++
+	frame := knxFrame(knxTunnelingRequest, []byte{0x04, t.channel, seq, 0x00}, cemi)
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err := t.conn.Write(frame); err != nil {
+			return err
+		}
+		acked, err := t.waitAck(seq)
+		if err != nil {
+			return err
+		}
+		if acked {
+			return nil
+		}
+	}
+	return errors.New("tunneling request not acknowledged")
+}
+
+// waitAck waits for the acknowledgement of a tunneling request, and
+// acknowledges the frames sent by the server meanwhile, like the
+// confirmations of the writes. It returns false on timeout.
+func (t *knxTunnel) waitAck(seq byte) (bool, error) {
+	deadline := time.Now().Add(knxRequestTimeout)
+	for {
+		service, body, err := t.receive(deadline)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if len(body) < 4 || body[0] != 0x04 || body[1] != t.channel {
+			continue
+		}
+		switch service {
+		case knxTunnelingAck:
+			if body[2] != seq {
+				continue
+			}
+			if body[3] != 0 {
+				return false, fmt.Errorf("tunneling request rejected with status 0x%02x", body[3])
+			}
+			return true, nil
+		case knxTunnelingRequest:
+			ack := knxFrame(knxTunnelingAck, []byte{0x04, t.channel, body[2], 0x00})
+			if _, err := t.conn.Write(ack); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// close disconnects from the server, without waiting for long for its
+// response, and closes the socket.
+func (t *knxTunnel) close() {
+	defer t.conn.Close()
+	req := knxFrame(knxDisconnectRequest, []byte{t.channel, 0x00}, knxHPAI(t.conn.LocalAddr()))
+	if _, err := t.conn.Write(req); err != nil {
+		return
+	}
+	deadline := time.Now().Add(knxRequestTimeout)
+	for {
+		service, _, err := t.receive(deadline)
+		if err != nil || service == knxDisconnectResp {
+			return
+		}
+	}
+}
+
+// knxPublisher periodically publishes the configured weather values to KNX
+// group addresses. Like the dashboard, it uses the data fetched by the last
+// scrape or poll and never calls the APIs.
+type knxPublisher struct {
+	config *KNXConfig
+	wc     *WeatherCollector
+}
+
+func newKNXPublisher(config *KNXConfig, wc *WeatherCollector) *knxPublisher {
+	return &knxPublisher{config: config, wc: wc}
+}
+
+// publish connects to the gateway, writes the values of the locations whose
+// weather is available, and disconnects. Connecting at every interval frees
+// the tunneling connection, which servers have few of, between publications,
+// and needs no heartbeat.
+func (p *knxPublisher) publish(ctx context.Context) (int, error) {
+	snapshot := make(map[string]*LocationWeather)
+	for _, lw := range p.wc.Snapshot() {
+		if !p.wc.isFailing(lw.Name) {
+			snapshot[lw.Name] = lw
+		}
+	}
+	var (
+		groups []uint16
+		values [][2]byte
+	)
+	for _, pub := range p.config.Publish {
+		lw, ok := snapshot[pub.Location]
+		if !ok {
+			continue
+		}
+		field, _ := lookupField(pub.Metric)
+		group, _ := parseKNXGroupAddress(pub.GroupAddress)
+		groups = append(groups, group)
+		values = append(values, knxFloat16(knxValue(field, field.Value(&lw.Weather.Forecast.Currently))))
+	}
+	if len(groups) == 0 {
+		return 0, nil
+	}
+	t, err := dialKNXTunnel(ctx, p.config.Gateway)
+	if err != nil {
+		return 0, err
+	}
+	defer t.close()
+	for idx, group := range groups {
+		if err := t.write(group, values[idx]); err != nil {
+			return idx, err
+		}
+	}
+	return len(groups), nil
+}
+
+// run publishes the values at every interval until ctx is done.
+func (p *knxPublisher) run(ctx context.Context) {
+	interval := time.Duration(p.config.Interval)
+	if interval <= 0 {
+		interval = defaultKNXInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := p.publish(ctx); err != nil {
+				warnf(ctx, "Failed to publish to KNX through %s: %v", p.config.Gateway, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/prometheus/common/model"
+)
+
+// reservedLabels are the variable labels used by the exported metrics,
+// including the exporter metrics and the Go and process collectors, which
+// cannot be used as constant labels.
+var reservedLabels = map[string]bool{
+	"location":        true,
+	"latitude":        true,
+	"longitude":       true,
+	"location_type":   true,
+	"source":          true,
+	"station":         true,
+	"window":          true,
+	"direction":       true,
+	"speed":           true,
+	"week":            true,
+	"day_offset":      true,
+	"hours_ahead":     true,
+	"unit":            true,
+	"group":           true,
+	"aggregation":     true,
+	"route":           true,
+	"waypoint":        true,
+	"airport":         true,
+	"gauge":           true,
+	"depth":           true,
+	"severity":        true,
+	"event":           true,
+	"provider":        true,
+	"endpoint":        true,
+	"response_sha256": true,
+	"region":          true,
+	"elevation":       true,
+	"aspect":          true,
+	"status":          true,
+	"reason":          true,
+	"key":             true,
+	"result":          true,
+	"code":            true,
+	"version":         true,
+	"quantile":        true,
+	"le":              true,
+}
+
+// validateConstLabels checks that the configured constant labels are valid
+// Prometheus label names, and that they do not clash with the labels of the
+// exported metrics.
+func validateConstLabels(labels map[string]string) error {
+	for name := range labels {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid label name '%s'", name)
+		}
+		if reservedLabels[name] {
+			return fmt.Errorf("label '%s' is reserved", name)
+		}
+	}
+	return nil
+}
+
+// exporterInstanceLabel is the name of the label identifying the exporter
+// instance, see addExporterInstanceLabel.
+const exporterInstanceLabel = "exporter_instance"
+
+// addExporterInstanceLabel adds the exporter instance label to the constant
+// labels, if configured. The value is either the configured string or the
+// host name. This label survives federation and remote write, where the
+// instance label is usually rewritten.
+func addExporterInstanceLabel(config *Config) error {
+	instance := config.ExporterInstance
+	if config.ExporterInstanceFromHostname {
+		if instance != "" {
+			return fmt.Errorf("exporter_instance and exporter_instance_from_hostname are mutually exclusive")
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to get host name: %w", err)
+		}
+		instance = hostname
+	}
+	if instance == "" {
+		return nil
+	}
+	if _, ok := config.ConstLabels[exporterInstanceLabel]; ok {
+		return fmt.Errorf("label '%s' is already set in const_labels", exporterInstanceLabel)
+	}
+	if config.ConstLabels == nil {
+		config.ConstLabels = make(map[string]string)
+	}
+	config.ConstLabels[exporterInstanceLabel] = instance
+	return nil
+}
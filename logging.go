@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log line.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel returns the level with the given name, e.g. "warn".
+func parseLogLevel(s string) (logLevel, error) {
+	for idx, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(idx), nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unsupported log level '%s', must be one of %s", s, strings.Join(logLevelNames, ", "))
+}
+
+type logFieldsKey struct{}
+
+// logField is a key/value pair added to the log lines, e.g. the location or
+// the provider a line is about.
+type logField struct {
+	key, value string
+}
+
+// withLogFields returns a copy of ctx whose log lines carry the given
+// key/value pairs, in addition to the ones carried by ctx. A key that is
+// already carried by ctx gets the new value.
+func withLogFields(ctx context.Context, kv ...string) context.Context {
+	old := logFields(ctx)
+	fields := make([]logField, 0, len(old)+len(kv)/2)
+	for _, f := range old {
+		replaced := false
+		for i := 0; i+1 < len(kv); i += 2 {
+			replaced = replaced || kv[i] == f.key
+		}
+		if !replaced {
+			fields = append(fields, f)
+		}
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		fields = append(fields, logField{key: kv[i], value: kv[i+1]})
+	}
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+// logFields returns the key/value pairs carried by ctx, if any.
+func logFields(ctx context.Context) []logField {
+	fields, _ := ctx.Value(logFieldsKey{}).([]logField)
+	return fields
+}
+
+// logger writes the log lines at or above its level, either as plain text or
+// as JSON objects, one per line.
+type logger struct {
+	level logLevel
+	json  bool
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// defaultLogger is used by logf and the other leveled functions. It is set up
+// by setupLogging.
+var defaultLogger = &logger{level: levelInfo, out: os.Stderr}
+
+// setupLogging configures the default logger with the given level and format,
+// either "text" or "json". The lines written directly with the log package,
+// e.g. by log.Fatalf, are logged as errors.
+func setupLogging(level, format string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("unsupported log format '%s', must be text or json", format)
+	}
+	defaultLogger.level = l
+	defaultLogger.json = format == "json"
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{defaultLogger})
+	return nil
+}
+
+// enabled returns whether lines of the given level are logged.
+func (l *logger) enabled(level logLevel) bool {
+	return level >= l.level
+}
+
+// write logs a message, with the correlation ID and the key/value pairs
+// carried by ctx, if any. In the text format the pairs follow the message as
+// key=value.
+func (l *logger) write(ctx context.Context, level logLevel, msg string) {
+	if !l.enabled(level) {
+		return
+	}
+	now := time.Now()
+	id, hasID := correlationID(ctx)
+	fields := logFields(ctx)
+	var data []byte
+	if l.json {
+		data = l.jsonLine(now, level, msg, id, fields)
+	} else {
+		// the same timestamp format as the log package
+		line := now.Format("2006/01/02 15:04:05") + " " + strings.ToUpper(level.String())
+		if hasID {
+			line += " [" + id + "]"
+		}
+		line += " " + msg
+		for _, f := range fields {
+			value := f.value
+			if value == "" || strings.ContainsAny(value, " =\"") {
+				value = strconv.Quote(value)
+			}
+			line += " " + f.key + "=" + value
+		}
+		data = []byte(line)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(append(data, '\n'))
+}
+
+// jsonLine returns a log line as a JSON object. The key/value pairs are
+// members of the object, after the standard ones.
+func (l *logger) jsonLine(t time.Time, level logLevel, msg, id string, fields []logField) []byte {
+	line := struct {
+		Time          string `json:"time"`
+		Level         string `json:"level"`
+		Message       string `json:"msg"`
+		CorrelationID string `json:"correlation_id,omitempty"`
+	}{
+		Time:          t.Format(time.RFC3339Nano),
+		Level:         level.String(),
+		Message:       msg,
+		CorrelationID: id,
+	}
+	// marshaling strings cannot fail
+	data, _ := json.Marshal(line)
+	if len(fields) == 0 {
+		return data
+	}
+	buf := bytes.NewBuffer(data[:len(data)-1])
+	for _, f := range fields {
+		key, _ := json.Marshal(f.key)
+		value, _ := json.Marshal(f.value)
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// stdLogWriter logs the lines written by the log package as errors.
+type stdLogWriter struct {
+	l *logger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.l.write(context.Background(), levelError, string(bytes.TrimRight(p, "\n")))
+	return len(p), nil
+}
+
+// debugf logs a debug message, with the correlation ID carried by ctx, if any.
+func debugf(ctx context.Context, format string, v ...interface{}) {
+	defaultLogger.write(ctx, levelDebug, fmt.Sprintf(format, v...))
+}
+
+// logf logs an informational message, with the correlation ID carried by ctx,
+// if any.
+func logf(ctx context.Context, format string, v ...interface{}) {
+	defaultLogger.write(ctx, levelInfo, fmt.Sprintf(format, v...))
+}
+
+// warnf logs a warning, with the correlation ID carried by ctx, if any.
+func warnf(ctx context.Context, format string, v ...interface{}) {
+	defaultLogger.write(ctx, levelWarn, fmt.Sprintf(format, v...))
+}
+
+// errorf logs an error, with the correlation ID carried by ctx, if any.
+func errorf(ctx context.Context, format string, v ...interface{}) {
+	defaultLogger.write(ctx, levelError, fmt.Sprintf(format, v...))
+}
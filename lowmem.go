@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// Settings applied when the low-memory mode is enabled. They are tuned for
+// single-core boards with 512MB of RAM or less, like the Raspberry Pi Zero.
+const (
+	lowMemoryGCPercent    = 50
+	lowMemoryMaxIdleConns = 2
+	lowMemoryDNSCacheSize = 16
+	// lowMemoryConcurrency is the number of parallel API requests
+	lowMemoryConcurrency = 1
+	// lowMemoryRoutePoints is the maximum number of provider points whose
+	// weather is cached for the routes and the route plans
+	lowMemoryRoutePoints = 64
+)
+
+// setupLowMemory configures the Go runtime for the low-memory mode.
+func setupLowMemory() {
+	old := debug.SetGCPercent(lowMemoryGCPercent)
+	logf(context.Background(), "Low-memory mode enabled, GC percent set to %d (was %d)", lowMemoryGCPercent, old)
+	debug.FreeOSMemory()
+}
+
+// trimmed returns a copy of a weather fetched at time now without the parts
+// of the forecast that are never exported: the minutely forecast, and the
+// hourly data points that are either past or beyond the given number of
+// hours. The weather is not modified, as some providers cache it.
+func trimmed(w *Weather, now time.Time, hours int) *Weather {
+	c := *w
+	fc := *w.Forecast
+	fc.Minutely.Data = nil
+	hourly := hourlyForecast(w.Forecast, now, hours)
+	fc.Hourly.Data = make([]forecast.DataPoint, len(hourly))
+	for idx, h := range hourly {
+		fc.Hourly.Data[idx] = *h.DataPoint
+	}
+	c.Forecast = &fc
+	return &c
+}
+
+// currentOnly returns a copy of a weather with only the current conditions,
+// for the caches that do not use the forecast.
+func currentOnly(w *Weather) *Weather {
+	c := *w
+	c.Forecast = &forecast.Forecast{
+		Latitude:  w.Forecast.Latitude,
+		Longitude: w.Forecast.Longitude,
+		Timezone:  w.Forecast.Timezone,
+		Offset:    w.Forecast.Offset,
+		Currently: w.Forecast.Currently,
+		Flags:     w.Forecast.Flags,
+	}
+	return &c
+}
@@ -3,31 +3,342 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	forecast "github.com/insomniacslk/darksky/v2"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"googlemaps.github.io/maps"
 )
 
 var (
-	flagPath       = flag.String("p", "/metrics", "HTTP path where to expose metrics to")
-	flagListen     = flag.String("l", ":9102", "Address to listen to")
-	flagConfigFile = flag.String("c", "config.json", "Configuration file")
+	flagPath            = flag.String("p", "/metrics", "HTTP path where to expose metrics to")
+	flagListen          = flag.String("l", ":9102", "Address to listen to")
+	flagConfigFile      = flag.String("c", "config.json", "Configuration file")
+	flagExporterPath    = flag.String("exporter-path", "/metrics/exporter", "HTTP path where to expose the exporter's own metrics to")
+	flagNoExporterStats = flag.Bool("disable-exporter-metrics", false, "Do not include the exporter's own metrics in the weather metrics endpoint")
+	flagAdminAPI        = flag.Bool("web.enable-admin-api", false, "Enable the admin API endpoints that change the locations or fetch the weather on demand")
+	flagLifecycle       = flag.Bool("web.enable-lifecycle", false, "Enable reloading the configuration via HTTP")
+	flagMaxRequests     = flag.Int("web.max-requests", 40, "Maximum number of parallel scrape requests, 0 means no limit")
+	flagNativeHist      = flag.Bool("native-histograms", false, "Export latency histograms as native histograms (requires Prometheus with native histograms enabled)")
+	flagRecordDir       = flag.String("record-dir", "", "Archive the raw API responses to this directory")
+	flagReplayDir       = flag.String("replay-dir", "", "Serve the API responses archived with -record-dir from this directory, without network access")
+	flagChaosLatency    = flag.Duration("chaos.latency", 0, "Developer option: add this latency to every API request")
+	flagChaosErrors     = flag.Float64("chaos.error-rate", 0, "Developer option: fail this fraction of the API requests, between 0 and 1")
+	flagChaosMalformed  = flag.Float64("chaos.malformed-rate", 0, "Developer option: truncate this fraction of the API responses, between 0 and 1")
+	flagConfigSchema    = flag.Bool("config.schema", false, "Print the JSON Schema of the configuration file and exit")
+	flagScrapeInterval  = flag.Duration("scrape-interval", time.Minute, "Scrape interval used to estimate the API usage")
+	flagFieldsDoc       = flag.Bool("fields-doc", false, "Print the documentation of the supported metrics in Markdown format and exit")
+	flagSNMPMIB         = flag.Bool("snmp-mib", false, "Print the MIB of the SNMP agent and exit")
+	flagModbusMap       = flag.Bool("modbus-map", false, "Print the Modbus register map of a location in Markdown format and exit")
+	flagStrictLocations = flag.Bool("strict-locations", false, "Refuse to start if any location cannot be geocoded or its weather fetched")
+	flagLogLevel        = flag.String("log.level", "info", "Only log messages with the given severity or above: debug, info, warn or error")
+	flagLogFormat       = flag.String("log.format", "text", "Output format of the log messages: text or json")
+	flagLogPayloads     = flag.Bool("log.payloads", false, "Log the API responses, with the API keys redacted, at debug level")
 )
 
 // Config is the configuration file type.
 type Config struct {
-	Locations        []string `json:"locations"`
-	Metrics          []string `json:"metrics"`
-	GoogleMapsAPIKey string   `json:"google_maps_api_key"`
-	DarkskyAPIKey    string   `json:"darksky_api_key"`
+	Locations        LocationList `json:"locations"`
+	Metrics          []string     `json:"metrics"`
+	GoogleMapsAPIKey string       `json:"google_maps_api_key"`
+	DarkskyAPIKey    string       `json:"darksky_api_key"`
+
+	GoogleMapsAPIKeyFile     string `json:"google_maps_api_key_file"`
+	DarkskyAPIKeyFile        string `json:"darksky_api_key_file"`
+	OpenWeatherMapAPIKeyFile string `json:"openweathermap_api_key_file"`
+	PirateWeatherAPIKeyFile  string `json:"pirateweather_api_key_file"`
+	TomorrowIOAPIKeyFile     string `json:"tomorrowio_api_key_file"`
+	AccuWeatherAPIKeyFile    string `json:"accuweather_api_key_file"`
+	VisualCrossingAPIKeyFile string `json:"visualcrossing_api_key_file"`
+
+	Geocoder     string `json:"geocoder"`
+	NominatimURL string `json:"nominatim_url"`
+
+	Provider             string `json:"provider"`
+	OpenWeatherMapAPIKey string `json:"openweathermap_api_key"`
+	PirateWeatherAPIKey  string `json:"pirateweather_api_key"`
+	TomorrowIOAPIKey     string `json:"tomorrowio_api_key"`
+	AccuWeatherAPIKey    string `json:"accuweather_api_key"`
+	VisualCrossingAPIKey string `json:"visualcrossing_api_key"`
+	// PirateWeatherURL is the base URL of the Pirate Weather API, e.g. of a
+	// self-hosted instance.
+	PirateWeatherURL string `json:"pirateweather_url"`
+	// FailoverTimeout is the time allowed to each provider of the failover
+	// chain of a location before trying the next one.
+	FailoverTimeout Duration `json:"failover_timeout"`
+
+	DNSCacheTTL Duration          `json:"dns_cache_ttl"`
+	StaticHosts map[string]string `json:"static_hosts"`
+
+	LowMemory bool `json:"low_memory"`
+
+	MinGeocodeAccuracy   string `json:"min_geocode_accuracy"`
+	RejectPartialMatches bool   `json:"reject_partial_matches"`
+
+	HelpLanguage string `json:"help_language"`
+	Units        string `json:"units"`
+	// Precision is the number of decimals the values of a metric are
+	// rounded to, by metric. Values are not rounded by default.
+	Precision map[string]int `json:"precision"`
+	// Smoothing configures the smoothing of the noisy metrics, by metric.
+	Smoothing map[string]*SmoothingConfig `json:"smoothing"`
+
+	Rollups *RollupsConfig `json:"rollups"`
+
+	// Routes are custom routes or grids whose conditions are interpolated
+	// from the nearest provider points.
+	Routes []*RouteConfig `json:"routes"`
+	// Consensus also fetches every location from several providers, to
+	// compare them.
+	Consensus *ConsensusConfig `json:"consensus"`
+	// RiverGauges are the hydrological gauges whose river level is exported.
+	RiverGauges []*RiverGaugeConfig `json:"river_gauges"`
+	// AvalancheRegions are the regions whose avalanche danger is exported.
+	AvalancheRegions []*AvalancheRegionConfig `json:"avalanche_regions"`
+
+	ConstLabels map[string]string `json:"const_labels"`
+
+	ExporterInstance             string `json:"exporter_instance"`
+	ExporterInstanceFromHostname bool   `json:"exporter_instance_from_hostname"`
+
+	Canary *CanaryConfig `json:"canary"`
+
+	QuietHours *QuietHours `json:"quiet_hours"`
+
+	DeltaMetrics []string   `json:"delta_metrics"`
+	DeltaWindows []Duration `json:"delta_windows"`
+
+	GeocodeCacheFile string   `json:"geocode_cache_file"`
+	GeocodeCacheTTL  Duration `json:"geocode_cache_ttl"`
+
+	StateFile          string `json:"state_file"`
+	PrecipitationTotal bool   `json:"precipitation_total"`
+	SunshineDuration   bool   `json:"sunshine_duration"`
+	UVDose             bool   `json:"uv_dose"`
+
+	WindRose bool `json:"wind_rose"`
+
+	ConditionCode bool `json:"condition_code"`
+
+	Provenance bool `json:"provenance"`
+
+	ClimateNormals bool `json:"climate_normals"`
+
+	Soil bool `json:"soil"`
+
+	// Airports maps location names to the FAA identifier of their airport,
+	// e.g. "EWR", to export the airport delays.
+	Airports map[string]string `json:"airports"`
+
+	OutlookWeeks int `json:"outlook_weeks"`
+
+	ForecastDays  int `json:"forecast_days"`
+	ForecastHours int `json:"forecast_hours"`
+
+	APIPricing map[string]float64 `json:"api_pricing"`
+
+	RenderTemplate    string `json:"render_template"`
+	RenderContentType string `json:"render_content_type"`
+
+	// Probe enables the multi-target endpoint, which fetches the weather of
+	// any location given in the scrape configuration.
+	Probe bool `json:"probe"`
+	// RouteAPI enables the route planning API, which fetches the weather
+	// along any route given in the request.
+	RouteAPI bool `json:"route_api"`
+
+	Consul *ConsulConfig `json:"consul"`
+
+	Alertmanager *AlertmanagerConfig `json:"alertmanager"`
+
+	Notifications *NotificationsConfig `json:"notifications"`
+	MDNS          *MDNSConfig          `json:"mdns"`
+	SNMP          *SNMPConfig          `json:"snmp"`
+	Modbus        *ModbusConfig        `json:"modbus"`
+	BACnet        *BACnetConfig        `json:"bacnet"`
+	KNX           *KNXConfig           `json:"knx"`
+
+	AdaptiveRefresh  *AdaptiveRefreshConfig     `json:"adaptive_refresh"`
+	RefreshSchedules map[string]RefreshSchedule `json:"refresh_schedules"`
+
+	DisabledLocations []string `json:"disabled_locations"`
+
+	CacheTTL Duration `json:"cache_ttl"`
+
+	RefreshInterval    Duration `json:"refresh_interval"`
+	RefreshConcurrency int      `json:"refresh_concurrency"`
+
+	Tenants      map[string]*TenantConfig `json:"tenants"`
+	TenantTokens map[string][]string      `json:"tenant_tokens"`
+}
+
+// enabledLocations returns the configured locations that are not disabled.
+func (c *Config) enabledLocations() []string {
+	disabled := make(map[string]bool, len(c.DisabledLocations))
+	for _, name := range c.DisabledLocations {
+		disabled[name] = true
+	}
+	var locations []string
+	for _, name := range c.Locations.Names() {
+		if !disabled[name] {
+			locations = append(locations, name)
+		}
+	}
+	return locations
+}
+
+// LocationConfig is a location in the configuration file, either a name to
+// geocode, e.g. "Dublin, Ireland", or an object with a name and explicit
+// coordinates, e.g. {"name": "Home", "lat": 52.1, "lng": 4.3}, which is never
+// geocoded. The object form can also set the provider of the location, or a
+// failover chain of providers, and its API key.
+type LocationConfig struct {
+	Name     string   `json:"name"`
+	Lat      *float64 `json:"lat"`
+	Lng      *float64 `json:"lng"`
+	Provider string   `json:"provider"`
+	// Providers are the providers of the location in priority order, each
+	// one tried when the previous one fails.
+	Providers []string `json:"providers"`
+	APIKey    string   `json:"api_key"`
+	// ProviderID is the provider-native ID of the location, e.g. an
+	// OpenWeatherMap city ID or an AccuWeather location key. The location is
+	// then looked up by its provider rather than geocoded.
+	ProviderID string `json:"provider_id"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler for LocationConfig.
+func (l *LocationConfig) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &l.Name); err == nil {
+		l.Lat, l.Lng = nil, nil
+		return nil
+	}
+	// avoid recursing into this method
+	type locationConfig LocationConfig
+	var v locationConfig
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("location must be a string or an object with a name: %w", err)
+	}
+	if v.Name == "" {
+		return fmt.Errorf("location has no name")
+	}
+	if (v.Lat == nil) != (v.Lng == nil) {
+		return fmt.Errorf("location '%s' must have both lat and lng", v.Name)
+	}
+	if v.Lat != nil && v.ProviderID != "" {
+		return fmt.Errorf("location '%s' cannot have both coordinates and a provider_id", v.Name)
+	}
+	if v.Lat != nil && (*v.Lat < -90 || *v.Lat > 90 || *v.Lng < -180 || *v.Lng > 180) {
+		return fmt.Errorf("location '%s' has invalid coordinates %f, %f", v.Name, *v.Lat, *v.Lng)
+	}
+	*l = LocationConfig(v)
+	return nil
+}
+
+// location returns the explicit coordinates of the location, or nil if the
+// location has to be geocoded.
+func (l *LocationConfig) location() *Location {
+	if l.Lat == nil || l.Lng == nil {
+		return nil
+	}
+	return &Location{Name: l.Name, Lat: *l.Lat, Lng: *l.Lng}
+}
+
+// LocationList is the list of the configured locations.
+type LocationList []LocationConfig
+
+// Names returns the names of the locations.
+func (l LocationList) Names() []string {
+	names := make([]string, 0, len(l))
+	for _, loc := range l {
+		names = append(names, loc.Name)
+	}
+	return names
+}
+
+// coordinates returns the explicit coordinates of a configured location, if
+// any.
+func (c *Config) coordinates(name string) (*Location, bool) {
+	for idx := range c.Locations {
+		if c.Locations[idx].Name == name {
+			loc := c.Locations[idx].location()
+			return loc, loc != nil
+		}
+	}
+	return nil, false
+}
+
+// providerID returns the provider-native ID of a configured location, if
+// any.
+func (c *Config) providerID(name string) string {
+	for idx := range c.Locations {
+		if c.Locations[idx].Name == name {
+			return c.Locations[idx].ProviderID
+		}
+	}
+	return ""
+}
+
+// geocodedLocations returns the enabled locations without explicit
+// coordinates or provider-native ID, which have to be geocoded.
+func (c *Config) geocodedLocations() []string {
+	var names []string
+	for _, name := range c.enabledLocations() {
+		if _, ok := c.coordinates(name); !ok && c.providerID(name) == "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Duration is a time.Duration that is expressed as a string like "5m" or
+// "1h30m" in the configuration file.
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler for Duration.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// String returns the duration in a compact form, e.g. "1h" rather than
+// "1h0m0s".
+func (d Duration) String() string {
+	s := time.Duration(d).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
 }
 
 // LoadConfig loads the configuration file into a Config type.
@@ -40,6 +351,9 @@ func LoadConfig(filepath string) (*Config, error) {
 	if err := json.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal JSON config: %w", err)
 	}
+	if err := config.resolveAPIKeys(); err != nil {
+		return nil, err
+	}
 	return &config, nil
 }
 
@@ -47,6 +361,13 @@ func LoadConfig(filepath string) (*Config, error) {
 type Location struct {
 	Name     string
 	Lat, Lng float64
+	// Accuracy is the geocoder location type, e.g. ROOFTOP or APPROXIMATE.
+	Accuracy     string
+	PartialMatch bool
+	// NativeID is the provider-native ID of the location, if configured, and
+	// NativeProvider the name of the provider it belongs to.
+	NativeProvider string
+	NativeID       string
 }
 
 // LatString returns a latitude string
@@ -59,16 +380,47 @@ func (l *Location) LngString() string {
 	return fmt.Sprintf("%f", l.Lng)
 }
 
-func getLocation(apikey, locName string) (*Location, error) {
-	client, err := maps.NewClient(maps.WithAPIKey(apikey))
+// Supported geocoders.
+const (
+	geocoderGoogleMaps  = "googlemaps"
+	geocoderNominatim   = "nominatim"
+	geocoderAccuWeather = "accuweather"
+)
+
+// geocoderName returns the configured geocoder, Google Maps by default.
+func (c *Config) geocoderName() string {
+	if c.Geocoder == "" {
+		return geocoderGoogleMaps
+	}
+	return c.Geocoder
+}
+
+// getLocation geocodes a location name with the configured geocoder.
+func getLocation(ctx context.Context, httpClient *http.Client, config *Config, locName string) (*Location, error) {
+	switch config.geocoderName() {
+	case geocoderGoogleMaps:
+		return googleMapsGeocode(ctx, httpClient, config.GoogleMapsAPIKey, locName)
+	case geocoderNominatim:
+		return nominatimGeocode(ctx, httpClient, config.NominatimURL, locName)
+	case geocoderAccuWeather:
+		return accuWeatherGeocode(ctx, httpClient, config.AccuWeatherAPIKey, locName)
+	default:
+		return nil, fmt.Errorf("unsupported geocoder '%s'", config.Geocoder)
+	}
+}
+
+// googleMapsGeocode geocodes a location name with the Google Maps API.
+func googleMapsGeocode(ctx context.Context, httpClient *http.Client, apikey, locName string) (*Location, error) {
+	client, err := maps.NewClient(maps.WithAPIKey(apikey), maps.WithHTTPClient(httpClient))
 	if err != nil {
 		return nil, err
 	}
 	r := maps.GeocodingRequest{
 		Address: locName,
 	}
-	resp, err := client.Geocode(context.Background(), &r)
+	resp, err := client.Geocode(ctx, &r)
 	if err != nil {
+		countAPIError("googlemaps", reasonForMapsError(err))
 		return nil, err
 	}
 	if len(resp) == 0 {
@@ -78,106 +430,973 @@ func getLocation(apikey, locName string) (*Location, error) {
 		Name: resp[0].AddressComponents[0].LongName,
 		Lat:  resp[0].Geometry.Location.Lat,
 		Lng:  resp[0].Geometry.Location.Lng,
+
+		Accuracy:     resp[0].Geometry.LocationType,
+		PartialMatch: resp[0].PartialMatch,
 	}
 	return &loc, nil
 }
 
-func getWeather(mapsAPIKey, darkskyAPIKey, locName string) (*forecast.Forecast, error) {
-	// TODO cache location
-	loc, err := getLocation(mapsAPIKey, locName)
+// Weather is the result of a weather request for a location.
+type Weather struct {
+	Forecast *forecast.Forecast
+	Stations *StationInfo
+	// QuotaUsage is the fraction of the daily quota used, if reported by the
+	// provider.
+	QuotaUsage    float64
+	HasQuotaUsage bool
+	// Endpoint is the API endpoint the data comes from, without credentials,
+	// and ResponseSHA256 the SHA-256 of the raw response, for auditing.
+	Endpoint       string
+	ResponseSHA256 string
+	// SoilTemperature and SoilMoisture are the soil temperature, in °C, and
+	// the volumetric soil moisture, in m³/m³, by depth, if supplied by the
+	// provider.
+	SoilTemperature map[string]float64
+	SoilMoisture    map[string]float64
+}
+
+// getForecast is equivalent to forecast.Get, but uses the provided HTTP
+// client instead of the default one, and also returns the station metadata.
+// baseURL is the URL of a Dark Sky-compatible API, and provider its name in
+// the errors.
+func getForecast(ctx context.Context, httpClient *http.Client, provider, baseURL, apikey string, loc *Location) (*Weather, error) {
+	url := fmt.Sprintf("%s/%s/%s,%s?units=%s&lang=%s", baseURL, apikey, loc.LatString(), loc.LngString(), forecast.SI, forecast.English)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		countAPIError(provider, reasonForError(err))
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("GMaps search failed: %w", err)
+		countAPIError(provider, reasonForError(err))
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		reason := reasonForStatus(resp.StatusCode, string(data))
+		countAPIError(provider, reason)
+		return nil, &APIError{Provider: provider, Reason: reason, Err: fmt.Errorf("HTTP status %s: %s", resp.Status, data)}
 	}
-	fc, err := forecast.Get(darkskyAPIKey, loc.LatString(), loc.LngString(), "now", forecast.SI, forecast.English)
+	var fc forecast.Forecast
+	if err := json.Unmarshal(data, &fc); err != nil {
+		countAPIError(provider, reasonDecode)
+		return nil, &APIError{Provider: provider, Reason: reasonDecode, Err: err}
+	}
+	if fc.Code >= 400 {
+		reason := reasonForStatus(fc.Code, fc.Error)
+		countAPIError(provider, reason)
+		return nil, &APIError{Provider: provider, Reason: reason, Err: fmt.Errorf("API error %d: %s", fc.Code, fc.Error)}
+	}
+	stations, err := parseDarkskyStations(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse station metadata: %w", err)
+	}
+	w := Weather{Forecast: &fc, Stations: stations, Endpoint: baseURL, ResponseSHA256: sha256Hex(data)}
+	w.QuotaUsage, w.HasQuotaUsage = quotaUsage(provider, resp.Header)
+	return &w, nil
+}
+
+func getWeather(ctx context.Context, httpClient *http.Client, provider, baseURL, apiKey string, loc *Location) (*Weather, error) {
+	w, err := getForecast(ctx, httpClient, provider, baseURL, apiKey, loc)
 	if err != nil {
 		return nil, fmt.Errorf("forecast request failed: %w", err)
 	}
-	if fc.Flags.Units != string(forecast.SI) {
-		return nil, fmt.Errorf("units are not SI: got %v", fc.Flags.Units)
-	}
-	return fc, nil
-}
-
-// getValueByFieldName returns a float64 value based on the supported
-// fields in the forecast datapoint.
-func getValueByFieldName(field string, dp *forecast.DataPoint) (float64, error) {
-	switch field {
-	case "temperature":
-		return dp.Temperature, nil
-	case "apparent_temperature":
-		return dp.ApparentTemperature, nil
-	case "wind_speed":
-		return dp.WindSpeed, nil
-	case "cloud_cover":
-		return dp.CloudCover, nil
-	case "humidity":
-		return dp.Humidity, nil
-	case "precip_intensity":
-		return dp.PrecipIntensity, nil
-	default:
-		return 0, fmt.Errorf("unsupported field '%s'", field)
+	if w.Forecast.Flags.Units != string(forecast.SI) {
+		return nil, fmt.Errorf("units are not SI: got %v", w.Forecast.Flags.Units)
 	}
+	return w, nil
 }
 
 // NewWeatherCollector returns a new WeatherCollector object.
-func NewWeatherCollector(ctx context.Context, locations []string, descs map[string]*prometheus.Desc, gmapsAPIKey, darkskyAPIKey string) *WeatherCollector {
-	return &WeatherCollector{
-		ctx:           ctx,
-		descs:         descs,
-		locations:     locations,
-		gmapsAPIKey:   gmapsAPIKey,
-		darkskyAPIKey: darkskyAPIKey,
+func NewWeatherCollector(ctx context.Context, config *Config, httpClient *http.Client, provider Provider, acc *accumulators) *WeatherCollector {
+	constLabels := prometheus.Labels(config.ConstLabels)
+	geocodes, err := loadGeocodeCache(config.GeocodeCacheFile)
+	if err != nil {
+		// the cache is only an optimization, start with an empty one
+		warnf(ctx, "Ignoring geocoding cache file '%s': %v", config.GeocodeCacheFile, err)
+		geocodes = newGeocodeCache()
+		geocodes.path = config.GeocodeCacheFile
 	}
+	var (
+		history    *historyStore
+		deltaDescs []*prometheus.Desc
+	)
+	if len(config.DeltaMetrics) > 0 {
+		history = newHistoryStore(config.DeltaWindows)
+		for _, key := range config.DeltaMetrics {
+			field, _ := lookupField(key)
+			deltaDescs = append(deltaDescs, prometheus.NewDesc(
+				fmt.Sprintf("weather_%s_change", key),
+				fmt.Sprintf("Change over the window - %s", field.helpString(config.HelpLanguage, fieldConversion(config.Units, field).unit)),
+				withUnitLabel([]string{"location", "window"}, config.Units),
+				constLabels,
+			))
+		}
+	}
+	disabled := make(map[string]bool, len(config.DisabledLocations))
+	for _, name := range config.DisabledLocations {
+		disabled[name] = true
+	}
+	var refresh *adaptiveRefresh
+	if config.AdaptiveRefresh != nil {
+		refresh = newAdaptiveRefresh(config.AdaptiveRefresh)
+	}
+	wc := &WeatherCollector{
+		ctx:         ctx,
+		httpClient:  httpClient,
+		provider:    provider,
+		descs:       getDescs(config.Metrics, config.HelpLanguage, config.Units, constLabels),
+		hourlyDescs: getHourlyDescs(config.Metrics, config.HelpLanguage, config.Units, constLabels),
+		upDesc: prometheus.NewDesc(
+			"weather_up",
+			"Whether the last fetch of the weather for the location succeeded",
+			[]string{"location"},
+			constLabels,
+		),
+		geocodeStaleDesc: prometheus.NewDesc(
+			"weather_geocode_stale",
+			"Whether the coordinates of the location come from the cache because geocoding failed",
+			[]string{"location"},
+			constLabels,
+		),
+		geocodeAccuracyDesc: prometheus.NewDesc(
+			"weather_geocode_accuracy",
+			"Accuracy of the geocoded coordinates, from 1 (approximate) to 4 (rooftop)",
+			[]string{"location", "location_type"},
+			constLabels,
+		),
+		stationInfoDesc: prometheus.NewDesc(
+			"weather_station_info",
+			"Weather station used for the location, for station-based data sources",
+			[]string{"location", "source", "station"},
+			constLabels,
+		),
+		stationDistanceDesc: prometheus.NewDesc(
+			"weather_station_distance_km",
+			"Distance from the location to the nearest weather station, in kilometers",
+			[]string{"location"},
+			constLabels,
+		),
+		geocodeCache: geocodes,
+		weatherCache: newWeatherCache(),
+		history:      history,
+		deltaDescs:   deltaDescs,
+		refresh:      refresh,
+		precipitationTotalDesc: prometheus.NewDesc(
+			"weather_precipitation_millimeters_total",
+			"Accumulated precipitation, integrated from the precipitation intensity",
+			[]string{"location"},
+			constLabels,
+		),
+		sunshineTotalDesc: prometheus.NewDesc(
+			"weather_sunshine_seconds_total",
+			"Accumulated sunshine duration, estimated from the cloud cover while the sun is up",
+			[]string{"location"},
+			constLabels,
+		),
+		sunshineTodayDesc: prometheus.NewDesc(
+			"weather_sunshine_today_seconds",
+			"Sunshine duration since the local midnight, estimated from the cloud cover while the sun is up",
+			[]string{"location"},
+			constLabels,
+		),
+		uvDoseTotalDesc: prometheus.NewDesc(
+			"weather_uv_dose_joules_per_square_meter_total",
+			"Accumulated erythemal UV dose, integrated from the UV index",
+			[]string{"location"},
+			constLabels,
+		),
+		uvDoseTodayDesc: prometheus.NewDesc(
+			"weather_uv_dose_today_joules_per_square_meter",
+			"Erythemal UV dose since the local midnight, integrated from the UV index",
+			[]string{"location"},
+			constLabels,
+		),
+		accumulators: acc,
+		windRoseDesc: prometheus.NewDesc(
+			"weather_wind_rose_observations_total",
+			"Number of wind observations, by direction sector and speed bucket in m/s",
+			[]string{"location", "direction", "speed"},
+			constLabels,
+		),
+		windRose: newWindRose(),
+		alertActiveDesc: prometheus.NewDesc(
+			"weather_alert_active",
+			"Severe weather alert issued by the provider and currently active, by severity and event",
+			[]string{"location", "severity", "event"},
+			constLabels,
+		),
+		alertsDesc: prometheus.NewDesc(
+			"weather_alerts_total",
+			"Number of severe weather alerts issued by the provider, by severity",
+			[]string{"location", "severity"},
+			constLabels,
+		),
+		alerts:      newAlertCounter(),
+		smoother:    newSmoother(config.Smoothing),
+		rollupDescs: newRollupDescs(config, constLabels),
+		rollupLocationsDesc: prometheus.NewDesc(
+			"weather_group_locations",
+			"Number of locations of the group whose weather is available",
+			[]string{"group"},
+			constLabels,
+		),
+		routeDescs:  newRouteDescs(config, constLabels),
+		routePoints: newRoutePoints(),
+		routePointsDesc: prometheus.NewDesc(
+			"weather_route_provider_points",
+			"Number of provider points whose weather is available for the route",
+			[]string{"route"},
+			constLabels,
+		),
+		// validated by validateConsensus
+		consensusProviders: newConsensusProviders(config, httpClient, provider),
+		consensusDescs:     newConsensusDescs(config, constLabels),
+		consensus:          newConsensusCache(),
+		riverGauges:        newRiverGauges(),
+		riverLevelDesc: prometheus.NewDesc(
+			"weather_river_level_meters",
+			"River level at the gauge, above the gauge datum",
+			[]string{"gauge", "source", "location"},
+			constLabels,
+		),
+		riverDischargeDesc: prometheus.NewDesc(
+			"weather_river_discharge_cubic_meters_per_second",
+			"River discharge at the gauge",
+			[]string{"gauge", "source", "location"},
+			constLabels,
+		),
+		riverFloodWarningsDesc: prometheus.NewDesc(
+			"weather_river_flood_warnings",
+			"Number of flood warnings in force near the gauge, by severity",
+			[]string{"gauge", "source", "location", "severity"},
+			constLabels,
+		),
+		avalanche: newAvalancheBulletins(),
+		avalancheDangerDesc: prometheus.NewDesc(
+			"weather_avalanche_danger_level",
+			"Avalanche danger level of the region, from 1 (low) to 5 (very high)",
+			[]string{"region", "source", "elevation", "aspect"},
+			constLabels,
+		),
+		provenanceDesc: prometheus.NewDesc(
+			"weather_provenance_info",
+			"Provider, API endpoint and SHA-256 of the response the current values come from",
+			[]string{"location", "provider", "endpoint", "response_sha256"},
+			constLabels,
+		),
+		providerActiveDesc: prometheus.NewDesc(
+			"weather_provider_active",
+			"Whether the provider of the failover chain of the location served the current values",
+			[]string{"location", "provider"},
+			constLabels,
+		),
+		conditionCodeDesc: prometheus.NewDesc(
+			"weather_condition_code",
+			"Current weather condition as a numeric code, see /api/v1/condition-codes for the mapping",
+			[]string{"location"},
+			constLabels,
+		),
+		temperatureNormalDesc: prometheus.NewDesc(
+			"weather_temperature_normal",
+			fmt.Sprintf("Normal mean temperature for the day of the year, 1991-2020 average (%s)", conversion(config.Units, "celsius").unit),
+			withUnitLabel([]string{"location"}, config.Units),
+			constLabels,
+		),
+		temperatureAnomalyDesc: prometheus.NewDesc(
+			"weather_temperature_anomaly",
+			fmt.Sprintf("Current temperature minus the normal mean temperature for the day of the year (%s)", conversion(config.Units, "celsius").unit),
+			withUnitLabel([]string{"location"}, config.Units),
+			constLabels,
+		),
+		outlookTemperatureDesc: prometheus.NewDesc(
+			"weather_outlook_temperature_mean",
+			fmt.Sprintf("Mean of the daily minimum and maximum temperatures forecast for the week (%s)", conversion(config.Units, "celsius").unit),
+			withUnitLabel([]string{"location", "week"}, config.Units),
+			constLabels,
+		),
+		outlookPrecipitationDesc: prometheus.NewDesc(
+			"weather_outlook_precipitation_millimeters",
+			"Total precipitation forecast for the week, in millimeters",
+			withUnitLabel([]string{"location", "week"}, config.Units),
+			constLabels,
+		),
+		outlookDaysDesc: prometheus.NewDesc(
+			"weather_outlook_days",
+			"Number of forecast days in the week",
+			[]string{"location", "week"},
+			constLabels,
+		),
+		dailyForecastDescs: newDailyForecastDescs(config.Units, constLabels),
+		normals:            newNormalsStore(httpClient),
+		soilTemperatureDesc: prometheus.NewDesc(
+			"weather_soil_temperature",
+			fmt.Sprintf("Soil temperature at the given depth (%s)", conversion(config.Units, "celsius").unit),
+			withUnitLabel([]string{"location", "depth"}, config.Units),
+			constLabels,
+		),
+		soilMoistureDesc: prometheus.NewDesc(
+			"weather_soil_moisture_ratio",
+			"Volumetric soil moisture in the given layer (m³/m³)",
+			[]string{"location", "depth"},
+			constLabels,
+		),
+		airports: newAirportStatuses(httpClient),
+		airportDelayDesc: prometheus.NewDesc(
+			"weather_airport_delay_minutes",
+			"Maximum delay of the airport of the location reported by the FAA, by direction",
+			[]string{"location", "airport", "direction"},
+			constLabels,
+		),
+		airportGroundStopDesc: prometheus.NewDesc(
+			"weather_airport_ground_stop",
+			"Whether the FAA reports a ground stop at the airport of the location",
+			[]string{"location", "airport"},
+			constLabels,
+		),
+		airportClosedDesc: prometheus.NewDesc(
+			"weather_airport_closed",
+			"Whether the FAA reports the airport of the location as closed",
+			[]string{"location", "airport"},
+			constLabels,
+		),
+		configured: config.Locations.Names(),
+		disabled:   disabled,
+		locations:  config.enabledLocations(),
+		explicit:   explicitCoordinates(config),
+		// validated by validateLocationProviders
+		locationProviders: newLocationProviders(config, httpClient),
+		failing:           make(map[string]bool),
+	}
+	wc.config.Store(config)
+	return wc
+}
+
+// cfg returns the current configuration. The reloadable settings of the
+// configuration are replaced as a whole when it is reloaded, see reload.
+func (wc *WeatherCollector) cfg() *Config {
+	return wc.config.Load().(*Config)
 }
 
 // WeatherCollector is a prometheus collector for weather metrics.
 type WeatherCollector struct {
-	ctx                        context.Context
-	descs                      map[string]*prometheus.Desc
-	locations                  []string
-	gmapsAPIKey, darkskyAPIKey string
+	ctx context.Context
+	// config holds the *Config, see cfg.
+	config     atomic.Value
+	httpClient *http.Client
+	provider   Provider
+	// descs and hourlyDescs are guarded by mu, as they change when the
+	// configuration is reloaded.
+	descs       map[string]*prometheus.Desc
+	hourlyDescs map[string]*prometheus.Desc
+
+	upDesc              *prometheus.Desc
+	geocodeStaleDesc    *prometheus.Desc
+	geocodeAccuracyDesc *prometheus.Desc
+	stationInfoDesc     *prometheus.Desc
+	stationDistanceDesc *prometheus.Desc
+	geocodeCache        *geocodeCache
+	weatherCache        *weatherCache
+	// history and deltaDescs are only set if delta metrics are configured.
+	// deltaDescs are in the same order as config.DeltaMetrics.
+	history    *historyStore
+	deltaDescs []*prometheus.Desc
+	// refresh is only set if the adaptive refresh interval is configured.
+	refresh *adaptiveRefresh
+
+	precipitationTotalDesc *prometheus.Desc
+	sunshineTotalDesc      *prometheus.Desc
+	sunshineTodayDesc      *prometheus.Desc
+	uvDoseTotalDesc        *prometheus.Desc
+	uvDoseTodayDesc        *prometheus.Desc
+	accumulators           *accumulators
+
+	windRoseDesc *prometheus.Desc
+	windRose     *windRose
+
+	alertActiveDesc *prometheus.Desc
+	alertsDesc      *prometheus.Desc
+	alerts          *alertCounter
+
+	smoother *smoother
+
+	// rollupDescs are empty if rollups are not configured. They are guarded
+	// by mu, as they change when the configuration is reloaded.
+	rollupDescs         map[string]*prometheus.Desc
+	rollupLocationsDesc *prometheus.Desc
+
+	// routeDescs are empty if no routes are configured. They are guarded by
+	// mu, like rollupDescs.
+	routeDescs      map[string]*prometheus.Desc
+	routePoints     *routePoints
+	routePointsDesc *prometheus.Desc
+
+	// consensusDescs are empty if the consensus mode is disabled. They are
+	// guarded by mu, like rollupDescs.
+	consensusProviders []Provider
+	consensusDescs     map[string]*prometheus.Desc
+	consensus          *consensusCache
+
+	riverGauges            *riverGauges
+	riverLevelDesc         *prometheus.Desc
+	riverDischargeDesc     *prometheus.Desc
+	riverFloodWarningsDesc *prometheus.Desc
+
+	avalanche           *avalancheBulletins
+	avalancheDangerDesc *prometheus.Desc
+
+	conditionCodeDesc *prometheus.Desc
+	provenanceDesc    *prometheus.Desc
+
+	providerActiveDesc *prometheus.Desc
+
+	temperatureNormalDesc  *prometheus.Desc
+	temperatureAnomalyDesc *prometheus.Desc
+	normals                *normalsStore
+
+	soilTemperatureDesc *prometheus.Desc
+	soilMoistureDesc    *prometheus.Desc
+
+	airports              *airportStatuses
+	airportDelayDesc      *prometheus.Desc
+	airportGroundStopDesc *prometheus.Desc
+	airportClosedDesc     *prometheus.Desc
+
+	outlookTemperatureDesc   *prometheus.Desc
+	outlookPrecipitationDesc *prometheus.Desc
+	outlookDaysDesc          *prometheus.Desc
+
+	// dailyForecastDescs are in the same order as dailyForecastFields.
+	dailyForecastDescs []*prometheus.Desc
+
+	mu sync.RWMutex
+	// configured are all the configured locations, locations only the
+	// enabled ones.
+	configured []string
+	disabled   map[string]bool
+	locations  []string
+	// explicit are the coordinates of the locations that are not geocoded.
+	explicit map[string]*Location
+	// locationProviders are the providers of the locations that have their
+	// own provider, API key or failover chain, by name, in priority order.
+	locationProviders map[string][]Provider
+	// failing are the locations whose last fetch failed.
+	failing map[string]bool
+}
+
+// setFailing records whether the last fetch of a location failed.
+func (wc *WeatherCollector) setFailing(name string, failing bool) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if failing {
+		wc.failing[name] = true
+	} else {
+		delete(wc.failing, name)
+	}
+}
+
+// isFailing returns whether the last fetch of a location failed.
+func (wc *WeatherCollector) isFailing(name string) bool {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	return wc.failing[name]
+}
+
+// Locations returns the locations currently exported by the collector.
+func (wc *WeatherCollector) Locations() []string {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	return wc.locations
+}
+
+// SetLocations replaces the configured locations. Locations that were
+// disabled stay disabled.
+func (wc *WeatherCollector) SetLocations(locations []string) {
+	wc.mu.Lock()
+	wc.configured = locations
+	wc.mu.Unlock()
+	wc.updateLocations()
+}
+
+// LocationState is a configured location and whether it is enabled.
+type LocationState struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// LocationStates returns all the configured locations, including the
+// disabled ones.
+func (wc *WeatherCollector) LocationStates() []LocationState {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	states := make([]LocationState, 0, len(wc.configured))
+	for _, name := range wc.configured {
+		states = append(states, LocationState{Name: name, Enabled: !wc.disabled[name]})
+	}
+	return states
+}
+
+// SetEnabled enables or disables a configured location. Disabled locations
+// are neither fetched nor exported.
+func (wc *WeatherCollector) SetEnabled(name string, enabled bool) error {
+	wc.mu.Lock()
+	found := false
+	for _, loc := range wc.configured {
+		if loc == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		wc.mu.Unlock()
+		return fmt.Errorf("unknown location '%s'", name)
+	}
+	if enabled {
+		delete(wc.disabled, name)
+	} else {
+		wc.disabled[name] = true
+	}
+	wc.mu.Unlock()
+	wc.updateLocations()
+	return nil
+}
+
+// updateLocations recomputes the exported locations from the configured and
+// the disabled ones. The state kept for locations that are no longer exported
+// is dropped, so their series disappear from the next scrape and are
+// correctly marked as stale by Prometheus.
+func (wc *WeatherCollector) updateLocations() {
+	wc.mu.Lock()
+	var locations []string
+	keep := make(map[string]bool, len(wc.configured))
+	for _, loc := range wc.configured {
+		if !wc.disabled[loc] {
+			locations = append(locations, loc)
+			keep[loc] = true
+		}
+	}
+	wc.locations = locations
+	for name := range wc.failing {
+		if !keep[name] {
+			delete(wc.failing, name)
+		}
+	}
+	wc.mu.Unlock()
+	if err := wc.geocodeCache.prune(keep); err != nil {
+		warnf(context.Background(), "Failed to save the geocoding cache: %v", err)
+	}
+	wc.weatherCache.prune(keep)
+	if wc.history != nil {
+		wc.history.prune(keep)
+	}
+	wc.windRose.prune(keep)
+	wc.alerts.prune(keep)
+	wc.smoother.prune(keep)
+	wc.normals.prune(keep)
+	wc.consensus.prune(keep)
+	if err := wc.accumulators.prune(keep); err != nil {
+		warnf(context.Background(), "Failed to save the state file: %v", err)
+	}
 }
 
 // Describe implements prometheus.Collector.Describe for WeatherCollector.
+//
+// No descriptors are sent, making this an unchecked collector: the
+// descriptors change when the configuration is reloaded, and describing them
+// by collecting would fetch the weather of every location at registration.
 func (wc *WeatherCollector) Describe(ch chan<- *prometheus.Desc) {
-	prometheus.DescribeByCollect(wc, ch)
 }
 
-func getDescs(metrics []string) map[string]*prometheus.Desc {
+// round rounds a value of a metric to the configured precision, if any.
+func (wc *WeatherCollector) round(key string, v float64) float64 {
+	decimals, ok := wc.cfg().Precision[key]
+	if !ok {
+		return v
+	}
+	p := math.Pow(10, float64(decimals))
+	return math.Round(v*p) / p
+}
+
+func getDescs(metrics []string, lang, units string, constLabels prometheus.Labels) map[string]*prometheus.Desc {
 	var descs = make(map[string]*prometheus.Desc)
 	for _, key := range metrics {
+		field, ok := lookupField(key)
+		if !ok {
+			continue
+		}
 		descs[key] = prometheus.NewDesc(
 			fmt.Sprintf("weather_%s", key),
-			fmt.Sprintf("Weather forecast - %s", strings.Replace(key, "_", " ", -1)),
-			[]string{"location", "latitude", "longitude"},
-			nil,
+			field.helpString(lang, fieldConversion(units, field).unit),
+			withUnitLabel([]string{"location", "latitude", "longitude"}, units),
+			constLabels,
 		)
 	}
 	return descs
 }
 
+// fetch geocodes a location and gets its weather.
+func (wc *WeatherCollector) fetch(ctx context.Context, name string) (*LocationWeather, error) {
+	if !wc.cfg().LowMemory {
+		debugf(ctx, "Getting weather for %s", name)
+	}
+	start := time.Now()
+	loc, stale, err := wc.resolveLocation(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("geocoding failed: %w", err)
+	}
+	var (
+		w        *Weather
+		provider Provider
+	)
+	chain := wc.providersFor(name)
+	for idx, p := range chain {
+		pctx, cancel := withLogFields(ctx, "provider", p.Name()), context.CancelFunc(func() {})
+		if len(chain) > 1 {
+			pctx, cancel = context.WithTimeout(pctx, wc.cfg().failoverTimeout())
+		}
+		w, err = p.Get(pctx, loc)
+		cancel()
+		if err == nil {
+			provider = p
+			break
+		}
+		if idx < len(chain)-1 {
+			warnf(pctx, "Failed to get weather for '%s' from %s, trying %s: %v", name, p.Name(), chain[idx+1].Name(), err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	lw := LocationWeather{
+		Name:         name,
+		Provider:     provider.Name(),
+		Location:     loc,
+		GeocodeStale: stale,
+		Weather:      w,
+		FetchedAt:    time.Now(),
+	}
+	if !wc.cfg().LowMemory {
+		// a summary only, the responses are logged with -log.payloads
+		logf(withLogFields(ctx, "provider", provider.Name()), "Got weather for '%s' from %s in %s, %d alert(s)", name, provider.Name(), lw.FetchedAt.Sub(start).Round(time.Millisecond), len(w.Forecast.Alerts))
+	}
+	if wc.cfg().ClimateNormals {
+		normal, err := wc.normals.get(ctx, name, loc, lw.FetchedAt)
+		if err != nil {
+			warnf(ctx, "Climate normals for '%s' are not available: %v", name, err)
+		} else {
+			lw.Normal, lw.HasNormal = normal, true
+		}
+	}
+	if code := wc.cfg().Airports[name]; code != "" {
+		status, err := wc.airports.get(ctx, code)
+		if err != nil {
+			warnf(ctx, "Airport status for '%s' is not available: %v", name, err)
+		} else {
+			lw.Airport = status
+		}
+	}
+	return &lw, nil
+}
+
+// getLocationWeather returns the weather for a location, either fetching it
+// or, during the quiet hours, from the cache.
+func (wc *WeatherCollector) getLocationWeather(ctx context.Context, name string) (*LocationWeather, error) {
+	ctx = withLogFields(ctx, "location", name)
+	if wc.cfg().QuietHours != nil && wc.cfg().QuietHours.Contains(time.Now()) {
+		if lw, ok := wc.weatherCache.get(name); ok {
+			stats.Add(statCacheHits, 1)
+			return lw, nil
+		}
+		// nothing to serve yet, e.g. right after a restart
+		logf(ctx, "No cached weather for '%s' during quiet hours, fetching it", name)
+	}
+	if interval := wc.refreshInterval(name, time.Now()); interval > 0 {
+		if lw, ok := wc.weatherCache.get(name); ok && time.Since(lw.FetchedAt)+refreshJitter < interval {
+			stats.Add(statCacheHits, 1)
+			return lw, nil
+		}
+	}
+	return wc.update(ctx, name)
+}
+
+// update fetches the weather for a location and updates the cache and the
+// derived values. If the provider is throttling, the cached weather is
+// returned if any.
+func (wc *WeatherCollector) update(ctx context.Context, name string) (*LocationWeather, error) {
+	ctx = withLogFields(ctx, "location", name)
+	stats.Add(statFetches, 1)
+	stats.Add(statFetchesInFlight, 1)
+	lw, err := wc.fetch(ctx, name)
+	stats.Add(statFetchesInFlight, -1)
+	wc.setFailing(name, err != nil)
+	if err != nil {
+		stats.Add(statFetchErrors, 1)
+		var apiErr *APIError
+		if wc.refresh != nil && errors.As(err, &apiErr) && apiErr.Reason == reasonQuota {
+			wc.refresh.throttled(apiErr.Provider, "is throttling")
+			if lw, ok := wc.weatherCache.get(name); ok {
+				stats.Add(statCacheHits, 1)
+				logf(ctx, "Serving cached weather for '%s' while throttled", name)
+				return lw, nil
+			}
+		}
+		return nil, err
+	}
+	if wc.refresh != nil {
+		wc.refresh.observe(lw.Provider, lw.Weather.QuotaUsage, lw.Weather.HasQuotaUsage)
+	}
+	if wc.cfg().LowMemory {
+		// keep the hours exported until the next fetch
+		hours := wc.cfg().ForecastHours + int(wc.refreshInterval(name, lw.FetchedAt)/time.Hour) + 1
+		lw.Weather = trimmed(lw.Weather, lw.FetchedAt, hours)
+	}
+	wc.weatherCache.set(name, lw)
+	if wc.history != nil {
+		o := observation{time: lw.FetchedAt}
+		for _, key := range wc.cfg().DeltaMetrics {
+			field, _ := lookupField(key)
+			o.values = append(o.values, field.Value(&lw.Weather.Forecast.Currently))
+		}
+		wc.history.add(name, o)
+	}
+	wc.alerts.observe(name, activeAlerts([]*LocationWeather{lw}, lw.FetchedAt))
+	wc.smoother.add(name, &lw.Weather.Forecast.Currently)
+	if wc.cfg().WindRose {
+		wc.windRose.add(name, lw.Weather.Forecast.Currently.WindBearing, lw.Weather.Forecast.Currently.WindSpeed)
+	}
+	if wc.cfg().PrecipitationTotal {
+		if err := wc.accumulators.add("precipitation", name, lw.FetchedAt, lw.Weather.Forecast.Currently.PrecipIntensity); err != nil {
+			errorf(ctx, "Failed to save state: %v", err)
+		}
+	}
+	if wc.cfg().SunshineDuration {
+		fc := lw.Weather.Forecast
+		if err := wc.accumulators.addDaily("sunshine", name, lw.FetchedAt, forecastLocation(fc), sunshineRate(fc)); err != nil {
+			errorf(ctx, "Failed to save state: %v", err)
+		}
+	}
+	if wc.cfg().UVDose {
+		fc := lw.Weather.Forecast
+		if err := wc.accumulators.addDaily("uv", name, lw.FetchedAt, forecastLocation(fc), float64(fc.Currently.UVIndex)); err != nil {
+			errorf(ctx, "Failed to save state: %v", err)
+		}
+	}
+	return lw, nil
+}
+
+// refreshInterval returns the minimum time between two fetches of a location
+// at time t, given the cache TTL, its refresh schedule and the adaptive
+// refresh interval, or 0 if the location is fetched at every scrape.
+func (wc *WeatherCollector) refreshInterval(name string, t time.Time) time.Duration {
+	interval := time.Duration(wc.cfg().CacheTTL)
+	if si := scheduleFor(wc.cfg(), name).interval(t); si > interval {
+		interval = si
+	}
+	if wc.refresh != nil {
+		if ri := wc.refresh.interval(wc.providersFor(name)[0].Name()); ri > interval {
+			interval = ri
+		}
+	}
+	return interval
+}
+
 // Collect implements prometheus.Collector.Collect for WeatherCollector.
 func (wc *WeatherCollector) Collect(ch chan<- prometheus.Metric) {
-	// TODO cache metrics to avoid calling the API method at every scrape
-	for _, loc := range wc.locations {
-		log.Printf("Getting weather for %s", loc)
-		fc, err := getWeather(wc.gmapsAPIKey, wc.darkskyAPIKey, loc)
+	if wc.polling() {
+		// the weather is refreshed in the background, only serve the
+		// latest values
+		snapshot := make(map[string]*LocationWeather)
+		for _, lw := range wc.Snapshot() {
+			snapshot[lw.Name] = lw
+		}
+		for _, name := range wc.Locations() {
+			if lw, ok := snapshot[name]; ok {
+				wc.collectLocation(ch, name, lw)
+			} else {
+				ch <- prometheus.MustNewConstMetric(wc.upDesc, prometheus.GaugeValue, 0, name)
+			}
+		}
+		wc.collectRollups(ch)
+		// the other data is fetched by the poller too, and only exported
+		ctx := withCorrelationID(wc.ctx, newCorrelationID())
+		wc.collectRoutes(ctx, ch)
+		wc.collectConsensus(ctx, ch)
+		wc.collectRiverGauges(ctx, ch)
+		wc.collectAvalanche(ctx, ch)
+		return
+	}
+	ctx := withCorrelationID(wc.ctx, newCorrelationID())
+	// fetch the locations concurrently, then export them in order
+	locations := wc.Locations()
+	results := make([]*LocationWeather, len(locations))
+	wc.forEachLocation(locations, func(idx int, name string) {
+		lw, err := wc.getLocationWeather(ctx, name)
 		if err != nil {
-			log.Printf("Failed to get weather for '%s': %v", loc, err)
+			errorf(withLogFields(ctx, "location", name), "Failed to get weather for '%s': %v", name, err)
+			return
+		}
+		results[idx] = lw
+	})
+	for idx, lw := range results {
+		if lw != nil {
+			wc.collectLocation(ch, locations[idx], lw)
 		} else {
-			// update values
-			for key, desc := range wc.descs {
-				val, err := getValueByFieldName(key, &fc.Currently)
-				if err != nil {
-					log.Printf("Warning: skipping '%s': %v", key, err)
-					continue
-				}
-				ch <- prometheus.MustNewConstMetric(
-					desc,
-					prometheus.GaugeValue,
-					val,
-					loc, fmt.Sprintf("%f", fc.Latitude), fmt.Sprintf("%f", fc.Longitude),
-				)
+			ch <- prometheus.MustNewConstMetric(wc.upDesc, prometheus.GaugeValue, 0, locations[idx])
+		}
+	}
+	wc.collectRollups(ch)
+	wc.collectRoutes(ctx, ch)
+	wc.collectConsensus(ctx, ch)
+	wc.collectRiverGauges(ctx, ch)
+	wc.collectAvalanche(ctx, ch)
+}
+
+// collectLocation sends the metrics for a location to ch.
+func (wc *WeatherCollector) collectLocation(ch chan<- prometheus.Metric, name string, lw *LocationWeather) {
+	// the values may come from the cache even if the last fetch failed
+	upVal := 1.0
+	if wc.isFailing(name) {
+		upVal = 0
+	}
+	ch <- prometheus.MustNewConstMetric(wc.upDesc, prometheus.GaugeValue, upVal, name)
+	var staleVal float64
+	if lw.GeocodeStale {
+		staleVal = 1
+	}
+	ch <- prometheus.MustNewConstMetric(wc.geocodeStaleDesc, prometheus.GaugeValue, staleVal, name)
+	// explicit coordinates have no geocoding accuracy
+	if lw.Location.Accuracy != "" {
+		ch <- prometheus.MustNewConstMetric(wc.geocodeAccuracyDesc, prometheus.GaugeValue, float64(geocodeAccuracyRank(lw.Location.Accuracy)), name, lw.Location.Accuracy)
+	}
+	w := lw.Weather
+	for _, st := range w.Stations.Stations {
+		ch <- prometheus.MustNewConstMetric(wc.stationInfoDesc, prometheus.GaugeValue, 1, name, st.Source, st.ID)
+	}
+	if w.Stations.NearestDistance > 0 {
+		ch <- prometheus.MustNewConstMetric(wc.stationDistanceDesc, prometheus.GaugeValue, w.Stations.NearestDistance, name)
+	}
+	fc := w.Forecast
+	units := wc.cfg().Units
+	for key, desc := range wc.metricDescs() {
+		field, _ := lookupField(key)
+		conv := fieldConversion(units, field)
+		ch <- prometheus.MustNewConstMetric(
+			desc,
+			prometheus.GaugeValue,
+			wc.round(key, conv.value(wc.currentValue(lw, key))),
+			wc.unitLabelValues(conv, name, fmt.Sprintf("%f", fc.Latitude), fmt.Sprintf("%f", fc.Longitude))...,
+		)
+	}
+	if wc.cfg().PrecipitationTotal {
+		if total, ok := wc.accumulators.total("precipitation", name); ok {
+			ch <- prometheus.MustNewConstMetric(wc.precipitationTotalDesc, prometheus.CounterValue, total, name)
+		}
+	}
+	if wc.cfg().SunshineDuration {
+		// the accumulators count hours
+		if total, ok := wc.accumulators.total("sunshine", name); ok {
+			ch <- prometheus.MustNewConstMetric(wc.sunshineTotalDesc, prometheus.CounterValue, total*3600, name)
+		}
+		today := time.Now().In(forecastLocation(fc)).Format("2006-01-02")
+		if total, ok := wc.accumulators.dayTotal("sunshine", name, today); ok {
+			ch <- prometheus.MustNewConstMetric(wc.sunshineTodayDesc, prometheus.GaugeValue, total*3600, name)
+		}
+	}
+	if wc.cfg().UVDose {
+		// the accumulators count UV index hours
+		if total, ok := wc.accumulators.total("uv", name); ok {
+			ch <- prometheus.MustNewConstMetric(wc.uvDoseTotalDesc, prometheus.CounterValue, total*uvIndexHourDose, name)
+		}
+		today := time.Now().In(forecastLocation(fc)).Format("2006-01-02")
+		if total, ok := wc.accumulators.dayTotal("uv", name, today); ok {
+			ch <- prometheus.MustNewConstMetric(wc.uvDoseTodayDesc, prometheus.GaugeValue, total*uvIndexHourDose, name)
+		}
+	}
+	if lw.HasNormal {
+		conv := conversion(units, "celsius")
+		ch <- prometheus.MustNewConstMetric(wc.temperatureNormalDesc, prometheus.GaugeValue, conv.value(lw.Normal), wc.unitLabelValues(conv, name)...)
+		ch <- prometheus.MustNewConstMetric(wc.temperatureAnomalyDesc, prometheus.GaugeValue, conv.delta(fc.Currently.Temperature-lw.Normal), wc.unitLabelValues(conv, name)...)
+	}
+	if wc.cfg().Soil {
+		conv := conversion(units, "celsius")
+		for depth, v := range w.SoilTemperature {
+			ch <- prometheus.MustNewConstMetric(wc.soilTemperatureDesc, prometheus.GaugeValue, conv.value(v), wc.unitLabelValues(conv, name, depth)...)
+		}
+		for depth, v := range w.SoilMoisture {
+			ch <- prometheus.MustNewConstMetric(wc.soilMoistureDesc, prometheus.GaugeValue, v, name, depth)
+		}
+	}
+	if st := lw.Airport; st != nil {
+		code := strings.ToUpper(wc.cfg().Airports[name])
+		ch <- prometheus.MustNewConstMetric(wc.airportDelayDesc, prometheus.GaugeValue, st.ArrivalDelay, name, code, "arrival")
+		ch <- prometheus.MustNewConstMetric(wc.airportDelayDesc, prometheus.GaugeValue, st.DepartureDelay, name, code, "departure")
+		ch <- prometheus.MustNewConstMetric(wc.airportGroundStopDesc, prometheus.GaugeValue, boolToFloat(st.GroundStop), name, code)
+		ch <- prometheus.MustNewConstMetric(wc.airportClosedDesc, prometheus.GaugeValue, boolToFloat(st.Closed), name, code)
+	}
+	for _, o := range weeklyOutlook(fc, time.Now(), wc.cfg().OutlookWeeks) {
+		week := strconv.Itoa(o.Week)
+		temp, precip := conversion(units, "celsius"), conversion(units, "millimeters")
+		ch <- prometheus.MustNewConstMetric(wc.outlookTemperatureDesc, prometheus.GaugeValue, temp.value(o.MeanTemperature), wc.unitLabelValues(temp, name, week)...)
+		ch <- prometheus.MustNewConstMetric(wc.outlookPrecipitationDesc, prometheus.GaugeValue, o.Precipitation, wc.unitLabelValues(precip, name, week)...)
+		ch <- prometheus.MustNewConstMetric(wc.outlookDaysDesc, prometheus.GaugeValue, float64(o.Days), name, week)
+	}
+	for _, day := range dailyForecast(fc, time.Now(), wc.cfg().ForecastDays) {
+		offset := strconv.Itoa(day.Offset)
+		for idx, f := range dailyForecastFields {
+			conv := conversion(units, f.unit)
+			ch <- prometheus.MustNewConstMetric(wc.dailyForecastDescs[idx], prometheus.GaugeValue, conv.value(f.value(day.DataPoint)), wc.unitLabelValues(conv, name, offset)...)
+		}
+	}
+	if wc.cfg().ForecastHours > 0 {
+		hourlyDescs := wc.hourlyMetricDescs()
+		for _, hour := range hourlyForecast(fc, time.Now(), wc.cfg().ForecastHours) {
+			ahead := strconv.Itoa(hour.HoursAhead)
+			for key, desc := range hourlyDescs {
+				field, _ := lookupField(key)
+				conv := fieldConversion(units, field)
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, wc.round(key, conv.value(field.Value(hour.DataPoint))), wc.unitLabelValues(conv, name, ahead)...)
+			}
+		}
+	}
+	if wc.cfg().Provenance {
+		ch <- prometheus.MustNewConstMetric(wc.provenanceDesc, prometheus.GaugeValue, float64(lw.FetchedAt.Unix()), name, lw.Provider, w.Endpoint, w.ResponseSHA256)
+	}
+	if chain := wc.providersFor(name); len(chain) > 1 {
+		for _, p := range chain {
+			ch <- prometheus.MustNewConstMetric(wc.providerActiveDesc, prometheus.GaugeValue, boolToFloat(p.Name() == lw.Provider), name, p.Name())
+		}
+	}
+	if wc.cfg().ConditionCode {
+		ch <- prometheus.MustNewConstMetric(wc.conditionCodeDesc, prometheus.GaugeValue, float64(conditionCode(fc.Currently.Icon)), name)
+	}
+	// several alerts can have the same event and severity
+	active := make(map[[2]string]bool)
+	for _, a := range activeAlerts([]*LocationWeather{lw}, time.Now()) {
+		active[[2]string{alertSeverity(&a), a.Title}] = true
+	}
+	for labels := range active {
+		ch <- prometheus.MustNewConstMetric(wc.alertActiveDesc, prometheus.GaugeValue, 1, name, labels[0], labels[1])
+	}
+	wc.alerts.forEach(name, func(severity string, count float64) {
+		ch <- prometheus.MustNewConstMetric(wc.alertsDesc, prometheus.CounterValue, count, name, severity)
+	})
+	if wc.cfg().WindRose {
+		wc.windRose.forEach(name, func(direction, speed string, count float64) {
+			ch <- prometheus.MustNewConstMetric(wc.windRoseDesc, prometheus.CounterValue, count, name, direction, speed)
+		})
+	}
+	for idx, desc := range wc.deltaDescs {
+		key := wc.cfg().DeltaMetrics[idx]
+		field, _ := lookupField(key)
+		conv := fieldConversion(units, field)
+		for _, window := range wc.cfg().DeltaWindows {
+			if delta, ok := wc.history.delta(name, idx, time.Duration(window)); ok {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, wc.round(key, conv.delta(delta)), wc.unitLabelValues(conv, name, window.String())...)
 			}
 		}
 	}
@@ -185,12 +1404,48 @@ func (wc *WeatherCollector) Collect(ch chan<- prometheus.Metric) {
 
 func main() {
 	flag.Parse()
+	if err := setupLogging(*flagLogLevel, *flagLogFormat); err != nil {
+		log.Fatalf("Invalid logging flags: %v", err)
+	}
+	if err := validateChaos(*flagChaosLatency, *flagChaosErrors, *flagChaosMalformed); err != nil {
+		log.Fatalf("Invalid chaos flags: %v", err)
+	}
+	if *flagFieldsDoc {
+		if err := writeFieldsDoc(os.Stdout); err != nil {
+			log.Fatalf("Failed to write fields documentation: %v", err)
+		}
+		return
+	}
+	if *flagSNMPMIB {
+		if err := writeSNMPMIB(os.Stdout); err != nil {
+			log.Fatalf("Failed to write SNMP MIB: %v", err)
+		}
+		return
+	}
+	if *flagModbusMap {
+		if err := writeModbusMap(os.Stdout); err != nil {
+			log.Fatalf("Failed to write Modbus register map: %v", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "init" {
+		if err := runInit(os.Stdin, os.Stdout, *flagConfigFile); err != nil {
+			log.Fatalf("Setup failed: %v", err)
+		}
+		return
+	}
+	if *flagConfigSchema {
+		if err := writeConfigSchema(os.Stdout); err != nil {
+			log.Fatalf("Failed to write configuration schema: %v", err)
+		}
+		return
+	}
 	config, err := LoadConfig(*flagConfigFile)
 	if err != nil {
 		log.Fatalf("Failed to load configuration file '%s': %v", *flagConfigFile, err)
 	}
-	log.Printf("Locations (%d): %s", len(config.Locations), config.Locations)
-	log.Printf("Metrics (%d): %s", len(config.Metrics), config.Metrics)
+	logf(context.Background(), "Locations (%d): %s", len(config.Locations), config.Locations.Names())
+	logf(context.Background(), "Metrics (%d): %s", len(config.Metrics), config.Metrics)
 
 	if len(config.Locations) == 0 {
 		log.Fatalf("Must specify at least one location")
@@ -198,13 +1453,368 @@ func main() {
 	if len(config.Metrics) == 0 {
 		log.Fatalf("Must specify at least one metric")
 	}
+	for _, m := range config.Metrics {
+		if _, ok := lookupField(m); !ok {
+			log.Fatalf("Unsupported metric '%s', see -fields-doc for the supported ones", m)
+		}
+	}
+	for _, m := range config.DeltaMetrics {
+		if _, ok := lookupField(m); !ok {
+			log.Fatalf("Unsupported delta metric '%s', see -fields-doc for the supported ones", m)
+		}
+	}
+	if len(config.DeltaMetrics) > 0 && len(config.DeltaWindows) == 0 {
+		log.Fatalf("delta_metrics requires at least one window in delta_windows")
+	}
+	if err := validateConstLabels(config.ConstLabels); err != nil {
+		log.Fatalf("Invalid const_labels: %v", err)
+	}
+	if err := addExporterInstanceLabel(config); err != nil {
+		log.Fatalf("Failed to set exporter instance label: %v", err)
+	}
+	if config.HelpLanguage != "" && !isSupportedHelpLanguage(config.HelpLanguage) {
+		log.Fatalf("Unsupported help_language '%s'", config.HelpLanguage)
+	}
+	if _, ok := unitSystems[config.Units]; config.Units != "" && !ok {
+		log.Fatalf("Unsupported units '%s', must be one of %s", config.Units, strings.Join(unitSystemNames(), ", "))
+	}
+	for key, decimals := range config.Precision {
+		if _, ok := lookupField(key); !ok {
+			log.Fatalf("Unknown metric '%s' in precision", key)
+		}
+		if decimals < 0 {
+			log.Fatalf("Invalid precision %d for metric '%s', must not be negative", decimals, key)
+		}
+	}
+	if err := validateSmoothing(config.Smoothing); err != nil {
+		log.Fatalf("Invalid smoothing: %v", err)
+	}
+	if config.Rollups != nil {
+		if err := validateRollups(config.Rollups, config.Locations.Names()); err != nil {
+			log.Fatalf("Invalid rollups: %v", err)
+		}
+	}
+	if err := validateRoutes(config.Routes); err != nil {
+		log.Fatalf("Invalid routes: %v", err)
+	}
+	if err := validateConsensus(config); err != nil {
+		log.Fatalf("Invalid consensus: %v", err)
+	}
+	if err := validateRiverGauges(config.RiverGauges); err != nil {
+		log.Fatalf("Invalid river gauges: %v", err)
+	}
+	if err := validateAvalancheRegions(config.AvalancheRegions); err != nil {
+		log.Fatalf("Invalid avalanche regions: %v", err)
+	}
+	if err := validateAirports(config.Airports); err != nil {
+		log.Fatalf("Invalid airports: %v", err)
+	}
+	if g := config.geocoderName(); g != geocoderGoogleMaps && g != geocoderNominatim && g != geocoderAccuWeather {
+		log.Fatalf("Unsupported geocoder '%s', must be %s, %s or %s", g, geocoderGoogleMaps, geocoderNominatim, geocoderAccuWeather)
+	}
+	if config.MinGeocodeAccuracy != "" && geocodeAccuracyRank(config.MinGeocodeAccuracy) == 0 {
+		log.Fatalf("Invalid min_geocode_accuracy '%s'", config.MinGeocodeAccuracy)
+	}
+	for _, name := range config.DisabledLocations {
+		found := false
+		for _, loc := range config.Locations.Names() {
+			if loc == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Fatalf("Unknown location '%s' in disabled_locations", name)
+		}
+	}
+	if len(config.DisabledLocations) > 0 {
+		logf(context.Background(), "Disabled locations (%d): %s", len(config.DisabledLocations), config.DisabledLocations)
+	}
+	if err := validateRefreshSchedules(config); err != nil {
+		log.Fatalf("Invalid refresh_schedules: %v", err)
+	}
+	if config.Alertmanager != nil && config.Alertmanager.URL == "" {
+		log.Fatalf("alertmanager requires a url")
+	}
+	if config.Notifications != nil {
+		if err := validateNotifications(config.Notifications); err != nil {
+			log.Fatalf("Invalid notifications: %v", err)
+		}
+	}
+	if config.KNX != nil {
+		if err := validateKNX(config.KNX); err != nil {
+			log.Fatalf("Invalid knx: %v", err)
+		}
+	}
+
+	if config.LowMemory {
+		setupLowMemory()
+	}
+
+	if *flagRecordDir != "" && *flagReplayDir != "" {
+		log.Fatalf("-record-dir and -replay-dir are mutually exclusive")
+	}
+	dev := devOptions{
+		RecordDir: *flagRecordDir,
+		ReplayDir: *flagReplayDir,
+
+		ChaosLatency:       *flagChaosLatency,
+		ChaosErrorRate:     *flagChaosErrors,
+		ChaosMalformedRate: *flagChaosMalformed,
+
+		LogPayloads: *flagLogPayloads,
+	}
+	httpClient := newHTTPClient(config, dev)
+	provider, err := newProvider(config, httpClient)
+	if err != nil {
+		log.Fatalf("Invalid provider: %v", err)
+	}
+	logf(context.Background(), "Weather provider: %s", provider.Name())
+	if err := validateLocationProviders(config); err != nil {
+		log.Fatalf("Invalid location provider: %v", err)
+	}
+	if flag.Arg(0) == "usage" {
+		writeUsageReport(os.Stdout, config, *flagScrapeInterval)
+		return
+	}
+	if flag.Arg(0) == "doctor" {
+		if err := runDoctor(os.Stdout, config, httpClient, provider, *flagScrapeInterval); err != nil {
+			log.Fatalf("Doctor: %v", err)
+		}
+		return
+	}
+
+	exporterRegistry := prometheus.NewRegistry()
+	// the exporter metrics carry the constant labels too, like the weather
+	// metrics
+	exporterRegisterer := prometheus.WrapRegistererWith(prometheus.Labels(config.ConstLabels), exporterRegistry)
+	exporterRegisterer.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(),
+	)
+	registerExporterMetrics(exporterRegisterer, *flagNativeHist)
+
+	acc, err := loadAccumulators(config.StateFile)
+	if err != nil {
+		log.Fatalf("Failed to load state file '%s': %v", config.StateFile, err)
+	}
 
-	wc := NewWeatherCollector(context.Background(), config.Locations, getDescs(config.Metrics), config.GoogleMapsAPIKey, config.DarkskyAPIKey)
-	if err := prometheus.Register(wc); err != nil {
+	weatherRegistry := prometheus.NewRegistry()
+	wc := NewWeatherCollector(context.Background(), config, httpClient, provider, acc)
+	if config.Canary != nil && config.Canary.Location != "" {
+		go newCanary(config, wc.resolveLocation, provider, exporterRegisterer).run(context.Background())
+	}
+	stats.Set("locations", expvar.Func(func() interface{} {
+		return len(wc.Locations())
+	}))
+	exporterRegisterer.MustRegister(newLastSuccessCollector(wc))
+	if failed := wc.geocodeAll(context.Background(), wc.Locations()); len(failed) > 0 {
+		var names []string
+		for _, name := range wc.Locations() {
+			if _, ok := failed[name]; ok {
+				names = append(names, name)
+			}
+		}
+		if *flagStrictLocations {
+			log.Fatalf("%d location(s) could not be geocoded: %v", len(names), names)
+		}
+		warnf(context.Background(), "%d location(s) could not be geocoded, retrying in the background: %v", len(names), names)
+		go wc.retryGeocoding(context.Background(), names)
+	}
+	if wc.polling() {
+		logf(context.Background(), "Refreshing the weather every %s in the background", time.Duration(config.RefreshInterval))
+		wc.refreshAll(context.Background())
+		go wc.poll(context.Background())
+	}
+	if err := weatherRegistry.Register(wc); err != nil {
 		log.Fatalf("Failed to register weather collector: %v", err)
 	}
+	reloader := configReloader{path: *flagConfigFile, wc: wc}
+	go reloader.reloadOnSignal()
+	if *flagStrictLocations {
+		// when polling, the locations that were fetched by the first
+		// refresh are served from the cache
+		failed := wc.refreshEach(context.Background(), wc.Locations(), wc.getLocationWeather)
+		var missing []string
+		for _, name := range wc.Locations() {
+			if _, ok := failed[name]; ok {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			log.Fatalf("Failed to get the weather of %d location(s): %v", len(missing), missing)
+		}
+	}
+
+	if wc.refresh != nil {
+		exporterRegisterer.MustRegister(wc.refresh)
+	}
+
+	var weatherGatherer prometheus.Gatherer = weatherRegistry
+	if !*flagNoExporterStats {
+		weatherGatherer = prometheus.Gatherers{weatherRegistry, exporterRegistry}
+	}
+	handlerOpts := promhttp.HandlerOpts{
+		MaxRequestsInFlight: *flagMaxRequests,
+		Registry:            exporterRegisterer,
+	}
+	http.Handle(*flagPath, promhttp.InstrumentMetricHandler(exporterRegisterer, promhttp.HandlerFor(weatherGatherer, handlerOpts)))
+	http.Handle(*flagExporterPath, promhttp.HandlerFor(exporterRegistry, handlerOpts))
+	if err := validateTenantTokens(config); err != nil {
+		log.Fatalf("Invalid tenant_tokens: %v", err)
+	}
+	for _, name := range config.tenantNames() {
+		if path.Join(*flagPath, name) == *flagExporterPath {
+			log.Fatalf("Tenant '%s' clashes with the exporter metrics path %s", name, *flagExporterPath)
+		}
+		t, err := newTenant(context.Background(), name, config, dev)
+		if err != nil {
+			log.Fatalf("Failed to set up tenant: %v", err)
+		}
+		logf(context.Background(), "Serving tenant '%s' metrics at %s", name, t.handle(*flagPath, handlerOpts, config.TenantTokens))
+	}
+	http.Handle("/-/cardinality", cardinalityHandler(weatherGatherer))
+	http.Handle("/-/usage", usageHandler(wc, *flagScrapeInterval))
+	if config.RenderTemplate != "" {
+		h, err := renderHandler(wc, config.RenderTemplate, config.RenderContentType)
+		if err != nil {
+			log.Fatalf("Failed to load render template: %v", err)
+		}
+		http.Handle("/render", h)
+	}
+	if config.Probe {
+		http.Handle(probePath, probeHandler(wc, handlerOpts))
+		logf(context.Background(), "Serving probes at %s?target=<location>", probePath)
+	}
+	if config.RouteAPI {
+		http.Handle(routePlanPath, routePlanHandler(wc))
+		logf(context.Background(), "Serving the route planning API at %s", routePlanPath)
+	}
+	http.Handle("/dashboard", dashboardHandler(wc))
+	http.Handle("/calendar.ics", calendarHandler(wc))
+	http.Handle("/alerts.atom", alertsFeedHandler(wc))
+	http.Handle("/api/v1/condition-codes", conditionCodesHandler())
+	http.Handle(locationsPath, locationsHandler(wc, *flagAdminAPI))
+	http.Handle(locationsPath+"/", locationsHandler(wc, *flagAdminAPI))
+	if *flagAdminAPI {
+		// every request spends API calls, so they are not served by default
+		http.Handle("/-/refresh", refreshHandler(wc))
+		http.Handle(refreshPath+"/", refreshLocationHandler(wc))
+	}
+	if *flagLifecycle {
+		http.Handle("/-/reload", reloader.handler())
+	}
+	http.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	})
+	warnUsage(config, *flagScrapeInterval)
+
+	var consul *consulRegistration
+	if config.Consul != nil {
+		consul, err = newConsulRegistration(config.Consul, *flagListen, *flagPath, wc.Locations())
+		if err != nil {
+			log.Fatalf("Failed to configure Consul registration: %v", err)
+		}
+	}
+
+	var mdns *mdnsResponder
+	if config.MDNS != nil {
+		mdns, err = newMDNSResponder(config.MDNS, *flagListen, *flagPath)
+		if err != nil {
+			log.Fatalf("Failed to configure mDNS advertisement: %v", err)
+		}
+	}
+
+	var snmp *snmpAgent
+	if config.SNMP != nil {
+		snmp, err = newSNMPAgent(config.SNMP, wc)
+		if err != nil {
+			log.Fatalf("Failed to start the SNMP agent: %v", err)
+		}
+	}
+
+	var modbus *modbusServer
+	if config.Modbus != nil {
+		modbus, err = newModbusServer(config.Modbus, wc)
+		if err != nil {
+			log.Fatalf("Failed to start the Modbus server: %v", err)
+		}
+	}
+
+	var bacnet *bacnetServer
+	if config.BACnet != nil {
+		bacnet, err = newBACnetServer(config.BACnet, wc)
+		if err != nil {
+			log.Fatalf("Failed to start the BACnet server: %v", err)
+		}
+	}
+
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	go wc.refreshOnSignal(shutdownCtx)
+	if config.Alertmanager != nil {
+		logf(context.Background(), "Sending weather alerts to Alertmanager at %s", config.Alertmanager.URL)
+		go newAlertmanagerBridge(config.Alertmanager, config.ConstLabels, wc).run(shutdownCtx)
+	}
+	if config.Notifications != nil {
+		logf(context.Background(), "Evaluating %d notification rule(s)", len(config.Notifications.Rules))
+		go newNotificationDispatcher(config.Notifications, wc).run(shutdownCtx)
+	}
+	if config.KNX != nil {
+		logf(context.Background(), "Publishing %d value(s) to KNX through %s", len(config.KNX.Publish), config.KNX.Gateway)
+		go newKNXPublisher(config.KNX, wc).run(shutdownCtx)
+	}
+	server := http.Server{Addr: *flagListen}
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		logf(context.Background(), "Received %s, shutting down", sig)
+		shutdown()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if consul != nil {
+			if err := consul.deregister(ctx); err != nil {
+				warnf(context.Background(), "Failed to deregister from Consul: %v", err)
+			}
+		}
+		if err := acc.save(); err != nil {
+			warnf(context.Background(), "Failed to save state file: %v", err)
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			warnf(context.Background(), "Failed to shut down the server: %v", err)
+		}
+	}()
 
-	http.Handle(*flagPath, promhttp.Handler())
-	log.Printf("Starting server on %s", *flagListen)
-	log.Fatal(http.ListenAndServe(*flagListen, nil))
+	logf(context.Background(), "Starting server on %s", *flagListen)
+	ln, err := net.Listen("tcp", *flagListen)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *flagListen, err)
+	}
+	if consul != nil {
+		// register once listening, so that the health check can pass right
+		// away
+		if err := consul.register(context.Background()); err != nil {
+			warnf(context.Background(), "Failed to register in Consul: %v", err)
+		} else {
+			logf(context.Background(), "Registered in Consul as '%s'", consul.service.ID)
+		}
+	}
+	if mdns != nil {
+		go mdns.run(shutdownCtx)
+	}
+	if snmp != nil {
+		logf(context.Background(), "Serving SNMP on %s", snmp.conn.LocalAddr())
+		go snmp.run(shutdownCtx)
+	}
+	if modbus != nil {
+		logf(context.Background(), "Serving Modbus TCP on %s", modbus.ln.Addr())
+		go modbus.run(shutdownCtx)
+	}
+	if bacnet != nil {
+		logf(context.Background(), "Serving BACnet/IP on %s as device %d", bacnet.conn.LocalAddr(), bacnet.device.instance)
+		go bacnet.run(shutdownCtx)
+	}
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
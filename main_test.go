@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// BenchmarkMetricsHandler measures a scrape of the metrics endpoint, with and
+// without gzip compression of the exposition, and reports the size of the
+// response.
+func BenchmarkMetricsHandler(b *testing.B) {
+	for _, n := range benchmarkLocations {
+		for _, encoding := range []string{"identity", "gzip"} {
+			b.Run(fmt.Sprintf("locations=%d/%s", n, encoding), func(b *testing.B) {
+				wc := newBenchmarkCollector(b, n, false)
+				wc.refreshAll(context.Background())
+				reg := prometheus.NewRegistry()
+				if err := reg.Register(wc); err != nil {
+					b.Fatal(err)
+				}
+				handler := promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+				var size int
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+					req.Header.Set("Accept-Encoding", encoding)
+					rec := httptest.NewRecorder()
+					handler.ServeHTTP(rec, req)
+					if rec.Code != http.StatusOK {
+						b.Fatalf("got HTTP status %d", rec.Code)
+					}
+					size = rec.Body.Len()
+				}
+				b.ReportMetric(float64(size), "bytes/scrape")
+			})
+		}
+	}
+}
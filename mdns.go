@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsServiceType is the DNS-SD service type Prometheus exporters are
+// advertised as.
+const mdnsServiceType = "_prometheus-http._tcp.local."
+
+// mdnsTTL is the TTL of the advertised records, in seconds.
+const mdnsTTL = 120
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNSConfig configures the mDNS (Zeroconf) advertisement of the exporter.
+type MDNSConfig struct {
+	// Instance is the service instance name. Defaults to
+	// "weather-exporter on <hostname>".
+	Instance string `json:"instance"`
+}
+
+// mdnsResponder advertises the exporter over multicast DNS, answering the
+// DNS-SD queries for the Prometheus service type. Only IPv4 is supported.
+type mdnsResponder struct {
+	conn     *net.UDPConn
+	port     uint16
+	path     string
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	service  dnsmessage.Name
+	addrs    []net.IP
+}
+
+// newMDNSResponder creates a responder for an exporter listening on
+// listenAddr and serving metrics on metricsPath.
+func newMDNSResponder(config *MDNSConfig, listenAddr, metricsPath string) (*mdnsResponder, error) {
+	host, portStr, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address '%s': %w", listenAddr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen port '%s': %w", portStr, err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+	hostname = strings.SplitN(hostname, ".", 2)[0]
+	instance := config.Instance
+	if instance == "" {
+		instance = "weather-exporter on " + hostname
+	}
+	var addrs []net.IP
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		addrs = append(addrs, ip)
+	} else {
+		ifaddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get interface addresses: %w", err)
+		}
+		for _, a := range ifaddrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				addrs = append(addrs, ipnet.IP)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no IPv4 address to advertise")
+	}
+	r := mdnsResponder{
+		port:  uint16(port),
+		path:  metricsPath,
+		addrs: addrs,
+	}
+	if r.service, err = dnsmessage.NewName(mdnsServiceType); err != nil {
+		return nil, err
+	}
+	// dots would split the instance name in several labels
+	instance = strings.ReplaceAll(instance, ".", "-")
+	if r.instance, err = dnsmessage.NewName(instance + "." + mdnsServiceType); err != nil {
+		return nil, fmt.Errorf("invalid instance name '%s': %w", instance, err)
+	}
+	if r.host, err = dnsmessage.NewName(hostname + ".local."); err != nil {
+		return nil, fmt.Errorf("invalid hostname '%s': %w", hostname, err)
+	}
+	r.conn, err = net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join the mDNS group: %w", err)
+	}
+	return &r, nil
+}
+
+// run announces the service and answers queries until ctx is done, then
+// sends a goodbye announcement.
+func (r *mdnsResponder) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		// a TTL of zero tells the other hosts to forget the records
+		if err := r.send(r.records(true, true, true, 0), mdnsGroup, 0, nil); err != nil {
+			warnf(ctx, "Failed to send mDNS goodbye: %v", err)
+		}
+		r.conn.Close()
+	}()
+	// announce twice, one second apart, as recommended by RFC 6762
+	for i := 0; i < 2; i++ {
+		if err := r.send(r.records(true, true, true, mdnsTTL), mdnsGroup, 0, nil); err != nil {
+			warnf(ctx, "Failed to send mDNS announcement: %v", err)
+		}
+		if i == 0 {
+			time.Sleep(time.Second)
+		}
+	}
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				warnf(ctx, "mDNS responder stopped: %v", err)
+			}
+			return
+		}
+		r.handle(buf[:n], src)
+	}
+}
+
+// handle answers a single query, ignoring the questions that are not about
+// the advertised service.
+func (r *mdnsResponder) handle(msg []byte, src *net.UDPAddr) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(msg)
+	if err != nil || hdr.Response {
+		return
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+	var ptr, srv, a bool
+	var answered []dnsmessage.Question
+	for _, q := range questions {
+		name := strings.ToLower(q.Name.String())
+		matched := true
+		switch {
+		case name == strings.ToLower(r.service.String()) && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL):
+			ptr = true
+		case name == strings.ToLower(r.instance.String()) && (q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT || q.Type == dnsmessage.TypeALL):
+			srv = true
+		case name == strings.ToLower(r.host.String()) && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL):
+			a = true
+		default:
+			matched = false
+		}
+		if matched {
+			answered = append(answered, q)
+		}
+	}
+	if !ptr && !srv && !a {
+		return
+	}
+	dst := mdnsGroup
+	var id uint16
+	if src.Port != mdnsGroup.Port {
+		// legacy unicast query, answer directly echoing the ID and the
+		// questions, see RFC 6762 section 6.7
+		dst, id = src, hdr.ID
+	} else {
+		answered = nil
+	}
+	if err := r.send(r.records(ptr, ptr || srv, ptr || srv || a, mdnsTTL), dst, id, answered); err != nil {
+		warnf(context.Background(), "Failed to send mDNS response to %s: %v", src, err)
+	}
+}
+
+// records returns the PTR, SRV and TXT, and A records as requested.
+func (r *mdnsResponder) records(ptr, srv, a bool, ttl uint32) []dnsmessage.Resource {
+	hdr := func(name dnsmessage.Name, typ dnsmessage.Type, flush bool) dnsmessage.ResourceHeader {
+		class := dnsmessage.ClassINET
+		if flush {
+			// cache-flush bit, the records are unique to this host
+			class |= 1 << 15
+		}
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: class, TTL: ttl}
+	}
+	var res []dnsmessage.Resource
+	if ptr {
+		res = append(res, dnsmessage.Resource{
+			Header: hdr(r.service, dnsmessage.TypePTR, false),
+			Body:   &dnsmessage.PTRResource{PTR: r.instance},
+		})
+	}
+	if srv {
+		res = append(res,
+			dnsmessage.Resource{
+				Header: hdr(r.instance, dnsmessage.TypeSRV, true),
+				Body:   &dnsmessage.SRVResource{Port: r.port, Target: r.host},
+			},
+			dnsmessage.Resource{
+				Header: hdr(r.instance, dnsmessage.TypeTXT, true),
+				Body:   &dnsmessage.TXTResource{TXT: []string{"path=" + r.path}},
+			},
+		)
+	}
+	if a {
+		for _, ip := range r.addrs {
+			var ip4 [4]byte
+			copy(ip4[:], ip.To4())
+			res = append(res, dnsmessage.Resource{
+				Header: hdr(r.host, dnsmessage.TypeA, true),
+				Body:   &dnsmessage.AResource{A: ip4},
+			})
+		}
+	}
+	return res
+}
+
+func (r *mdnsResponder) send(answers []dnsmessage.Resource, dst *net.UDPAddr, id uint16, questions []dnsmessage.Question) error {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions: questions,
+		Answers:   answers,
+	}
+	data, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = r.conn.WriteToUDP(data, dst)
+	return err
+}
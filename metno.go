@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// metNoURL is the endpoint of the met.no Locationforecast API, in the
+// variant with all the variables.
+const metNoURL = "https://api.met.no/weatherapi/locationforecast/2.0/complete"
+
+// metNoSymbolWords are the words the met.no weather symbol codes are made of,
+// e.g. "lightrainshowersandthunder", with their text. Longer words come
+// first, and the misspelled codes used by the API are included.
+var metNoSymbolWords = []struct{ code, text string }{
+	{"clearsky", "clear sky"},
+	{"partlycloudy", "partly cloudy"},
+	{"fair", "fair"},
+	{"cloudy", "cloudy"},
+	{"fog", "fog"},
+	{"lightssleet", "light sleet"},
+	{"lightssnow", "light snow"},
+	{"light", "light"},
+	{"heavy", "heavy"},
+	{"rain", "rain"},
+	{"sleet", "sleet"},
+	{"snow", "snow"},
+	{"showers", "showers"},
+	{"and", "and"},
+	{"thunder", "thunder"},
+}
+
+// metNoCondition returns the Dark Sky icon and the summary for a met.no
+// weather symbol code, e.g. "lightrainshowers_day".
+func metNoCondition(symbol string) (string, string) {
+	if symbol == "" {
+		return "", ""
+	}
+	code, variant := symbol, ""
+	if idx := strings.IndexByte(symbol, '_'); idx >= 0 {
+		code, variant = symbol[:idx], symbol[idx+1:]
+	}
+	var words []string
+	for rest := code; rest != ""; {
+		found := false
+		for _, w := range metNoSymbolWords {
+			if strings.HasPrefix(rest, w.code) {
+				words = append(words, w.text)
+				rest = rest[len(w.code):]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", ""
+		}
+	}
+	summary := strings.Join(words, " ")
+	summary = strings.ToUpper(summary[:1]) + summary[1:]
+	var icon string
+	switch {
+	case strings.Contains(code, "thunder"):
+		icon = "thunderstorm"
+	case strings.Contains(code, "sleet"):
+		icon = "sleet"
+	case strings.Contains(code, "snow"):
+		icon = "snow"
+	case strings.Contains(code, "rain"):
+		icon = "rain"
+	case code == "fog":
+		icon = "fog"
+	case code == "cloudy":
+		icon = "cloudy"
+	case code == "clearsky":
+		icon = "clear-day"
+	default:
+		icon = "partly-cloudy-day"
+	}
+	if variant == "night" {
+		icon = strings.Replace(icon, "-day", "-night", 1)
+	}
+	return icon, summary
+}
+
+// apparentTemperature returns the apparent temperature, in Celsius, as
+// defined by the Australian Bureau of Meteorology, for providers that do not
+// report it. The humidity is a ratio and the wind speed is in m/s.
+func apparentTemperature(t, humidity, windSpeed float64) float64 {
+	// water vapour pressure, in hPa
+	e := humidity * 6.105 * math.Exp(17.27*t/(237.7+t))
+	return t + 0.33*e - 0.70*windSpeed - 4.00
+}
+
+// metNoPeriod is the forecast for the period following a time step.
+type metNoPeriod struct {
+	Summary struct {
+		SymbolCode string `json:"symbol_code"`
+	} `json:"summary"`
+	Details map[string]float64 `json:"details"`
+}
+
+// metNoTimestep is a time step of the forecast. The first steps are hourly,
+// the following ones cover 6 hours.
+type metNoTimestep struct {
+	Time time.Time `json:"time"`
+	Data struct {
+		Instant struct {
+			Details map[string]float64 `json:"details"`
+		} `json:"instant"`
+		Next1Hours  *metNoPeriod `json:"next_1_hours"`
+		Next6Hours  *metNoPeriod `json:"next_6_hours"`
+		Next12Hours *metNoPeriod `json:"next_12_hours"`
+	} `json:"data"`
+}
+
+// period returns the shortest period of a time step, and its duration in
+// hours, or nil if there is none.
+func (s *metNoTimestep) period() (*metNoPeriod, float64) {
+	switch {
+	case s.Data.Next1Hours != nil:
+		return s.Data.Next1Hours, 1
+	case s.Data.Next6Hours != nil:
+		return s.Data.Next6Hours, 6
+	case s.Data.Next12Hours != nil:
+		return s.Data.Next12Hours, 12
+	}
+	return nil, 0
+}
+
+// dataPoint converts a time step to SI units, as used by the Dark Sky data
+// model.
+func (s *metNoTimestep) dataPoint() forecast.DataPoint {
+	v := s.Data.Instant.Details
+	dp := forecast.DataPoint{
+		Time:        s.Time.Unix(),
+		Temperature: v["air_temperature"],
+		Humidity:    v["relative_humidity"] / 100,
+		DewPoint:    v["dew_point_temperature"],
+		CloudCover:  v["cloud_area_fraction"] / 100,
+		Pressure:    v["air_pressure_at_sea_level"],
+		WindSpeed:   v["wind_speed"],
+		WindBearing: v["wind_from_direction"],
+		WindGust:    v["wind_speed_of_gust"],
+		UVIndex:     int64(math.Round(v["ultraviolet_index_clear_sky"])),
+	}
+	dp.ApparentTemperature = apparentTemperature(dp.Temperature, dp.Humidity, dp.WindSpeed)
+	if p, hours := s.period(); p != nil {
+		dp.PrecipIntensity = p.Details["precipitation_amount"] / hours
+		dp.PrecipProbability = p.Details["probability_of_precipitation"] / 100
+		dp.Icon, dp.Summary = metNoCondition(p.Summary.SymbolCode)
+		if dp.PrecipIntensity > 0 {
+			dp.PrecipType = metNoPrecipType(p.Summary.SymbolCode)
+		}
+	}
+	return dp
+}
+
+// metNoPrecipType returns the Dark Sky precipitation type for a weather
+// symbol code.
+func metNoPrecipType(symbol string) string {
+	switch {
+	case strings.Contains(symbol, "sleet"):
+		return "sleet"
+	case strings.Contains(symbol, "snow"):
+		return "snow"
+	}
+	return "rain"
+}
+
+type metNoResponse struct {
+	Geometry struct {
+		// Coordinates are the longitude, the latitude and the altitude.
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties struct {
+		Timeseries []metNoTimestep `json:"timeseries"`
+	} `json:"properties"`
+}
+
+// forecast converts a met.no response to the Dark Sky data model. The current
+// conditions are the last time step before now. The API reports no time zone,
+// so the days of the daily forecast follow the solar time of the longitude.
+func (r *metNoResponse) forecast(now time.Time) (*forecast.Forecast, error) {
+	steps := r.Properties.Timeseries
+	if len(steps) == 0 || len(r.Geometry.Coordinates) < 2 {
+		return nil, fmt.Errorf("empty forecast")
+	}
+	fc := forecast.Forecast{
+		Longitude: r.Geometry.Coordinates[0],
+		Latitude:  r.Geometry.Coordinates[1],
+		Offset:    math.Round(r.Geometry.Coordinates[0] / 15),
+		Flags:     forecast.Flags{Units: string(forecast.SI), Sources: []string{"metno"}},
+	}
+	current := 0
+	for idx := range steps {
+		if steps[idx].Time.After(now) {
+			break
+		}
+		current = idx
+	}
+	fc.Currently = steps[current].dataPoint()
+	for idx := range steps {
+		if steps[idx].Data.Next1Hours != nil {
+			fc.Hourly.Data = append(fc.Hourly.Data, steps[idx].dataPoint())
+		}
+	}
+	fc.Daily.Data = metNoDaily(steps, forecastLocation(&fc))
+	return &fc, nil
+}
+
+// metNoDaily aggregates the time steps by day in the given time zone. The
+// condition of a day is the one of the period closest to noon.
+func metNoDaily(steps []metNoTimestep, tz *time.Location) []forecast.DataPoint {
+	var (
+		days []forecast.DataPoint
+		noon []float64
+	)
+	for idx := range steps {
+		s := &steps[idx]
+		t := s.Time.In(tz)
+		midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, tz).Unix()
+		if len(days) == 0 || days[len(days)-1].Time != midnight {
+			days = append(days, forecast.DataPoint{
+				Time:           midnight,
+				TemperatureMin: math.Inf(1),
+				TemperatureMax: math.Inf(-1),
+			})
+			noon = append(noon, math.Inf(1))
+		}
+		day := &days[len(days)-1]
+		dp := s.dataPoint()
+		day.TemperatureMin = math.Min(day.TemperatureMin, dp.Temperature)
+		day.TemperatureMax = math.Max(day.TemperatureMax, dp.Temperature)
+		day.WindSpeed = math.Max(day.WindSpeed, dp.WindSpeed)
+		day.WindGust = math.Max(day.WindGust, dp.WindGust)
+		day.UVIndex = int64(math.Max(float64(day.UVIndex), float64(dp.UVIndex)))
+		day.PrecipProbability = math.Max(day.PrecipProbability, dp.PrecipProbability)
+		p, hours := s.period()
+		if p == nil {
+			continue
+		}
+		// the daily intensity is the total over 24 hours, like Dark Sky
+		day.PrecipIntensity += dp.PrecipIntensity * hours / 24
+		if d := math.Abs(float64(t.Hour()) - 12); d < noon[len(noon)-1] {
+			noon[len(noon)-1] = d
+			day.Icon, day.Summary = metNoCondition(p.Summary.SymbolCode)
+			day.Icon = strings.Replace(day.Icon, "-night", "-day", 1)
+		}
+		if dp.PrecipType != "" && day.PrecipType == "" {
+			day.PrecipType = dp.PrecipType
+		}
+	}
+	return days
+}
+
+// metNoCacheEntry is the last response for a location, reused until it
+// expires, and then revalidated.
+type metNoCacheEntry struct {
+	data         []byte
+	expires      time.Time
+	lastModified string
+}
+
+// metNoProvider gets the weather from the met.no Locationforecast API, which
+// does not require an API key. As per the terms of service, the responses are
+// not requested again before they expire, and are then revalidated with
+// If-Modified-Since.
+type metNoProvider struct {
+	httpClient *http.Client
+	mu         sync.Mutex
+	cache      map[string]*metNoCacheEntry
+}
+
+func newMetNoProvider(httpClient *http.Client) *metNoProvider {
+	return &metNoProvider{httpClient: httpClient, cache: make(map[string]*metNoCacheEntry)}
+}
+
+// Name implements Provider.Name for metNoProvider.
+func (p *metNoProvider) Name() string {
+	return "metno"
+}
+
+// Get implements Provider.Get for metNoProvider.
+func (p *metNoProvider) Get(ctx context.Context, loc *Location) (*Weather, error) {
+	q := url.Values{}
+	// the API rejects coordinates with more than 4 decimals
+	q.Set("lat", strconv.FormatFloat(loc.Lat, 'f', 4, 64))
+	q.Set("lon", strconv.FormatFloat(loc.Lng, 'f', 4, 64))
+	u := metNoURL + "?" + q.Encode()
+	data, err := p.fetch(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	var r metNoResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		countAPIError(p.Name(), reasonDecode)
+		return nil, &APIError{Provider: p.Name(), Reason: reasonDecode, Err: err}
+	}
+	fc, err := r.forecast(time.Now())
+	if err != nil {
+		countAPIError(p.Name(), reasonDecode)
+		return nil, &APIError{Provider: p.Name(), Reason: reasonDecode, Err: err}
+	}
+	return &Weather{Forecast: fc, Stations: &StationInfo{}, Endpoint: metNoURL, ResponseSHA256: sha256Hex(data)}, nil
+}
+
+// fetch returns the response for a URL, from the cache if it has not
+// expired or was not modified.
+func (p *metNoProvider) fetch(ctx context.Context, u string) ([]byte, error) {
+	p.mu.Lock()
+	cached := p.cache[u]
+	p.mu.Unlock()
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached.data, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", exporterUserAgent)
+	if cached != nil && cached.lastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.lastModified)
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		data = cached.data
+	} else if resp.StatusCode >= 400 {
+		reason := reasonForStatus(resp.StatusCode, string(data))
+		countAPIError(p.Name(), reason)
+		return nil, &APIError{Provider: p.Name(), Reason: reason, Err: fmt.Errorf("HTTP status %s: %s", resp.Status, data)}
+	}
+	entry := metNoCacheEntry{data: data, lastModified: resp.Header.Get("Last-Modified")}
+	if cached != nil && entry.lastModified == "" {
+		entry.lastModified = cached.lastModified
+	}
+	if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		entry.expires = expires
+	}
+	p.mu.Lock()
+	p.cache[u] = &entry
+	p.mu.Unlock()
+	return data, nil
+}
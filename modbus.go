@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// ModbusConfig configures the read-only Modbus TCP server.
+type ModbusConfig struct {
+	// Listen is the TCP address to listen to. Defaults to ":5020", since the
+	// standard port 502 requires privileges.
+	Listen string `json:"listen"`
+}
+
+const (
+	defaultModbusListen = ":5020"
+	// modbusIdleTimeout is how long a client connection can stay idle.
+	modbusIdleTimeout = 2 * time.Minute
+	// modbusBlockSize is the number of registers reserved for each location.
+	modbusBlockSize = 64
+	// modbusFirstFieldRegister is the offset in a location block of the first
+	// weather field. Every field takes two registers.
+	modbusFirstFieldRegister = 2
+	// modbusMaxRegisters is the maximum number of registers in a read
+	// request, as per the Modbus specification.
+	modbusMaxRegisters = 125
+)
+
+// Modbus function codes and exception codes.
+const (
+	modbusReadHoldingRegisters = 0x03
+	modbusReadInputRegisters   = 0x04
+
+	modbusIllegalFunction    = 0x01
+	modbusIllegalDataAddress = 0x02
+	modbusIllegalDataValue   = 0x03
+)
+
+func init() {
+	// every location block must fit all the fields
+	if modbusFirstFieldRegister+2*len(fields) > modbusBlockSize {
+		panic(fmt.Sprintf("%d fields do not fit in a Modbus block of %d registers", len(fields), modbusBlockSize))
+	}
+}
+
+// modbusServer is a read-only Modbus TCP server serving the current
+// conditions of every location as holding and input registers. Like the
+// dashboard, it uses the data fetched by the last scrape or poll and never
+// calls the APIs.
+type modbusServer struct {
+	ln net.Listener
+	wc *WeatherCollector
+}
+
+// newModbusServer creates a Modbus TCP server for wc, listening on the
+// configured address.
+func newModbusServer(config *ModbusConfig, wc *WeatherCollector) (*modbusServer, error) {
+	listen := config.Listen
+	if listen == "" {
+		listen = defaultModbusListen
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", listen, err)
+	}
+	return &modbusServer{ln: ln, wc: wc}, nil
+}
+
+// run accepts connections until ctx is done.
+func (s *modbusServer) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.ln.Close()
+	}()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				warnf(ctx, "Modbus server stopped: %v", err)
+			}
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+// serve answers the requests of a client until it disconnects or stays idle
+// for too long.
+func (s *modbusServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	header := make([]byte, 7)
+	for {
+		if err := conn.SetDeadline(time.Now().Add(modbusIdleTimeout)); err != nil {
+			return
+		}
+		// MBAP header: transaction ID, protocol ID, length and unit ID
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		protocol := binary.BigEndian.Uint16(header[2:4])
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		if protocol != 0 || length < 2 || length > 254 {
+			// not Modbus, the stream cannot be resynchronized
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(r, pdu); err != nil {
+			return
+		}
+		resp := s.handle(pdu)
+		frame := make([]byte, 7, 7+len(resp))
+		copy(frame, header[:4])
+		binary.BigEndian.PutUint16(frame[4:6], uint16(len(resp)+1))
+		frame[6] = header[6]
+		if _, err := conn.Write(append(frame, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the response PDU to a request PDU.
+func (s *modbusServer) handle(pdu []byte) []byte {
+	function := pdu[0]
+	exception := func(code byte) []byte {
+		return []byte{function | 0x80, code}
+	}
+	if function != modbusReadHoldingRegisters && function != modbusReadInputRegisters {
+		return exception(modbusIllegalFunction)
+	}
+	if len(pdu) != 5 {
+		return exception(modbusIllegalDataValue)
+	}
+	address := int(binary.BigEndian.Uint16(pdu[1:3]))
+	count := int(binary.BigEndian.Uint16(pdu[3:5]))
+	if count < 1 || count > modbusMaxRegisters {
+		return exception(modbusIllegalDataValue)
+	}
+	registers := s.registers()
+	if address+count > len(registers) {
+		return exception(modbusIllegalDataAddress)
+	}
+	resp := make([]byte, 2, 2+2*count)
+	resp[0], resp[1] = function, byte(2*count)
+	for _, reg := range registers[address : address+count] {
+		resp = append(resp, byte(reg>>8), byte(reg))
+	}
+	return resp
+}
+
+// registers returns the register map for the current weather: a block of
+// modbusBlockSize registers per location, in the configuration order. The
+// first register of a block is 1 if the last fetch succeeded, 0 otherwise,
+// and the weather fields follow as 32-bit floats in big-endian word order,
+// or NaN if the weather has not been fetched yet.
+func (s *modbusServer) registers() []uint16 {
+	snapshot := make(map[string]*LocationWeather)
+	for _, lw := range s.wc.Snapshot() {
+		snapshot[lw.Name] = lw
+	}
+	locations := s.wc.Locations()
+	registers := make([]uint16, len(locations)*modbusBlockSize)
+	for idx, name := range locations {
+		block := registers[idx*modbusBlockSize : (idx+1)*modbusBlockSize]
+		lw, ok := snapshot[name]
+		if ok && !s.wc.isFailing(name) {
+			block[0] = 1
+		}
+		for col := range fields {
+			v := math.NaN()
+			if ok {
+				v = fields[col].Value(&lw.Weather.Forecast.Currently)
+			}
+			bits := math.Float32bits(float32(v))
+			reg := modbusFirstFieldRegister + 2*col
+			block[reg], block[reg+1] = uint16(bits>>16), uint16(bits)
+		}
+	}
+	return registers
+}
+
+// writeModbusMap writes a Markdown table documenting the registers of a
+// location block.
+func writeModbusMap(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "| Offset | Type | Value |\n|--------|------|-------|\n| 0 | uint16 | 1 if the last fetch succeeded, 0 otherwise |"); err != nil {
+		return err
+	}
+	for idx := range fields {
+		f := &fields[idx]
+		if _, err := fmt.Fprintf(w, "| %d | float32 | `%s` (%s) |\n", modbusFirstFieldRegister+2*idx, f.Name, f.Unit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
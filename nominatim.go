@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultNominatimURL is the base URL of the public Nominatim instance.
+const defaultNominatimURL = "https://nominatim.openstreetmap.org"
+
+// nominatimPublicInterval is the minimum interval between two requests to
+// the public Nominatim instance, as per its usage policy. Self-hosted
+// instances are not rate limited.
+const nominatimPublicInterval = time.Second
+
+// nominatimLimiter spaces the requests to the public Nominatim instance.
+var nominatimLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// waitNominatim waits until a request to the public Nominatim instance is
+// allowed, or ctx is done.
+func waitNominatim(ctx context.Context) error {
+	nominatimLimiter.mu.Lock()
+	now := time.Now()
+	at := nominatimLimiter.next
+	if at.Before(now) {
+		at = now
+	}
+	nominatimLimiter.next = at.Add(nominatimPublicInterval)
+	nominatimLimiter.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(at)):
+		return nil
+	}
+}
+
+// nominatimResult is a search result of the Nominatim API, in jsonv2 format.
+type nominatimResult struct {
+	Lat         string `json:"lat"`
+	Lon         string `json:"lon"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	PlaceRank   int    `json:"place_rank"`
+}
+
+// nominatimAccuracy maps the place rank of a result, from 0 (continent) to
+// 30 (building), to the Google Maps location types used for the geocoding
+// accuracy.
+func nominatimAccuracy(placeRank int) string {
+	switch {
+	case placeRank >= 30:
+		return "ROOFTOP"
+	case placeRank >= 26:
+		return "GEOMETRIC_CENTER"
+	default:
+		return "APPROXIMATE"
+	}
+}
+
+// nominatimGeocode geocodes a location name with the Nominatim API at
+// baseURL.
+func nominatimGeocode(ctx context.Context, httpClient *http.Client, baseURL, locName string) (*Location, error) {
+	if baseURL == "" {
+		baseURL = defaultNominatimURL
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if baseURL == defaultNominatimURL {
+		if err := waitNominatim(ctx); err != nil {
+			return nil, err
+		}
+	}
+	q := url.Values{}
+	q.Set("q", locName)
+	q.Set("format", "jsonv2")
+	q.Set("limit", "1")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/search?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", exporterUserAgent)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		countAPIError("nominatim", reasonForError(err))
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		countAPIError("nominatim", reasonForError(err))
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		reason := reasonForStatus(resp.StatusCode, string(data))
+		countAPIError("nominatim", reason)
+		return nil, &APIError{Provider: "nominatim", Reason: reason, Err: fmt.Errorf("HTTP status %s: %s", resp.Status, data)}
+	}
+	var results []nominatimResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		countAPIError("nominatim", reasonDecode)
+		return nil, &APIError{Provider: "nominatim", Reason: reasonDecode, Err: err}
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no location found for '%s'", locName)
+	}
+	r := results[0]
+	lat, err := strconv.ParseFloat(r.Lat, 64)
+	if err != nil {
+		countAPIError("nominatim", reasonDecode)
+		return nil, &APIError{Provider: "nominatim", Reason: reasonDecode, Err: fmt.Errorf("invalid latitude '%s'", r.Lat)}
+	}
+	lng, err := strconv.ParseFloat(r.Lon, 64)
+	if err != nil {
+		countAPIError("nominatim", reasonDecode)
+		return nil, &APIError{Provider: "nominatim", Reason: reasonDecode, Err: fmt.Errorf("invalid longitude '%s'", r.Lon)}
+	}
+	name := r.Name
+	if name == "" {
+		name = strings.Split(r.DisplayName, ",")[0]
+	}
+	return &Location{
+		Name:     name,
+		Lat:      lat,
+		Lng:      lng,
+		Accuracy: nominatimAccuracy(r.PlaceRank),
+	}, nil
+}
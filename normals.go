@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// normalsURL is the Open-Meteo historical weather API, based on the ERA5
+	// reanalysis.
+	normalsURL = "https://archive-api.open-meteo.com/v1/archive"
+	// normalsStartDate and normalsEndDate delimit the WMO reference period.
+	normalsStartDate = "1991-01-01"
+	normalsEndDate   = "2020-12-31"
+	// normalsSmoothingDays is the half-width of the window, in days, used to
+	// smooth the daily normals.
+	normalsSmoothingDays = 7
+	// normalsRetryInterval is the minimum time between two attempts to fetch
+	// the normals of a location after a failure.
+	normalsRetryInterval = time.Hour
+)
+
+// normalsTable holds the normal mean temperature for each day of a
+// non-leap year.
+type normalsTable [365]float64
+
+// dayOfYear returns the 0-based day of a non-leap year for t. The 29th of
+// February is treated as the 28th.
+func dayOfYear(t time.Time) int {
+	doy := t.YearDay() - 1
+	if isLeap(t.Year()) && doy >= 59 {
+		doy--
+	}
+	return doy
+}
+
+func isLeap(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+// getNormals fetches the daily mean temperatures of the reference period for
+// a location, and computes the normal for each day of the year.
+func getNormals(ctx context.Context, httpClient *http.Client, loc *Location) (*normalsTable, error) {
+	params := url.Values{}
+	params.Set("latitude", loc.LatString())
+	params.Set("longitude", loc.LngString())
+	params.Set("start_date", normalsStartDate)
+	params.Set("end_date", normalsEndDate)
+	params.Set("daily", "temperature_2m_mean")
+	var data struct {
+		Daily struct {
+			Time        []string   `json:"time"`
+			Temperature []*float64 `json:"temperature_2m_mean"`
+		} `json:"daily"`
+	}
+	if err := getJSON(ctx, httpClient, normalsURL+"?"+params.Encode(), &data); err != nil {
+		return nil, err
+	}
+	if len(data.Daily.Time) != len(data.Daily.Temperature) {
+		return nil, fmt.Errorf("malformed response: %d days but %d values", len(data.Daily.Time), len(data.Daily.Temperature))
+	}
+	var sums, counts [365]float64
+	for idx, day := range data.Daily.Time {
+		t, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			return nil, fmt.Errorf("malformed date '%s': %w", day, err)
+		}
+		if data.Daily.Temperature[idx] == nil {
+			continue
+		}
+		doy := dayOfYear(t)
+		sums[doy] += *data.Daily.Temperature[idx]
+		counts[doy]++
+	}
+	var table normalsTable
+	for doy := range table {
+		var sum, count float64
+		for d := doy - normalsSmoothingDays; d <= doy+normalsSmoothingDays; d++ {
+			wrapped := (d + 365) % 365
+			sum += sums[wrapped]
+			count += counts[wrapped]
+		}
+		if count == 0 {
+			return nil, fmt.Errorf("no data around day %d", doy+1)
+		}
+		table[doy] = sum / count
+	}
+	return &table, nil
+}
+
+// normalsStore holds the climate normals of every location. They are fetched
+// once, since they do not change.
+type normalsStore struct {
+	httpClient *http.Client
+
+	mu          sync.Mutex
+	tables      map[string]*normalsTable
+	lastAttempt map[string]time.Time
+}
+
+func newNormalsStore(httpClient *http.Client) *normalsStore {
+	return &normalsStore{
+		httpClient:  httpClient,
+		tables:      make(map[string]*normalsTable),
+		lastAttempt: make(map[string]time.Time),
+	}
+}
+
+// get returns the normal temperature for a location at time t, fetching the
+// normals if needed. Only one caller fetches the normals of a location, at
+// most once per normalsRetryInterval: the concurrent ones, e.g. overlapping
+// scrapes, get an error until the normals are available.
+func (s *normalsStore) get(ctx context.Context, name string, loc *Location, t time.Time) (float64, error) {
+	s.mu.Lock()
+	table, ok := s.tables[name]
+	if !ok {
+		if time.Since(s.lastAttempt[name]) < normalsRetryInterval {
+			s.mu.Unlock()
+			return 0, fmt.Errorf("normals not available yet")
+		}
+		s.lastAttempt[name] = time.Now()
+	}
+	s.mu.Unlock()
+	if !ok {
+		var err error
+		table, err = getNormals(ctx, s.httpClient, loc)
+		if err != nil {
+			return 0, err
+		}
+		s.mu.Lock()
+		s.tables[name] = table
+		s.mu.Unlock()
+	}
+	return table[dayOfYear(t)], nil
+}
+
+// prune removes the normals of all the locations not in keep.
+func (s *normalsStore) prune(keep map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.tables {
+		if !keep[name] {
+			delete(s.tables, name)
+			delete(s.lastAttempt, name)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultNotificationInterval is how often the notification rules are
+// evaluated, if not configured.
+const defaultNotificationInterval = time.Minute
+
+// Endpoints of the notification services.
+const (
+	pushoverURL = "https://api.pushover.net/1/messages.json"
+	telegramURL = "https://api.telegram.org"
+)
+
+// NotificationsConfig configures the notifications sent when a metric
+// crosses a threshold, for setups without Prometheus or Alertmanager.
+type NotificationsConfig struct {
+	// Interval is how often the rules are evaluated against the latest
+	// weather.
+	Interval Duration            `json:"interval"`
+	Rules    []*NotificationRule `json:"rules"`
+
+	Ntfy     *NtfyConfig     `json:"ntfy"`
+	Pushover *PushoverConfig `json:"pushover"`
+	Telegram *TelegramConfig `json:"telegram"`
+}
+
+// NotificationRule is a threshold on a metric, e.g. temperature below 0. A
+// notification is sent when the value crosses the threshold, and another one
+// when it crosses it back.
+type NotificationRule struct {
+	Name   string   `json:"name"`
+	Metric string   `json:"metric"`
+	Below  *float64 `json:"below"`
+	Above  *float64 `json:"above"`
+	// Locations restricts the rule to some locations, all by default.
+	Locations []string `json:"locations"`
+}
+
+// NtfyConfig configures the notifications through ntfy.
+type NtfyConfig struct {
+	// URL is the topic URL, e.g. https://ntfy.sh/my-weather.
+	URL string `json:"url"`
+	// Token is the access token, if the topic is protected.
+	Token string `json:"token"`
+}
+
+// PushoverConfig configures the notifications through Pushover.
+type PushoverConfig struct {
+	Token string `json:"token"`
+	User  string `json:"user"`
+}
+
+// TelegramConfig configures the notifications through a Telegram bot.
+type TelegramConfig struct {
+	BotToken string `json:"bot_token"`
+	ChatID   string `json:"chat_id"`
+}
+
+// matches returns whether the value satisfies the rule.
+func (r *NotificationRule) matches(v float64) bool {
+	return (r.Below != nil && v < *r.Below) || (r.Above != nil && v > *r.Above)
+}
+
+// appliesTo returns whether the rule applies to a location.
+func (r *NotificationRule) appliesTo(name string) bool {
+	if len(r.Locations) == 0 {
+		return true
+	}
+	for _, loc := range r.Locations {
+		if loc == name {
+			return true
+		}
+	}
+	return false
+}
+
+// threshold describes the threshold of the rule, e.g. "below 0".
+func (r *NotificationRule) threshold() string {
+	var parts []string
+	if r.Below != nil {
+		parts = append(parts, fmt.Sprintf("below %g", *r.Below))
+	}
+	if r.Above != nil {
+		parts = append(parts, fmt.Sprintf("above %g", *r.Above))
+	}
+	return strings.Join(parts, " or ")
+}
+
+// validateNotifications checks the notification rules and sinks.
+func validateNotifications(config *NotificationsConfig) error {
+	if config.Ntfy == nil && config.Pushover == nil && config.Telegram == nil {
+		return fmt.Errorf("no sink configured, set ntfy, pushover or telegram")
+	}
+	if config.Ntfy != nil && config.Ntfy.URL == "" {
+		return fmt.Errorf("ntfy requires a url")
+	}
+	if config.Pushover != nil && (config.Pushover.Token == "" || config.Pushover.User == "") {
+		return fmt.Errorf("pushover requires a token and a user")
+	}
+	if config.Telegram != nil && (config.Telegram.BotToken == "" || config.Telegram.ChatID == "") {
+		return fmt.Errorf("telegram requires a bot_token and a chat_id")
+	}
+	for idx, r := range config.Rules {
+		if r.Name == "" {
+			return fmt.Errorf("rule %d has no name", idx)
+		}
+		if _, ok := lookupField(r.Metric); !ok {
+			return fmt.Errorf("rule '%s': unsupported metric '%s'", r.Name, r.Metric)
+		}
+		if r.Below == nil && r.Above == nil {
+			return fmt.Errorf("rule '%s' needs below or above", r.Name)
+		}
+	}
+	return nil
+}
+
+// notifier sends notifications to a service.
+type notifier interface {
+	name() string
+	notify(ctx context.Context, httpClient *http.Client, title, message string) error
+}
+
+type ntfyNotifier struct{ config *NtfyConfig }
+
+func (n *ntfyNotifier) name() string { return "ntfy" }
+
+func (n *ntfyNotifier) notify(ctx context.Context, httpClient *http.Client, title, message string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.config.URL, strings.NewReader(message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", title)
+	if n.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.config.Token)
+	}
+	return doNotification(httpClient, req)
+}
+
+type pushoverNotifier struct{ config *PushoverConfig }
+
+func (n *pushoverNotifier) name() string { return "pushover" }
+
+func (n *pushoverNotifier) notify(ctx context.Context, httpClient *http.Client, title, message string) error {
+	form := url.Values{
+		"token":   {n.config.Token},
+		"user":    {n.config.User},
+		"title":   {title},
+		"message": {message},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pushoverURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doNotification(httpClient, req)
+}
+
+type telegramNotifier struct{ config *TelegramConfig }
+
+func (n *telegramNotifier) name() string { return "telegram" }
+
+func (n *telegramNotifier) notify(ctx context.Context, httpClient *http.Client, title, message string) error {
+	form := url.Values{
+		"chat_id": {n.config.ChatID},
+		"text":    {title + "\n" + message},
+	}
+	u := fmt.Sprintf("%s/bot%s/sendMessage", telegramURL, n.config.BotToken)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doNotification(httpClient, req)
+}
+
+// doNotification sends a notification request and checks the response
+// status. The URL is not part of the errors, as it can contain credentials.
+func doNotification(httpClient *http.Client, req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// notificationDispatcher evaluates the notification rules against the latest
+// weather of every location, and notifies the threshold crossings to all the
+// configured sinks.
+type notificationDispatcher struct {
+	config     *NotificationsConfig
+	httpClient *http.Client
+	wc         *WeatherCollector
+	notifiers  []notifier
+	// active holds whether each rule was matching at the last evaluation, by
+	// rule and location.
+	active map[string]bool
+}
+
+func newNotificationDispatcher(config *NotificationsConfig, wc *WeatherCollector) *notificationDispatcher {
+	d := notificationDispatcher{
+		config:     config,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		wc:         wc,
+		active:     make(map[string]bool),
+	}
+	if config.Ntfy != nil {
+		d.notifiers = append(d.notifiers, &ntfyNotifier{config: config.Ntfy})
+	}
+	if config.Pushover != nil {
+		d.notifiers = append(d.notifiers, &pushoverNotifier{config: config.Pushover})
+	}
+	if config.Telegram != nil {
+		d.notifiers = append(d.notifiers, &telegramNotifier{config: config.Telegram})
+	}
+	return &d
+}
+
+// evaluate checks every rule against the latest weather, and sends a
+// notification for every rule that started or stopped matching.
+func (d *notificationDispatcher) evaluate(ctx context.Context) {
+	for _, lw := range d.wc.Snapshot() {
+		for _, r := range d.config.Rules {
+			if !r.appliesTo(lw.Name) {
+				continue
+			}
+			field, _ := lookupField(r.Metric)
+			v := field.Value(&lw.Weather.Forecast.Currently)
+			key := r.Name + "\x00" + lw.Name
+			matching := r.matches(v)
+			if matching == d.active[key] {
+				continue
+			}
+			d.active[key] = matching
+			title := fmt.Sprintf("%s in %s", r.Name, lw.Name)
+			message := fmt.Sprintf("%s is %g, %s", r.Metric, v, r.threshold())
+			if !matching {
+				title = fmt.Sprintf("%s in %s is over", r.Name, lw.Name)
+				message = fmt.Sprintf("%s is back to %g", r.Metric, v)
+			}
+			d.send(ctx, title, message)
+		}
+	}
+}
+
+// send sends a notification to all the sinks, logging the failures.
+func (d *notificationDispatcher) send(ctx context.Context, title, message string) {
+	logf(ctx, "Notification: %s: %s", title, message)
+	for _, n := range d.notifiers {
+		if err := n.notify(ctx, d.httpClient, title, message); err != nil {
+			warnf(ctx, "Failed to send notification through %s: %v", n.name(), err)
+		}
+	}
+}
+
+// run evaluates the rules at every interval until ctx is done.
+func (d *notificationDispatcher) run(ctx context.Context) {
+	interval := time.Duration(d.config.Interval)
+	if interval <= 0 {
+		interval = defaultNotificationInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.evaluate(ctx)
+		}
+	}
+}
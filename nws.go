@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// nwsURL is the base URL of the National Weather Service API.
+const nwsURL = "https://api.weather.gov"
+
+// nwsCloudCover is the cloud cover of the METAR cloud layer amounts.
+var nwsCloudCover = map[string]float64{
+	"SKC": 0,
+	"CLR": 0,
+	"FEW": 0.1875,
+	"SCT": 0.4375,
+	"BKN": 0.75,
+	"OVC": 1,
+	"VV":  1,
+}
+
+// nwsIcons maps the condition codes in the NWS icon URLs to a Dark Sky icon,
+// using "-day" for the icons that have a night variant.
+var nwsIcons = map[string]string{
+	"skc":             "clear-day",
+	"few":             "clear-day",
+	"hot":             "clear-day",
+	"cold":            "clear-day",
+	"sct":             "partly-cloudy-day",
+	"bkn":             "partly-cloudy-day",
+	"ovc":             "cloudy",
+	"wind_skc":        "wind",
+	"wind_few":        "wind",
+	"wind_sct":        "wind",
+	"wind_bkn":        "wind",
+	"wind_ovc":        "wind",
+	"hurricane":       "wind",
+	"tropical_storm":  "wind",
+	"snow":            "snow",
+	"blizzard":        "snow",
+	"rain_snow":       "sleet",
+	"rain_sleet":      "sleet",
+	"snow_sleet":      "sleet",
+	"sleet":           "sleet",
+	"fzra":            "sleet",
+	"rain_fzra":       "sleet",
+	"snow_fzra":       "sleet",
+	"rain":            "rain",
+	"rain_showers":    "rain",
+	"rain_showers_hi": "rain",
+	"tsra":            "thunderstorm",
+	"tsra_sct":        "thunderstorm",
+	"tsra_hi":         "thunderstorm",
+	"tornado":         "tornado",
+	"fog":             "fog",
+	"haze":            "fog",
+	"smoke":           "fog",
+	"dust":            "fog",
+}
+
+// nwsIcon returns the Dark Sky icon for an NWS icon URL, e.g.
+// https://api.weather.gov/icons/land/night/rain,40?size=small .
+func nwsIcon(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(strings.TrimPrefix(parsed.Path, "/icons/land/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	icon := nwsIcons[strings.SplitN(parts[1], ",", 2)[0]]
+	if parts[0] == "night" {
+		icon = strings.Replace(icon, "-day", "-night", 1)
+	}
+	return icon
+}
+
+// compassDirections are the 16 compass points, clockwise from north.
+var compassDirections = []string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+
+// compassBearing returns the bearing in degrees of a compass point, e.g.
+// "SW", or 0 if unknown.
+func compassBearing(direction string) float64 {
+	for idx, d := range compassDirections {
+		if d == direction {
+			return float64(idx) * 360 / float64(len(compassDirections))
+		}
+	}
+	return 0
+}
+
+// greatCircleDistance returns the distance in kilometers between two
+// points, given in degrees.
+func greatCircleDistance(lat1, lng1, lat2, lng2 float64) float64 {
+	const earthRadius = 6371.0
+	rad := math.Pi / 180
+	dLat, dLng := (lat2-lat1)*rad, (lng2-lng1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// nwsQuantity is a value with its WMO unit code, e.g. wmoUnit:degC. Missing
+// values are null.
+type nwsQuantity struct {
+	UnitCode string   `json:"unitCode"`
+	Value    *float64 `json:"value"`
+}
+
+// si returns the value in Celsius, m/s, Pa, meters or percent, and whether
+// it is available.
+func (q *nwsQuantity) si() (float64, bool) {
+	if q == nil || q.Value == nil {
+		return 0, false
+	}
+	v := *q.Value
+	switch strings.TrimPrefix(q.UnitCode, "wmoUnit:") {
+	case "degF":
+		return (v - 32) / 1.8, true
+	case "km_h-1":
+		return v / 3.6, true
+	case "mm":
+		return v / 1000, true
+	case "hPa":
+		return v * 100, true
+	}
+	return v, true
+}
+
+// nwsObservation is the latest observation of a station.
+type nwsObservation struct {
+	Properties struct {
+		Timestamp             time.Time    `json:"timestamp"`
+		TextDescription       string       `json:"textDescription"`
+		Icon                  string       `json:"icon"`
+		Temperature           *nwsQuantity `json:"temperature"`
+		Dewpoint              *nwsQuantity `json:"dewpoint"`
+		WindDirection         *nwsQuantity `json:"windDirection"`
+		WindSpeed             *nwsQuantity `json:"windSpeed"`
+		WindGust              *nwsQuantity `json:"windGust"`
+		SeaLevelPressure      *nwsQuantity `json:"seaLevelPressure"`
+		Visibility            *nwsQuantity `json:"visibility"`
+		RelativeHumidity      *nwsQuantity `json:"relativeHumidity"`
+		HeatIndex             *nwsQuantity `json:"heatIndex"`
+		WindChill             *nwsQuantity `json:"windChill"`
+		PrecipitationLastHour *nwsQuantity `json:"precipitationLastHour"`
+		CloudLayers           []struct {
+			Amount string `json:"amount"`
+		} `json:"cloudLayers"`
+	} `json:"properties"`
+}
+
+// apply overwrites the values of a data point with the observed ones, if
+// available.
+func (o *nwsObservation) apply(dp *forecast.DataPoint) {
+	p := &o.Properties
+	if !p.Timestamp.IsZero() {
+		dp.Time = p.Timestamp.Unix()
+	}
+	if p.TextDescription != "" {
+		dp.Summary = p.TextDescription
+	}
+	if icon := nwsIcon(p.Icon); icon != "" {
+		dp.Icon = icon
+	}
+	if v, ok := p.Temperature.si(); ok {
+		dp.Temperature = v
+	}
+	if v, ok := p.Dewpoint.si(); ok {
+		dp.DewPoint = v
+	}
+	if v, ok := p.RelativeHumidity.si(); ok {
+		dp.Humidity = v / 100
+	}
+	if v, ok := p.WindDirection.si(); ok {
+		dp.WindBearing = v
+	}
+	if v, ok := p.WindSpeed.si(); ok {
+		dp.WindSpeed = v
+	}
+	if v, ok := p.WindGust.si(); ok {
+		dp.WindGust = v
+	}
+	if v, ok := p.SeaLevelPressure.si(); ok {
+		dp.Pressure = v / 100
+	}
+	if v, ok := p.Visibility.si(); ok {
+		dp.Visibility = v / 1000
+	}
+	if v, ok := p.PrecipitationLastHour.si(); ok {
+		dp.PrecipIntensity = v * 1000
+	}
+	for _, l := range p.CloudLayers {
+		dp.CloudCover = math.Max(dp.CloudCover, nwsCloudCover[l.Amount])
+	}
+	dp.ApparentTemperature = apparentTemperature(dp.Temperature, dp.Humidity, dp.WindSpeed)
+	if v, ok := p.HeatIndex.si(); ok {
+		dp.ApparentTemperature = v
+	} else if v, ok := p.WindChill.si(); ok {
+		dp.ApparentTemperature = v
+	}
+}
+
+// nwsPeriod is a period of the hourly forecast, requested in SI units.
+type nwsPeriod struct {
+	StartTime                  time.Time    `json:"startTime"`
+	Temperature                float64      `json:"temperature"`
+	ProbabilityOfPrecipitation *nwsQuantity `json:"probabilityOfPrecipitation"`
+	Dewpoint                   *nwsQuantity `json:"dewpoint"`
+	RelativeHumidity           *nwsQuantity `json:"relativeHumidity"`
+	// WindSpeed is a text, e.g. "15 km/h" or "10 to 15 km/h".
+	WindSpeed     string `json:"windSpeed"`
+	WindDirection string `json:"windDirection"`
+	Icon          string `json:"icon"`
+	ShortForecast string `json:"shortForecast"`
+}
+
+// nwsWindSpeed returns the highest speed in m/s of a forecast wind speed
+// text in km/h.
+func nwsWindSpeed(s string) float64 {
+	var kmh float64
+	for _, f := range strings.Fields(s) {
+		if v, err := strconv.ParseFloat(f, 64); err == nil {
+			kmh = math.Max(kmh, v)
+		}
+	}
+	return kmh / 3.6
+}
+
+// dataPoint converts a forecast period to the Dark Sky data model.
+func (p *nwsPeriod) dataPoint() forecast.DataPoint {
+	dp := forecast.DataPoint{
+		Time:        p.StartTime.Unix(),
+		Summary:     p.ShortForecast,
+		Icon:        nwsIcon(p.Icon),
+		Temperature: p.Temperature,
+		WindSpeed:   nwsWindSpeed(p.WindSpeed),
+		WindBearing: compassBearing(p.WindDirection),
+	}
+	if v, ok := p.ProbabilityOfPrecipitation.si(); ok {
+		dp.PrecipProbability = v / 100
+	}
+	if v, ok := p.Dewpoint.si(); ok {
+		dp.DewPoint = v
+	}
+	if v, ok := p.RelativeHumidity.si(); ok {
+		dp.Humidity = v / 100
+	}
+	dp.ApparentTemperature = apparentTemperature(dp.Temperature, dp.Humidity, dp.WindSpeed)
+	return dp
+}
+
+// nwsAlert is an active alert. The severity of the alert is in its event
+// name, e.g. "Flood Watch".
+type nwsAlert struct {
+	ID         string `json:"id"`
+	Properties struct {
+		Event       string     `json:"event"`
+		AreaDesc    string     `json:"areaDesc"`
+		Description string     `json:"description"`
+		Onset       *time.Time `json:"onset"`
+		Effective   *time.Time `json:"effective"`
+		Ends        *time.Time `json:"ends"`
+		Expires     *time.Time `json:"expires"`
+	} `json:"properties"`
+}
+
+// nwsAlerts converts the NWS alerts to the JSON representation of the Dark
+// Sky alerts, whose type is not exported.
+func nwsAlerts(alerts []nwsAlert) []byte {
+	type dsAlert struct {
+		Title       string   `json:"title"`
+		Regions     []string `json:"regions,omitempty"`
+		Severity    string   `json:"severity,omitempty"`
+		Description string   `json:"description"`
+		Time        int64    `json:"time"`
+		Expires     float64  `json:"expires,omitempty"`
+		URI         string   `json:"uri"`
+	}
+	converted := make([]dsAlert, 0, len(alerts))
+	for _, a := range alerts {
+		p := &a.Properties
+		da := dsAlert{Title: p.Event, Description: p.Description, URI: a.ID}
+		for _, severity := range []string{"warning", "watch", "advisory"} {
+			if strings.HasSuffix(strings.ToLower(p.Event), " "+severity) {
+				da.Severity = severity
+			}
+		}
+		if p.AreaDesc != "" {
+			da.Regions = strings.Split(p.AreaDesc, "; ")
+		}
+		if start := p.Onset; start != nil || p.Effective != nil {
+			if start == nil {
+				start = p.Effective
+			}
+			da.Time = start.Unix()
+		}
+		if end := p.Ends; end != nil || p.Expires != nil {
+			if end == nil {
+				end = p.Expires
+			}
+			da.Expires = float64(end.Unix())
+		}
+		converted = append(converted, da)
+	}
+	// marshaling strings and numbers cannot fail
+	data, _ := json.Marshal(converted)
+	return data
+}
+
+// nwsDaily aggregates the hourly forecast by day in the given time zone. The
+// condition of a day is the one of the hour closest to noon.
+func nwsDaily(hourly []forecast.DataPoint, tz *time.Location) []forecast.DataPoint {
+	var (
+		days []forecast.DataPoint
+		noon []float64
+	)
+	for _, dp := range hourly {
+		t := time.Unix(dp.Time, 0).In(tz)
+		midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, tz).Unix()
+		if len(days) == 0 || days[len(days)-1].Time != midnight {
+			days = append(days, forecast.DataPoint{
+				Time:           midnight,
+				TemperatureMin: math.Inf(1),
+				TemperatureMax: math.Inf(-1),
+			})
+			noon = append(noon, math.Inf(1))
+		}
+		day := &days[len(days)-1]
+		day.TemperatureMin = math.Min(day.TemperatureMin, dp.Temperature)
+		day.TemperatureMax = math.Max(day.TemperatureMax, dp.Temperature)
+		day.WindSpeed = math.Max(day.WindSpeed, dp.WindSpeed)
+		day.PrecipProbability = math.Max(day.PrecipProbability, dp.PrecipProbability)
+		if d := math.Abs(float64(t.Hour()) - 12); d < noon[len(noon)-1] {
+			noon[len(noon)-1] = d
+			day.Summary = dp.Summary
+			day.Icon = strings.Replace(dp.Icon, "-night", "-day", 1)
+		}
+	}
+	return days
+}
+
+// nwsPoint is the forecast grid point of a location, and its nearest
+// observation station.
+type nwsPoint struct {
+	forecastHourly string
+	timeZone       string
+	station        string
+	// distance is the distance to the station, in kilometers.
+	distance float64
+}
+
+// nwsProvider gets the weather from the National Weather Service API, which
+// does not require an API key and only covers the United States. The current
+// conditions are the latest observation of the nearest station, completed
+// with the forecast for the current hour.
+type nwsProvider struct {
+	httpClient *http.Client
+	mu         sync.Mutex
+	// points are the resolved grid points, by coordinates. They never
+	// change.
+	points map[string]*nwsPoint
+}
+
+func newNWSProvider(httpClient *http.Client) *nwsProvider {
+	return &nwsProvider{httpClient: httpClient, points: make(map[string]*nwsPoint)}
+}
+
+// Name implements Provider.Name for nwsProvider.
+func (p *nwsProvider) Name() string {
+	return "nws"
+}
+
+// get decodes the JSON response for a URL into v, and returns the raw
+// response.
+func (p *nwsProvider) get(ctx context.Context, u string, v interface{}) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", exporterUserAgent)
+	req.Header.Set("Accept", "application/geo+json")
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		reason := reasonForStatus(resp.StatusCode, string(data))
+		countAPIError(p.Name(), reason)
+		return nil, &APIError{Provider: p.Name(), Reason: reason, Err: fmt.Errorf("HTTP status %s: %s", resp.Status, data)}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		countAPIError(p.Name(), reasonDecode)
+		return nil, &APIError{Provider: p.Name(), Reason: reasonDecode, Err: err}
+	}
+	return data, nil
+}
+
+// nwsCoordinates returns the coordinates of a location as expected by the
+// API, which redirects coordinates with more than 4 decimals.
+func nwsCoordinates(loc *Location) string {
+	return strconv.FormatFloat(loc.Lat, 'f', 4, 64) + "," + strconv.FormatFloat(loc.Lng, 'f', 4, 64)
+}
+
+// point returns the grid point of a location, resolving it the first time.
+func (p *nwsProvider) point(ctx context.Context, loc *Location) (*nwsPoint, error) {
+	coords := nwsCoordinates(loc)
+	p.mu.Lock()
+	pt, ok := p.points[coords]
+	p.mu.Unlock()
+	if ok {
+		return pt, nil
+	}
+	var points struct {
+		Properties struct {
+			ForecastHourly      string `json:"forecastHourly"`
+			ObservationStations string `json:"observationStations"`
+			TimeZone            string `json:"timeZone"`
+		} `json:"properties"`
+	}
+	if _, err := p.get(ctx, nwsURL+"/points/"+coords, &points); err != nil {
+		return nil, fmt.Errorf("failed to resolve the grid point: %w", err)
+	}
+	var stations struct {
+		Features []struct {
+			Geometry struct {
+				Coordinates []float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties struct {
+				StationIdentifier string `json:"stationIdentifier"`
+			} `json:"properties"`
+		} `json:"features"`
+	}
+	if _, err := p.get(ctx, points.Properties.ObservationStations, &stations); err != nil {
+		return nil, fmt.Errorf("failed to get the observation stations: %w", err)
+	}
+	// the stations are sorted by distance
+	if len(stations.Features) == 0 {
+		return nil, &APIError{Provider: p.Name(), Reason: reasonAPI, Err: fmt.Errorf("no observation station for %s", coords)}
+	}
+	nearest := stations.Features[0]
+	pt = &nwsPoint{
+		forecastHourly: points.Properties.ForecastHourly,
+		timeZone:       points.Properties.TimeZone,
+		station:        nearest.Properties.StationIdentifier,
+	}
+	if c := nearest.Geometry.Coordinates; len(c) >= 2 {
+		pt.distance = greatCircleDistance(loc.Lat, loc.Lng, c[1], c[0])
+	}
+	p.mu.Lock()
+	p.points[coords] = pt
+	p.mu.Unlock()
+	return pt, nil
+}
+
+// Get implements Provider.Get for nwsProvider.
+func (p *nwsProvider) Get(ctx context.Context, loc *Location) (*Weather, error) {
+	pt, err := p.point(ctx, loc)
+	if err != nil {
+		return nil, err
+	}
+	var hourly struct {
+		Properties struct {
+			Periods []nwsPeriod `json:"periods"`
+		} `json:"properties"`
+	}
+	hourlyData, err := p.get(ctx, pt.forecastHourly+"?units=si", &hourly)
+	if err != nil {
+		return nil, err
+	}
+	var obs nwsObservation
+	obsData, err := p.get(ctx, nwsURL+"/stations/"+pt.station+"/observations/latest", &obs)
+	if err != nil {
+		return nil, err
+	}
+	var alerts struct {
+		Features []nwsAlert `json:"features"`
+	}
+	alertsData, err := p.get(ctx, nwsURL+"/alerts/active?point="+nwsCoordinates(loc), &alerts)
+	if err != nil {
+		return nil, err
+	}
+	fc := forecast.Forecast{
+		Latitude:  loc.Lat,
+		Longitude: loc.Lng,
+		Timezone:  pt.timeZone,
+		Flags:     forecast.Flags{Units: string(forecast.SI), Sources: []string{"nws"}},
+	}
+	tz := forecastLocation(&fc)
+	_, offset := time.Now().In(tz).Zone()
+	fc.Offset = float64(offset) / 3600
+	for idx := range hourly.Properties.Periods {
+		fc.Hourly.Data = append(fc.Hourly.Data, hourly.Properties.Periods[idx].dataPoint())
+	}
+	if len(fc.Hourly.Data) > 0 {
+		fc.Currently = fc.Hourly.Data[0]
+	}
+	obs.apply(&fc.Currently)
+	fc.Daily.Data = nwsDaily(fc.Hourly.Data, tz)
+	if len(alerts.Features) > 0 {
+		// the JSON representation matches the Dark Sky one, so this cannot
+		// fail
+		_ = json.Unmarshal(nwsAlerts(alerts.Features), &fc.Alerts)
+	}
+	return &Weather{
+		Forecast: &fc,
+		Stations: &StationInfo{
+			Stations:        []Station{{Source: "nws", ID: pt.station}},
+			NearestDistance: pt.distance,
+		},
+		Endpoint: nwsURL,
+		// there is one response per endpoint
+		ResponseSHA256: sha256Hex(bytes.Join([][]byte{hourlyData, obsData, alertsData}, nil)),
+	}, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// openMeteoURL is the endpoint of the Open-Meteo forecast API.
+const openMeteoURL = "https://api.open-meteo.com/v1/forecast"
+
+// openMeteoVariables are the variables requested for the current conditions
+// and the hourly forecast.
+var openMeteoVariables = []string{
+	"temperature_2m",
+	"apparent_temperature",
+	"relative_humidity_2m",
+	"dew_point_2m",
+	"precipitation",
+	"snowfall",
+	"weather_code",
+	"cloud_cover",
+	"pressure_msl",
+	"visibility",
+	"wind_speed_10m",
+	"wind_direction_10m",
+	"wind_gusts_10m",
+	"uv_index",
+	"is_day",
+}
+
+// openMeteoDailyVariables are the variables requested for the daily forecast.
+var openMeteoDailyVariables = []string{
+	"weather_code",
+	"temperature_2m_max",
+	"temperature_2m_min",
+	"precipitation_sum",
+	"snowfall_sum",
+	"precipitation_probability_max",
+	"sunrise",
+	"sunset",
+	"wind_speed_10m_max",
+	"wind_direction_10m_dominant",
+	"uv_index_max",
+}
+
+// openMeteoConditions maps the WMO weather codes used by Open-Meteo to a Dark
+// Sky icon, using "-day" for the icons that have a night variant, and to a
+// summary.
+var openMeteoConditions = map[int]struct{ icon, summary string }{
+	0:  {"clear-day", "Clear sky"},
+	1:  {"partly-cloudy-day", "Mainly clear"},
+	2:  {"partly-cloudy-day", "Partly cloudy"},
+	3:  {"cloudy", "Overcast"},
+	45: {"fog", "Fog"},
+	48: {"fog", "Depositing rime fog"},
+	51: {"rain", "Light drizzle"},
+	53: {"rain", "Moderate drizzle"},
+	55: {"rain", "Dense drizzle"},
+	56: {"sleet", "Light freezing drizzle"},
+	57: {"sleet", "Dense freezing drizzle"},
+	61: {"rain", "Slight rain"},
+	63: {"rain", "Moderate rain"},
+	65: {"rain", "Heavy rain"},
+	66: {"sleet", "Light freezing rain"},
+	67: {"sleet", "Heavy freezing rain"},
+	71: {"snow", "Slight snowfall"},
+	73: {"snow", "Moderate snowfall"},
+	75: {"snow", "Heavy snowfall"},
+	77: {"snow", "Snow grains"},
+	80: {"rain", "Slight rain showers"},
+	81: {"rain", "Moderate rain showers"},
+	82: {"rain", "Violent rain showers"},
+	85: {"snow", "Slight snow showers"},
+	86: {"snow", "Heavy snow showers"},
+	95: {"thunderstorm", "Thunderstorm"},
+	96: {"thunderstorm", "Thunderstorm with slight hail"},
+	99: {"thunderstorm", "Thunderstorm with heavy hail"},
+}
+
+// openMeteoCondition returns the Dark Sky icon and the summary for a WMO
+// weather code.
+func openMeteoCondition(code float64, isDay bool) (string, string) {
+	c, ok := openMeteoConditions[int(code)]
+	if !ok {
+		return "", ""
+	}
+	if !isDay {
+		c.icon = strings.Replace(c.icon, "-day", "-night", 1)
+	}
+	return c.icon, c.summary
+}
+
+// openMeteoValues are the values of a data point, by variable name.
+type openMeteoValues map[string]float64
+
+// dataPoint converts the values of an Open-Meteo data point to SI units, as
+// used by the Dark Sky data model. precipHours is the duration, in hours, of
+// the period the precipitation refers to.
+func (v openMeteoValues) dataPoint(t int64, precipHours float64) forecast.DataPoint {
+	dp := forecast.DataPoint{
+		Time:                t,
+		Temperature:         v["temperature_2m"],
+		ApparentTemperature: v["apparent_temperature"],
+		Humidity:            v["relative_humidity_2m"] / 100,
+		DewPoint:            v["dew_point_2m"],
+		CloudCover:          v["cloud_cover"] / 100,
+		Pressure:            v["pressure_msl"],
+		Visibility:          v["visibility"] / 1000,
+		WindSpeed:           v["wind_speed_10m"],
+		WindBearing:         v["wind_direction_10m"],
+		WindGust:            v["wind_gusts_10m"],
+		UVIndex:             int64(math.Round(v["uv_index"])),
+		PrecipProbability:   v["precipitation_probability"] / 100,
+	}
+	if precipHours > 0 {
+		dp.PrecipIntensity = v["precipitation"] / precipHours
+	}
+	switch {
+	case v["snowfall"] > 0:
+		dp.PrecipType = "snow"
+	case v["precipitation"] > 0:
+		dp.PrecipType = "rain"
+	}
+	dp.Icon, dp.Summary = openMeteoCondition(v["weather_code"], v["is_day"] != 0)
+	return dp
+}
+
+// openMeteoSeries is an hourly or daily block of the Open-Meteo response, with
+// one array of values per variable. Missing values are null, and decoded as
+// 0.
+type openMeteoSeries map[string]json.RawMessage
+
+// values returns the times of the series, and the values of each time by
+// variable name.
+func (s openMeteoSeries) values() ([]int64, []openMeteoValues, error) {
+	var times []int64
+	if err := json.Unmarshal(s["time"], &times); err != nil {
+		return nil, nil, fmt.Errorf("invalid time: %w", err)
+	}
+	values := make([]openMeteoValues, len(times))
+	for idx := range values {
+		values[idx] = make(openMeteoValues)
+	}
+	for name, raw := range s {
+		if name == "time" {
+			continue
+		}
+		var series []*float64
+		if err := json.Unmarshal(raw, &series); err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		for idx := 0; idx < len(series) && idx < len(times); idx++ {
+			if series[idx] != nil {
+				values[idx][name] = *series[idx]
+			}
+		}
+	}
+	return times, values, nil
+}
+
+type openMeteoResponse struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Timezone  string  `json:"timezone"`
+	// UTCOffset is the offset of the timezone, in seconds.
+	UTCOffset float64         `json:"utc_offset_seconds"`
+	Current   openMeteoValues `json:"current"`
+	Hourly    openMeteoSeries `json:"hourly"`
+	Daily     openMeteoSeries `json:"daily"`
+}
+
+// forecast converts an Open-Meteo response to the Dark Sky data model.
+func (r *openMeteoResponse) forecast() (*forecast.Forecast, error) {
+	fc := forecast.Forecast{
+		Latitude:  r.Latitude,
+		Longitude: r.Longitude,
+		Timezone:  r.Timezone,
+		Offset:    r.UTCOffset / 3600,
+		Flags:     forecast.Flags{Units: string(forecast.SI), Sources: []string{"openmeteo"}},
+	}
+	// the current precipitation is the sum over the preceding interval
+	interval := r.Current["interval"]
+	if interval <= 0 {
+		interval = 3600
+	}
+	fc.Currently = r.Current.dataPoint(int64(r.Current["time"]), interval/3600)
+	times, values, err := r.Hourly.values()
+	if err != nil {
+		return nil, fmt.Errorf("hourly: %w", err)
+	}
+	for idx, t := range times {
+		fc.Hourly.Data = append(fc.Hourly.Data, values[idx].dataPoint(t, 1))
+	}
+	times, values, err = r.Daily.values()
+	if err != nil {
+		return nil, fmt.Errorf("daily: %w", err)
+	}
+	for idx, t := range times {
+		v := values[idx]
+		dp := forecast.DataPoint{
+			Time:              t,
+			TemperatureMin:    v["temperature_2m_min"],
+			TemperatureMax:    v["temperature_2m_max"],
+			PrecipIntensity:   v["precipitation_sum"] / 24,
+			PrecipProbability: v["precipitation_probability_max"] / 100,
+			SunriseTime:       int64(v["sunrise"]),
+			SunsetTime:        int64(v["sunset"]),
+			WindSpeed:         v["wind_speed_10m_max"],
+			WindBearing:       v["wind_direction_10m_dominant"],
+			UVIndex:           int64(math.Round(v["uv_index_max"])),
+		}
+		switch {
+		case v["snowfall_sum"] > 0:
+			dp.PrecipType = "snow"
+		case v["precipitation_sum"] > 0:
+			dp.PrecipType = "rain"
+		}
+		dp.Icon, dp.Summary = openMeteoCondition(v["weather_code"], true)
+		fc.Daily.Data = append(fc.Daily.Data, dp)
+	}
+	return &fc, nil
+}
+
+// openMeteoProvider gets the weather from the Open-Meteo forecast API, which
+// does not require an API key.
+type openMeteoProvider struct {
+	httpClient *http.Client
+	// soil is whether the current soil conditions are requested too.
+	soil bool
+}
+
+// Name implements Provider.Name for openMeteoProvider.
+func (p *openMeteoProvider) Name() string {
+	return "openmeteo"
+}
+
+// Get implements Provider.Get for openMeteoProvider.
+func (p *openMeteoProvider) Get(ctx context.Context, loc *Location) (*Weather, error) {
+	q := url.Values{}
+	q.Set("latitude", loc.LatString())
+	q.Set("longitude", loc.LngString())
+	current := openMeteoVariables
+	if p.soil {
+		current = append(append([]string{}, current...), openMeteoSoilVariables()...)
+	}
+	q.Set("current", strings.Join(current, ","))
+	q.Set("hourly", strings.Join(append(openMeteoVariables, "precipitation_probability"), ","))
+	q.Set("daily", strings.Join(openMeteoDailyVariables, ","))
+	q.Set("wind_speed_unit", "ms")
+	q.Set("timeformat", "unixtime")
+	q.Set("timezone", "auto")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, openMeteoURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		reason := reasonForStatus(resp.StatusCode, string(data))
+		countAPIError(p.Name(), reason)
+		return nil, &APIError{Provider: p.Name(), Reason: reason, Err: fmt.Errorf("HTTP status %s: %s", resp.Status, data)}
+	}
+	var r openMeteoResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		countAPIError(p.Name(), reasonDecode)
+		return nil, &APIError{Provider: p.Name(), Reason: reasonDecode, Err: err}
+	}
+	fc, err := r.forecast()
+	if err != nil {
+		countAPIError(p.Name(), reasonDecode)
+		return nil, &APIError{Provider: p.Name(), Reason: reasonDecode, Err: err}
+	}
+	w := Weather{Forecast: fc, Stations: &StationInfo{}, Endpoint: openMeteoURL, ResponseSHA256: sha256Hex(data)}
+	if p.soil {
+		if w.SoilTemperature, w.SoilMoisture, err = openMeteoSoil(data); err != nil {
+			countAPIError(p.Name(), reasonDecode)
+			return nil, &APIError{Provider: p.Name(), Reason: reasonDecode, Err: err}
+		}
+	}
+	w.QuotaUsage, w.HasQuotaUsage = quotaUsage(p.Name(), resp.Header)
+	return &w, nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// openWeatherMapURL is the endpoint of the OpenWeatherMap One Call API 3.0.
+const openWeatherMapURL = "https://api.openweathermap.org/data/3.0/onecall"
+
+// openWeatherMapCityURL is the endpoint of the OpenWeatherMap Current Weather
+// API, the only one that takes city IDs.
+const openWeatherMapCityURL = "https://api.openweathermap.org/data/2.5/weather"
+
+type owmCondition struct {
+	ID          int    `json:"id"`
+	Description string `json:"description"`
+	Icon        string `json:"icon"`
+}
+
+type owmPrecipitation struct {
+	OneHour float64 `json:"1h"`
+}
+
+// owmDataPoint is a current or hourly data point of the One Call API.
+type owmDataPoint struct {
+	Time       int64             `json:"dt"`
+	Sunrise    int64             `json:"sunrise"`
+	Sunset     int64             `json:"sunset"`
+	Temp       float64           `json:"temp"`
+	FeelsLike  float64           `json:"feels_like"`
+	Pressure   float64           `json:"pressure"`
+	Humidity   float64           `json:"humidity"`
+	DewPoint   float64           `json:"dew_point"`
+	UVI        float64           `json:"uvi"`
+	Clouds     float64           `json:"clouds"`
+	Visibility float64           `json:"visibility"`
+	WindSpeed  float64           `json:"wind_speed"`
+	WindDeg    float64           `json:"wind_deg"`
+	WindGust   float64           `json:"wind_gust"`
+	Pop        float64           `json:"pop"`
+	Weather    []owmCondition    `json:"weather"`
+	Rain       *owmPrecipitation `json:"rain"`
+	Snow       *owmPrecipitation `json:"snow"`
+}
+
+// owmDaily is a daily data point of the One Call API. Rain and snow are daily
+// totals in millimeters.
+type owmDaily struct {
+	Time      int64   `json:"dt"`
+	Sunrise   int64   `json:"sunrise"`
+	Sunset    int64   `json:"sunset"`
+	MoonPhase float64 `json:"moon_phase"`
+	Summary   string  `json:"summary"`
+	Temp      struct {
+		Min float64 `json:"min"`
+		Max float64 `json:"max"`
+	} `json:"temp"`
+	Pressure  float64        `json:"pressure"`
+	Humidity  float64        `json:"humidity"`
+	DewPoint  float64        `json:"dew_point"`
+	WindSpeed float64        `json:"wind_speed"`
+	WindDeg   float64        `json:"wind_deg"`
+	WindGust  float64        `json:"wind_gust"`
+	Clouds    float64        `json:"clouds"`
+	Pop       float64        `json:"pop"`
+	Rain      float64        `json:"rain"`
+	Snow      float64        `json:"snow"`
+	UVI       float64        `json:"uvi"`
+	Weather   []owmCondition `json:"weather"`
+}
+
+type owmResponse struct {
+	Lat            float64      `json:"lat"`
+	Lon            float64      `json:"lon"`
+	Timezone       string       `json:"timezone"`
+	TimezoneOffset float64      `json:"timezone_offset"`
+	Current        owmDataPoint `json:"current"`
+	Minutely       []struct {
+		Time          int64   `json:"dt"`
+		Precipitation float64 `json:"precipitation"`
+	} `json:"minutely"`
+	Hourly []owmDataPoint `json:"hourly"`
+	Daily  []owmDaily     `json:"daily"`
+	Alerts []owmAlert     `json:"alerts"`
+}
+
+// owmAlert is a national weather alert of the One Call API. It has no
+// severity.
+type owmAlert struct {
+	SenderName  string `json:"sender_name"`
+	Event       string `json:"event"`
+	Start       int64  `json:"start"`
+	End         int64  `json:"end"`
+	Description string `json:"description"`
+}
+
+// owmAlerts converts the One Call API alerts to the JSON representation of
+// the Dark Sky alerts, whose type is not exported.
+func owmAlerts(alerts []owmAlert) []byte {
+	type dsAlert struct {
+		Title       string   `json:"title"`
+		Regions     []string `json:"regions,omitempty"`
+		Description string   `json:"description"`
+		Time        int64    `json:"time"`
+		Expires     float64  `json:"expires,omitempty"`
+	}
+	converted := make([]dsAlert, 0, len(alerts))
+	for _, a := range alerts {
+		da := dsAlert{Title: a.Event, Description: a.Description, Time: a.Start, Expires: float64(a.End)}
+		if a.SenderName != "" {
+			da.Regions = []string{a.SenderName}
+		}
+		converted = append(converted, da)
+	}
+	// marshaling strings and numbers cannot fail
+	data, _ := json.Marshal(converted)
+	return data
+}
+
+// owmIcon maps an OpenWeatherMap condition to a Dark Sky icon, see
+// https://openweathermap.org/weather-conditions .
+func owmIcon(conds []owmCondition) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	c := conds[0]
+	night := strings.HasSuffix(c.Icon, "n")
+	switch {
+	case c.ID >= 200 && c.ID < 300:
+		return "thunderstorm"
+	case c.ID >= 611 && c.ID <= 616:
+		return "sleet"
+	case c.ID >= 300 && c.ID < 600:
+		return "rain"
+	case c.ID >= 600 && c.ID < 700:
+		return "snow"
+	case c.ID == 781:
+		return "tornado"
+	case c.ID >= 700 && c.ID < 800:
+		return "fog"
+	case c.ID == 800 && night:
+		return "clear-night"
+	case c.ID == 800:
+		return "clear-day"
+	case (c.ID == 801 || c.ID == 802) && night:
+		return "partly-cloudy-night"
+	case c.ID == 801 || c.ID == 802:
+		return "partly-cloudy-day"
+	case c.ID > 802:
+		return "cloudy"
+	}
+	return ""
+}
+
+func owmSummary(conds []owmCondition) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	d := conds[0].Description
+	if d == "" {
+		return ""
+	}
+	return strings.ToUpper(d[:1]) + d[1:]
+}
+
+// dataPoint converts an OpenWeatherMap data point to SI units, as used by
+// the Dark Sky data model: ratios instead of percentages, and visibility in
+// kilometers.
+func (p *owmDataPoint) dataPoint() forecast.DataPoint {
+	dp := forecast.DataPoint{
+		Time:                p.Time,
+		Summary:             owmSummary(p.Weather),
+		Icon:                owmIcon(p.Weather),
+		SunriseTime:         p.Sunrise,
+		SunsetTime:          p.Sunset,
+		Temperature:         p.Temp,
+		ApparentTemperature: p.FeelsLike,
+		DewPoint:            p.DewPoint,
+		WindSpeed:           p.WindSpeed,
+		WindGust:            p.WindGust,
+		WindBearing:         p.WindDeg,
+		CloudCover:          p.Clouds / 100,
+		Humidity:            p.Humidity / 100,
+		Pressure:            p.Pressure,
+		Visibility:          p.Visibility / 1000,
+		UVIndex:             int64(math.Round(p.UVI)),
+		PrecipProbability:   p.Pop,
+	}
+	if p.Rain != nil {
+		dp.PrecipIntensity += p.Rain.OneHour
+		dp.PrecipType = "rain"
+	}
+	if p.Snow != nil {
+		dp.PrecipIntensity += p.Snow.OneHour
+		dp.PrecipType = "snow"
+	}
+	return dp
+}
+
+func (d *owmDaily) dataPoint() forecast.DataPoint {
+	dp := forecast.DataPoint{
+		Time:              d.Time,
+		Summary:           d.Summary,
+		Icon:              owmIcon(d.Weather),
+		SunriseTime:       d.Sunrise,
+		SunsetTime:        d.Sunset,
+		MoonPhase:         d.MoonPhase,
+		TemperatureMin:    d.Temp.Min,
+		TemperatureMax:    d.Temp.Max,
+		DewPoint:          d.DewPoint,
+		WindSpeed:         d.WindSpeed,
+		WindGust:          d.WindGust,
+		WindBearing:       d.WindDeg,
+		CloudCover:        d.Clouds / 100,
+		Humidity:          d.Humidity / 100,
+		Pressure:          d.Pressure,
+		UVIndex:           int64(math.Round(d.UVI)),
+		PrecipProbability: d.Pop,
+		// daily totals, while Dark Sky reports the mean intensity
+		PrecipIntensity: (d.Rain + d.Snow) / 24,
+	}
+	switch {
+	case d.Snow > 0:
+		dp.PrecipType = "snow"
+	case d.Rain > 0:
+		dp.PrecipType = "rain"
+	}
+	return dp
+}
+
+// forecast converts a One Call API response to the Dark Sky data model.
+func (r *owmResponse) forecast() *forecast.Forecast {
+	fc := forecast.Forecast{
+		Latitude:  r.Lat,
+		Longitude: r.Lon,
+		Timezone:  r.Timezone,
+		Offset:    r.TimezoneOffset / 3600,
+		Currently: r.Current.dataPoint(),
+		Flags:     forecast.Flags{Units: string(forecast.SI), Sources: []string{"openweathermap"}},
+	}
+	for _, m := range r.Minutely {
+		fc.Minutely.Data = append(fc.Minutely.Data, forecast.DataPoint{Time: m.Time, PrecipIntensity: m.Precipitation})
+	}
+	for idx := range r.Hourly {
+		fc.Hourly.Data = append(fc.Hourly.Data, r.Hourly[idx].dataPoint())
+	}
+	for idx := range r.Daily {
+		fc.Daily.Data = append(fc.Daily.Data, r.Daily[idx].dataPoint())
+	}
+	if len(r.Alerts) > 0 {
+		// the JSON representation matches the Dark Sky one, so this cannot
+		// fail
+		_ = json.Unmarshal(owmAlerts(r.Alerts), &fc.Alerts)
+	}
+	return &fc
+}
+
+// openWeatherMapProvider gets the weather from the OpenWeatherMap One Call
+// API.
+type openWeatherMapProvider struct {
+	httpClient *http.Client
+	apiKey     string
+}
+
+// Name implements Provider.Name for openWeatherMapProvider.
+func (p *openWeatherMapProvider) Name() string {
+	return "openweathermap"
+}
+
+// locate implements nativeLocator.locate for openWeatherMapProvider, with the
+// OpenWeatherMap city IDs. The One Call API only takes coordinates, so the
+// ones of the city are used.
+func (p *openWeatherMapProvider) locate(ctx context.Context, id string) (*Location, error) {
+	q := url.Values{}
+	q.Set("id", id)
+	q.Set("appid", p.apiKey)
+	var r struct {
+		Name  string `json:"name"`
+		Coord struct {
+			Lat float64 `json:"lat"`
+			Lon float64 `json:"lon"`
+		} `json:"coord"`
+	}
+	if err := getJSON(ctx, p.httpClient, openWeatherMapCityURL+"?"+q.Encode(), &r); err != nil {
+		return nil, fmt.Errorf("city ID lookup failed: %w", err)
+	}
+	return &Location{Name: r.Name, Lat: r.Coord.Lat, Lng: r.Coord.Lon, Accuracy: "APPROXIMATE"}, nil
+}
+
+// Get implements Provider.Get for openWeatherMapProvider.
+func (p *openWeatherMapProvider) Get(ctx context.Context, loc *Location) (*Weather, error) {
+	q := url.Values{}
+	q.Set("lat", loc.LatString())
+	q.Set("lon", loc.LngString())
+	q.Set("units", "metric")
+	q.Set("appid", p.apiKey)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, openWeatherMapURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		reason := reasonForStatus(resp.StatusCode, string(data))
+		countAPIError(p.Name(), reason)
+		return nil, &APIError{Provider: p.Name(), Reason: reason, Err: fmt.Errorf("HTTP status %s: %s", resp.Status, data)}
+	}
+	var r owmResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		countAPIError(p.Name(), reasonDecode)
+		return nil, &APIError{Provider: p.Name(), Reason: reasonDecode, Err: err}
+	}
+	w := Weather{Forecast: r.forecast(), Stations: &StationInfo{}, Endpoint: openWeatherMapURL, ResponseSHA256: sha256Hex(data)}
+	w.QuotaUsage, w.HasQuotaUsage = quotaUsage(p.Name(), resp.Header)
+	return &w, nil
+}
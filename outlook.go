@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// weekOutlook aggregates the daily forecast over a week.
+type weekOutlook struct {
+	// Week is the offset from the current week, starting at 0 for the next
+	// seven days including today.
+	Week int
+	// Days is the number of forecast days in the week, which can be less
+	// than seven for the last week covered by the provider.
+	Days int
+	// MeanTemperature is the mean of the daily minimum and maximum
+	// temperatures, in celsius.
+	MeanTemperature float64
+	// Precipitation is the expected total precipitation, in millimeters.
+	Precipitation float64
+}
+
+// weeklyOutlook aggregates the daily forecast into at most weeks weekly
+// outlooks. Like for the daily forecast, the days are bucketed by their offset
+// from today in the timezone of the location, so that a cached forecast does
+// not count past days in the current week.
+func weeklyOutlook(fc *forecast.Forecast, now time.Time, weeks int) []weekOutlook {
+	var outlooks []weekOutlook
+	for _, day := range dailyForecast(fc, now, weeks*7) {
+		week := day.Offset / 7
+		// the days are in order, and weeks without any day are skipped
+		if len(outlooks) == 0 || outlooks[len(outlooks)-1].Week != week {
+			outlooks = append(outlooks, weekOutlook{Week: week})
+		}
+		o := &outlooks[len(outlooks)-1]
+		o.Days++
+		o.MeanTemperature += (day.DataPoint.TemperatureMin + day.DataPoint.TemperatureMax) / 2
+		// the daily precipitation intensity is the average over the day, in
+		// mm/h
+		o.Precipitation += day.DataPoint.PrecipIntensity * 24
+	}
+	for idx := range outlooks {
+		outlooks[idx].MeanTemperature /= float64(outlooks[idx].Days)
+	}
+	return outlooks
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultRefreshConcurrency is the number of locations fetched in parallel,
+// if not configured.
+const defaultRefreshConcurrency = 4
+
+// refreshJitter is how early a refresh can happen. It makes sure that a poll
+// or scrape that is aligned with the refresh interval is not skipped because
+// the previous one was slightly delayed.
+const refreshJitter = 2 * time.Second
+
+// polling returns whether the weather is refreshed in the background rather
+// than at scrape time.
+func (wc *WeatherCollector) polling() bool {
+	return wc.cfg().RefreshInterval > 0
+}
+
+// refreshAll refreshes the weather of every location, using a pool of
+// workers, and then the data that is not fetched by location, so that Collect
+// never calls the APIs. Errors are logged, and the last values of the failed
+// locations are kept.
+func (wc *WeatherCollector) refreshAll(ctx context.Context) {
+	ctx = withCorrelationID(ctx, "poll-"+newCorrelationID())
+	wc.refreshEach(ctx, wc.Locations(), wc.getLocationWeather)
+	wc.refreshRoutes(ctx)
+	wc.refreshConsensus(ctx)
+	wc.refreshRiverGauges(ctx)
+	wc.refreshAvalanche(ctx)
+}
+
+// refreshEach calls get for each location, using a pool of workers, and
+// returns the errors by location. Errors are also logged.
+func (wc *WeatherCollector) refreshEach(ctx context.Context, locations []string, get func(context.Context, string) (*LocationWeather, error)) map[string]error {
+	var mu sync.Mutex
+	failed := make(map[string]error)
+	wc.forEachLocation(locations, func(_ int, name string) {
+		if _, err := get(ctx, name); err != nil {
+			errorf(withLogFields(ctx, "location", name), "Failed to refresh weather for '%s': %v", name, err)
+			mu.Lock()
+			failed[name] = err
+			mu.Unlock()
+		}
+	})
+	return failed
+}
+
+// forEachLocation calls fn with the index and the name of every location,
+// using a pool of refresh_concurrency workers, and waits for all the calls
+// to return. If refresh_concurrency is not set, the low-memory mode uses a
+// single worker.
+func (wc *WeatherCollector) forEachLocation(locations []string, fn func(int, string)) {
+	concurrency := wc.cfg().RefreshConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultRefreshConcurrency
+		if wc.cfg().LowMemory {
+			concurrency = lowMemoryConcurrency
+		}
+	}
+	if concurrency > len(locations) {
+		concurrency = len(locations)
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				fn(idx, locations[idx])
+			}
+		}()
+	}
+	for idx := range locations {
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// poll refreshes the weather of every location at every refresh interval,
+// until ctx is done.
+func (wc *WeatherCollector) poll(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(wc.cfg().RefreshInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wc.refreshAll(ctx)
+		}
+	}
+}
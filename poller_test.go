@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// benchmarkLocations are the numbers of locations of the benchmarks, from the
+// target of the low-memory mode to a large deployment.
+var benchmarkLocations = []int{10, 100, 1000}
+
+// staticProvider returns the same weather for every location, without any
+// network access.
+type staticProvider struct {
+	weather *Weather
+}
+
+func (p *staticProvider) Name() string {
+	return "static"
+}
+
+func (p *staticProvider) Get(ctx context.Context, loc *Location) (*Weather, error) {
+	return p.weather, nil
+}
+
+// newStaticProvider returns a provider with a 48-hour and 8-day forecast, like
+// most of the real ones.
+func newStaticProvider() *staticProvider {
+	now := time.Now()
+	point := func(t time.Time) forecast.DataPoint {
+		return forecast.DataPoint{
+			Time:              t.Unix(),
+			Temperature:       21.5,
+			TemperatureMin:    15,
+			TemperatureMax:    25,
+			Humidity:          0.6,
+			Pressure:          1013,
+			WindSpeed:         3,
+			WindBearing:       270,
+			CloudCover:        0.4,
+			PrecipIntensity:   0.2,
+			PrecipProbability: 0.3,
+			UVIndex:           4,
+		}
+	}
+	fc := forecast.Forecast{Latitude: 52.1, Longitude: 4.3, Timezone: "Europe/Amsterdam", Currently: point(now)}
+	for h := 0; h < 48; h++ {
+		fc.Hourly.Data = append(fc.Hourly.Data, point(now.Add(time.Duration(h)*time.Hour)))
+	}
+	for d := 0; d < 8; d++ {
+		fc.Daily.Data = append(fc.Daily.Data, point(now.AddDate(0, 0, d)))
+	}
+	return &staticProvider{weather: &Weather{Forecast: &fc, Stations: &StationInfo{}}}
+}
+
+// newBenchmarkCollector returns a polling collector of n locations with
+// explicit coordinates, so that nothing is geocoded, exporting the hourly and
+// daily forecasts. Nothing is logged.
+func newBenchmarkCollector(b *testing.B, n int, lowMemory bool) *WeatherCollector {
+	defaultLogger.out = io.Discard
+	config := Config{
+		Metrics:         []string{"temperature", "apparent_temperature", "humidity", "pressure", "wind_speed", "cloud_cover", "precip_intensity", "precip_probability"},
+		RefreshInterval: Duration(time.Hour),
+		LowMemory:       lowMemory,
+		ForecastHours:   24,
+		ForecastDays:    7,
+	}
+	for idx := 0; idx < n; idx++ {
+		lat, lng := 52.1+float64(idx/100)/10, 4.3+float64(idx%100)/10
+		config.Locations = append(config.Locations, LocationConfig{Name: fmt.Sprintf("location %d", idx), Lat: &lat, Lng: &lng})
+	}
+	acc, err := loadAccumulators("")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return NewWeatherCollector(context.Background(), &config, http.DefaultClient, newStaticProvider(), acc)
+}
+
+// BenchmarkRefreshAll measures a background refresh of all the locations.
+func BenchmarkRefreshAll(b *testing.B) {
+	for _, n := range benchmarkLocations {
+		for _, lowMemory := range []bool{false, true} {
+			b.Run(fmt.Sprintf("locations=%d/low_memory=%v", n, lowMemory), func(b *testing.B) {
+				wc := newBenchmarkCollector(b, n, lowMemory)
+				ctx := context.Background()
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					wc.refreshAll(ctx)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkCollect measures a scrape of the cached weather of all the
+// locations, including the encoding of the metrics.
+func BenchmarkCollect(b *testing.B) {
+	for _, n := range benchmarkLocations {
+		for _, lowMemory := range []bool{false, true} {
+			b.Run(fmt.Sprintf("locations=%d/low_memory=%v", n, lowMemory), func(b *testing.B) {
+				wc := newBenchmarkCollector(b, n, lowMemory)
+				wc.refreshAll(context.Background())
+				reg := prometheus.NewPedanticRegistry()
+				if err := reg.Register(wc); err != nil {
+					b.Fatal(err)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := reg.Gather(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
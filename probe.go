@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probePath is the path of the multi-target endpoint.
+const probePath = "/probe"
+
+// probeCollector collects the weather of a single location, given by the
+// scrape configuration rather than by the exporter configuration.
+type probeCollector struct {
+	wc     *WeatherCollector
+	target string
+}
+
+// Describe implements prometheus.Collector.Describe for probeCollector. It
+// sends no descriptors, which makes the collector unchecked, since
+// describing the metrics would fetch the weather.
+func (c *probeCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.Collect for probeCollector.
+// Configured locations go through the caches like in a regular scrape, the
+// others are fetched at every probe.
+func (c *probeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := withCorrelationID(c.wc.ctx, "probe-"+newCorrelationID())
+	get := c.wc.fetch
+	for _, name := range c.wc.Locations() {
+		if name == c.target {
+			get = c.wc.getLocationWeather
+			break
+		}
+	}
+	lw, err := get(ctx, c.target)
+	if err != nil {
+		errorf(ctx, "Failed to get weather for '%s': %v", c.target, err)
+		ch <- prometheus.MustNewConstMetric(c.wc.upDesc, prometheus.GaugeValue, 0, c.target)
+		return
+	}
+	c.wc.collectLocation(ch, c.target, lw)
+}
+
+// probeHandler returns an HTTP handler exporting the weather of the location
+// in the target query parameter, e.g. /probe?target=Amsterdam, as per the
+// Prometheus multi-target exporter pattern.
+func probeHandler(wc *WeatherCollector, opts promhttp.HandlerOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "missing target parameter", http.StatusBadRequest)
+			return
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(&probeCollector{wc: wc, target: target})
+		promhttp.HandlerFor(registry, opts).ServeHTTP(w, r)
+	})
+}
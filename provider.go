@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// defaultProvider is the weather provider used if none is configured.
+const defaultProvider = "darksky"
+
+// Provider is a source of weather data. Every provider maps its data onto
+// the Dark Sky data model, in SI units, so that the same metrics are exported
+// regardless of the provider.
+type Provider interface {
+	// Name returns the name of the provider, as used in the configuration
+	// file and in the exporter metrics.
+	Name() string
+	// Get returns the weather at the given location.
+	Get(ctx context.Context, loc *Location) (*Weather, error)
+}
+
+// nativeLocator is implemented by the providers that have their own location
+// IDs, which can be used instead of geocoding the location names.
+type nativeLocator interface {
+	// locate returns the location with the given provider-native ID.
+	locate(ctx context.Context, id string) (*Location, error)
+}
+
+// providers are the constructors of the supported providers, by name.
+var providers = map[string]func(config *Config, httpClient *http.Client) Provider{
+	"darksky": func(config *Config, httpClient *http.Client) Provider {
+		return &darkskyProvider{httpClient: httpClient, apiKey: config.DarkskyAPIKey}
+	},
+	"openweathermap": func(config *Config, httpClient *http.Client) Provider {
+		return &openWeatherMapProvider{httpClient: httpClient, apiKey: config.OpenWeatherMapAPIKey}
+	},
+	"openmeteo": func(config *Config, httpClient *http.Client) Provider {
+		return &openMeteoProvider{httpClient: httpClient, soil: config.Soil}
+	},
+	"metno": func(config *Config, httpClient *http.Client) Provider {
+		return newMetNoProvider(httpClient)
+	},
+	"nws": func(config *Config, httpClient *http.Client) Provider {
+		return newNWSProvider(httpClient)
+	},
+	"pirateweather": func(config *Config, httpClient *http.Client) Provider {
+		baseURL := strings.TrimSuffix(config.PirateWeatherURL, "/")
+		if baseURL == "" {
+			baseURL = defaultPirateWeatherURL
+		}
+		return &pirateWeatherProvider{httpClient: httpClient, apiKey: config.PirateWeatherAPIKey, baseURL: baseURL}
+	},
+	"tomorrowio": func(config *Config, httpClient *http.Client) Provider {
+		return &tomorrowIOProvider{httpClient: httpClient, apiKey: config.TomorrowIOAPIKey}
+	},
+	"accuweather": func(config *Config, httpClient *http.Client) Provider {
+		hourly, daily := config.accuWeatherForecasts()
+		return &accuWeatherProvider{
+			httpClient: httpClient,
+			apiKey:     config.AccuWeatherAPIKey,
+			hourly:     hourly,
+			daily:      daily,
+		}
+	},
+	"visualcrossing": func(config *Config, httpClient *http.Client) Provider {
+		return &visualCrossingProvider{httpClient: httpClient, apiKey: config.VisualCrossingAPIKey}
+	},
+}
+
+// providerEndpoints are the base URLs of the providers, used to check the
+// connectivity.
+var providerEndpoints = map[string]string{
+	"darksky":        "https://api.darksky.net/",
+	"openweathermap": "https://api.openweathermap.org/",
+	"openmeteo":      "https://api.open-meteo.com/",
+	"metno":          "https://api.met.no/",
+	"nws":            "https://api.weather.gov/",
+	"pirateweather":  "https://api.pirateweather.net/",
+	"tomorrowio":     "https://api.tomorrow.io/",
+	"accuweather":    "https://dataservice.accuweather.com/",
+	"visualcrossing": "https://weather.visualcrossing.com/",
+}
+
+// providerNames returns the names of the supported providers, sorted.
+func providerNames() []string {
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// providerName returns the name of the configured provider.
+func (c *Config) providerName() string {
+	if c.Provider == "" {
+		return defaultProvider
+	}
+	return c.Provider
+}
+
+// newProvider returns the configured provider.
+func newProvider(config *Config, httpClient *http.Client) (Provider, error) {
+	newFunc, ok := providers[config.providerName()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported provider '%s', must be one of %v", config.providerName(), providerNames())
+	}
+	return newFunc(config, httpClient), nil
+}
+
+// defaultFailoverTimeout is the default time allowed to each provider of a
+// failover chain before trying the next one.
+const defaultFailoverTimeout = 10 * time.Second
+
+// providerList returns the providers of a location in priority order, or nil
+// if it uses the main provider.
+func (l *LocationConfig) providerList() []string {
+	if len(l.Providers) > 0 {
+		return l.Providers
+	}
+	if l.Provider != "" {
+		return []string{l.Provider}
+	}
+	return nil
+}
+
+// providerConfig returns the configuration of a provider, with the given API
+// key if set.
+func (c *Config) providerConfig(name, apiKey string) (*Config, error) {
+	pc := *c
+	pc.Provider = name
+	if _, ok := providers[pc.providerName()]; !ok {
+		return nil, fmt.Errorf("unsupported provider '%s', must be one of %v", pc.providerName(), providerNames())
+	}
+	if apiKey == "" {
+		return &pc, nil
+	}
+	switch pc.providerName() {
+	case "darksky":
+		pc.DarkskyAPIKey = apiKey
+	case "openweathermap":
+		pc.OpenWeatherMapAPIKey = apiKey
+	case "pirateweather":
+		pc.PirateWeatherAPIKey = apiKey
+	case "tomorrowio":
+		pc.TomorrowIOAPIKey = apiKey
+	case "accuweather":
+		pc.AccuWeatherAPIKey = apiKey
+	case "visualcrossing":
+		pc.VisualCrossingAPIKey = apiKey
+	default:
+		return nil, fmt.Errorf("provider '%s' does not use an API key", pc.providerName())
+	}
+	return &pc, nil
+}
+
+// locationProviderName returns the name of the provider of a location, the
+// first one of its failover chain if any.
+func (c *Config) locationProviderName(name string) string {
+	for idx := range c.Locations {
+		if c.Locations[idx].Name == name {
+			if list := c.Locations[idx].providerList(); len(list) > 0 {
+				return list[0]
+			}
+		}
+	}
+	return c.providerName()
+}
+
+// failoverTimeout returns the time allowed to each provider of a failover
+// chain.
+func (c *Config) failoverTimeout() time.Duration {
+	if c.FailoverTimeout > 0 {
+		return time.Duration(c.FailoverTimeout)
+	}
+	return defaultFailoverTimeout
+}
+
+// validateLocationProviders checks the providers and the API keys of the
+// locations.
+func validateLocationProviders(config *Config) error {
+	for idx := range config.Locations {
+		l := &config.Locations[idx]
+		if l.Provider != "" && len(l.Providers) > 0 {
+			return fmt.Errorf("location '%s': cannot set both provider and providers", l.Name)
+		}
+		list := l.providerList()
+		if len(list) == 0 {
+			list = []string{config.providerName()}
+		}
+		seen := make(map[string]bool)
+		for pidx, name := range list {
+			if seen[name] {
+				return fmt.Errorf("location '%s': duplicate provider '%s'", l.Name, name)
+			}
+			seen[name] = true
+			apiKey := ""
+			if pidx == 0 {
+				apiKey = l.APIKey
+			}
+			pc, err := config.providerConfig(name, apiKey)
+			if err != nil {
+				return fmt.Errorf("location '%s': %w", l.Name, err)
+			}
+			// the ID is the one of the first provider, the others get the
+			// coordinates it resolves to
+			if pidx == 0 && l.ProviderID != "" {
+				if _, ok := providers[name](pc, http.DefaultClient).(nativeLocator); !ok {
+					return fmt.Errorf("location '%s': provider '%s' does not support provider_id", l.Name, name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// newLocationProviders returns the providers of the locations that have their
+// own provider, API key or failover chain, by location name, in priority
+// order. The API key of a location is the one of its first provider. The
+// locations with the same provider and API key share the same provider.
+// Invalid locations are skipped, see validateLocationProviders.
+func newLocationProviders(config *Config, httpClient *http.Client) map[string][]Provider {
+	shared := make(map[[2]string]Provider)
+	result := make(map[string][]Provider)
+	for idx := range config.Locations {
+		l := &config.Locations[idx]
+		list := l.providerList()
+		if l.APIKey == "" && (len(list) == 0 || len(list) == 1 && list[0] == config.providerName()) {
+			continue
+		}
+		if len(list) == 0 {
+			list = []string{config.providerName()}
+		}
+		var chain []Provider
+		for pidx, name := range list {
+			apiKey := ""
+			if pidx == 0 {
+				apiKey = l.APIKey
+			}
+			pc, err := config.providerConfig(name, apiKey)
+			if err != nil {
+				chain = nil
+				break
+			}
+			key := [2]string{pc.providerName(), apiKey}
+			if shared[key] == nil {
+				shared[key] = providers[pc.providerName()](pc, httpClient)
+			}
+			chain = append(chain, shared[key])
+		}
+		if len(chain) > 0 {
+			result[l.Name] = chain
+		}
+	}
+	return result
+}
+
+// providersFor returns the providers of a location, in priority order.
+func (wc *WeatherCollector) providersFor(name string) []Provider {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	if chain, ok := wc.locationProviders[name]; ok {
+		return chain
+	}
+	return []Provider{wc.provider}
+}
+
+// darkskyProvider gets the weather from the Dark Sky API.
+type darkskyProvider struct {
+	httpClient *http.Client
+	apiKey     string
+}
+
+// Name implements Provider.Name for darkskyProvider.
+func (p *darkskyProvider) Name() string {
+	return "darksky"
+}
+
+// Get implements Provider.Get for darkskyProvider.
+func (p *darkskyProvider) Get(ctx context.Context, loc *Location) (*Weather, error) {
+	return getWeather(ctx, p.httpClient, p.Name(), forecast.BASEURL, p.apiKey, loc)
+}
+
+// defaultPirateWeatherURL is the base URL of the public Pirate Weather API.
+const defaultPirateWeatherURL = "https://api.pirateweather.net/forecast"
+
+// pirateWeatherProvider gets the weather from the Pirate Weather API, which
+// is compatible with the Dark Sky one.
+type pirateWeatherProvider struct {
+	httpClient *http.Client
+	apiKey     string
+	baseURL    string
+}
+
+// Name implements Provider.Name for pirateWeatherProvider.
+func (p *pirateWeatherProvider) Name() string {
+	return "pirateweather"
+}
+
+// Get implements Provider.Get for pirateWeatherProvider.
+func (p *pirateWeatherProvider) Get(ctx context.Context, loc *Location) (*Weather, error) {
+	return getWeather(ctx, p.httpClient, p.Name(), p.baseURL, p.apiKey, loc)
+}
+
+// sha256Hex returns the hex-encoded SHA-256 of a response body.
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuietHours is a daily time range, in local time, during which the upstream
+// APIs are not called and the last fetched values are exported instead.
+type QuietHours struct {
+	Start ClockTime `json:"start"`
+	End   ClockTime `json:"end"`
+}
+
+// ClockTime is a time of the day, expressed as "HH:MM" in the configuration
+// file.
+type ClockTime struct {
+	Hour, Minute int
+}
+
+// UnmarshalJSON implements json.Unmarshaler for ClockTime.
+func (c *ClockTime) UnmarshalJSON(data []byte) error {
+	var h, m int
+	if _, err := fmt.Sscanf(string(data), `"%d:%d"`, &h, &m); err != nil {
+		return fmt.Errorf("time of day must be a string like \"HH:MM\": %w", err)
+	}
+	if h < 0 || h > 23 || m < 0 || m > 59 {
+		return fmt.Errorf("invalid time of day %02d:%02d", h, m)
+	}
+	c.Hour, c.Minute = h, m
+	return nil
+}
+
+func (c ClockTime) minutes() int {
+	return c.Hour*60 + c.Minute
+}
+
+// Contains returns whether t falls within the quiet hours. The range can span
+// midnight, e.g. from 23:00 to 05:00.
+func (q *QuietHours) Contains(t time.Time) bool {
+	return inClockRange(q.Start, q.End, t)
+}
+
+// inClockRange returns whether the time of the day of t is in [start, end).
+// The range can span midnight.
+func inClockRange(start, end ClockTime, t time.Time) bool {
+	now := t.Hour()*60 + t.Minute()
+	s, e := start.minutes(), end.minutes()
+	if s <= e {
+		return now >= s && now < e
+	}
+	return now >= s || now < e
+}
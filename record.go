@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// recordedResponse is an API response archived by recordTransport.
+type recordedResponse struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
+
+// redactor removes the API keys from URLs, so that they are not written to
+// disk and the archives can be shared in bug reports.
+type redactor []string
+
+func (r redactor) redact(s string) string {
+	for _, secret := range r {
+		if secret != "" {
+			s = strings.Replace(s, secret, "REDACTED", -1)
+		}
+	}
+	return s
+}
+
+// recordFile returns the archive file name for a request.
+func recordFile(dir string, req *http.Request, r redactor) (string, string) {
+	u := r.redact(req.URL.String())
+	sum := sha256.Sum256([]byte(req.Method + " " + u))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json"), u
+}
+
+// recordTransport is an http.RoundTripper that archives every response to a
+// directory.
+type recordTransport struct {
+	next     http.RoundTripper
+	dir      string
+	redactor redactor
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip for recordTransport.
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	file, u := recordFile(t.dir, req, t.redactor)
+	rec := recordedResponse{
+		Method:     req.Method,
+		URL:        u,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		Body:       t.redactor.redact(string(body)),
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(file, data, 0o644)
+	}
+	if err != nil {
+		// recording is a debugging aid, do not fail the request
+		warnf(req.Context(), "Failed to record response for %s: %v", u, err)
+	}
+	return resp, nil
+}
+
+// maxLoggedPayload is the maximum number of bytes of a response logged by
+// payloadLogTransport.
+const maxLoggedPayload = 16 << 10
+
+// payloadLogTransport is an http.RoundTripper that logs every response at
+// debug level. The responses may contain the coordinates of the locations, so
+// they are only logged if explicitly requested.
+type payloadLogTransport struct {
+	next     http.RoundTripper
+	redactor redactor
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip for payloadLogTransport.
+func (t *payloadLogTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || !defaultLogger.enabled(levelDebug) {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	payload := t.redactor.redact(string(body))
+	if len(payload) > maxLoggedPayload {
+		payload = payload[:maxLoggedPayload] + "... (truncated)"
+	}
+	debugf(req.Context(), "Response to %s %s: %s: %s", req.Method, t.redactor.redact(req.URL.String()), resp.Status, payload)
+	return resp, nil
+}
+
+// replayTransport is an http.RoundTripper that serves the responses archived
+// by recordTransport, without any network access.
+type replayTransport struct {
+	dir      string
+	redactor redactor
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip for replayTransport.
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	file, u := recordFile(t.dir, req, t.redactor)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no recorded response for %s %s", req.Method, u)
+		}
+		return nil, err
+	}
+	var rec recordedResponse
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("malformed recorded response '%s': %w", file, err)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.StatusCode, http.StatusText(rec.StatusCode)),
+		StatusCode:    rec.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Header,
+		Body:          ioutil.NopCloser(strings.NewReader(rec.Body)),
+		ContentLength: int64(len(rec.Body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// forceRefresh fetches the weather of the given locations right away,
+// regardless of the cache, the refresh schedules and the quiet hours, and
+// returns the errors by location.
+func (wc *WeatherCollector) forceRefresh(ctx context.Context, names []string) map[string]error {
+	ctx = withCorrelationID(ctx, "refresh-"+newCorrelationID())
+	logf(ctx, "Forcing a refresh of %d location(s)", len(names))
+	return wc.refreshEach(ctx, names, wc.update)
+}
+
+// refreshResult is the response of the refresh endpoint.
+type refreshResult struct {
+	Refreshed []string          `json:"refreshed"`
+	Failed    map[string]string `json:"failed,omitempty"`
+}
+
+// refreshHandler returns an HTTP handler forcing a refresh of all the
+// locations, or of a single one with the location query parameter, e.g.
+// "POST /-/refresh?location=Dublin". It responds with 502 if any location
+// could not be refreshed.
+func refreshHandler(wc *WeatherCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "method not allowed, use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		names := wc.Locations()
+		if name := r.URL.Query().Get("location"); name != "" {
+			found := false
+			for _, n := range names {
+				if n == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				http.Error(w, fmt.Sprintf("unknown or disabled location '%s'", name), http.StatusNotFound)
+				return
+			}
+			names = []string{name}
+		}
+		failed := wc.forceRefresh(r.Context(), names)
+		res := refreshResult{Refreshed: []string{}}
+		for _, name := range names {
+			if err, ok := failed[name]; ok {
+				if res.Failed == nil {
+					res.Failed = make(map[string]string)
+				}
+				res.Failed[name] = err.Error()
+				continue
+			}
+			res.Refreshed = append(res.Refreshed, name)
+		}
+		if len(failed) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		writeJSON(w, res)
+	})
+}
+
+// refreshOnSignal forces a refresh of all the locations on SIGUSR1, until ctx
+// is done.
+func (wc *WeatherCollector) refreshOnSignal(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-sigs:
+			logf(ctx, "Received %s, refreshing the weather", sig)
+			failed := wc.forceRefresh(ctx, wc.Locations())
+			logf(ctx, "Refresh done, %d location(s) failed", len(failed))
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// explicitCoordinates returns the configured locations with explicit
+// coordinates, by name.
+func explicitCoordinates(config *Config) map[string]*Location {
+	explicit := make(map[string]*Location)
+	for idx := range config.Locations {
+		if loc := config.Locations[idx].location(); loc != nil {
+			explicit[loc.Name] = loc
+		}
+	}
+	return explicit
+}
+
+// explicitCoordinates returns the explicit coordinates of a location, if any.
+func (wc *WeatherCollector) explicitCoordinates(name string) (*Location, bool) {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	loc, ok := wc.explicit[name]
+	return loc, ok
+}
+
+// metricDescs returns the descriptors of the configured metrics, by field
+// name.
+func (wc *WeatherCollector) metricDescs() map[string]*prometheus.Desc {
+	wc.mu.RLock()
+	defer wc.mu.RUnlock()
+	return wc.descs
+}
+
+// validateReloadable checks the settings that can be reloaded.
+func validateReloadable(config *Config) error {
+	if len(config.Locations) == 0 {
+		return fmt.Errorf("must specify at least one location")
+	}
+	if len(config.Metrics) == 0 {
+		return fmt.Errorf("must specify at least one metric")
+	}
+	for _, m := range config.Metrics {
+		if _, ok := lookupField(m); !ok {
+			return fmt.Errorf("unsupported metric '%s'", m)
+		}
+	}
+	if err := validateLocationProviders(config); err != nil {
+		return err
+	}
+	if config.Rollups != nil {
+		if err := validateRollups(config.Rollups, config.Locations.Names()); err != nil {
+			return fmt.Errorf("invalid rollups: %w", err)
+		}
+	}
+	if err := validateAirports(config.Airports); err != nil {
+		return fmt.Errorf("invalid airports: %w", err)
+	}
+	if err := validateRefreshSchedules(config); err != nil {
+		return fmt.Errorf("invalid refresh_schedules: %w", err)
+	}
+	known := make(map[string]bool, len(config.Locations))
+	for _, name := range config.Locations.Names() {
+		known[name] = true
+	}
+	for _, name := range config.DisabledLocations {
+		if !known[name] {
+			return fmt.Errorf("unknown location '%s' in disabled_locations", name)
+		}
+	}
+	return nil
+}
+
+// reload applies the reloadable settings of config: the locations, the
+// disabled locations, the metrics, the refresh schedules, the quiet hours, the
+// airports and the rollups. The other settings keep their current values.
+// Locations disabled with the admin API are enabled again, unless disabled in
+// config.
+func (wc *WeatherCollector) reload(config *Config) {
+	c := *wc.cfg()
+	c.Locations = config.Locations
+	c.DisabledLocations = config.DisabledLocations
+	c.Metrics = config.Metrics
+	c.RefreshSchedules = config.RefreshSchedules
+	c.QuietHours = config.QuietHours
+	c.Airports = config.Airports
+	c.Rollups = config.Rollups
+	disabled := make(map[string]bool, len(c.DisabledLocations))
+	for _, name := range c.DisabledLocations {
+		disabled[name] = true
+	}
+	constLabels := prometheus.Labels(c.ConstLabels)
+	wc.mu.Lock()
+	wc.descs = getDescs(c.Metrics, c.HelpLanguage, c.Units, constLabels)
+	wc.hourlyDescs = getHourlyDescs(c.Metrics, c.HelpLanguage, c.Units, constLabels)
+	wc.rollupDescs = newRollupDescs(&c, constLabels)
+	wc.consensusDescs = newConsensusDescs(&c, constLabels)
+	wc.routeDescs = newRouteDescs(&c, constLabels)
+	wc.explicit = explicitCoordinates(&c)
+	wc.locationProviders = newLocationProviders(&c, wc.httpClient)
+	wc.disabled = disabled
+	wc.config.Store(&c)
+	wc.mu.Unlock()
+	wc.SetLocations(c.Locations.Names())
+}
+
+// configReloader reloads the configuration file into a collector.
+type configReloader struct {
+	path string
+	wc   *WeatherCollector
+
+	// mu serializes the reloads from signals and HTTP requests.
+	mu sync.Mutex
+}
+
+// reload reads the configuration file and applies the reloadable settings.
+// The collector is unchecked, so it does not need to be registered again for
+// the new metric descriptors.
+func (r *configReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	config, err := LoadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	if err := validateReloadable(config); err != nil {
+		return err
+	}
+	r.wc.reload(config)
+	logf(context.Background(), "Configuration reloaded: %d location(s), %d metric(s)", len(config.Locations), len(config.Metrics))
+	return nil
+}
+
+// reloadOnSignal reloads the configuration on SIGHUP.
+func (r *configReloader) reloadOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for sig := range sigs {
+		logf(context.Background(), "Received %s, reloading the configuration", sig)
+		if err := r.reload(); err != nil {
+			errorf(context.Background(), "Failed to reload the configuration, keeping the current one: %v", err)
+		}
+	}
+}
+
+// handler returns an HTTP handler reloading the configuration on POST.
+func (r *configReloader) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost && req.Method != http.MethodPut {
+			http.Error(w, "method not allowed, use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.reload(); err != nil {
+			errorf(req.Context(), "Failed to reload the configuration, keeping the current one: %v", err)
+			http.Error(w, fmt.Sprintf("failed to reload the configuration: %v", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "configuration reloaded")
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+// defaultRenderContentType is the content type of the /render responses if
+// not configured.
+const defaultRenderContentType = "text/plain; charset=utf-8"
+
+// RenderData is the data passed to the /render template.
+type RenderData struct {
+	Now       time.Time
+	Locations []RenderLocation
+}
+
+// RenderLocation is the latest observation of a location, as passed to the
+// /render template and returned by the refresh API.
+type RenderLocation struct {
+	Name      string    `json:"name"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	FetchedAt time.Time `json:"fetched_at"`
+	Summary   string    `json:"summary"`
+	Icon      string    `json:"icon"`
+	// Values holds the value of every supported field, by name, e.g.
+	// "temperature".
+	Values map[string]float64 `json:"values"`
+}
+
+// newRenderData builds the template data from the cached weather.
+func newRenderData(snapshot []*LocationWeather) *RenderData {
+	data := RenderData{Now: time.Now()}
+	for _, lw := range snapshot {
+		dp := &lw.Weather.Forecast.Currently
+		rl := RenderLocation{
+			Name:      lw.Name,
+			Latitude:  lw.Location.Lat,
+			Longitude: lw.Location.Lng,
+			FetchedAt: lw.FetchedAt,
+			Summary:   dp.Summary,
+			Icon:      dp.Icon,
+			Values:    make(map[string]float64, len(fields)),
+		}
+		for idx := range fields {
+			rl.Values[fields[idx].Name] = fields[idx].Value(dp)
+		}
+		data.Locations = append(data.Locations, rl)
+	}
+	return &data
+}
+
+var renderFuncs = template.FuncMap{
+	// round rounds a value to the given number of decimals.
+	"round": func(v float64, decimals int) float64 {
+		p := math.Pow(10, float64(decimals))
+		return math.Round(v*p) / p
+	},
+	// percent converts a ratio to a percentage.
+	"percent": func(v float64) float64 {
+		return v * 100
+	},
+}
+
+// renderHandler returns an HTTP handler that fills the template in the given
+// file with the latest observations. It never calls the APIs.
+func renderHandler(wc *WeatherCollector, path, contentType string) (http.Handler, error) {
+	tmpl, err := template.New(filepath.Base(path)).Funcs(renderFuncs).ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	if contentType == "" {
+		contentType = defaultRenderContentType
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, newRenderData(wc.Snapshot())); err != nil {
+			errorf(r.Context(), "Failed to render template: %v", err)
+			http.Error(w, fmt.Sprintf("failed to render template: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		if _, err := buf.WriteTo(w); err != nil {
+			errorf(r.Context(), "Failed to write rendered template: %v", err)
+		}
+	}), nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// usgsIVURL is the USGS Instantaneous Values service.
+	usgsIVURL = "https://waterservices.usgs.gov/nwis/iv/"
+	// eaFloodURL is the base URL of the Environment Agency flood monitoring
+	// API, which covers England.
+	eaFloodURL = "https://environment.data.gov.uk/flood-monitoring"
+	// riverGaugeMaxAge is how long the readings of the gauges are reused.
+	// Most gauges report every 15 minutes.
+	riverGaugeMaxAge = 15 * time.Minute
+	// eaFloodDistance is the distance from an Environment Agency gauge, in
+	// km, within which the flood warnings are counted.
+	eaFloodDistance = 5
+)
+
+// USGS parameter codes.
+const (
+	usgsDischarge  = "00060"
+	usgsGageHeight = "00065"
+)
+
+// Sources of the river gauges.
+const (
+	riverSourceUSGS = "usgs"
+	riverSourceEA   = "ea"
+)
+
+// eaFloodSeverities are the labels of the Environment Agency flood warning
+// severity levels. Level 4 means that a warning is no longer in force.
+var eaFloodSeverities = map[int]string{
+	1: "severe_flood_warning",
+	2: "flood_warning",
+	3: "flood_alert",
+}
+
+// RiverGaugeConfig is a hydrological gauge, identified by its source and its
+// identifier in the source, e.g. a USGS site number.
+type RiverGaugeConfig struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+	ID     string `json:"id"`
+	// Location is the location the gauge belongs to, if any, exported as a
+	// label to graph the gauge next to the weather of the location.
+	Location string `json:"location"`
+}
+
+// validateRiverGauges checks that the gauges have unique names, a supported
+// source and an identifier.
+func validateRiverGauges(gauges []*RiverGaugeConfig) error {
+	names := make(map[string]bool)
+	for _, g := range gauges {
+		if g == nil || g.Name == "" {
+			return fmt.Errorf("river gauge with no name")
+		}
+		if names[g.Name] {
+			return fmt.Errorf("duplicate river gauge '%s'", g.Name)
+		}
+		names[g.Name] = true
+		if g.Source != riverSourceUSGS && g.Source != riverSourceEA {
+			return fmt.Errorf("river gauge '%s': unsupported source '%s', must be %s or %s", g.Name, g.Source, riverSourceUSGS, riverSourceEA)
+		}
+		if g.ID == "" || strings.ContainsAny(g.ID, "/?#,") {
+			return fmt.Errorf("river gauge '%s': invalid id '%s'", g.Name, g.ID)
+		}
+	}
+	return nil
+}
+
+// riverReading is the latest reading of a gauge, in SI units.
+type riverReading struct {
+	// Level is the river level, or stage, in meters above the gauge datum.
+	Level    float64
+	HasLevel bool
+	// Discharge is the flow, in m³/s.
+	Discharge    float64
+	HasDischarge bool
+	// FloodWarnings are the number of flood warnings in force near the gauge,
+	// by severity label, if available.
+	FloodWarnings map[string]int
+}
+
+// usgsReadings gets the latest gage height and discharge of the given USGS
+// sites, with a single request, by site number.
+func usgsReadings(ctx context.Context, httpClient *http.Client, sites []string) (map[string]*riverReading, error) {
+	q := url.Values{}
+	q.Set("format", "json")
+	q.Set("sites", strings.Join(sites, ","))
+	q.Set("parameterCd", usgsDischarge+","+usgsGageHeight)
+	q.Set("siteStatus", "active")
+	var r struct {
+		Value struct {
+			TimeSeries []struct {
+				SourceInfo struct {
+					SiteCode []struct {
+						Value string `json:"value"`
+					} `json:"siteCode"`
+				} `json:"sourceInfo"`
+				Variable struct {
+					VariableCode []struct {
+						Value string `json:"value"`
+					} `json:"variableCode"`
+					NoDataValue float64 `json:"noDataValue"`
+				} `json:"variable"`
+				Values []struct {
+					Value []struct {
+						Value string `json:"value"`
+					} `json:"value"`
+				} `json:"values"`
+			} `json:"timeSeries"`
+		} `json:"value"`
+	}
+	if err := getJSON(ctx, httpClient, usgsIVURL+"?"+q.Encode(), &r); err != nil {
+		return nil, err
+	}
+	readings := make(map[string]*riverReading)
+	for _, ts := range r.Value.TimeSeries {
+		if len(ts.SourceInfo.SiteCode) == 0 || len(ts.Variable.VariableCode) == 0 || len(ts.Values) == 0 || len(ts.Values[0].Value) == 0 {
+			continue
+		}
+		values := ts.Values[0].Value
+		v, err := strconv.ParseFloat(values[len(values)-1].Value, 64)
+		if err != nil || v == ts.Variable.NoDataValue {
+			continue
+		}
+		site := ts.SourceInfo.SiteCode[0].Value
+		if readings[site] == nil {
+			readings[site] = &riverReading{}
+		}
+		switch ts.Variable.VariableCode[0].Value {
+		case usgsGageHeight:
+			// feet
+			readings[site].Level, readings[site].HasLevel = v*0.3048, true
+		case usgsDischarge:
+			// cubic feet per second
+			readings[site].Discharge, readings[site].HasDischarge = v*0.028316846592, true
+		}
+	}
+	return readings, nil
+}
+
+// eaStationCoordinates gets the coordinates of an Environment Agency station.
+func eaStationCoordinates(ctx context.Context, httpClient *http.Client, id string) (float64, float64, error) {
+	var r struct {
+		Items struct {
+			// some stations have several coordinates, in which case they
+			// are arrays
+			Lat  json.RawMessage `json:"lat"`
+			Long json.RawMessage `json:"long"`
+		} `json:"items"`
+	}
+	if err := getJSON(ctx, httpClient, eaFloodURL+"/id/stations/"+url.PathEscape(id), &r); err != nil {
+		return 0, 0, err
+	}
+	first := func(raw json.RawMessage) (float64, error) {
+		var v float64
+		if err := json.Unmarshal(raw, &v); err == nil {
+			return v, nil
+		}
+		var vs []float64
+		if err := json.Unmarshal(raw, &vs); err != nil || len(vs) == 0 {
+			return 0, fmt.Errorf("station '%s' has no coordinates", id)
+		}
+		return vs[0], nil
+	}
+	lat, err := first(r.Items.Lat)
+	if err != nil {
+		return 0, 0, err
+	}
+	lng, err := first(r.Items.Long)
+	if err != nil {
+		return 0, 0, err
+	}
+	return lat, lng, nil
+}
+
+// eaReading gets the latest level and flow of an Environment Agency station,
+// and the flood warnings in force near the given coordinates.
+func eaReading(ctx context.Context, httpClient *http.Client, id string, lat, lng float64) (*riverReading, error) {
+	var readings struct {
+		Items []struct {
+			Measure string `json:"measure"`
+			// usually a number, but some erroneous readings are arrays
+			Value json.RawMessage `json:"value"`
+		} `json:"items"`
+	}
+	if err := getJSON(ctx, httpClient, eaFloodURL+"/id/stations/"+url.PathEscape(id)+"/readings?latest", &readings); err != nil {
+		return nil, err
+	}
+	reading := riverReading{FloodWarnings: make(map[string]int)}
+	for _, item := range readings.Items {
+		var v float64
+		if err := json.Unmarshal(item.Value, &v); err != nil {
+			continue
+		}
+		// the measures are named after the parameter, e.g.
+		// .../id/measures/3400TH-level-stage-i-15_min-mASD
+		measure := item.Measure[strings.LastIndex(item.Measure, "/")+1:]
+		switch {
+		case strings.Contains(measure, "-level-stage-") && !reading.HasLevel:
+			reading.Level, reading.HasLevel = v, true
+		case strings.Contains(measure, "-flow-") && strings.HasSuffix(measure, "-m3_s"):
+			reading.Discharge, reading.HasDischarge = v, true
+		}
+	}
+	q := url.Values{}
+	q.Set("lat", strconv.FormatFloat(lat, 'f', -1, 64))
+	q.Set("long", strconv.FormatFloat(lng, 'f', -1, 64))
+	q.Set("dist", strconv.Itoa(eaFloodDistance))
+	var floods struct {
+		Items []struct {
+			SeverityLevel int `json:"severityLevel"`
+		} `json:"items"`
+	}
+	if err := getJSON(ctx, httpClient, eaFloodURL+"/id/floods?"+q.Encode(), &floods); err != nil {
+		return nil, fmt.Errorf("flood warnings: %w", err)
+	}
+	for _, f := range floods.Items {
+		if severity, ok := eaFloodSeverities[f.SeverityLevel]; ok {
+			reading.FloodWarnings[severity]++
+		}
+	}
+	return &reading, nil
+}
+
+// riverGauges caches the readings of the gauges, by gauge name.
+type riverGauges struct {
+	mu        sync.Mutex
+	readings  map[string]*riverReading
+	fetchedAt time.Time
+	// eaStations are the coordinates of the Environment Agency stations,
+	// which are only looked up once.
+	eaStations map[string][2]float64
+}
+
+func newRiverGauges() *riverGauges {
+	return &riverGauges{eaStations: make(map[string][2]float64)}
+}
+
+// cached returns the last readings of the gauges, however old.
+func (rg *riverGauges) cached() map[string]*riverReading {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	return rg.readings
+}
+
+// get returns the readings of the gauges, fetching them if they are older
+// than riverGaugeMaxAge. The USGS gauges are fetched with a single request.
+// Gauges that cannot be fetched are not returned.
+func (rg *riverGauges) get(ctx context.Context, httpClient *http.Client, gauges []*RiverGaugeConfig) map[string]*riverReading {
+	rg.mu.Lock()
+	defer rg.mu.Unlock()
+	if rg.readings != nil && time.Since(rg.fetchedAt) < riverGaugeMaxAge {
+		return rg.readings
+	}
+	readings := make(map[string]*riverReading)
+	var sites []string
+	for _, g := range gauges {
+		if g.Source == riverSourceUSGS {
+			sites = append(sites, g.ID)
+		}
+	}
+	if len(sites) > 0 {
+		usgs, err := usgsReadings(ctx, httpClient, sites)
+		if err != nil {
+			errorf(ctx, "Failed to get the USGS gauges: %v", err)
+		}
+		for _, g := range gauges {
+			if r, ok := usgs[g.ID]; ok && g.Source == riverSourceUSGS {
+				readings[g.Name] = r
+			}
+		}
+	}
+	for _, g := range gauges {
+		if g.Source != riverSourceEA {
+			continue
+		}
+		coords, ok := rg.eaStations[g.ID]
+		if !ok {
+			lat, lng, err := eaStationCoordinates(ctx, httpClient, g.ID)
+			if err != nil {
+				errorf(ctx, "Failed to get river gauge '%s': %v", g.Name, err)
+				continue
+			}
+			coords = [2]float64{lat, lng}
+			rg.eaStations[g.ID] = coords
+		}
+		r, err := eaReading(ctx, httpClient, g.ID, coords[0], coords[1])
+		if err != nil {
+			errorf(ctx, "Failed to get river gauge '%s': %v", g.Name, err)
+			continue
+		}
+		readings[g.Name] = r
+	}
+	rg.readings = readings
+	rg.fetchedAt = time.Now()
+	return readings
+}
+
+// refreshRiverGauges fetches the readings of the river gauges if they are too
+// old.
+func (wc *WeatherCollector) refreshRiverGauges(ctx context.Context) {
+	if len(wc.cfg().RiverGauges) == 0 {
+		return
+	}
+	wc.riverGauges.get(ctx, wc.httpClient, wc.cfg().RiverGauges)
+}
+
+// collectRiverGauges sends the metrics of the river gauges to ch. When
+// polling, the readings are fetched by the poller, and only the cached ones
+// are sent.
+func (wc *WeatherCollector) collectRiverGauges(ctx context.Context, ch chan<- prometheus.Metric) {
+	if len(wc.cfg().RiverGauges) == 0 {
+		return
+	}
+	var readings map[string]*riverReading
+	if wc.polling() {
+		readings = wc.riverGauges.cached()
+	} else {
+		readings = wc.riverGauges.get(ctx, wc.httpClient, wc.cfg().RiverGauges)
+	}
+	for _, g := range wc.cfg().RiverGauges {
+		r, ok := readings[g.Name]
+		if !ok {
+			continue
+		}
+		if r.HasLevel {
+			ch <- prometheus.MustNewConstMetric(wc.riverLevelDesc, prometheus.GaugeValue, r.Level, g.Name, g.Source, g.Location)
+		}
+		if r.HasDischarge {
+			ch <- prometheus.MustNewConstMetric(wc.riverDischargeDesc, prometheus.GaugeValue, r.Discharge, g.Name, g.Source, g.Location)
+		}
+		if r.FloodWarnings != nil {
+			for _, severity := range eaFloodSeverities {
+				ch <- prometheus.MustNewConstMetric(wc.riverFloodWarningsDesc, prometheus.GaugeValue, float64(r.FloodWarnings[severity]), g.Name, g.Source, g.Location, severity)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// allLocationsGroup is the name of the rollup group of all the locations,
+// used if no group is configured.
+const allLocationsGroup = "all"
+
+// RollupsConfig configures the aggregates of some metrics across groups of
+// locations, for fleet-level overviews.
+type RollupsConfig struct {
+	Metrics []string `json:"metrics"`
+	// Groups are the locations of each group, by group name. All the
+	// locations form a single group named "all" if not set.
+	Groups map[string][]string `json:"groups"`
+}
+
+// validateRollups checks the rollup metrics, and that the groups only contain
+// configured locations.
+func validateRollups(config *RollupsConfig, locations []string) error {
+	if len(config.Metrics) == 0 {
+		return fmt.Errorf("no metrics configured")
+	}
+	for _, key := range config.Metrics {
+		if _, ok := lookupField(key); !ok {
+			return fmt.Errorf("unknown metric '%s'", key)
+		}
+	}
+	known := make(map[string]bool, len(locations))
+	for _, name := range locations {
+		known[name] = true
+	}
+	for group, members := range config.Groups {
+		if group == "" {
+			return fmt.Errorf("group with no name")
+		}
+		if len(members) == 0 {
+			return fmt.Errorf("group '%s' has no locations", group)
+		}
+		for _, name := range members {
+			if !known[name] {
+				return fmt.Errorf("unknown location '%s' in group '%s'", name, group)
+			}
+		}
+	}
+	return nil
+}
+
+// rollupGroups returns the groups of locations, by name.
+func (c *RollupsConfig) rollupGroups(locations []string) map[string][]string {
+	if len(c.Groups) > 0 {
+		return c.Groups
+	}
+	return map[string][]string{allLocationsGroup: locations}
+}
+
+// newRollupDescs returns the descriptors of the rollups of the configured
+// metrics, by field name.
+func newRollupDescs(config *Config, constLabels prometheus.Labels) map[string]*prometheus.Desc {
+	descs := make(map[string]*prometheus.Desc)
+	if config.Rollups == nil {
+		return descs
+	}
+	for _, key := range config.Rollups.Metrics {
+		field, _ := lookupField(key)
+		descs[key] = prometheus.NewDesc(
+			fmt.Sprintf("weather_group_%s", key),
+			fmt.Sprintf("Aggregate across the locations of the group - %s", field.helpString(config.HelpLanguage, fieldConversion(config.Units, field).unit)),
+			withUnitLabel([]string{"group", "aggregation"}, config.Units),
+			constLabels,
+		)
+	}
+	return descs
+}
+
+// currentValue returns the exported current value of a metric of a location,
+// smoothed if configured, before the unit conversion.
+func (wc *WeatherCollector) currentValue(lw *LocationWeather, key string) float64 {
+	if v, ok := wc.smoother.value(lw.Name, key); ok {
+		return v
+	}
+	field, _ := lookupField(key)
+	return field.Value(&lw.Weather.Forecast.Currently)
+}
+
+// collectRollups sends the minimum, the maximum and the mean of the rollup
+// metrics of every group to ch, computed from the last weather of its
+// locations. Groups whose weather is not available yet are skipped.
+func (wc *WeatherCollector) collectRollups(ch chan<- prometheus.Metric) {
+	if wc.cfg().Rollups == nil {
+		return
+	}
+	snapshot := make(map[string]*LocationWeather)
+	for _, lw := range wc.Snapshot() {
+		snapshot[lw.Name] = lw
+	}
+	wc.mu.RLock()
+	descs := wc.rollupDescs
+	wc.mu.RUnlock()
+	groups := wc.cfg().Rollups.rollupGroups(wc.Locations())
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	sort.Strings(names)
+	for _, group := range names {
+		var members []*LocationWeather
+		for _, name := range groups[group] {
+			if lw, ok := snapshot[name]; ok {
+				members = append(members, lw)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(wc.rollupLocationsDesc, prometheus.GaugeValue, float64(len(members)), group)
+		for key, desc := range descs {
+			field, _ := lookupField(key)
+			conv := fieldConversion(wc.cfg().Units, field)
+			min, max, sum := math.Inf(1), math.Inf(-1), 0.0
+			for _, lw := range members {
+				v := wc.currentValue(lw, key)
+				min, max, sum = math.Min(min, v), math.Max(max, v), sum+v
+			}
+			for _, agg := range []struct {
+				name  string
+				value float64
+			}{{"min", min}, {"max", max}, {"mean", sum / float64(len(members))}} {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, wc.round(key, conv.value(agg.value)), wc.unitLabelValues(conv, group, agg.name)...)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// routePlanPath is the path of the route planning API.
+const routePlanPath = "/api/v1/route"
+
+// defaultRouteSpeed is the average speed along a planned route if not given,
+// in km/h.
+const defaultRouteSpeed = 60
+
+// RoutePlanRequest is a route to plan, given either as points or as an
+// encoded polyline.
+type RoutePlanRequest struct {
+	Points   []Waypoint `json:"points"`
+	Polyline string     `json:"polyline"`
+	// Departure is the departure time, now if not set.
+	Departure time.Time `json:"departure"`
+	// Speed is the average speed, in km/h.
+	Speed float64 `json:"speed"`
+	// Resolution is the spacing of the provider points, in degrees, like
+	// for the configured routes.
+	Resolution float64 `json:"resolution"`
+}
+
+// RoutePlanPoint is the expected weather at a point of a planned route, at
+// the time it is reached.
+type RoutePlanPoint struct {
+	Name      string  `json:"name,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Distance is the distance from the departure along the route, in
+	// kilometers.
+	Distance float64   `json:"distance"`
+	ETA      time.Time `json:"eta"`
+	Summary  string    `json:"summary,omitempty"`
+	Icon     string    `json:"icon,omitempty"`
+	// Values holds the value of every supported field at the ETA, by name,
+	// in SI units.
+	Values map[string]float64 `json:"values,omitempty"`
+	// Error is set if the weather at the ETA is not available, e.g. because
+	// it is beyond the forecast horizon.
+	Error string `json:"error,omitempty"`
+}
+
+// decodePolyline decodes a polyline in the Google encoded polyline format,
+// with 5 decimals.
+func decodePolyline(s string) ([]Waypoint, error) {
+	var (
+		points   []Waypoint
+		lat, lng int
+	)
+	for idx := 0; idx < len(s); {
+		var deltas [2]int
+		for i := range deltas {
+			var result, shift uint
+			for {
+				if idx >= len(s) {
+					return nil, fmt.Errorf("truncated polyline")
+				}
+				b := uint(s[idx]) - 63
+				idx++
+				if b > 63 {
+					return nil, fmt.Errorf("invalid character at offset %d", idx-1)
+				}
+				result |= (b & 0x1f) << shift
+				shift += 5
+				if b < 0x20 {
+					break
+				}
+			}
+			if result&1 != 0 {
+				deltas[i] = ^int(result >> 1)
+			} else {
+				deltas[i] = int(result >> 1)
+			}
+		}
+		lat += deltas[0]
+		lng += deltas[1]
+		points = append(points, Waypoint{Lat: float64(lat) / 1e5, Lng: float64(lng) / 1e5})
+	}
+	return points, nil
+}
+
+// waypoints returns the points of the route, checking that they are valid.
+func (r *RoutePlanRequest) waypoints() ([]Waypoint, error) {
+	if (len(r.Points) == 0) == (r.Polyline == "") {
+		return nil, fmt.Errorf("the route must have either points or a polyline")
+	}
+	points := r.Points
+	if r.Polyline != "" {
+		var err error
+		if points, err = decodePolyline(r.Polyline); err != nil {
+			return nil, fmt.Errorf("invalid polyline: %w", err)
+		}
+	}
+	if len(points) > maxRoutePoints {
+		return nil, fmt.Errorf("the route has %d points, at most %d are allowed", len(points), maxRoutePoints)
+	}
+	for idx, p := range points {
+		if p.Lat < -90 || p.Lat > 90 || p.Lng < -180 || p.Lng > 180 {
+			return nil, fmt.Errorf("point %d has invalid coordinates", idx)
+		}
+	}
+	return points, nil
+}
+
+// dataPointAt returns the forecast at time t: the hourly data point of that
+// hour, or the current conditions before the first one. It returns nil if t
+// is beyond the forecast horizon.
+func dataPointAt(fc *forecast.Forecast, t time.Time) *forecast.DataPoint {
+	if len(fc.Hourly.Data) == 0 || t.Unix() < fc.Hourly.Data[0].Time {
+		if t.Sub(time.Unix(fc.Currently.Time, 0)) < time.Hour {
+			return &fc.Currently
+		}
+		return nil
+	}
+	for idx := len(fc.Hourly.Data) - 1; idx >= 0; idx-- {
+		dp := &fc.Hourly.Data[idx]
+		if dp.Time <= t.Unix() {
+			if t.Unix() < dp.Time+int64(time.Hour/time.Second) {
+				return dp
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// routePlanHandler returns an HTTP handler for the route planning API: POST
+// /api/v1/route with a RoutePlanRequest returns the expected weather at every
+// point of the route, at the time it is reached at the given speed.
+func routePlanHandler(wc *WeatherCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req RoutePlanRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		points, err := req.waypoints()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Speed < 0 || req.Resolution < 0 {
+			http.Error(w, "speed and resolution must not be negative", http.StatusBadRequest)
+			return
+		}
+		if req.Speed == 0 {
+			req.Speed = defaultRouteSpeed
+		}
+		if req.Departure.IsZero() {
+			req.Departure = time.Now()
+		}
+		route := RouteConfig{Resolution: req.Resolution}
+		locations := make([]*Location, len(points))
+		for idx, p := range points {
+			locations[idx] = snapToGrid(p, route.resolution())
+		}
+		ctx := withCorrelationID(r.Context(), "route-"+newCorrelationID())
+		weather := wc.routeWeather(ctx, locations)
+		plan := make([]RoutePlanPoint, len(points))
+		var distance float64
+		for idx, p := range points {
+			if idx > 0 {
+				distance += greatCircleDistance(points[idx-1].Lat, points[idx-1].Lng, p.Lat, p.Lng)
+			}
+			rp := RoutePlanPoint{
+				Name:      p.Name,
+				Latitude:  p.Lat,
+				Longitude: p.Lng,
+				Distance:  distance,
+				ETA:       req.Departure.Add(time.Duration(distance / req.Speed * float64(time.Hour))),
+			}
+			if fw, ok := weather[locations[idx].Name]; !ok {
+				rp.Error = "weather not available"
+			} else if dp := dataPointAt(fw.Forecast, rp.ETA); dp == nil {
+				rp.Error = "beyond the forecast horizon"
+			} else {
+				rp.Summary, rp.Icon = dp.Summary, dp.Icon
+				rp.Values = make(map[string]float64, len(fields))
+				for fidx := range fields {
+					rp.Values[fields[fidx].Name] = fields[fidx].Value(dp)
+				}
+			}
+			plan[idx] = rp
+		}
+		writeJSON(w, plan)
+	})
+}
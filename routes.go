@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultRouteResolution is the default spacing of the provider points of a
+// route, in degrees, about 11 km in latitude.
+const defaultRouteResolution = 0.1
+
+// maxRoutePoints is the maximum number of waypoints of a route, to protect
+// the API quota from a mistyped grid.
+const maxRoutePoints = 1000
+
+// Waypoint is a point of a route, with explicit coordinates.
+type Waypoint struct {
+	Name string  `json:"name"`
+	Lat  float64 `json:"lat"`
+	Lng  float64 `json:"lng"`
+}
+
+// RouteGrid is a regular grid of waypoints within a bounding box, in degrees.
+type RouteGrid struct {
+	North float64 `json:"north"`
+	South float64 `json:"south"`
+	West  float64 `json:"west"`
+	East  float64 `json:"east"`
+	Step  float64 `json:"step"`
+}
+
+// RouteConfig is a custom set of points, e.g. a delivery route or the
+// sensors of a pipeline, whose conditions are interpolated from the nearest
+// provider point rather than fetched for every point.
+type RouteConfig struct {
+	Name      string     `json:"name"`
+	Waypoints []Waypoint `json:"waypoints"`
+	Grid      *RouteGrid `json:"grid"`
+	// Resolution is the spacing of the provider points, in degrees. The
+	// waypoints closer than that share the same provider point.
+	Resolution float64 `json:"resolution"`
+}
+
+// points returns the waypoints of the route. The grid waypoints are named
+// after their coordinates.
+func (r *RouteConfig) points() []Waypoint {
+	if r.Grid == nil {
+		return r.Waypoints
+	}
+	g := r.Grid
+	var points []Waypoint
+	// the steps are counted to avoid accumulating rounding errors
+	for i := 0; g.South+float64(i)*g.Step <= g.North+1e-9; i++ {
+		lat := g.South + float64(i)*g.Step
+		for j := 0; g.West+float64(j)*g.Step <= g.East+1e-9; j++ {
+			lng := g.West + float64(j)*g.Step
+			points = append(points, Waypoint{
+				Name: strconv.FormatFloat(lat, 'f', -1, 64) + "," + strconv.FormatFloat(lng, 'f', -1, 64),
+				Lat:  lat,
+				Lng:  lng,
+			})
+		}
+	}
+	return points
+}
+
+// resolution returns the spacing of the provider points of the route.
+func (r *RouteConfig) resolution() float64 {
+	if r.Resolution > 0 {
+		return r.Resolution
+	}
+	return defaultRouteResolution
+}
+
+// validateRoutes checks that the routes have unique names, and either valid
+// waypoints or a valid grid.
+func validateRoutes(routes []*RouteConfig) error {
+	names := make(map[string]bool)
+	for _, r := range routes {
+		if r == nil || r.Name == "" {
+			return fmt.Errorf("route with no name")
+		}
+		if names[r.Name] {
+			return fmt.Errorf("duplicate route '%s'", r.Name)
+		}
+		names[r.Name] = true
+		if r.Resolution < 0 {
+			return fmt.Errorf("route '%s': resolution must not be negative", r.Name)
+		}
+		if (len(r.Waypoints) == 0) == (r.Grid == nil) {
+			return fmt.Errorf("route '%s' must have either waypoints or a grid", r.Name)
+		}
+		if g := r.Grid; g != nil {
+			if g.Step <= 0 {
+				return fmt.Errorf("route '%s': the grid step must be positive", r.Name)
+			}
+			if g.South > g.North || g.West > g.East {
+				return fmt.Errorf("route '%s': the grid is empty", r.Name)
+			}
+			if n := (math.Floor((g.North-g.South)/g.Step) + 1) * (math.Floor((g.East-g.West)/g.Step) + 1); n > maxRoutePoints {
+				return fmt.Errorf("route '%s': the grid has %.0f points, at most %d are allowed", r.Name, n, maxRoutePoints)
+			}
+		}
+		if len(r.Waypoints) > maxRoutePoints {
+			return fmt.Errorf("route '%s' has %d waypoints, at most %d are allowed", r.Name, len(r.Waypoints), maxRoutePoints)
+		}
+		waypoints := make(map[string]bool)
+		for _, wp := range r.points() {
+			if wp.Name == "" {
+				return fmt.Errorf("route '%s': waypoint with no name", r.Name)
+			}
+			if waypoints[wp.Name] {
+				return fmt.Errorf("route '%s': duplicate waypoint '%s'", r.Name, wp.Name)
+			}
+			waypoints[wp.Name] = true
+			if wp.Lat < -90 || wp.Lat > 90 || wp.Lng < -180 || wp.Lng > 180 {
+				return fmt.Errorf("route '%s': waypoint '%s' has invalid coordinates", r.Name, wp.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// snapToGrid returns the nearest provider point of a waypoint, given the
+// spacing of the provider points in degrees.
+func snapToGrid(wp Waypoint, resolution float64) *Location {
+	lat := math.Round(wp.Lat/resolution) * resolution
+	lng := math.Round(wp.Lng/resolution) * resolution
+	// round away the floating point noise, so that the points have stable
+	// names
+	lat, _ = strconv.ParseFloat(strconv.FormatFloat(lat, 'f', 6, 64), 64)
+	lng, _ = strconv.ParseFloat(strconv.FormatFloat(lng, 'f', 6, 64), 64)
+	return &Location{Name: fmt.Sprintf("%f,%f", lat, lng), Lat: lat, Lng: lng}
+}
+
+// routePoint is the last weather of a provider point.
+type routePoint struct {
+	weather   *Weather
+	fetchedAt time.Time
+}
+
+// routePoints caches the weather of the provider points of the routes, by
+// point name. The points are shared by all the routes.
+type routePoints struct {
+	mu     sync.Mutex
+	points map[string]routePoint
+}
+
+func newRoutePoints() *routePoints {
+	return &routePoints{points: make(map[string]routePoint)}
+}
+
+// evict removes the points older than maxAge, then the oldest ones until at
+// most max are left. It must be called with mu held.
+func (p *routePoints) evict(maxAge time.Duration, max int) {
+	for name, point := range p.points {
+		if time.Since(point.fetchedAt) >= maxAge {
+			delete(p.points, name)
+		}
+	}
+	for len(p.points) > max {
+		var oldest string
+		for name, point := range p.points {
+			if oldest == "" || point.fetchedAt.Before(p.points[oldest].fetchedAt) {
+				oldest = name
+			}
+		}
+		delete(p.points, oldest)
+	}
+}
+
+// minRouteMaxAge is the minimum time the weather of a provider point is
+// reused, so that the points are not fetched at every scrape if neither the
+// cache nor polling are configured.
+const minRouteMaxAge = 10 * time.Minute
+
+// routeMaxAge returns how long the weather of a provider point is reused,
+// which is the cache TTL, or the refresh interval when polling, and at least
+// minRouteMaxAge.
+func (c *Config) routeMaxAge() time.Duration {
+	maxAge := time.Duration(c.CacheTTL)
+	if ri := time.Duration(c.RefreshInterval); ri > maxAge {
+		maxAge = ri
+	}
+	if maxAge < minRouteMaxAge {
+		maxAge = minRouteMaxAge
+	}
+	return maxAge
+}
+
+// cachedRouteWeather returns the last weather of the given provider points,
+// however old. Points that were never fetched are not returned.
+func (wc *WeatherCollector) cachedRouteWeather(locations []*Location) map[string]*Weather {
+	result := make(map[string]*Weather, len(locations))
+	wc.routePoints.mu.Lock()
+	defer wc.routePoints.mu.Unlock()
+	for _, loc := range locations {
+		if p, ok := wc.routePoints.points[loc.Name]; ok {
+			result[loc.Name] = p.weather
+		}
+	}
+	return result
+}
+
+// routeWeather returns the weather of the given provider points, fetching
+// the ones that are missing or too old. Points that cannot be fetched are
+// not returned.
+func (wc *WeatherCollector) routeWeather(ctx context.Context, locations []*Location) map[string]*Weather {
+	maxAge := wc.cfg().routeMaxAge()
+	result := make(map[string]*Weather, len(locations))
+	var missing []string
+	byName := make(map[string]*Location)
+	wc.routePoints.mu.Lock()
+	for _, loc := range locations {
+		if p, ok := wc.routePoints.points[loc.Name]; ok && time.Since(p.fetchedAt) < maxAge {
+			result[loc.Name] = p.weather
+		} else if _, ok := byName[loc.Name]; !ok {
+			missing = append(missing, loc.Name)
+			byName[loc.Name] = loc
+		}
+	}
+	wc.routePoints.mu.Unlock()
+	var mu sync.Mutex
+	wc.forEachLocation(missing, func(_ int, name string) {
+		ctx := withLogFields(ctx, "location", name, "provider", wc.provider.Name())
+		w, err := wc.provider.Get(ctx, byName[name])
+		if err != nil {
+			errorf(ctx, "Failed to get weather for route point %s: %v", name, err)
+			return
+		}
+		wc.routePoints.mu.Lock()
+		if wc.cfg().LowMemory {
+			wc.routePoints.evict(maxAge, lowMemoryRoutePoints-1)
+		}
+		wc.routePoints.points[name] = routePoint{weather: w, fetchedAt: time.Now()}
+		wc.routePoints.mu.Unlock()
+		mu.Lock()
+		result[name] = w
+		mu.Unlock()
+	})
+	return result
+}
+
+// newRouteDescs returns the descriptors of the interpolated metrics of the
+// routes, by field name.
+func newRouteDescs(config *Config, constLabels prometheus.Labels) map[string]*prometheus.Desc {
+	descs := make(map[string]*prometheus.Desc)
+	if len(config.Routes) == 0 {
+		return descs
+	}
+	for _, key := range config.Metrics {
+		field, _ := lookupField(key)
+		descs[key] = prometheus.NewDesc(
+			fmt.Sprintf("weather_route_%s", key),
+			fmt.Sprintf("Interpolated from the nearest provider point - %s", field.helpString(config.HelpLanguage, fieldConversion(config.Units, field).unit)),
+			withUnitLabel([]string{"route", "waypoint", "latitude", "longitude"}, config.Units),
+			constLabels,
+		)
+	}
+	return descs
+}
+
+// routeLocations returns the provider points of all the routes, and the
+// provider point of every waypoint, by route.
+func (c *Config) routeLocations() ([]*Location, [][]*Location) {
+	var locations []*Location
+	nearest := make([][]*Location, len(c.Routes))
+	for idx, r := range c.Routes {
+		for _, wp := range r.points() {
+			loc := snapToGrid(wp, r.resolution())
+			nearest[idx] = append(nearest[idx], loc)
+			locations = append(locations, loc)
+		}
+	}
+	return locations, nearest
+}
+
+// refreshRoutes fetches the weather of the provider points of the routes that
+// are missing or too old.
+func (wc *WeatherCollector) refreshRoutes(ctx context.Context) {
+	if len(wc.cfg().Routes) == 0 {
+		return
+	}
+	locations, _ := wc.cfg().routeLocations()
+	wc.routeWeather(ctx, locations)
+}
+
+// collectRoutes sends the metrics of every waypoint of the routes to ch,
+// taken from the nearest provider point. Every provider point is fetched
+// once, however many waypoints share it. When polling, the provider points
+// are fetched by the poller, and only the cached ones are sent.
+func (wc *WeatherCollector) collectRoutes(ctx context.Context, ch chan<- prometheus.Metric) {
+	if len(wc.cfg().Routes) == 0 {
+		return
+	}
+	locations, nearest := wc.cfg().routeLocations()
+	var weather map[string]*Weather
+	if wc.polling() {
+		weather = wc.cachedRouteWeather(locations)
+	} else {
+		weather = wc.routeWeather(ctx, locations)
+	}
+	wc.mu.RLock()
+	descs := wc.routeDescs
+	wc.mu.RUnlock()
+	units := wc.cfg().Units
+	for idx, r := range wc.cfg().Routes {
+		points := make(map[string]bool)
+		for pidx, wp := range r.points() {
+			w, ok := weather[nearest[idx][pidx].Name]
+			if !ok {
+				continue
+			}
+			points[nearest[idx][pidx].Name] = true
+			for key, desc := range descs {
+				field, _ := lookupField(key)
+				conv := fieldConversion(units, field)
+				ch <- prometheus.MustNewConstMetric(
+					desc,
+					prometheus.GaugeValue,
+					wc.round(key, conv.value(field.Value(&w.Forecast.Currently))),
+					wc.unitLabelValues(conv, r.Name, wp.Name, fmt.Sprintf("%f", wp.Lat), fmt.Sprintf("%f", wp.Lng))...,
+				)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(wc.routePointsDesc, prometheus.GaugeValue, float64(len(points)), r.Name)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultScheduleKey is the key of the refresh schedule applied to the
+// locations without their own.
+const defaultScheduleKey = "*"
+
+// RefreshWindow is a daily time range, in local time, during which the
+// weather of a location is refreshed at most every Interval. The range can
+// span midnight.
+type RefreshWindow struct {
+	Start    ClockTime `json:"start"`
+	End      ClockTime `json:"end"`
+	Interval Duration  `json:"interval"`
+}
+
+// RefreshSchedule is a list of refresh windows. The first window containing
+// the current time applies, outside of every window the weather is refreshed
+// at every scrape.
+type RefreshSchedule []RefreshWindow
+
+// interval returns the refresh interval at time t, or 0 if no window applies.
+func (s RefreshSchedule) interval(t time.Time) time.Duration {
+	for _, w := range s {
+		if inClockRange(w.Start, w.End, t) {
+			return time.Duration(w.Interval)
+		}
+	}
+	return 0
+}
+
+// scheduleFor returns the refresh schedule of a location, falling back to the
+// default one.
+func scheduleFor(config *Config, name string) RefreshSchedule {
+	if s, ok := config.RefreshSchedules[name]; ok {
+		return s
+	}
+	return config.RefreshSchedules[defaultScheduleKey]
+}
+
+// validateRefreshSchedules checks that every schedule refers to a configured
+// location and has positive intervals.
+func validateRefreshSchedules(config *Config) error {
+	known := make(map[string]bool, len(config.Locations))
+	for _, loc := range config.Locations.Names() {
+		known[loc] = true
+	}
+	for name, schedule := range config.RefreshSchedules {
+		if name != defaultScheduleKey && !known[name] {
+			return fmt.Errorf("refresh schedule for unknown location '%s'", name)
+		}
+		for idx, w := range schedule {
+			if w.Interval <= 0 {
+				return fmt.Errorf("refresh schedule for '%s': window %d has no interval", name, idx)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// schemaProvider is implemented by the configuration types whose JSON
+// representation differs from their Go type, e.g. Duration.
+type schemaProvider interface {
+	jsonSchema() map[string]interface{}
+}
+
+var schemaProviderType = reflect.TypeOf((*schemaProvider)(nil)).Elem()
+
+// jsonSchema returns the JSON Schema for a Go type, following the same rules
+// as encoding/json.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	if t.Implements(schemaProviderType) {
+		return reflect.Zero(t).Interface().(schemaProvider).jsonSchema()
+	}
+	if reflect.PtrTo(t).Implements(schemaProviderType) {
+		return reflect.New(t).Interface().(schemaProvider).jsonSchema()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		panic(fmt.Sprintf("unsupported type in configuration: %s", t))
+	}
+}
+
+// structSchema returns the JSON Schema of the fields of a struct, ignoring
+// the jsonSchema method of the struct itself, if any.
+func structSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	for idx := 0; idx < t.NumField(); idx++ {
+		f := t.Field(idx)
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			name = strings.Split(tag, ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+		}
+		props[name] = jsonSchema(f.Type)
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+// writeConfigSchema writes the JSON Schema of the configuration file.
+func writeConfigSchema(w io.Writer) error {
+	schema := jsonSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "prometheus-weather-exporter configuration"
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(schema)
+}
+
+func (Duration) jsonSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "string",
+		"pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`,
+	}
+}
+
+func (LocationConfig) jsonSchema() map[string]interface{} {
+	// the object form is generated from the fields, with the constraints
+	// checked by UnmarshalJSON and validateLocationProviders
+	object := structSchema(reflect.TypeOf(LocationConfig{}))
+	object["required"] = []string{"name"}
+	// the coordinates are either both set or geocoded
+	object["dependencies"] = map[string]interface{}{
+		"lat": []string{"lng"},
+		"lng": []string{"lat"},
+	}
+	// a single provider or a failover chain
+	object["not"] = map[string]interface{}{"required": []string{"provider", "providers"}}
+	return map[string]interface{}{
+		"oneOf": []interface{}{
+			map[string]interface{}{"type": "string"},
+			object,
+		},
+	}
+}
+
+func (ClockTime) jsonSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "string",
+		"pattern": `^([01]?[0-9]|2[0-3]):[0-5][0-9]$`,
+	}
+}
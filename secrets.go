@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// apiKeySource describes where an API key can be set, in order of
+// precedence: the configuration file, a file whose path is in the
+// configuration file, e.g. a Kubernetes or Docker secret, or an environment
+// variable.
+type apiKeySource struct {
+	name string
+	key  *string
+	file string
+	env  string
+}
+
+// readAPIKey returns the API key from a source, or an empty string if not
+// set anywhere. Setting the key both inline and as a file is an error.
+func readAPIKey(s apiKeySource) (string, error) {
+	if *s.key != "" && s.file != "" {
+		return "", fmt.Errorf("%s and %s_file are mutually exclusive", s.name, s.name)
+	}
+	if *s.key != "" {
+		return *s.key, nil
+	}
+	if s.file != "" {
+		data, err := ioutil.ReadFile(s.file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s_file: %w", s.name, err)
+		}
+		// secret files often end with a newline
+		return strings.TrimSpace(string(data)), nil
+	}
+	if s.env != "" {
+		return os.Getenv(s.env), nil
+	}
+	return "", nil
+}
+
+// resolveAPIKeys reads the API keys set as files or environment variables
+// into the configuration. The tenants can use files, but not environment
+// variables, which would be shared by all of them.
+func (c *Config) resolveAPIKeys() error {
+	sources := []apiKeySource{
+		{name: "google_maps_api_key", key: &c.GoogleMapsAPIKey, file: c.GoogleMapsAPIKeyFile, env: "GOOGLE_MAPS_API_KEY"},
+		{name: "darksky_api_key", key: &c.DarkskyAPIKey, file: c.DarkskyAPIKeyFile, env: "DARKSKY_API_KEY"},
+		{name: "openweathermap_api_key", key: &c.OpenWeatherMapAPIKey, file: c.OpenWeatherMapAPIKeyFile, env: "OPENWEATHERMAP_API_KEY"},
+		{name: "pirateweather_api_key", key: &c.PirateWeatherAPIKey, file: c.PirateWeatherAPIKeyFile, env: "PIRATEWEATHER_API_KEY"},
+		{name: "tomorrowio_api_key", key: &c.TomorrowIOAPIKey, file: c.TomorrowIOAPIKeyFile, env: "TOMORROWIO_API_KEY"},
+		{name: "accuweather_api_key", key: &c.AccuWeatherAPIKey, file: c.AccuWeatherAPIKeyFile, env: "ACCUWEATHER_API_KEY"},
+		{name: "visualcrossing_api_key", key: &c.VisualCrossingAPIKey, file: c.VisualCrossingAPIKeyFile, env: "VISUALCROSSING_API_KEY"},
+	}
+	for _, s := range sources {
+		key, err := readAPIKey(s)
+		if err != nil {
+			return err
+		}
+		*s.key = key
+	}
+	for name, t := range c.Tenants {
+		if t == nil {
+			continue
+		}
+		for _, s := range []apiKeySource{
+			{name: "google_maps_api_key", key: &t.GoogleMapsAPIKey, file: t.GoogleMapsAPIKeyFile},
+			{name: "darksky_api_key", key: &t.DarkskyAPIKey, file: t.DarkskyAPIKeyFile},
+			{name: "openweathermap_api_key", key: &t.OpenWeatherMapAPIKey, file: t.OpenWeatherMapAPIKeyFile},
+			{name: "pirateweather_api_key", key: &t.PirateWeatherAPIKey, file: t.PirateWeatherAPIKeyFile},
+			{name: "tomorrowio_api_key", key: &t.TomorrowIOAPIKey, file: t.TomorrowIOAPIKeyFile},
+			{name: "accuweather_api_key", key: &t.AccuWeatherAPIKey, file: t.AccuWeatherAPIKeyFile},
+			{name: "visualcrossing_api_key", key: &t.VisualCrossingAPIKey, file: t.VisualCrossingAPIKeyFile},
+		} {
+			key, err := readAPIKey(s)
+			if err != nil {
+				return fmt.Errorf("tenant '%s': %w", name, err)
+			}
+			*s.key = key
+		}
+	}
+	return nil
+}
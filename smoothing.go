@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// SmoothingConfig configures the smoothing of a noisy metric, e.g. the wind
+// gusts. The average is applied first, then the minimum change.
+type SmoothingConfig struct {
+	// Alpha is the weight of a new value in the exponential moving average,
+	// between 0 and 1. 0 or 1 disables the average.
+	Alpha float64 `json:"alpha"`
+	// MinChange is the minimum change from the exported value for a new
+	// value to be exported. 0 exports every change.
+	MinChange float64 `json:"min_change"`
+}
+
+// validateSmoothing checks the smoothing configuration of every metric.
+func validateSmoothing(config map[string]*SmoothingConfig) error {
+	for key, s := range config {
+		if _, ok := lookupField(key); !ok {
+			return fmt.Errorf("unknown metric '%s'", key)
+		}
+		if s == nil {
+			return fmt.Errorf("metric '%s' has no smoothing settings", key)
+		}
+		if s.Alpha < 0 || s.Alpha > 1 {
+			return fmt.Errorf("metric '%s': alpha must be between 0 and 1", key)
+		}
+		if s.MinChange < 0 {
+			return fmt.Errorf("metric '%s': min_change must not be negative", key)
+		}
+	}
+	return nil
+}
+
+// smoother keeps the smoothed values of the configured metrics for each
+// location, updated at every fetch.
+type smoother struct {
+	config map[string]*SmoothingConfig
+	mu     sync.Mutex
+	values map[string]map[string]float64
+}
+
+func newSmoother(config map[string]*SmoothingConfig) *smoother {
+	return &smoother{
+		config: config,
+		values: make(map[string]map[string]float64),
+	}
+}
+
+// add smooths the values of a new data point of a location. The first data
+// point of a location is taken as is.
+func (s *smoother) add(name string, dp *forecast.DataPoint) {
+	if len(s.config) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values, ok := s.values[name]
+	if !ok {
+		values = make(map[string]float64, len(s.config))
+		s.values[name] = values
+	}
+	for key, c := range s.config {
+		field, _ := lookupField(key)
+		v := field.Value(dp)
+		prev, ok := values[key]
+		if ok {
+			if c.Alpha > 0 && c.Alpha < 1 {
+				v = prev + c.Alpha*(v-prev)
+			}
+			if math.Abs(v-prev) < c.MinChange {
+				v = prev
+			}
+		}
+		values[key] = v
+	}
+}
+
+// value returns the smoothed value of a metric of a location, if the metric
+// is smoothed and the location was fetched.
+func (s *smoother) value(name, key string) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[name][key]
+	return v, ok
+}
+
+// prune removes the values of all the locations not in keep.
+func (s *smoother) prune(keep map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.values {
+		if !keep[name] {
+			delete(s.values, name)
+		}
+	}
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SNMPConfig configures the read-only SNMP agent.
+type SNMPConfig struct {
+	// Listen is the UDP address to listen to. Defaults to ":1161", since the
+	// standard port 161 requires privileges.
+	Listen string `json:"listen"`
+	// Community is the SNMP v1 and v2c community. Defaults to "public".
+	Community string `json:"community"`
+}
+
+const (
+	defaultSNMPListen    = ":1161"
+	defaultSNMPCommunity = "public"
+	// snmpMaxVarBinds limits the size of the GetBulk responses.
+	snmpMaxVarBinds = 256
+)
+
+// snmpBaseOID is the root of the WEATHER-EXPORTER-MIB. The exporter has no
+// private enterprise number, so the MIB lives under the Net-SNMP playpen
+// (netSnmpPlaypen), using the default exporter port as arc.
+var snmpBaseOID = oid{1, 3, 6, 1, 4, 1, 8072, 9999, 9999, 9102}
+
+// The objects of the MIB, relative to snmpBaseOID.
+var (
+	snmpLocationCountOID = oid{1, 1}
+	snmpLocationEntryOID = oid{1, 2, 1}
+)
+
+// The columns of weatherLocationTable. The weather fields follow, in the order
+// of the field registry, starting at snmpFirstFieldColumn.
+const (
+	snmpColumnIndex      = 1
+	snmpColumnName       = 2
+	snmpColumnUp         = 3
+	snmpFirstFieldColumn = 4
+)
+
+// BER tags used by SNMP.
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+
+	snmpNoSuchObject   = 0x80
+	snmpNoSuchInstance = 0x81
+	snmpEndOfMibView   = 0x82
+
+	snmpGetRequest     = 0xa0
+	snmpGetNextRequest = 0xa1
+	snmpResponse       = 0xa2
+	snmpSetRequest     = 0xa3
+	snmpGetBulkRequest = 0xa5
+)
+
+// SNMP versions and error statuses.
+const (
+	snmpVersion1  = 0
+	snmpVersion2c = 1
+
+	snmpErrNoSuchName  = 2
+	snmpErrNotWritable = 17
+)
+
+// oid is an SNMP object identifier.
+type oid []uint32
+
+func (o oid) String() string {
+	arcs := make([]string, 0, len(o))
+	for _, arc := range o {
+		arcs = append(arcs, strconv.FormatUint(uint64(arc), 10))
+	}
+	return strings.Join(arcs, ".")
+}
+
+// join returns a new OID made of o followed by the given arcs.
+func (o oid) join(arcs ...uint32) oid {
+	joined := make(oid, 0, len(o)+len(arcs))
+	return append(append(joined, o...), arcs...)
+}
+
+// compare compares two OIDs in lexicographic order, returning -1, 0 or 1.
+func (o oid) compare(p oid) int {
+	for idx := 0; idx < len(o) && idx < len(p); idx++ {
+		switch {
+		case o[idx] < p[idx]:
+			return -1
+		case o[idx] > p[idx]:
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(p):
+		return -1
+	case len(o) > len(p):
+		return 1
+	}
+	return 0
+}
+
+var errMalformedBER = errors.New("malformed BER encoding")
+
+// berRead reads a TLV from data, and returns its tag, its value and the bytes
+// that follow it.
+func berRead(data []byte) (tag byte, value, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errMalformedBER
+	}
+	tag, length := data[0], int(data[1])
+	data = data[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(data) < n {
+			return 0, nil, nil, errMalformedBER
+		}
+		length = 0
+		for _, b := range data[:n] {
+			length = length<<8 | int(b)
+		}
+		data = data[n:]
+	}
+	if length > len(data) {
+		return 0, nil, nil, errMalformedBER
+	}
+	return tag, data[:length], data[length:], nil
+}
+
+// berExpect reads a TLV with the given tag from data.
+func berExpect(data []byte, tag byte) (value, rest []byte, err error) {
+	t, value, rest, err := berRead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t != tag {
+		return nil, nil, fmt.Errorf("unexpected tag 0x%02x, want 0x%02x", t, tag)
+	}
+	return value, rest, nil
+}
+
+// berReadInt reads an INTEGER from data.
+func berReadInt(data []byte) (int64, []byte, error) {
+	value, rest, err := berExpect(data, berInteger)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(value) == 0 || len(value) > 8 {
+		return 0, nil, errMalformedBER
+	}
+	// sign-extend the first byte
+	v := int64(int8(value[0]))
+	for _, b := range value[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, rest, nil
+}
+
+// berParseOID decodes the value of an OBJECT IDENTIFIER.
+func berParseOID(value []byte) (oid, error) {
+	if len(value) == 0 {
+		return nil, errMalformedBER
+	}
+	var (
+		arcs oid
+		arc  uint64
+	)
+	for idx, b := range value {
+		arc = arc<<7 | uint64(b&0x7f)
+		if arc > math.MaxUint32 {
+			return nil, errMalformedBER
+		}
+		if b&0x80 != 0 {
+			if idx == len(value)-1 {
+				return nil, errMalformedBER
+			}
+			continue
+		}
+		if len(arcs) == 0 {
+			// the first two arcs are encoded together
+			switch {
+			case arc < 40:
+				arcs = append(arcs, 0, uint32(arc))
+			case arc < 80:
+				arcs = append(arcs, 1, uint32(arc-40))
+			default:
+				arcs = append(arcs, 2, uint32(arc-80))
+			}
+		} else {
+			arcs = append(arcs, uint32(arc))
+		}
+		arc = 0
+	}
+	return arcs, nil
+}
+
+// berAppend appends a TLV to buf.
+func berAppend(buf []byte, tag byte, value []byte) []byte {
+	buf = append(buf, tag)
+	switch n := len(value); {
+	case n < 0x80:
+		buf = append(buf, byte(n))
+	case n <= 0xff:
+		buf = append(buf, 0x81, byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 0x82, byte(n>>8), byte(n))
+	default:
+		buf = append(buf, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(buf, value...)
+}
+
+// berInt encodes the value of an INTEGER, using the minimum number of bytes.
+func berInt(v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		// stop when the remaining bits are just the sign extension of the
+		// encoded ones
+		if (v == 0 && b[0]&0x80 == 0) || (v == -1 && b[0]&0x80 != 0) {
+			return b
+		}
+	}
+}
+
+// berOIDValue encodes the value of an OBJECT IDENTIFIER.
+func berOIDValue(o oid) []byte {
+	if len(o) < 2 {
+		return []byte{0}
+	}
+	// the first two arcs are encoded together
+	arcs := make([]uint64, 0, len(o)-1)
+	arcs = append(arcs, uint64(o[0])*40+uint64(o[1]))
+	for _, arc := range o[2:] {
+		arcs = append(arcs, uint64(arc))
+	}
+	var b []byte
+	for _, arc := range arcs {
+		enc := []byte{byte(arc & 0x7f)}
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			enc = append([]byte{byte(arc&0x7f) | 0x80}, enc...)
+		}
+		b = append(b, enc...)
+	}
+	return b
+}
+
+// snmpVarBind is a variable binding. value is the encoded value of the given
+// tag.
+type snmpVarBind struct {
+	name  oid
+	tag   byte
+	value []byte
+}
+
+// snmpRequest is a decoded SNMP v1 or v2c request.
+type snmpRequest struct {
+	version   int64
+	community string
+	pduType   byte
+	requestID int64
+	// nonRepeaters and maxRepetitions are only set for GetBulk requests.
+	nonRepeaters   int64
+	maxRepetitions int64
+	varBinds       []snmpVarBind
+}
+
+// parseSNMPRequest decodes an SNMP message.
+func parseSNMPRequest(msg []byte) (*snmpRequest, error) {
+	body, _, err := berExpect(msg, berSequence)
+	if err != nil {
+		return nil, err
+	}
+	var req snmpRequest
+	if req.version, body, err = berReadInt(body); err != nil {
+		return nil, err
+	}
+	community, body, err := berExpect(body, berOctetString)
+	if err != nil {
+		return nil, err
+	}
+	req.community = string(community)
+	var pdu []byte
+	if req.pduType, pdu, _, err = berRead(body); err != nil {
+		return nil, err
+	}
+	if req.requestID, pdu, err = berReadInt(pdu); err != nil {
+		return nil, err
+	}
+	// error-status and error-index, or non-repeaters and max-repetitions
+	var a, b int64
+	if a, pdu, err = berReadInt(pdu); err != nil {
+		return nil, err
+	}
+	if b, pdu, err = berReadInt(pdu); err != nil {
+		return nil, err
+	}
+	if req.pduType == snmpGetBulkRequest {
+		req.nonRepeaters, req.maxRepetitions = a, b
+	}
+	list, _, err := berExpect(pdu, berSequence)
+	if err != nil {
+		return nil, err
+	}
+	for len(list) > 0 {
+		var vb []byte
+		if vb, list, err = berExpect(list, berSequence); err != nil {
+			return nil, err
+		}
+		value, rest, err := berExpect(vb, berOID)
+		if err != nil {
+			return nil, err
+		}
+		name, err := berParseOID(value)
+		if err != nil {
+			return nil, err
+		}
+		tag, value, _, err := berRead(rest)
+		if err != nil {
+			return nil, err
+		}
+		req.varBinds = append(req.varBinds, snmpVarBind{name: name, tag: tag, value: value})
+	}
+	return &req, nil
+}
+
+// encodeSNMPResponse encodes the response to req.
+func encodeSNMPResponse(req *snmpRequest, errStatus, errIndex int, varBinds []snmpVarBind) []byte {
+	var list []byte
+	for _, vb := range varBinds {
+		var enc []byte
+		enc = berAppend(enc, berOID, berOIDValue(vb.name))
+		enc = berAppend(enc, vb.tag, vb.value)
+		list = berAppend(list, berSequence, enc)
+	}
+	var pdu []byte
+	pdu = berAppend(pdu, berInteger, berInt(req.requestID))
+	pdu = berAppend(pdu, berInteger, berInt(int64(errStatus)))
+	pdu = berAppend(pdu, berInteger, berInt(int64(errIndex)))
+	pdu = berAppend(pdu, berSequence, list)
+	var msg []byte
+	msg = berAppend(msg, berInteger, berInt(req.version))
+	msg = berAppend(msg, berOctetString, []byte(req.community))
+	msg = berAppend(msg, snmpResponse, pdu)
+	return berAppend(nil, berSequence, msg)
+}
+
+// snmpInteger returns the encoded Integer32 value of a weather field, in
+// hundredths of its unit, since SNMP has no floating point type.
+func snmpInteger(v float64) []byte {
+	v = math.Round(v * 100)
+	switch {
+	case math.IsNaN(v):
+		v = 0
+	case v > math.MaxInt32:
+		v = math.MaxInt32
+	case v < math.MinInt32:
+		v = math.MinInt32
+	}
+	return berInt(int64(v))
+}
+
+// snmpAgent is a read-only SNMP v1 and v2c agent serving the current
+// conditions of every location. Like the dashboard, it uses the data fetched
+// by the last scrape or poll and never calls the APIs.
+type snmpAgent struct {
+	conn      *net.UDPConn
+	community string
+	wc        *WeatherCollector
+}
+
+// newSNMPAgent creates an SNMP agent for wc, listening on the configured
+// address.
+func newSNMPAgent(config *SNMPConfig, wc *WeatherCollector) (*snmpAgent, error) {
+	listen := config.Listen
+	if listen == "" {
+		listen = defaultSNMPListen
+	}
+	community := config.Community
+	if community == "" {
+		community = defaultSNMPCommunity
+	}
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address '%s': %w", listen, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", listen, err)
+	}
+	return &snmpAgent{conn: conn, community: community, wc: wc}, nil
+}
+
+// run answers the requests until ctx is done.
+func (a *snmpAgent) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		a.conn.Close()
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, src, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				warnf(ctx, "SNMP agent stopped: %v", err)
+			}
+			return
+		}
+		resp := a.handle(buf[:n])
+		if resp == nil {
+			continue
+		}
+		if _, err := a.conn.WriteToUDP(resp, src); err != nil {
+			warnf(ctx, "Failed to send SNMP response to %s: %v", src, err)
+		}
+	}
+}
+
+// handle returns the response to an SNMP message, or nil if the message must
+// be dropped, e.g. because of a wrong community.
+func (a *snmpAgent) handle(msg []byte) []byte {
+	req, err := parseSNMPRequest(msg)
+	if err != nil {
+		return nil
+	}
+	if req.version != snmpVersion1 && req.version != snmpVersion2c {
+		return nil
+	}
+	if req.community != a.community {
+		return nil
+	}
+	v1 := req.version == snmpVersion1
+	tree := a.tree()
+	var resp []snmpVarBind
+	switch req.pduType {
+	case snmpGetRequest, snmpGetNextRequest:
+		for idx, vb := range req.varBinds {
+			var (
+				found snmpVarBind
+				ok    bool
+			)
+			if req.pduType == snmpGetRequest {
+				found, ok = tree.get(vb.name)
+			} else {
+				found, ok = tree.next(vb.name)
+			}
+			if !ok {
+				if v1 {
+					return encodeSNMPResponse(req, snmpErrNoSuchName, idx+1, req.varBinds)
+				}
+				found = snmpVarBind{name: vb.name, tag: snmpNoSuchObject}
+				if req.pduType == snmpGetRequest && tree.hasObject(vb.name) {
+					found.tag = snmpNoSuchInstance
+				} else if req.pduType == snmpGetNextRequest {
+					found.tag = snmpEndOfMibView
+				}
+			}
+			resp = append(resp, found)
+		}
+	case snmpGetBulkRequest:
+		if v1 {
+			return nil
+		}
+		resp = tree.bulk(req.varBinds, int(req.nonRepeaters), int(req.maxRepetitions))
+	case snmpSetRequest:
+		if v1 {
+			return encodeSNMPResponse(req, snmpErrNoSuchName, 1, req.varBinds)
+		}
+		return encodeSNMPResponse(req, snmpErrNotWritable, 1, req.varBinds)
+	default:
+		return nil
+	}
+	return encodeSNMPResponse(req, 0, 0, resp)
+}
+
+// snmpTree is the list of the objects served by the agent, sorted by OID.
+type snmpTree []snmpVarBind
+
+// tree returns the objects for the current weather.
+func (a *snmpAgent) tree() snmpTree {
+	snapshot := make(map[string]*LocationWeather)
+	for _, lw := range a.wc.Snapshot() {
+		snapshot[lw.Name] = lw
+	}
+	locations := a.wc.Locations()
+	tree := snmpTree{{
+		name:  snmpBaseOID.join(snmpLocationCountOID...).join(0),
+		tag:   berInteger,
+		value: berInt(int64(len(locations))),
+	}}
+	entry := snmpBaseOID.join(snmpLocationEntryOID...)
+	for idx, name := range locations {
+		row := uint32(idx + 1)
+		lw, ok := snapshot[name]
+		up := int64(1)
+		if !ok || a.wc.isFailing(name) {
+			up = 0
+		}
+		tree = append(tree,
+			snmpVarBind{name: entry.join(snmpColumnName, row), tag: berOctetString, value: []byte(name)},
+			snmpVarBind{name: entry.join(snmpColumnUp, row), tag: berInteger, value: berInt(up)},
+		)
+		if !ok {
+			continue
+		}
+		for col := range fields {
+			tree = append(tree, snmpVarBind{
+				name:  entry.join(uint32(snmpFirstFieldColumn+col), row),
+				tag:   berInteger,
+				value: snmpInteger(fields[col].Value(&lw.Weather.Forecast.Currently)),
+			})
+		}
+	}
+	sort.Slice(tree, func(i, j int) bool { return tree[i].name.compare(tree[j].name) < 0 })
+	return tree
+}
+
+// get returns the object with the given OID.
+func (t snmpTree) get(name oid) (snmpVarBind, bool) {
+	idx := sort.Search(len(t), func(i int) bool { return t[i].name.compare(name) >= 0 })
+	if idx < len(t) && t[idx].name.compare(name) == 0 {
+		return t[idx], true
+	}
+	return snmpVarBind{}, false
+}
+
+// next returns the first object following the given OID.
+func (t snmpTree) next(name oid) (snmpVarBind, bool) {
+	idx := sort.Search(len(t), func(i int) bool { return t[i].name.compare(name) > 0 })
+	if idx < len(t) {
+		return t[idx], true
+	}
+	return snmpVarBind{}, false
+}
+
+// hasObject returns whether name is an instance of an object defined in the
+// MIB, even if the instance does not exist, e.g. a row that is not there.
+func (t snmpTree) hasObject(name oid) bool {
+	count := snmpBaseOID.join(snmpLocationCountOID...)
+	if len(name) == len(count)+1 && name[:len(count)].compare(count) == 0 {
+		return true
+	}
+	entry := snmpBaseOID.join(snmpLocationEntryOID...)
+	if len(name) != len(entry)+2 || name[:len(entry)].compare(entry) != 0 {
+		return false
+	}
+	col := name[len(entry)]
+	return col > snmpColumnIndex && col < uint32(snmpFirstFieldColumn+len(fields))
+}
+
+// bulk answers a GetBulk request.
+func (t snmpTree) bulk(varBinds []snmpVarBind, nonRepeaters, maxRepetitions int) []snmpVarBind {
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
+	}
+	if nonRepeaters > len(varBinds) {
+		nonRepeaters = len(varBinds)
+	}
+	if maxRepetitions < 0 {
+		maxRepetitions = 0
+	}
+	nextOrEnd := func(name oid) snmpVarBind {
+		if vb, ok := t.next(name); ok {
+			return vb
+		}
+		return snmpVarBind{name: name, tag: snmpEndOfMibView}
+	}
+	var resp []snmpVarBind
+	for _, vb := range varBinds[:nonRepeaters] {
+		resp = append(resp, nextOrEnd(vb.name))
+	}
+	repeaters := make([]oid, 0, len(varBinds)-nonRepeaters)
+	for _, vb := range varBinds[nonRepeaters:] {
+		repeaters = append(repeaters, vb.name)
+	}
+	for rep := 0; rep < maxRepetitions && len(repeaters) > 0; rep++ {
+		if len(resp)+len(repeaters) > snmpMaxVarBinds {
+			break
+		}
+		done := true
+		for idx, name := range repeaters {
+			vb := nextOrEnd(name)
+			resp = append(resp, vb)
+			repeaters[idx] = vb.name
+			if vb.tag != snmpEndOfMibView {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	return resp
+}
+
+// snmpObjectName returns the MIB object name of a weather field, e.g.
+// "weatherApparentTemperature".
+func snmpObjectName(f *Field) string {
+	name := "weather"
+	for _, word := range strings.Split(f.Name, "_") {
+		name += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return name
+}
+
+// writeSNMPMIB writes the WEATHER-EXPORTER-MIB module describing the objects
+// served by the SNMP agent.
+func writeSNMPMIB(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString(`WEATHER-EXPORTER-MIB DEFINITIONS ::= BEGIN
+
+IMPORTS
+    MODULE-IDENTITY, OBJECT-TYPE, Integer32 FROM SNMPv2-SMI
+    DisplayString                           FROM SNMPv2-TC
+    netSnmpPlaypen                          FROM NET-SNMP-MIB;
+
+weatherExporterMIB MODULE-IDENTITY
+    LAST-UPDATED "202610150000Z"
+    ORGANIZATION "prometheus-weather-exporter"
+    CONTACT-INFO "https://github.com/insomniacslk/prometheus-weather-exporter"
+    DESCRIPTION  "Current weather conditions of the locations configured in
+                 prometheus-weather-exporter. Values are integers in
+                 hundredths of the unit of the corresponding metric."
+    REVISION     "202610150000Z"
+    DESCRIPTION  "Initial version."
+    ::= { netSnmpPlaypen 9102 }
+
+weatherObjects OBJECT IDENTIFIER ::= { weatherExporterMIB 1 }
+
+weatherLocationCount OBJECT-TYPE
+    SYNTAX      Integer32
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "The number of rows in weatherLocationTable."
+    ::= { weatherObjects 1 }
+
+weatherLocationTable OBJECT-TYPE
+    SYNTAX      SEQUENCE OF WeatherLocationEntry
+    MAX-ACCESS  not-accessible
+    STATUS      current
+    DESCRIPTION "The current weather conditions, one row per location."
+    ::= { weatherObjects 2 }
+
+weatherLocationEntry OBJECT-TYPE
+    SYNTAX      WeatherLocationEntry
+    MAX-ACCESS  not-accessible
+    STATUS      current
+    DESCRIPTION "The current weather conditions of a location. The weather
+                 values are missing until the weather of the location has
+                 been fetched."
+    INDEX       { weatherLocationIndex }
+    ::= { weatherLocationTable 1 }
+
+WeatherLocationEntry ::= SEQUENCE {
+    weatherLocationIndex Integer32,
+    weatherLocationName  DisplayString,
+    weatherLocationUp    Integer32`)
+	for idx := range fields {
+		fmt.Fprintf(&b, ",\n    %s Integer32", snmpObjectName(&fields[idx]))
+	}
+	fmt.Fprintf(&b, `
+}
+
+weatherLocationIndex OBJECT-TYPE
+    SYNTAX      Integer32 (1..2147483647)
+    MAX-ACCESS  not-accessible
+    STATUS      current
+    DESCRIPTION "The position of the location in the configuration file,
+                 starting at 1. It changes when locations are added, removed
+                 or disabled."
+    ::= { weatherLocationEntry %d }
+
+weatherLocationName OBJECT-TYPE
+    SYNTAX      DisplayString
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "The name of the location, as in the configuration file."
+    ::= { weatherLocationEntry %d }
+
+weatherLocationUp OBJECT-TYPE
+    SYNTAX      Integer32 (0..1)
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "1 if the last fetch of the weather succeeded, 0 otherwise."
+    ::= { weatherLocationEntry %d }
+`, snmpColumnIndex, snmpColumnName, snmpColumnUp)
+	for idx := range fields {
+		f := &fields[idx]
+		help := f.Help[defaultHelpLanguage]
+		fmt.Fprintf(&b, `
+%s OBJECT-TYPE
+    SYNTAX      Integer32
+    UNITS       "0.01 %s"
+    MAX-ACCESS  read-only
+    STATUS      current
+    DESCRIPTION "%s, in hundredths of %s."
+    ::= { weatherLocationEntry %d }
+`, snmpObjectName(f), f.Unit, strings.ToUpper(help[:1])+help[1:], f.Unit, snmpFirstFieldColumn+idx)
+	}
+	b.WriteString("\nEND\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
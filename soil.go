@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// openMeteoSoilTemperatures are the Open-Meteo soil temperature variables,
+// in °C, by depth label.
+var openMeteoSoilTemperatures = map[string]string{
+	"soil_temperature_0cm":  "0cm",
+	"soil_temperature_6cm":  "6cm",
+	"soil_temperature_18cm": "18cm",
+	"soil_temperature_54cm": "54cm",
+}
+
+// openMeteoSoilMoistures are the Open-Meteo volumetric soil moisture
+// variables, in m³/m³, by depth label.
+var openMeteoSoilMoistures = map[string]string{
+	"soil_moisture_0_to_1cm":   "0-1cm",
+	"soil_moisture_1_to_3cm":   "1-3cm",
+	"soil_moisture_3_to_9cm":   "3-9cm",
+	"soil_moisture_9_to_27cm":  "9-27cm",
+	"soil_moisture_27_to_81cm": "27-81cm",
+}
+
+// openMeteoSoilVariables returns the names of the soil variables.
+func openMeteoSoilVariables() []string {
+	var names []string
+	for _, m := range []map[string]string{openMeteoSoilTemperatures, openMeteoSoilMoistures} {
+		for name := range m {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// openMeteoSoil returns the current soil temperatures and moistures, by depth
+// label, from an Open-Meteo response. Missing values, e.g. over water, are
+// skipped.
+func openMeteoSoil(data []byte) (map[string]float64, map[string]float64, error) {
+	var r struct {
+		Current map[string]*float64 `json:"current"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, nil, err
+	}
+	temperatures := make(map[string]float64)
+	moistures := make(map[string]float64)
+	for name, v := range r.Current {
+		if v == nil || !strings.HasPrefix(name, "soil_") {
+			continue
+		}
+		if depth, ok := openMeteoSoilTemperatures[name]; ok {
+			temperatures[depth] = *v
+		}
+		if depth, ok := openMeteoSoilMoistures[name]; ok {
+			moistures[depth] = *v
+		}
+	}
+	return temperatures, moistures, nil
+}
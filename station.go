@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Station identifies a weather station that contributed to a forecast.
+type Station struct {
+	Source string
+	ID     string
+}
+
+// StationInfo holds the station metadata for a forecast, for station-based
+// data sources.
+type StationInfo struct {
+	Stations []Station
+	// NearestDistance is the distance to the nearest station, in kilometers.
+	// It is zero if unknown.
+	NearestDistance float64
+}
+
+// parseDarkskyStations extracts the station metadata from the flags in a raw
+// Dark Sky response. The forecast package does not decode the nearest station
+// distance, and only knows a subset of the station lists.
+func parseDarkskyStations(data []byte) (*StationInfo, error) {
+	var raw struct {
+		Flags map[string]json.RawMessage `json:"flags"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	var info StationInfo
+	if v, ok := raw.Flags["nearest-station"]; ok {
+		if err := json.Unmarshal(v, &info.NearestDistance); err != nil {
+			return nil, err
+		}
+	}
+	keys := make([]string, 0, len(raw.Flags))
+	for key := range raw.Flags {
+		if strings.HasSuffix(key, "-stations") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var ids []string
+		if err := json.Unmarshal(raw.Flags[key], &ids); err != nil || len(ids) == 0 {
+			continue
+		}
+		// only the first station of each source is reported, the lists can
+		// be long and would blow up the cardinality
+		info.Stations = append(info.Stations, Station{
+			Source: strings.TrimSuffix(key, "-stations"),
+			ID:     ids[0],
+		})
+	}
+	return &info, nil
+}
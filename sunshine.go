@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// sunshineMinElevation is the solar elevation, in degrees, below which there
+// is no sunshine. The WMO counts sunshine from a direct irradiance of 120
+// W/m², which a clear sky reaches at about 3 degrees.
+const sunshineMinElevation = 3
+
+// uvIndexHourDose is the erythemal dose of one hour at UV index 1, in J/m².
+// A UV index of 1 is an erythemal irradiance of 25 mW/m².
+const uvIndexHourDose = 0.025 * 3600
+
+// solarElevation returns the elevation of the sun at the given coordinates and
+// time, in degrees, using the NOAA approximation of the solar position.
+func solarElevation(lat, lng float64, t time.Time) float64 {
+	t = t.UTC()
+	// fractional year, in radians
+	g := 2 * math.Pi / 365 * (float64(t.YearDay()-1) + (float64(t.Hour())-12)/24)
+	decl := 0.006918 - 0.399912*math.Cos(g) + 0.070257*math.Sin(g) -
+		0.006758*math.Cos(2*g) + 0.000907*math.Sin(2*g) -
+		0.002697*math.Cos(3*g) + 0.00148*math.Sin(3*g)
+	// equation of time, in minutes
+	eqtime := 229.18 * (0.000075 + 0.001868*math.Cos(g) - 0.032077*math.Sin(g) -
+		0.014615*math.Cos(2*g) - 0.040849*math.Sin(2*g))
+	minutes := float64(t.Hour()*60+t.Minute()) + float64(t.Second())/60
+	hourAngle := (minutes+eqtime+4*lng)/4 - 180
+	latRad, haRad := lat*math.Pi/180, hourAngle*math.Pi/180
+	sinElev := math.Sin(latRad)*math.Sin(decl) + math.Cos(latRad)*math.Cos(decl)*math.Cos(haRad)
+	return math.Asin(math.Max(-1, math.Min(1, sinElev))) * 180 / math.Pi
+}
+
+// sunshineRate estimates the sunshine duration per hour of the current
+// conditions, as the fraction of the sky that is clear while the sun is up.
+func sunshineRate(fc *forecast.Forecast) float64 {
+	t := time.Unix(fc.Currently.Time, 0)
+	if solarElevation(fc.Latitude, fc.Longitude, t) < sunshineMinElevation {
+		return 0
+	}
+	return math.Max(0, math.Min(1, 1-fc.Currently.CloudCover))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// tenantNameRE is the format of the tenant names, which are used in URLs.
+var tenantNameRE = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// TenantConfig is the configuration of a tenant. Every tenant has its own
+// locations, metrics, provider and API keys, and inherits all the other
+// settings from the main configuration.
+type TenantConfig struct {
+	Locations            LocationList `json:"locations"`
+	Metrics              []string     `json:"metrics"`
+	Provider             string       `json:"provider"`
+	GoogleMapsAPIKey     string       `json:"google_maps_api_key"`
+	DarkskyAPIKey        string       `json:"darksky_api_key"`
+	OpenWeatherMapAPIKey string       `json:"openweathermap_api_key"`
+	PirateWeatherAPIKey  string       `json:"pirateweather_api_key"`
+	TomorrowIOAPIKey     string       `json:"tomorrowio_api_key"`
+	AccuWeatherAPIKey    string       `json:"accuweather_api_key"`
+	VisualCrossingAPIKey string       `json:"visualcrossing_api_key"`
+
+	GoogleMapsAPIKeyFile     string `json:"google_maps_api_key_file"`
+	DarkskyAPIKeyFile        string `json:"darksky_api_key_file"`
+	OpenWeatherMapAPIKeyFile string `json:"openweathermap_api_key_file"`
+	PirateWeatherAPIKeyFile  string `json:"pirateweather_api_key_file"`
+	TomorrowIOAPIKeyFile     string `json:"tomorrowio_api_key_file"`
+	AccuWeatherAPIKeyFile    string `json:"accuweather_api_key_file"`
+	VisualCrossingAPIKeyFile string `json:"visualcrossing_api_key_file"`
+}
+
+// tenantNames returns the names of the configured tenants, sorted.
+func (c *Config) tenantNames() []string {
+	var names []string
+	for name := range c.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tenantConfig returns the configuration of a tenant, i.e. a copy of the main
+// configuration with the tenant settings. The tenant state, if any, is kept
+// in its own file, next to the main one.
+func (c *Config) tenantConfig(name string) (*Config, error) {
+	t := c.Tenants[name]
+	if !tenantNameRE.MatchString(name) {
+		return nil, fmt.Errorf("invalid tenant name '%s', must match %s", name, tenantNameRE)
+	}
+	if t == nil || len(t.Locations) == 0 {
+		return nil, fmt.Errorf("tenant '%s' must specify at least one location", name)
+	}
+	tc := *c
+	tc.Tenants = nil
+	tc.TenantTokens = nil
+	tc.Locations = t.Locations
+	tc.DisabledLocations = nil
+	tc.RefreshSchedules = nil
+	tc.Canary = nil
+	tc.Consul = nil
+	tc.Alertmanager = nil
+	tc.Notifications = nil
+	tc.MDNS = nil
+	tc.SNMP = nil
+	tc.Modbus = nil
+	tc.BACnet = nil
+	tc.KNX = nil
+	tc.Rollups = nil
+	tc.Routes = nil
+	tc.RiverGauges = nil
+	tc.AvalancheRegions = nil
+	tc.RenderTemplate = ""
+	if len(t.Metrics) > 0 {
+		tc.Metrics = t.Metrics
+	}
+	for _, m := range tc.Metrics {
+		if _, ok := lookupField(m); !ok {
+			return nil, fmt.Errorf("tenant '%s': unsupported metric '%s'", name, m)
+		}
+	}
+	if t.Provider != "" {
+		tc.Provider = t.Provider
+	}
+	if t.GoogleMapsAPIKey != "" {
+		tc.GoogleMapsAPIKey = t.GoogleMapsAPIKey
+	}
+	if t.DarkskyAPIKey != "" {
+		tc.DarkskyAPIKey = t.DarkskyAPIKey
+	}
+	if t.OpenWeatherMapAPIKey != "" {
+		tc.OpenWeatherMapAPIKey = t.OpenWeatherMapAPIKey
+	}
+	if t.PirateWeatherAPIKey != "" {
+		tc.PirateWeatherAPIKey = t.PirateWeatherAPIKey
+	}
+	if t.TomorrowIOAPIKey != "" {
+		tc.TomorrowIOAPIKey = t.TomorrowIOAPIKey
+	}
+	if t.AccuWeatherAPIKey != "" {
+		tc.AccuWeatherAPIKey = t.AccuWeatherAPIKey
+	}
+	if t.VisualCrossingAPIKey != "" {
+		tc.VisualCrossingAPIKey = t.VisualCrossingAPIKey
+	}
+	if c.StateFile != "" {
+		tc.StateFile = c.StateFile + "." + name
+	}
+	if c.GeocodeCacheFile != "" {
+		tc.GeocodeCacheFile = c.GeocodeCacheFile + "." + name
+	}
+	return &tc, nil
+}
+
+// tenant is a tenant with its own collector, served at its own path.
+type tenant struct {
+	name      string
+	config    *Config
+	collector *WeatherCollector
+}
+
+// newTenant creates the collector of a tenant, with its own HTTP client and
+// provider, and starts the background refreshes if enabled.
+func newTenant(ctx context.Context, name string, config *Config, dev devOptions) (*tenant, error) {
+	tc, err := config.tenantConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := newHTTPClient(tc, dev)
+	provider, err := newProvider(tc, httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("tenant '%s': %w", name, err)
+	}
+	if err := validateConsensus(tc); err != nil {
+		return nil, fmt.Errorf("tenant '%s': consensus: %w", name, err)
+	}
+	if err := validateLocationProviders(tc); err != nil {
+		return nil, fmt.Errorf("tenant '%s': %w", name, err)
+	}
+	acc, err := loadAccumulators(tc.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("tenant '%s': failed to load state file '%s': %w", name, tc.StateFile, err)
+	}
+	wc := NewWeatherCollector(withCorrelationID(ctx, "tenant-"+name), tc, httpClient, provider, acc)
+	if wc.polling() {
+		wc.refreshAll(ctx)
+		go wc.poll(ctx)
+	}
+	logf(ctx, "Tenant '%s': %d location(s), provider %s", name, len(tc.Locations), provider.Name())
+	return &tenant{name: name, config: tc, collector: wc}, nil
+}
+
+// handle registers the metrics handler of the tenant under basePath. If
+// tokens are configured, the handler requires one allowing the tenant.
+func (t *tenant) handle(basePath string, opts promhttp.HandlerOpts, tokens map[string][]string) string {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(t.collector)
+	p := path.Join(basePath, t.name)
+	var h http.Handler = promhttp.HandlerFor(reg, opts)
+	if len(tokens) > 0 {
+		h = authorizeTenant(tokens, t.name, h)
+	}
+	http.Handle(p, h)
+	return p
+}
+
+// allTenants allows a token to access every tenant.
+const allTenants = "*"
+
+// validateTenantTokens checks that every token is non-empty and only refers to
+// configured tenants.
+func validateTenantTokens(config *Config) error {
+	for token, tenants := range config.TenantTokens {
+		if token == "" {
+			return fmt.Errorf("empty token")
+		}
+		for _, name := range tenants {
+			if _, ok := config.Tenants[name]; !ok && name != allTenants {
+				return fmt.Errorf("unknown tenant '%s'", name)
+			}
+		}
+	}
+	return nil
+}
+
+// authorizeTenant wraps h to require a bearer token allowing the tenant.
+// Requests without a valid token are rejected with 401, requests with a valid
+// token not allowing the tenant with 403.
+func authorizeTenant(tokens map[string][]string, tenant string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="weather-exporter"`)
+			http.Error(w, "missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		given := []byte(strings.TrimPrefix(auth, "Bearer "))
+		var (
+			valid   bool
+			allowed []string
+		)
+		// compare all the tokens in constant time, to not leak them
+		for token, tenants := range tokens {
+			if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+				valid, allowed = true, tenants
+			}
+		}
+		if !valid {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="weather-exporter", error="invalid_token"`)
+			http.Error(w, "invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		for _, name := range allowed {
+			if name == tenant || name == allTenants {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		http.Error(w, fmt.Sprintf("token not allowed for tenant '%s'", tenant), http.StatusForbidden)
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// tomorrowIOURL is the endpoint of the Tomorrow.io forecast API.
+const tomorrowIOURL = "https://api.tomorrow.io/v4/weather/forecast"
+
+// tomorrowIOConditions maps the Tomorrow.io weather codes to a Dark Sky icon,
+// using "-day" for the icons that have a night variant, and to a summary.
+var tomorrowIOConditions = map[int]struct{ icon, summary string }{
+	1000: {"clear-day", "Clear"},
+	1100: {"clear-day", "Mostly clear"},
+	1101: {"partly-cloudy-day", "Partly cloudy"},
+	1102: {"partly-cloudy-day", "Mostly cloudy"},
+	1001: {"cloudy", "Cloudy"},
+	2000: {"fog", "Fog"},
+	2100: {"fog", "Light fog"},
+	4000: {"rain", "Drizzle"},
+	4001: {"rain", "Rain"},
+	4200: {"rain", "Light rain"},
+	4201: {"rain", "Heavy rain"},
+	5000: {"snow", "Snow"},
+	5001: {"snow", "Flurries"},
+	5100: {"snow", "Light snow"},
+	5101: {"snow", "Heavy snow"},
+	6000: {"sleet", "Freezing drizzle"},
+	6001: {"sleet", "Freezing rain"},
+	6200: {"sleet", "Light freezing rain"},
+	6201: {"sleet", "Heavy freezing rain"},
+	7000: {"sleet", "Ice pellets"},
+	7101: {"sleet", "Heavy ice pellets"},
+	7102: {"sleet", "Light ice pellets"},
+	8000: {"thunderstorm", "Thunderstorm"},
+}
+
+// tomorrowIOCondition returns the Dark Sky icon and the summary for a
+// Tomorrow.io weather code.
+func tomorrowIOCondition(code float64, isDay bool) (string, string) {
+	c, ok := tomorrowIOConditions[int(code)]
+	if !ok {
+		return "", ""
+	}
+	if !isDay {
+		c.icon = strings.Replace(c.icon, "-day", "-night", 1)
+	}
+	return c.icon, c.summary
+}
+
+// tomorrowIOValues are the numeric data layers of a data point, by name.
+// Missing values are read as 0.
+type tomorrowIOValues map[string]float64
+
+// precipitation returns the precipitation intensity in mm/h, and its type.
+// The older data layer precipitationIntensity is used if present, otherwise
+// the intensities of each type are summed.
+func (v tomorrowIOValues) precipitation() (float64, string) {
+	rain := v["rainIntensity"] + v["freezingRainIntensity"]
+	snow := v["snowIntensity"]
+	sleet := v["sleetIntensity"]
+	total := rain + snow + sleet
+	if pi, ok := v["precipitationIntensity"]; ok {
+		total = pi
+	}
+	switch {
+	case snow > 0:
+		return total, "snow"
+	case sleet > 0:
+		return total, "sleet"
+	case total > 0:
+		return total, "rain"
+	}
+	return total, ""
+}
+
+// dataPoint converts the data layers of a Tomorrow.io data point, in metric
+// units, to the Dark Sky data model.
+func (v tomorrowIOValues) dataPoint(t time.Time, isDay bool) forecast.DataPoint {
+	dp := forecast.DataPoint{
+		Time:                t.Unix(),
+		Temperature:         v["temperature"],
+		ApparentTemperature: v["temperatureApparent"],
+		Humidity:            v["humidity"] / 100,
+		DewPoint:            v["dewPoint"],
+		CloudCover:          v["cloudCover"] / 100,
+		Pressure:            v["pressureSeaLevel"],
+		Visibility:          v["visibility"],
+		WindSpeed:           v["windSpeed"],
+		WindBearing:         v["windDirection"],
+		WindGust:            v["windGust"],
+		UVIndex:             int64(math.Round(v["uvIndex"])),
+		PrecipProbability:   v["precipitationProbability"] / 100,
+	}
+	if dp.Pressure == 0 {
+		// not available everywhere, the surface pressure is better than
+		// nothing
+		dp.Pressure = v["pressureSurfaceLevel"]
+	}
+	dp.PrecipIntensity, dp.PrecipType = v.precipitation()
+	dp.Icon, dp.Summary = tomorrowIOCondition(v["weatherCode"], isDay)
+	return dp
+}
+
+// tomorrowIOInterval is a data point of a timeline.
+type tomorrowIOInterval struct {
+	Time   time.Time
+	Values tomorrowIOValues
+	// Times are the data layers that are times, e.g. sunriseTime.
+	Times map[string]time.Time
+}
+
+// UnmarshalJSON implements json.Unmarshaler for tomorrowIOInterval, splitting
+// the data layers into numbers and times. Null values are skipped.
+func (i *tomorrowIOInterval) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Time   time.Time                  `json:"time"`
+		Values map[string]json.RawMessage `json:"values"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	i.Time = raw.Time
+	i.Values = make(tomorrowIOValues, len(raw.Values))
+	i.Times = make(map[string]time.Time)
+	for name, v := range raw.Values {
+		if string(v) == "null" {
+			continue
+		}
+		var f float64
+		if err := json.Unmarshal(v, &f); err == nil {
+			i.Values[name] = f
+			continue
+		}
+		var t time.Time
+		if err := json.Unmarshal(v, &t); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		i.Times[name] = t
+	}
+	return nil
+}
+
+// tomorrowIOResponse is a response of the forecast API. The minutely timeline
+// starts at the current minute.
+type tomorrowIOResponse struct {
+	Timelines struct {
+		Minutely []tomorrowIOInterval `json:"minutely"`
+		Hourly   []tomorrowIOInterval `json:"hourly"`
+		Daily    []tomorrowIOInterval `json:"daily"`
+	} `json:"timelines"`
+	Location struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	} `json:"location"`
+}
+
+// isDay returns whether t is between the sunrise and the sunset of one of the
+// days of the daily forecast. Times not covered by the daily forecast are
+// considered day.
+func (r *tomorrowIOResponse) isDay(t time.Time) bool {
+	for _, d := range r.Timelines.Daily {
+		sunrise, sunset := d.Times["sunriseTime"], d.Times["sunsetTime"]
+		if sunrise.IsZero() || sunset.IsZero() {
+			continue
+		}
+		// the night before the sunrise and the night after the sunset
+		// belong to the same day
+		if t.Before(sunset.Add(12 * time.Hour)) {
+			return !t.Before(sunrise) && t.Before(sunset)
+		}
+	}
+	return true
+}
+
+// forecast converts a Tomorrow.io response to the Dark Sky data model.
+func (r *tomorrowIOResponse) forecast() *forecast.Forecast {
+	fc := forecast.Forecast{
+		Latitude:  r.Location.Lat,
+		Longitude: r.Location.Lon,
+		// the API reports no time zone, use the solar time
+		Offset: math.Round(r.Location.Lon / 15),
+		Flags:  forecast.Flags{Units: string(forecast.SI), Sources: []string{"tomorrowio"}},
+	}
+	for _, h := range r.Timelines.Hourly {
+		fc.Hourly.Data = append(fc.Hourly.Data, h.Values.dataPoint(h.Time, r.isDay(h.Time)))
+	}
+	switch {
+	case len(r.Timelines.Minutely) > 0:
+		m := r.Timelines.Minutely[0]
+		fc.Currently = m.Values.dataPoint(m.Time, r.isDay(m.Time))
+	case len(fc.Hourly.Data) > 0:
+		fc.Currently = fc.Hourly.Data[0]
+	}
+	for _, d := range r.Timelines.Daily {
+		v := d.Values
+		dp := forecast.DataPoint{
+			Time:              d.Time.Unix(),
+			TemperatureMin:    v["temperatureMin"],
+			TemperatureMax:    v["temperatureMax"],
+			PrecipIntensity:   (v["rainAccumulationSum"] + v["snowAccumulationSum"] + v["sleetAccumulationSum"] + v["iceAccumulationSum"]) / 24,
+			PrecipProbability: v["precipitationProbabilityMax"] / 100,
+			WindSpeed:         v["windSpeedMax"],
+			WindBearing:       v["windDirectionAvg"],
+			UVIndex:           int64(math.Round(v["uvIndexMax"])),
+		}
+		if t, ok := d.Times["sunriseTime"]; ok {
+			dp.SunriseTime = t.Unix()
+		}
+		if t, ok := d.Times["sunsetTime"]; ok {
+			dp.SunsetTime = t.Unix()
+		}
+		switch {
+		case v["snowAccumulationSum"] > 0:
+			dp.PrecipType = "snow"
+		case v["rainAccumulationSum"] > 0:
+			dp.PrecipType = "rain"
+		}
+		dp.Icon, dp.Summary = tomorrowIOCondition(v["weatherCodeMax"], true)
+		fc.Daily.Data = append(fc.Daily.Data, dp)
+	}
+	return &fc
+}
+
+// tomorrowIOProvider gets the weather from the Tomorrow.io forecast API.
+type tomorrowIOProvider struct {
+	httpClient *http.Client
+	apiKey     string
+}
+
+// Name implements Provider.Name for tomorrowIOProvider.
+func (p *tomorrowIOProvider) Name() string {
+	return "tomorrowio"
+}
+
+// Get implements Provider.Get for tomorrowIOProvider.
+func (p *tomorrowIOProvider) Get(ctx context.Context, loc *Location) (*Weather, error) {
+	q := url.Values{}
+	q.Set("location", loc.LatString()+","+loc.LngString())
+	q.Set("units", "metric")
+	q.Set("apikey", p.apiKey)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tomorrowIOURL+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		reason := reasonForStatus(resp.StatusCode, string(data))
+		countAPIError(p.Name(), reason)
+		return nil, &APIError{Provider: p.Name(), Reason: reason, Err: fmt.Errorf("HTTP status %s: %s", resp.Status, data)}
+	}
+	var r tomorrowIOResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		countAPIError(p.Name(), reasonDecode)
+		return nil, &APIError{Provider: p.Name(), Reason: reasonDecode, Err: err}
+	}
+	w := Weather{Forecast: r.forecast(), Stations: &StationInfo{}, Endpoint: tomorrowIOURL, ResponseSHA256: sha256Hex(data)}
+	w.QuotaUsage, w.HasQuotaUsage = quotaUsage(p.Name(), resp.Header)
+	return &w, nil
+}
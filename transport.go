@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exporterUserAgent identifies the exporter to the APIs that require it, as
+// per the Nominatim usage policy, the met.no terms of service and the NWS API
+// documentation.
+const exporterUserAgent = "prometheus-weather-exporter (+https://github.com/insomniacslk/prometheus-weather-exporter)"
+
+// providerHosts maps the upstream API hosts to the provider names used in the
+// exporter metrics.
+var providerHosts = map[string]string{
+	"maps.googleapis.com":         "googlemaps",
+	"api.avalanche.org":           "avalancheorg",
+	"nominatim.openstreetmap.org": "nominatim",
+	"api.darksky.net":             "darksky",
+	"dataservice.accuweather.com": "accuweather",
+	"environment.data.gov.uk":     "ea",
+	"nasstatus.faa.gov":           "faa",
+	"api.met.no":                  "metno",
+	"archive-api.open-meteo.com":  "openmeteo",
+	"api.open-meteo.com":          "openmeteo",
+	"api.openweathermap.org":      "openweathermap",
+	"api.pirateweather.net":       "pirateweather",
+	"api.tomorrow.io":             "tomorrowio",
+	"api.weather.gov":             "nws",
+	"static.avalanche.report":     "eaws",
+	"waterservices.usgs.gov":      "usgs",
+	"weather.visualcrossing.com":  "visualcrossing",
+}
+
+// providerForHost returns the provider name for an API host, or the host
+// itself if unknown.
+func providerForHost(host string) string {
+	if p, ok := providerHosts[host]; ok {
+		return p
+	}
+	return host
+}
+
+// keyFingerprint returns a short, non-reversible identifier for an API key,
+// that can be safely used as a label value.
+func keyFingerprint(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// instrumentedTransport is an http.RoundTripper that records metrics about
+// the requests to the upstream APIs, and propagates the correlation ID of the
+// request context, if any.
+type instrumentedTransport struct {
+	next http.RoundTripper
+	// pricing is the cost per call, by provider.
+	pricing map[string]float64
+	// keys are the API keys the requests can use, the global ones and the
+	// ones of the locations.
+	keys []string
+}
+
+// keyFingerprint returns the fingerprint of the API key used by a request,
+// found in its URL path, query or headers, or an empty string if it uses
+// none of the configured keys.
+func (t *instrumentedTransport) keyFingerprint(req *http.Request) string {
+	values := []string{req.URL.Path}
+	for _, v := range req.URL.Query() {
+		values = append(values, v...)
+	}
+	for _, v := range req.Header {
+		values = append(values, v...)
+	}
+	for _, key := range t.keys {
+		if key == "" {
+			continue
+		}
+		for _, v := range values {
+			if strings.Contains(v, key) {
+				return keyFingerprint(key)
+			}
+		}
+	}
+	return ""
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip for instrumentedTransport.
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id, ok := correlationID(req.Context()); ok {
+		req = req.Clone(req.Context())
+		req.Header.Set(correlationIDHeader, id)
+	}
+	provider := providerForHost(req.URL.Hostname())
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if apiRequestDuration != nil {
+		apiRequestDuration.WithLabelValues(provider).Observe(time.Since(start).Seconds())
+	}
+	if apiRequests != nil {
+		var code int
+		if resp != nil {
+			code = resp.StatusCode
+		}
+		apiRequests.WithLabelValues(provider, requestStatus(code, err)).Inc()
+	}
+	// requests that reached the API are assumed to be billed
+	if price, ok := t.pricing[provider]; ok && err == nil && apiCost != nil {
+		apiCost.WithLabelValues(provider, t.keyFingerprint(req)).Add(price)
+	}
+	return resp, err
+}
+
+// devOptions are developer options for the HTTP client, set from the command
+// line.
+type devOptions struct {
+	// RecordDir is a directory where all the API responses are archived.
+	RecordDir string
+	// ReplayDir is a directory of archived API responses to serve instead of
+	// calling the APIs.
+	ReplayDir string
+	// ChaosLatency, ChaosErrorRate and ChaosMalformedRate configure the
+	// fault injection, see chaosTransport.
+	ChaosLatency       time.Duration
+	ChaosErrorRate     float64
+	ChaosMalformedRate float64
+	// LogPayloads logs all the API responses at debug level, see
+	// payloadLogTransport.
+	LogPayloads bool
+}
+
+// newHTTPClient returns the HTTP client used for all the outgoing API
+// requests.
+func newHTTPClient(config *Config, dev devOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dnsCacheSize := 0
+	if config.LowMemory {
+		transport.MaxIdleConns = lowMemoryMaxIdleConns
+		transport.MaxIdleConnsPerHost = 1
+		transport.IdleConnTimeout = 30 * time.Second
+		dnsCacheSize = lowMemoryDNSCacheSize
+	}
+	if config.DNSCacheTTL > 0 || len(config.StaticHosts) > 0 {
+		transport.DialContext = newDNSCache(time.Duration(config.DNSCacheTTL), dnsCacheSize, config.StaticHosts).DialContext
+	}
+	var next http.RoundTripper = transport
+	secrets := redactor{config.GoogleMapsAPIKey, config.DarkskyAPIKey, config.OpenWeatherMapAPIKey, config.PirateWeatherAPIKey, config.TomorrowIOAPIKey, config.AccuWeatherAPIKey, config.VisualCrossingAPIKey}
+	for _, l := range config.Locations {
+		secrets = append(secrets, l.APIKey)
+	}
+	if dev.ReplayDir != "" {
+		next = &replayTransport{dir: dev.ReplayDir, redactor: secrets}
+	} else if dev.RecordDir != "" {
+		next = &recordTransport{next: transport, dir: dev.RecordDir, redactor: secrets}
+	}
+	if dev.LogPayloads {
+		next = &payloadLogTransport{next: next, redactor: secrets}
+	}
+	if dev.ChaosLatency > 0 || dev.ChaosErrorRate > 0 || dev.ChaosMalformedRate > 0 {
+		next = newChaosTransport(next, dev.ChaosLatency, dev.ChaosErrorRate, dev.ChaosMalformedRate)
+	}
+	if dev.ReplayDir != "" {
+		// replayed responses are not API calls, so they are not counted nor
+		// billed
+		return &http.Client{Transport: next}
+	}
+	return &http.Client{Transport: &instrumentedTransport{
+		next:    next,
+		pricing: config.APIPricing,
+		keys:    secrets,
+	}}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// unitConversion converts a value from the SI unit of a field to another
+// unit, as value*scale + offset.
+type unitConversion struct {
+	unit   string
+	scale  float64
+	offset float64
+}
+
+var (
+	toFahrenheit    = unitConversion{unit: "fahrenheit", scale: 1.8, offset: 32}
+	toMilesPerHour  = unitConversion{unit: "miles per hour", scale: 1 / 0.44704}
+	toKmPerHour     = unitConversion{unit: "kilometers per hour", scale: 3.6}
+	toMiles         = unitConversion{unit: "miles", scale: 1 / 1.609344}
+	toInchesPerHour = unitConversion{unit: "inches per hour", scale: 1 / 25.4}
+)
+
+// unitSystems are the conversions of each supported unit system, named as in
+// the Dark Sky API, by SI unit. Units that are not listed are not converted.
+// The providers are always queried in SI units, which the derived values rely
+// on, and the values are converted when exported.
+var unitSystems = map[string]map[string]unitConversion{
+	"si": {},
+	"us": {
+		"celsius":              toFahrenheit,
+		"meters per second":    toMilesPerHour,
+		"kilometers":           toMiles,
+		"millimeters per hour": toInchesPerHour,
+	},
+	"uk": {
+		"meters per second": toMilesPerHour,
+		"kilometers":        toMiles,
+	},
+	"ca": {
+		"meters per second": toKmPerHour,
+	},
+}
+
+// unitSystemNames returns the names of the supported unit systems, sorted.
+func unitSystemNames() []string {
+	names := make([]string, 0, len(unitSystems))
+	for name := range unitSystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fieldConversion returns the conversion of a field to the given unit system,
+// which does nothing for SI or an empty unit system.
+func fieldConversion(units string, f *Field) unitConversion {
+	return conversion(units, f.Unit)
+}
+
+// conversion returns the conversion of a value in the given SI unit to the
+// given unit system, for the values that are not fields.
+func conversion(units, unit string) unitConversion {
+	if conv, ok := unitSystems[units][unit]; ok {
+		return conv
+	}
+	return unitConversion{unit: unit, scale: 1}
+}
+
+// value converts a value.
+func (u unitConversion) value(v float64) float64 {
+	return v*u.scale + u.offset
+}
+
+// delta converts a difference between two values, which does not depend on
+// the offset.
+func (u unitConversion) delta(v float64) float64 {
+	return v * u.scale
+}
+
+// withUnitLabel appends the unit label to the labels of a metric if a unit
+// system is configured.
+func withUnitLabel(labels []string, units string) []string {
+	if units == "" {
+		return labels
+	}
+	return append(labels, "unit")
+}
+
+// label returns the value of the unit label, e.g. "miles_per_hour".
+func (u unitConversion) label() string {
+	return strings.ReplaceAll(u.unit, " ", "_")
+}
+
+// unitLabelValues appends the value of the unit label to the label values of
+// a metric if a unit system is configured.
+func (wc *WeatherCollector) unitLabelValues(conv unitConversion, values ...string) []string {
+	if wc.cfg().Units == "" {
+		return values
+	}
+	return append(values, conv.label())
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// freeTierDailyQuotas are the known free-tier limits of the providers, in
+// calls per day. Google Maps has a monthly credit rather than a daily limit,
+// the value is the credit divided by the price of a geocoding request and by
+// 30 days.
+var freeTierDailyQuotas = map[string]float64{
+	"darksky":        1000,
+	"openweathermap": 1000,
+	"tomorrowio":     500,
+	"accuweather":    50,
+	// 1000 records per day, a forecast is 15 daily records
+	"visualcrossing": 1000.0 / 15,
+	// non-commercial use only
+	"openmeteo":  10000,
+	"googlemaps": 200.0 / 0.005 / 30,
+}
+
+// ProviderUsage is the projected API usage of a provider.
+type ProviderUsage struct {
+	Provider    string  `json:"provider"`
+	CallsPerDay float64 `json:"calls_per_day"`
+	// FreeTierQuota is the known free-tier daily quota, or 0 if unknown.
+	FreeTierQuota float64 `json:"free_tier_quota,omitempty"`
+}
+
+// OverQuota returns whether the projected usage exceeds the free-tier quota.
+func (u *ProviderUsage) OverQuota() bool {
+	return u.FreeTierQuota > 0 && u.CallsPerDay > u.FreeTierQuota
+}
+
+// fetchCalls returns the number of API calls of a fetch of the weather of a
+// location from a provider.
+func fetchCalls(config *Config, provider string) float64 {
+	switch provider {
+	case "accuweather":
+		// the current conditions, and the forecasts if exported
+		calls := 1.0
+		hourly, daily := config.accuWeatherForecasts()
+		if hourly {
+			calls++
+		}
+		if daily {
+			calls++
+		}
+		return calls
+	case "nws":
+		// the hourly forecast, the latest observations and the alerts
+		return 3
+	}
+	return 1
+}
+
+// lookupCalls returns the number of API calls a provider makes once per
+// location, on its first fetch: the AccuWeather location key and the NWS
+// grid point.
+func lookupCalls(provider string) float64 {
+	switch provider {
+	case "accuweather", "nws":
+		return 1
+	}
+	return 0
+}
+
+// estimateUsage projects the number of API calls per day per provider, given
+// the configuration and the interval between two collections. The calls made
+// once per location, e.g. to look up the climate normals, are counted as on
+// the first day.
+func estimateUsage(config *Config, scrapeInterval time.Duration) []ProviderUsage {
+	calls := make(map[string]float64)
+	day := float64(24 * time.Hour)
+	if scrapeInterval > 0 {
+		// the adaptive refresh never fetches more often than its minimum
+		// interval, and only gets slower when throttled
+		var minInterval time.Duration
+		if config.AdaptiveRefresh != nil {
+			minInterval = time.Duration(config.AdaptiveRefresh.MinInterval)
+			if minInterval <= 0 {
+				minInterval = defaultAdaptiveMinInterval
+			}
+		}
+		// collectInterval is how often the data that is not fetched by
+		// location is looked at: at every poll or at every scrape
+		collectInterval := scrapeInterval
+		if config.RefreshInterval > 0 {
+			collectInterval = time.Duration(config.RefreshInterval)
+		}
+		every := func(maxAge time.Duration) float64 {
+			if collectInterval > maxAge {
+				maxAge = collectInterval
+			}
+			return day / float64(maxAge)
+		}
+		// sum the fetches minute by minute, as quiet hours and refresh
+		// schedules depend on the time of the day
+		start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local)
+		var fetches float64
+		for _, name := range config.enabledLocations() {
+			schedule := scheduleFor(config, name)
+			provider := config.locationProviderName(name)
+			calls[provider] += lookupCalls(provider)
+			// the locations with a provider-native ID are looked up by their
+			// provider rather than geocoded, which for AccuWeather is the
+			// location key lookup itself
+			if config.providerID(name) != "" && provider != "accuweather" {
+				calls[provider] += day / float64(config.geocodeCacheTTL())
+			}
+			for m := 0; m < 24*60; m++ {
+				t := start.Add(time.Duration(m) * time.Minute)
+				if config.QuietHours != nil && config.QuietHours.Contains(t) {
+					continue
+				}
+				interval := scrapeInterval
+				if config.RefreshInterval > 0 {
+					// scrapes never trigger a fetch in polling mode
+					interval = time.Duration(config.RefreshInterval)
+				}
+				if ttl := time.Duration(config.CacheTTL); ttl > interval {
+					interval = ttl
+				}
+				if si := schedule.interval(t); si > interval {
+					interval = si
+				}
+				if minInterval > interval {
+					interval = minInterval
+				}
+				n := float64(time.Minute) / float64(interval)
+				calls[provider] += n * fetchCalls(config, provider)
+				fetches += n
+			}
+			if config.ClimateNormals {
+				calls["openmeteo"]++
+			}
+		}
+		// locations are only geocoded again when their cached coordinates
+		// expire
+		if n := len(config.geocodedLocations()); n > 0 {
+			calls[config.geocoderName()] += float64(n) * day / float64(config.geocodeCacheTTL())
+		}
+		// the FAA status of all the airports is fetched with the weather,
+		// at most once per faaStatusMaxAge
+		if len(config.Airports) > 0 {
+			calls["faa"] += math.Min(fetches, day/float64(faaStatusMaxAge))
+		}
+		// the consensus providers and the route points are fetched at most
+		// once per cache TTL or refresh interval, and the main provider is
+		// shared with the main metrics
+		if c := config.Consensus; c != nil {
+			for _, name := range c.Providers {
+				if name != config.providerName() {
+					n := float64(len(config.enabledLocations()))
+					calls[name] += n * (lookupCalls(name) + fetchCalls(config, name)*every(config.routeMaxAge()))
+				}
+			}
+		}
+		if len(config.Routes) > 0 {
+			locations, _ := config.routeLocations()
+			points := make(map[string]bool)
+			for _, loc := range locations {
+				points[loc.Name] = true
+			}
+			provider := config.providerName()
+			n := float64(len(points))
+			calls[provider] += n * (lookupCalls(provider) + fetchCalls(config, provider)*every(config.routeMaxAge()))
+		}
+		// all the USGS gauges are fetched with a single call, every
+		// Environment Agency gauge needs its readings and the nearby flood
+		// warnings, and its coordinates once
+		var usgs bool
+		for _, g := range config.RiverGauges {
+			switch g.Source {
+			case riverSourceUSGS:
+				usgs = true
+			case riverSourceEA:
+				calls["ea"] += 1 + 2*every(riverGaugeMaxAge)
+			}
+		}
+		if usgs {
+			calls["usgs"] += every(riverGaugeMaxAge)
+		}
+		// every EAWS bulletin collection is fetched once for all its regions
+		eaws := make(map[string]bool)
+		for _, r := range config.AvalancheRegions {
+			switch r.Source {
+			case avalancheSourceEAWS:
+				u := r.URL
+				if u == "" {
+					u = defaultEAWSURL
+				}
+				if !eaws[u] {
+					eaws[u] = true
+					calls["eaws"] += every(avalancheMaxAge)
+				}
+			case avalancheSourceAvalancheOrg:
+				calls["avalancheorg"] += every(avalancheMaxAge)
+			}
+		}
+	}
+	if config.Canary != nil && config.Canary.Location != "" {
+		interval := time.Duration(config.Canary.Interval)
+		if interval <= 0 {
+			interval = defaultCanaryInterval
+		}
+		// the canary location is geocoded like the other locations
+		if _, ok := config.coordinates(config.Canary.Location); !ok {
+			calls[config.geocoderName()] += math.Min(day/float64(interval), day/float64(config.geocodeCacheTTL()))
+		}
+		calls[config.providerName()] += day / float64(interval) * fetchCalls(config, config.providerName())
+	}
+	var usage []ProviderUsage
+	for provider, n := range calls {
+		usage = append(usage, ProviderUsage{
+			Provider:      provider,
+			CallsPerDay:   n,
+			FreeTierQuota: freeTierDailyQuotas[provider],
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Provider < usage[j].Provider })
+	return usage
+}
+
+// writeUsageReport writes the projected API usage in a human-readable form.
+func writeUsageReport(w io.Writer, config *Config, scrapeInterval time.Duration) {
+	fmt.Fprintf(w, "Projected API usage with %d location(s) and a scrape interval of %s:\n", len(config.enabledLocations()), scrapeInterval)
+	for _, u := range estimateUsage(config, scrapeInterval) {
+		fmt.Fprintf(w, "  %-15s %8.0f calls/day", u.Provider, u.CallsPerDay)
+		if u.FreeTierQuota > 0 {
+			fmt.Fprintf(w, " (%.0f%% of the free tier)", u.CallsPerDay/u.FreeTierQuota*100)
+		}
+		if u.OverQuota() {
+			fmt.Fprint(w, " WARNING: above the free tier")
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// warnUsage logs a warning for every provider whose projected usage exceeds
+// the free tier.
+func warnUsage(config *Config, scrapeInterval time.Duration) {
+	for _, u := range estimateUsage(config, scrapeInterval) {
+		if u.OverQuota() {
+			warnf(context.Background(), "With a scrape interval of %s, %s is projected to get %.0f calls/day, above the free tier of %.0f calls/day", scrapeInterval, u.Provider, u.CallsPerDay, u.FreeTierQuota)
+		}
+	}
+}
+
+// usageHandler returns an HTTP handler serving the projected API usage of the
+// current configuration of wc in JSON format. The scrape interval can be
+// passed with the scrape_interval query parameter, e.g.
+// "?scrape_interval=30s".
+func usageHandler(wc *WeatherCollector, defaultScrapeInterval time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrapeInterval := defaultScrapeInterval
+		if v := r.URL.Query().Get("scrape_interval"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf("invalid scrape_interval '%s'", v), http.StatusBadRequest)
+				return
+			}
+			scrapeInterval = d
+		}
+		usage := estimateUsage(wc.cfg(), scrapeInterval)
+		var warnings []string
+		for _, u := range usage {
+			if u.OverQuota() {
+				warnings = append(warnings, fmt.Sprintf("%s is above the free tier", u.Provider))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			ScrapeInterval string          `json:"scrape_interval"`
+			Providers      []ProviderUsage `json:"providers"`
+			Warnings       []string        `json:"warnings,omitempty"`
+		}{
+			ScrapeInterval: scrapeInterval.String(),
+			Providers:      usage,
+			Warnings:       warnings,
+		}); err != nil {
+			errorf(r.Context(), "Failed to write usage report: %v", err)
+		}
+	})
+}
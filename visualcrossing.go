@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	forecast "github.com/insomniacslk/darksky/v2"
+)
+
+// visualCrossingURL is the endpoint of the Visual Crossing Timeline API.
+const visualCrossingURL = "https://weather.visualcrossing.com/VisualCrossingWebServices/rest/services/timeline"
+
+// visualCrossingConditions are the values of a data point of the Timeline API,
+// in metric units. The icons of the default icon set are the Dark Sky ones.
+type visualCrossingConditions struct {
+	DatetimeEpoch int64    `json:"datetimeEpoch"`
+	Temp          float64  `json:"temp"`
+	FeelsLike     float64  `json:"feelslike"`
+	TempMax       float64  `json:"tempmax"`
+	TempMin       float64  `json:"tempmin"`
+	Humidity      float64  `json:"humidity"`
+	Dew           float64  `json:"dew"`
+	Precip        float64  `json:"precip"`
+	PrecipProb    float64  `json:"precipprob"`
+	PrecipType    []string `json:"preciptype"`
+	WindSpeed     float64  `json:"windspeed"`
+	WindGust      float64  `json:"windgust"`
+	WindDir       float64  `json:"winddir"`
+	Pressure      float64  `json:"pressure"`
+	Visibility    float64  `json:"visibility"`
+	CloudCover    float64  `json:"cloudcover"`
+	UVIndex       float64  `json:"uvindex"`
+	SunriseEpoch  int64    `json:"sunriseEpoch"`
+	SunsetEpoch   int64    `json:"sunsetEpoch"`
+	Conditions    string   `json:"conditions"`
+	Icon          string   `json:"icon"`
+}
+
+// visualCrossingPrecipType returns the Dark Sky precipitation type of the
+// Visual Crossing ones, e.g. "freezingrain".
+func visualCrossingPrecipType(types []string) string {
+	var result string
+	for _, t := range types {
+		switch t {
+		case "snow":
+			return "snow"
+		case "freezingrain", "ice":
+			result = "sleet"
+		case "rain":
+			if result == "" {
+				result = "rain"
+			}
+		}
+	}
+	return result
+}
+
+// dataPoint converts the values of a data point to SI units, as used by the
+// Dark Sky data model. precipHours is the duration, in hours, of the period
+// the precipitation refers to.
+func (c *visualCrossingConditions) dataPoint(precipHours float64) forecast.DataPoint {
+	return forecast.DataPoint{
+		Time:                c.DatetimeEpoch,
+		Summary:             c.Conditions,
+		Icon:                c.Icon,
+		Temperature:         c.Temp,
+		ApparentTemperature: c.FeelsLike,
+		TemperatureMax:      c.TempMax,
+		TemperatureMin:      c.TempMin,
+		Humidity:            c.Humidity / 100,
+		DewPoint:            c.Dew,
+		PrecipIntensity:     c.Precip / precipHours,
+		PrecipProbability:   c.PrecipProb / 100,
+		PrecipType:          visualCrossingPrecipType(c.PrecipType),
+		// km/h
+		WindSpeed:   c.WindSpeed / 3.6,
+		WindGust:    c.WindGust / 3.6,
+		WindBearing: c.WindDir,
+		Pressure:    c.Pressure,
+		Visibility:  c.Visibility,
+		CloudCover:  c.CloudCover / 100,
+		UVIndex:     int64(math.Round(c.UVIndex)),
+		SunriseTime: c.SunriseEpoch,
+		SunsetTime:  c.SunsetEpoch,
+	}
+}
+
+// visualCrossingDay is a day of the timeline, with its hours.
+type visualCrossingDay struct {
+	visualCrossingConditions
+	Hours []visualCrossingConditions `json:"hours"`
+}
+
+// visualCrossingAlert is an active alert.
+type visualCrossingAlert struct {
+	ID          string `json:"id"`
+	Event       string `json:"event"`
+	Headline    string `json:"headline"`
+	Description string `json:"description"`
+	Link        string `json:"link"`
+	OnsetEpoch  int64  `json:"onsetEpoch"`
+	EndsEpoch   int64  `json:"endsEpoch"`
+}
+
+// visualCrossingAlerts converts the Visual Crossing alerts to the JSON
+// representation of the Dark Sky alerts, whose type is not exported.
+func visualCrossingAlerts(alerts []visualCrossingAlert) []byte {
+	type dsAlert struct {
+		Title       string  `json:"title"`
+		Description string  `json:"description"`
+		Time        int64   `json:"time"`
+		Expires     float64 `json:"expires,omitempty"`
+		URI         string  `json:"uri"`
+	}
+	converted := make([]dsAlert, 0, len(alerts))
+	for _, a := range alerts {
+		title := a.Event
+		if title == "" {
+			title = a.Headline
+		}
+		converted = append(converted, dsAlert{
+			Title:       title,
+			Description: a.Description,
+			Time:        a.OnsetEpoch,
+			Expires:     float64(a.EndsEpoch),
+			URI:         a.Link,
+		})
+	}
+	// marshaling strings and numbers cannot fail
+	data, _ := json.Marshal(converted)
+	return data
+}
+
+// visualCrossingResponse is a response of the Timeline API.
+type visualCrossingResponse struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Timezone  string  `json:"timezone"`
+	// TZOffset is the offset of the time zone, in hours.
+	TZOffset          float64                   `json:"tzoffset"`
+	CurrentConditions *visualCrossingConditions `json:"currentConditions"`
+	Days              []visualCrossingDay       `json:"days"`
+	Alerts            []visualCrossingAlert     `json:"alerts"`
+}
+
+// hours returns the hours of the timeline from start, included.
+func (r *visualCrossingResponse) hours(start time.Time) []forecast.DataPoint {
+	var hours []forecast.DataPoint
+	for _, d := range r.Days {
+		for idx := range d.Hours {
+			h := &d.Hours[idx]
+			if h.DatetimeEpoch >= start.Unix() {
+				hours = append(hours, h.dataPoint(1))
+			}
+		}
+	}
+	return hours
+}
+
+// forecast converts a Visual Crossing response to the Dark Sky data model.
+// The hourly forecast starts at the current hour.
+func (r *visualCrossingResponse) forecast(now time.Time) *forecast.Forecast {
+	fc := forecast.Forecast{
+		Latitude:  r.Latitude,
+		Longitude: r.Longitude,
+		Timezone:  r.Timezone,
+		Offset:    r.TZOffset,
+		Flags:     forecast.Flags{Units: string(forecast.SI), Sources: []string{"visualcrossing"}},
+	}
+	fc.Hourly.Data = r.hours(now.Truncate(time.Hour))
+	switch {
+	case r.CurrentConditions != nil:
+		fc.Currently = r.CurrentConditions.dataPoint(1)
+	case len(fc.Hourly.Data) > 0:
+		fc.Currently = fc.Hourly.Data[0]
+	}
+	for idx := range r.Days {
+		fc.Daily.Data = append(fc.Daily.Data, r.Days[idx].dataPoint(24))
+	}
+	if len(r.Alerts) > 0 {
+		_ = json.Unmarshal(visualCrossingAlerts(r.Alerts), &fc.Alerts)
+	}
+	return &fc
+}
+
+// visualCrossingProvider gets the weather from the Visual Crossing Timeline
+// API.
+type visualCrossingProvider struct {
+	httpClient *http.Client
+	apiKey     string
+}
+
+// Name implements Provider.Name for visualCrossingProvider.
+func (p *visualCrossingProvider) Name() string {
+	return "visualcrossing"
+}
+
+// get requests the timeline of a location, and decodes it into r.
+func (p *visualCrossingProvider) get(ctx context.Context, loc *Location, r *visualCrossingResponse) ([]byte, http.Header, error) {
+	q := url.Values{}
+	q.Set("unitGroup", "metric")
+	q.Set("include", "current,hours,days,alerts")
+	q.Set("contentType", "json")
+	q.Set("key", p.apiKey)
+	u := visualCrossingURL + "/" + url.PathEscape(loc.LatString()+","+loc.LngString()) + "?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		countAPIError(p.Name(), reasonForError(err))
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		reason := reasonForStatus(resp.StatusCode, string(data))
+		countAPIError(p.Name(), reason)
+		return nil, nil, &APIError{Provider: p.Name(), Reason: reason, Err: fmt.Errorf("HTTP status %s: %s", resp.Status, data)}
+	}
+	if err := json.Unmarshal(data, r); err != nil {
+		countAPIError(p.Name(), reasonDecode)
+		return nil, nil, &APIError{Provider: p.Name(), Reason: reasonDecode, Err: err}
+	}
+	return data, resp.Header, nil
+}
+
+// Get implements Provider.Get for visualCrossingProvider.
+func (p *visualCrossingProvider) Get(ctx context.Context, loc *Location) (*Weather, error) {
+	var r visualCrossingResponse
+	data, header, err := p.get(ctx, loc, &r)
+	if err != nil {
+		return nil, err
+	}
+	w := Weather{Forecast: r.forecast(time.Now()), Stations: &StationInfo{}, Endpoint: visualCrossingURL, ResponseSHA256: sha256Hex(data)}
+	w.QuotaUsage, w.HasQuotaUsage = quotaUsage(p.Name(), header)
+	return &w, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// windDirections are the sectors of the wind rose, clockwise from north.
+var windDirections = []string{"N", "NE", "E", "SE", "S", "SW", "W", "NW"}
+
+// windSpeedBounds are the upper bounds, in m/s, of the wind rose speed
+// buckets. The last bucket has no upper bound.
+var windSpeedBounds = []float64{2, 4, 6, 8, 10}
+
+// windSector returns the wind rose sector for a wind bearing in degrees. The
+// bearing can be negative or above 360.
+func windSector(bearing float64) string {
+	width := 360 / float64(len(windDirections))
+	// math.Mod keeps the sign of the bearing
+	bearing = math.Mod(math.Mod(bearing, 360)+360, 360)
+	idx := int(math.Floor(math.Mod(bearing+width/2, 360) / width))
+	return windDirections[idx%len(windDirections)]
+}
+
+// windSpeedBucket returns the wind rose bucket for a wind speed in m/s, e.g.
+// "2-4" or "10+".
+func windSpeedBucket(speed float64) string {
+	lower := 0.0
+	for _, upper := range windSpeedBounds {
+		if speed < upper {
+			return fmt.Sprintf("%g-%g", lower, upper)
+		}
+		lower = upper
+	}
+	return fmt.Sprintf("%g+", lower)
+}
+
+type windRoseKey struct {
+	direction, speed string
+}
+
+// windRose counts the wind observations of each location by direction sector
+// and speed bucket.
+type windRose struct {
+	mu     sync.Mutex
+	counts map[string]map[windRoseKey]float64
+}
+
+func newWindRose() *windRose {
+	return &windRose{counts: make(map[string]map[windRoseKey]float64)}
+}
+
+func (w *windRose) add(name string, bearing, speed float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.counts[name] == nil {
+		w.counts[name] = make(map[windRoseKey]float64)
+	}
+	w.counts[name][windRoseKey{direction: windSector(bearing), speed: windSpeedBucket(speed)}]++
+}
+
+// forEach calls fn for every counter of a location.
+func (w *windRose) forEach(name string, fn func(direction, speed string, count float64)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, count := range w.counts[name] {
+		fn(key.direction, key.speed, count)
+	}
+}
+
+// prune removes the counters of all the locations not in keep.
+func (w *windRose) prune(keep map[string]bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name := range w.counts {
+		if !keep[name] {
+			delete(w.counts, name)
+		}
+	}
+}
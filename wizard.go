@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// wizardDefaultMetrics are the metrics proposed by the setup wizard.
+var wizardDefaultMetrics = []string{"temperature", "apparent_temperature", "wind_speed", "humidity", "cloud_cover", "precip_intensity"}
+
+// wizard interactively asks the user for the configuration.
+type wizard struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+// ask prints a prompt and returns the answer, or def if the answer is empty.
+func (w *wizard) ask(prompt, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", prompt, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", prompt)
+	}
+	if !w.in.Scan() {
+		if err := w.in.Err(); err != nil {
+			return "", err
+		}
+		return "", io.ErrUnexpectedEOF
+	}
+	answer := strings.TrimSpace(w.in.Text())
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// confirm asks a yes/no question.
+func (w *wizard) confirm(prompt string, def bool) (bool, error) {
+	d := "y/N"
+	if def {
+		d = "Y/n"
+	}
+	answer, err := w.ask(prompt+" ("+d+")", "")
+	if err != nil {
+		return false, err
+	}
+	if answer == "" {
+		return def, nil
+	}
+	return strings.HasPrefix(strings.ToLower(answer), "y"), nil
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// askCoordinates asks for the explicit coordinates of a location, as
+// "lat, lng". It returns nil if the answer is empty, i.e. the location has to
+// be geocoded.
+func (w *wizard) askCoordinates(name string) (*float64, *float64, error) {
+	for {
+		answer, err := w.ask(fmt.Sprintf("Coordinates of '%s' as lat, lng (empty to geocode it)", name), "")
+		if err != nil || answer == "" {
+			return nil, nil, err
+		}
+		if parts := splitList(answer); len(parts) == 2 {
+			lat, latErr := strconv.ParseFloat(parts[0], 64)
+			lng, lngErr := strconv.ParseFloat(parts[1], 64)
+			if latErr == nil && lngErr == nil && lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180 {
+				return &lat, &lng, nil
+			}
+		}
+		fmt.Fprintf(w.out, "Invalid coordinates '%s', e.g. 52.1, 4.3\n", answer)
+	}
+}
+
+// runInit runs the interactive setup wizard, verifies the answers with live
+// API calls, and writes the configuration file to path.
+func runInit(in io.Reader, out io.Writer, path string) error {
+	w := wizard{in: bufio.NewScanner(in), out: out}
+	fmt.Fprintf(out, "This will create the configuration file '%s'.\n\n", path)
+	if _, err := os.Stat(path); err == nil {
+		ok, err := w.confirm(fmt.Sprintf("'%s' already exists, overwrite it?", path), false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("not overwriting '%s'", path)
+		}
+	}
+	var (
+		config Config
+		err    error
+	)
+	config.Provider, err = w.ask(fmt.Sprintf("Weather provider (supported: %s)", strings.Join(providerNames(), ", ")), defaultProvider)
+	if err != nil {
+		return err
+	}
+	switch config.Provider {
+	case "darksky":
+		config.DarkskyAPIKey, err = w.ask("Dark Sky API key", "")
+	case "openweathermap":
+		config.OpenWeatherMapAPIKey, err = w.ask("OpenWeatherMap API key", "")
+	case "pirateweather":
+		config.PirateWeatherAPIKey, err = w.ask("Pirate Weather API key", "")
+	case "tomorrowio":
+		config.TomorrowIOAPIKey, err = w.ask("Tomorrow.io API key", "")
+	case "accuweather":
+		config.AccuWeatherAPIKey, err = w.ask("AccuWeather API key", "")
+	case "visualcrossing":
+		config.VisualCrossingAPIKey, err = w.ask("Visual Crossing API key", "")
+	case "openmeteo", "metno", "nws":
+		// no API key required
+	default:
+		return fmt.Errorf("unsupported provider '%s'", config.Provider)
+	}
+	if err != nil {
+		return err
+	}
+	for len(config.Locations) == 0 {
+		answer, err := w.ask("Locations, comma-separated", "")
+		if err != nil {
+			return err
+		}
+		for _, name := range splitList(answer) {
+			config.Locations = append(config.Locations, LocationConfig{Name: name})
+		}
+	}
+	explicit, err := w.confirm("Set the coordinates of some locations explicitly, so that they are not geocoded?", false)
+	if err != nil {
+		return err
+	}
+	if explicit {
+		for idx := range config.Locations {
+			l := &config.Locations[idx]
+			if l.Lat, l.Lng, err = w.askCoordinates(l.Name); err != nil {
+				return err
+			}
+		}
+	}
+	// the geocoder is not needed if all the locations have coordinates
+	if len(config.geocodedLocations()) > 0 {
+		if config.Geocoder, err = w.ask(fmt.Sprintf("Geocoder (supported: %s, %s, %s)", geocoderGoogleMaps, geocoderNominatim, geocoderAccuWeather), geocoderGoogleMaps); err != nil {
+			return err
+		}
+		switch config.Geocoder {
+		case geocoderGoogleMaps:
+			config.GoogleMapsAPIKey, err = w.ask("Google Maps API key", "")
+		case geocoderNominatim:
+			config.NominatimURL, err = w.ask("Nominatim base URL", defaultNominatimURL)
+		case geocoderAccuWeather:
+			if config.AccuWeatherAPIKey == "" {
+				config.AccuWeatherAPIKey, err = w.ask("AccuWeather API key", "")
+			}
+		default:
+			return fmt.Errorf("unsupported geocoder '%s'", config.Geocoder)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	answer, err := w.ask("Metrics, comma-separated", strings.Join(wizardDefaultMetrics, ", "))
+	if err != nil {
+		return err
+	}
+	config.Metrics = splitList(answer)
+	for _, m := range config.Metrics {
+		if _, ok := lookupField(m); !ok {
+			return fmt.Errorf("unsupported metric '%s', see -fields-doc for the supported ones", m)
+		}
+	}
+	if config.Units, err = w.ask(fmt.Sprintf("Units (supported: %s)", strings.Join(unitSystemNames(), ", ")), "si"); err != nil {
+		return err
+	}
+	if _, ok := unitSystems[config.Units]; !ok {
+		return fmt.Errorf("unsupported units '%s', must be one of %s", config.Units, strings.Join(unitSystemNames(), ", "))
+	}
+
+	fmt.Fprintln(out, "\nVerifying the configuration with the live APIs...")
+	if err := verifyConfig(context.Background(), out, &config); err != nil {
+		fmt.Fprintf(out, "Verification failed: %v\n", err)
+		ok, err := w.confirm("Write the configuration file anyway?", false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("verification failed, configuration not written")
+		}
+	}
+
+	// the locations to geocode are written in the string form
+	locations := make([]interface{}, len(config.Locations))
+	for idx, l := range config.Locations {
+		locations[idx] = l.Name
+		if l.Lat != nil {
+			locations[idx] = struct {
+				Name string  `json:"name"`
+				Lat  float64 `json:"lat"`
+				Lng  float64 `json:"lng"`
+			}{l.Name, *l.Lat, *l.Lng}
+		}
+	}
+	data, err := json.MarshalIndent(struct {
+		Locations            []interface{} `json:"locations"`
+		Metrics              []string      `json:"metrics"`
+		Units                string        `json:"units"`
+		Provider             string        `json:"provider"`
+		Geocoder             string        `json:"geocoder,omitempty"`
+		NominatimURL         string        `json:"nominatim_url,omitempty"`
+		GoogleMapsAPIKey     string        `json:"google_maps_api_key,omitempty"`
+		DarkskyAPIKey        string        `json:"darksky_api_key,omitempty"`
+		OpenWeatherMapAPIKey string        `json:"openweathermap_api_key,omitempty"`
+		PirateWeatherAPIKey  string        `json:"pirateweather_api_key,omitempty"`
+		TomorrowIOAPIKey     string        `json:"tomorrowio_api_key,omitempty"`
+		AccuWeatherAPIKey    string        `json:"accuweather_api_key,omitempty"`
+		VisualCrossingAPIKey string        `json:"visualcrossing_api_key,omitempty"`
+	}{
+		Locations:            locations,
+		Metrics:              config.Metrics,
+		Units:                config.Units,
+		Provider:             config.Provider,
+		Geocoder:             config.Geocoder,
+		NominatimURL:         config.NominatimURL,
+		GoogleMapsAPIKey:     config.GoogleMapsAPIKey,
+		DarkskyAPIKey:        config.DarkskyAPIKey,
+		OpenWeatherMapAPIKey: config.OpenWeatherMapAPIKey,
+		PirateWeatherAPIKey:  config.PirateWeatherAPIKey,
+		TomorrowIOAPIKey:     config.TomorrowIOAPIKey,
+		AccuWeatherAPIKey:    config.AccuWeatherAPIKey,
+		VisualCrossingAPIKey: config.VisualCrossingAPIKey,
+	}, "", "    ")
+	if err != nil {
+		return err
+	}
+	// the file contains API keys
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write configuration file: %w", err)
+	}
+	fmt.Fprintf(out, "\nConfiguration written to '%s'. Run the exporter with:\n\n  %s -c %s\n", path, os.Args[0], path)
+	return nil
+}
+
+// verifyConfig geocodes every location without explicit coordinates and
+// fetches the weather for the first one.
+func verifyConfig(ctx context.Context, out io.Writer, config *Config) error {
+	httpClient := newHTTPClient(config, devOptions{})
+	var first *Location
+	for idx := range config.Locations {
+		name := config.Locations[idx].Name
+		loc := config.Locations[idx].location()
+		if loc == nil {
+			var err error
+			if loc, err = getLocation(ctx, httpClient, config, name); err != nil {
+				return fmt.Errorf("failed to geocode '%s': %w", name, err)
+			}
+			fmt.Fprintf(out, "  %s: found %s (%s, %s)\n", name, loc.Name, loc.LatString(), loc.LngString())
+		}
+		if first == nil {
+			first = loc
+		}
+	}
+	provider, err := newProvider(config, httpClient)
+	if err != nil {
+		return err
+	}
+	w, err := provider.Get(ctx, first)
+	if err != nil {
+		return fmt.Errorf("failed to get weather for '%s': %w", config.Locations[0].Name, err)
+	}
+	fmt.Fprintf(out, "  %s: %s, %.1f°C\n", config.Locations[0].Name, w.Forecast.Currently.Summary, w.Forecast.Currently.Temperature)
+	return nil
+}